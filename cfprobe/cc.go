@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CCClient talks to the Cloud Controller v3 API
+type CCClient struct {
+	API   string
+	Token string
+	HTTP  *http.Client
+}
+
+// NewCCClient returns a client for the Cloud Controller at api
+func NewCCClient(api string, skipSSLValidation bool) *CCClient {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipSSLValidation},
+	}
+	return &CCClient{
+		API:  strings.TrimRight(api, "/"),
+		HTTP: &http.Client{Transport: transport, Timeout: time.Minute},
+	}
+}
+
+// CCError is an error response from the Cloud Controller or UAA
+type CCError struct {
+	StatusCode int             `json:"-"`
+	Errors     []CCErrorDetail `json:"errors"`
+}
+
+// CCErrorDetail is a single entry in a v3 error response
+type CCErrorDetail struct {
+	Code   int    `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e *CCError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("cloud controller returned %d", e.StatusCode)
+	}
+	details := make([]string, len(e.Errors))
+	for i, d := range e.Errors {
+		details[i] = fmt.Sprintf("%s: %s", d.Title, d.Detail)
+	}
+	return fmt.Sprintf("cloud controller returned %d: %s", e.StatusCode, strings.Join(details, "; "))
+}
+
+// IsNotFound reports whether err is a 404 from the Cloud Controller
+func IsNotFound(err error) bool {
+	ccErr, ok := err.(*CCError)
+	return ok && ccErr.StatusCode == http.StatusNotFound
+}
+
+// Login fetches a token from UAA, using the password grant when a username is
+// given and the client credentials grant otherwise
+func (c *CCClient) Login(username, password, clientID, clientSecret string) error {
+	var info struct {
+		Links struct {
+			Login struct {
+				Href string `json:"href"`
+			} `json:"login"`
+		} `json:"links"`
+	}
+	if _, err := c.do("GET", "/", nil, &info); err != nil {
+		return err
+	}
+	if info.Links.Login.Href == "" {
+		return fmt.Errorf("no login endpoint advertised by %s", c.API)
+	}
+
+	form := url.Values{}
+	if username != "" {
+		if clientID == "" {
+			clientID = "cf"
+		}
+		form.Set("grant_type", "password")
+		form.Set("username", username)
+		form.Set("password", password)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+
+	req, err := http.NewRequest("POST", info.Links.Login.Href+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(clientID, clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &CCError{StatusCode: resp.StatusCode}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.Token = token.AccessToken
+	return nil
+}
+
+// do sends a JSON request and decodes a JSON response into out when given
+func (c *CCClient) do(method, path string, in, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	return c.send(method, path, "application/json", body, out)
+}
+
+// send issues a request with an arbitrary body and decodes the JSON response
+func (c *CCClient) send(method, path, contentType string, body io.Reader, out interface{}) (*http.Response, error) {
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = c.API + path
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "bearer "+c.Token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= 400 {
+		ccErr := &CCError{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, ccErr)
+		return resp, ccErr
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp, fmt.Errorf("Failed to decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp, nil
+}
+
+// list follows the pagination of a v3 list endpoint, decoding every resource
+// into out, which must be a pointer to a slice
+func (c *CCClient) list(path string, query url.Values, out interface{}) error {
+	var all []json.RawMessage
+	next := path
+	if len(query) > 0 {
+		next += "?" + query.Encode()
+	}
+
+	for next != "" {
+		var page struct {
+			Pagination struct {
+				Next *struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			Resources []json.RawMessage `json:"resources"`
+		}
+		if _, err := c.do("GET", next, nil, &page); err != nil {
+			return err
+		}
+		all = append(all, page.Resources...)
+		next = ""
+		if page.Pagination.Next != nil {
+			next = page.Pagination.Next.Href
+		}
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Relationship is a to-one relationship in a v3 resource
+type Relationship struct {
+	Data *GUIDRef `json:"data"`
+}
+
+// GUIDRef refers to another resource by GUID
+type GUIDRef struct {
+	GUID string `json:"guid"`
+}
+
+func toOne(guid string) Relationship {
+	return Relationship{Data: &GUIDRef{GUID: guid}}
+}
+
+// Resource carries the fields common to every v3 resource
+type Resource struct {
+	GUID      string    `json:"guid"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Metadata  Metadata  `json:"metadata"`
+}
+
+// Metadata holds the labels attached to a resource
+type Metadata struct {
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// LastOperation is the state of the most recent broker operation on a service instance
+type LastOperation struct {
+	Type        string    `json:"type"`
+	State       string    `json:"state"`
+	Description string    `json:"description"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ServiceInstance is a v3 service instance
+type ServiceInstance struct {
+	Resource
+	Type          string        `json:"type"`
+	LastOperation LastOperation `json:"last_operation"`
+	Relationships struct {
+		ServicePlan Relationship `json:"service_plan"`
+		Space       Relationship `json:"space"`
+	} `json:"relationships"`
+}
+
+// App is a v3 app
+type App struct {
+	Resource
+	State string `json:"state"`
+}
+
+// Route is a v3 route
+type Route struct {
+	Resource
+	URL string `json:"url"`
+}
+
+// Binding is a v3 service credential binding
+type Binding struct {
+	Resource
+	Type          string `json:"type"`
+	Relationships struct {
+		App             Relationship `json:"app"`
+		ServiceInstance Relationship `json:"service_instance"`
+	} `json:"relationships"`
+}
+
+// Job is a v3 asynchronous job
+type Job struct {
+	GUID      string          `json:"guid"`
+	Operation string          `json:"operation"`
+	State     string          `json:"state"`
+	Errors    []CCErrorDetail `json:"errors"`
+}
+
+// FindSpace returns the GUID of the named space in the named org
+func (c *CCClient) FindSpace(org, space string) (string, error) {
+	var orgs []Resource
+	if err := c.list("/v3/organizations", url.Values{"names": {org}}, &orgs); err != nil {
+		return "", err
+	}
+	if len(orgs) == 0 {
+		return "", fmt.Errorf("org %q not found", org)
+	}
+
+	var spaces []Resource
+	query := url.Values{"names": {space}, "organization_guids": {orgs[0].GUID}}
+	if err := c.list("/v3/spaces", query, &spaces); err != nil {
+		return "", err
+	}
+	if len(spaces) == 0 {
+		return "", fmt.Errorf("space %q not found in org %q", space, org)
+	}
+	return spaces[0].GUID, nil
+}
+
+// ServicePlan is a v3 service plan
+type ServicePlan struct {
+	Resource
+	Description string `json:"description"`
+	Available   bool   `json:"available"`
+}
+
+// ServicePlans lists the plans of the named service offering visible to the user
+func (c *CCClient) ServicePlans(offering string) ([]ServicePlan, error) {
+	var plans []ServicePlan
+	err := c.list("/v3/service_plans", url.Values{"service_offering_names": {offering}}, &plans)
+	if err == nil && len(plans) == 0 {
+		err = fmt.Errorf("no plans found for service %q", offering)
+	}
+	return plans, err
+}
+
+// FindServicePlan returns the GUID of a plan of the named service offering
+func (c *CCClient) FindServicePlan(offering, plan string) (string, error) {
+	var plans []Resource
+	query := url.Values{"names": {plan}, "service_offering_names": {offering}}
+	if err := c.list("/v3/service_plans", query, &plans); err != nil {
+		return "", err
+	}
+	if len(plans) == 0 {
+		return "", fmt.Errorf("plan %q of service %q not found", plan, offering)
+	}
+	return plans[0].GUID, nil
+}
+
+// CreateServiceInstance asks the broker for a new managed service instance
+// carrying the given labels. Provisioning carries on asynchronously; use
+// GetServiceInstance to follow it.
+func (c *CCClient) CreateServiceInstance(spaceGUID, planGUID, name string, labels map[string]string) (*ServiceInstance, error) {
+	body := map[string]interface{}{
+		"type": "managed",
+		"name": name,
+		"relationships": map[string]Relationship{
+			"space":        toOne(spaceGUID),
+			"service_plan": toOne(planGUID),
+		},
+		"metadata": Metadata{Labels: labels},
+	}
+	if _, err := c.do("POST", "/v3/service_instances", body, nil); err != nil {
+		return nil, err
+	}
+	return c.FindServiceInstance(spaceGUID, name)
+}
+
+// FindServiceInstance returns the named service instance in a space
+func (c *CCClient) FindServiceInstance(spaceGUID, name string) (*ServiceInstance, error) {
+	var instances []ServiceInstance
+	query := url.Values{"names": {name}, "space_guids": {spaceGUID}}
+	if err := c.list("/v3/service_instances", query, &instances); err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &CCError{StatusCode: http.StatusNotFound, Errors: []CCErrorDetail{
+			{Title: "CF-ResourceNotFound", Detail: fmt.Sprintf("service instance %q not found", name)},
+		}}
+	}
+	return &instances[0], nil
+}
+
+// GetServiceInstance fetches a service instance by GUID
+func (c *CCClient) GetServiceInstance(guid string) (*ServiceInstance, error) {
+	var instance ServiceInstance
+	_, err := c.do("GET", "/v3/service_instances/"+guid, nil, &instance)
+	return &instance, err
+}
+
+// UpdateServicePlan moves a service instance to another plan, as cf
+// update-service -p does. The broker carries on asynchronously; use
+// GetServiceInstance to follow it.
+func (c *CCClient) UpdateServicePlan(guid, planGUID string) error {
+	body := map[string]interface{}{
+		"relationships": map[string]Relationship{"service_plan": toOne(planGUID)},
+	}
+	_, err := c.do("PATCH", "/v3/service_instances/"+guid, body, nil)
+	return err
+}
+
+// DeleteServiceInstance starts deprovisioning a service instance
+func (c *CCClient) DeleteServiceInstance(guid string) error {
+	_, err := c.do("DELETE", "/v3/service_instances/"+guid, nil, nil)
+	return err
+}
+
+// ServiceInstances lists the service instances in a space, optionally
+// filtered by a label selector
+func (c *CCClient) ServiceInstances(spaceGUID, selector string) ([]ServiceInstance, error) {
+	query := url.Values{"space_guids": {spaceGUID}}
+	if selector != "" {
+		query.Set("label_selector", selector)
+	}
+	var instances []ServiceInstance
+	err := c.list("/v3/service_instances", query, &instances)
+	return instances, err
+}
+
+// Apps lists the apps in a space, optionally filtered by a label selector
+func (c *CCClient) Apps(spaceGUID, selector string) ([]App, error) {
+	query := url.Values{"space_guids": {spaceGUID}}
+	if selector != "" {
+		query.Set("label_selector", selector)
+	}
+	var apps []App
+	err := c.list("/v3/apps", query, &apps)
+	return apps, err
+}
+
+// FindApp returns the named app in a space
+func (c *CCClient) FindApp(spaceGUID, name string) (*App, error) {
+	var apps []App
+	query := url.Values{"names": {name}, "space_guids": {spaceGUID}}
+	if err := c.list("/v3/apps", query, &apps); err != nil {
+		return nil, err
+	}
+	if len(apps) == 0 {
+		return nil, &CCError{StatusCode: http.StatusNotFound, Errors: []CCErrorDetail{
+			{Title: "CF-ResourceNotFound", Detail: fmt.Sprintf("app %q not found", name)},
+		}}
+	}
+	return &apps[0], nil
+}
+
+// DeleteApp deletes an app and waits for the deletion job to finish
+func (c *CCClient) DeleteApp(guid string, timeout, interval time.Duration) error {
+	resp, err := c.do("DELETE", "/v3/apps/"+guid, nil, nil)
+	if err != nil {
+		return err
+	}
+	return c.WaitForJob(resp.Header.Get("Location"), timeout, interval)
+}
+
+// AppRoutes lists the routes mapped to an app
+func (c *CCClient) AppRoutes(appGUID string) ([]Route, error) {
+	var routes []Route
+	err := c.list("/v3/apps/"+appGUID+"/routes", nil, &routes)
+	return routes, err
+}
+
+// Bind creates an app binding to a service instance and waits for it to complete
+func (c *CCClient) Bind(appGUID, instanceGUID string, timeout, interval time.Duration) error {
+	body := map[string]interface{}{
+		"type": "app",
+		"relationships": map[string]Relationship{
+			"app":              toOne(appGUID),
+			"service_instance": toOne(instanceGUID),
+		},
+	}
+	resp, err := c.do("POST", "/v3/service_credential_bindings", body, nil)
+	if err != nil {
+		return err
+	}
+	return c.WaitForJob(resp.Header.Get("Location"), timeout, interval)
+}
+
+// Bindings lists app bindings filtered by service instance, app or both
+func (c *CCClient) Bindings(instanceGUID, appGUID string) ([]Binding, error) {
+	query := url.Values{"type": {"app"}}
+	if instanceGUID != "" {
+		query.Set("service_instance_guids", instanceGUID)
+	}
+	if appGUID != "" {
+		query.Set("app_guids", appGUID)
+	}
+	var bindings []Binding
+	err := c.list("/v3/service_credential_bindings", query, &bindings)
+	return bindings, err
+}
+
+// CreateServiceKey creates a named service key for an instance, waits for the
+// broker and returns the key
+func (c *CCClient) CreateServiceKey(instanceGUID, name string, timeout, interval time.Duration) (*Binding, error) {
+	body := map[string]interface{}{
+		"type": "key",
+		"name": name,
+		"relationships": map[string]Relationship{
+			"service_instance": toOne(instanceGUID),
+		},
+	}
+	resp, err := c.do("POST", "/v3/service_credential_bindings", body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.WaitForJob(resp.Header.Get("Location"), timeout, interval); err != nil {
+		return nil, err
+	}
+
+	keys, err := c.ServiceKeys(instanceGUID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].Name == name {
+			return &keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("service key %q not found after creating it", name)
+}
+
+// ServiceKeys lists the service keys of an instance
+func (c *CCClient) ServiceKeys(instanceGUID string) ([]Binding, error) {
+	query := url.Values{"type": {"key"}, "service_instance_guids": {instanceGUID}}
+	var keys []Binding
+	err := c.list("/v3/service_credential_bindings", query, &keys)
+	return keys, err
+}
+
+// BindingCredentials fetches the credentials of a binding or service key
+func (c *CCClient) BindingCredentials(bindingGUID string) (map[string]interface{}, error) {
+	var details struct {
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+	_, err := c.do("GET", "/v3/service_credential_bindings/"+bindingGUID+"/details", nil, &details)
+	return details.Credentials, err
+}
+
+// Unbind deletes a service credential binding and waits for it to go
+func (c *CCClient) Unbind(bindingGUID string, timeout, interval time.Duration) error {
+	resp, err := c.do("DELETE", "/v3/service_credential_bindings/"+bindingGUID, nil, nil)
+	if err != nil {
+		return err
+	}
+	return c.WaitForJob(resp.Header.Get("Location"), timeout, interval)
+}
+
+// WaitForJob polls a job until it completes. An empty location means the
+// request finished synchronously.
+func (c *CCClient) WaitForJob(location string, timeout, interval time.Duration) error {
+	if location == "" {
+		return nil
+	}
+	return poll(timeout, interval, func() (bool, error) {
+		var job Job
+		if _, err := c.do("GET", location, nil, &job); err != nil {
+			return false, err
+		}
+		switch job.State {
+		case "COMPLETE":
+			return true, nil
+		case "FAILED":
+			return false, fmt.Errorf("%s job failed: %v", job.Operation, &CCError{StatusCode: http.StatusOK, Errors: job.Errors})
+		}
+		return false, nil
+	})
+}
+
+// poll calls check every interval until it reports done, fails or timeout passes
+func poll(timeout, interval time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		time.Sleep(interval)
+	}
+}
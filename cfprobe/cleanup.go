@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Cleanup removes probe apps and service instances left behind by runs that
+// died partway through. Resources are matched by name prefix or by label
+// selector; apps are unbound and deleted before any instance is deprovisioned.
+type Cleanup struct {
+	*Lifecycle
+	Prefixes []string
+	Selector string
+	DryRun   bool
+}
+
+// Run finds and removes the matching resources, carrying on past failures
+// and returning the first error
+func (c *Cleanup) Run() error {
+	apps, err := c.findApps()
+	if err != nil {
+		return err
+	}
+	instances, err := c.findInstances()
+	if err != nil {
+		return err
+	}
+	if len(apps) == 0 && len(instances) == 0 {
+		fmt.Fprintln(c.Out, "nothing to clean up")
+		return nil
+	}
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil {
+			fmt.Fprintf(c.Out, "error: %v\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	for i := range apps {
+		record(c.removeApp(&apps[i]))
+	}
+	for i := range instances {
+		record(c.removeInstance(&instances[i]))
+	}
+	return firstErr
+}
+
+func (c *Cleanup) removeApp(app *App) error {
+	bindings, err := c.CC.Bindings("", app.GUID)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		c.step("%sunbinding %s from %s", c.prefix(), b.Relationships.ServiceInstance.Data.GUID, app.Name)
+		if c.DryRun {
+			continue
+		}
+		if err := c.CC.Unbind(b.GUID, c.Timeout, c.Interval); err != nil {
+			return err
+		}
+	}
+
+	if c.DryRun {
+		c.step("%sdeleting app %s", c.prefix(), app.Name)
+		return nil
+	}
+	return c.DeleteApp(app)
+}
+
+func (c *Cleanup) removeInstance(instance *ServiceInstance) error {
+	bindings, err := c.CC.Bindings(instance.GUID, "")
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		c.step("%sunbinding %s from app %s", c.prefix(), instance.Name, b.Relationships.App.Data.GUID)
+		if c.DryRun {
+			continue
+		}
+		if err := c.CC.Unbind(b.GUID, c.Timeout, c.Interval); err != nil {
+			return err
+		}
+	}
+
+	keys, err := c.CC.ServiceKeys(instance.GUID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.step("%sdeleting service key %s of %s", c.prefix(), key.Name, instance.Name)
+		if c.DryRun {
+			continue
+		}
+		if err := c.CC.Unbind(key.GUID, c.Timeout, c.Interval); err != nil {
+			return err
+		}
+	}
+
+	if c.DryRun {
+		c.step("%sdeleting service %s", c.prefix(), instance.Name)
+		return nil
+	}
+	return c.DeleteService(instance)
+}
+
+func (c *Cleanup) prefix() string {
+	if c.DryRun {
+		return "[dry run] "
+	}
+	return ""
+}
+
+func (c *Cleanup) findApps() ([]App, error) {
+	var matched []App
+	if c.Selector != "" {
+		apps, err := c.CC.Apps(c.SpaceGUID, c.Selector)
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, apps...)
+	}
+	if len(c.Prefixes) > 0 {
+		apps, err := c.CC.Apps(c.SpaceGUID, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			if c.hasPrefix(app.Name) && !containsGUID(appGUIDs(matched), app.GUID) {
+				matched = append(matched, app)
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (c *Cleanup) findInstances() ([]ServiceInstance, error) {
+	var matched []ServiceInstance
+	if c.Selector != "" {
+		instances, err := c.CC.ServiceInstances(c.SpaceGUID, c.Selector)
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, instances...)
+	}
+	if len(c.Prefixes) > 0 {
+		instances, err := c.CC.ServiceInstances(c.SpaceGUID, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			if c.hasPrefix(instance.Name) && !containsGUID(instanceGUIDs(matched), instance.GUID) {
+				matched = append(matched, instance)
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (c *Cleanup) hasPrefix(name string) bool {
+	for _, prefix := range c.Prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func appGUIDs(apps []App) []string {
+	guids := make([]string, len(apps))
+	for i, app := range apps {
+		guids[i] = app.GUID
+	}
+	return guids
+}
+
+func instanceGUIDs(instances []ServiceInstance) []string {
+	guids := make([]string, len(instances))
+	for i, instance := range instances {
+		guids[i] = instance.GUID
+	}
+	return guids
+}
+
+func containsGUID(guids []string, guid string) bool {
+	for _, g := range guids {
+		if g == guid {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanupCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	prefixes := fs.String("prefix", "", "comma separated name prefixes of apps and service instances to remove")
+	selector := fs.String("selector", ProbeLabel, "label selector of apps and service instances to remove")
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *prefixes == "" && *selector == "" {
+		fmt.Fprintln(stderr, "one of -prefix or -selector is required")
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	cleanup := &Cleanup{
+		Lifecycle: opts.Lifecycle(cc, spaceGUID, stdout),
+		Selector:  *selector,
+		DryRun:    *dryRun,
+	}
+	if *prefixes != "" {
+		cleanup.Prefixes = strings.Split(*prefixes, ",")
+	}
+
+	if err := cleanup.Run(); err != nil {
+		return 1
+	}
+	return 0
+}
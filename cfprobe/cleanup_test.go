@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedLeftovers leaves a half-finished probe run and some unrelated
+// resources in the fake Cloud Controller
+func seedLeftovers(cc *FakeCC) (keepApp *fakeApp, keepInstance *fakeInstance) {
+	labelled := cc.AddInstance("test-psql", map[string]string{ProbeLabel: "rds"})
+	prefixed := cc.AddInstance("test-rmq-old", nil)
+	app := cc.AddApp("cf-test-rds", map[string]string{ProbeLabel: "rds"})
+	cc.AddBinding(app, labelled)
+
+	keepApp = cc.AddApp("production-app", nil)
+	keepInstance = cc.AddInstance("production-db", nil)
+	cc.AddBinding(keepApp, keepInstance)
+	cc.AddBinding(keepApp, prefixed)
+	return
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	seedLeftovers(cc)
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"cleanup", "-api", cc.URL, "-org", "o", "-space", "s", "-prefix", "test-", "-dry-run"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	assert.Contains(t, stdout.String(), "[dry run] deleting app cf-test-rds")
+	assert.Contains(t, stdout.String(), "[dry run] deleting service test-psql")
+	assert.Contains(t, stdout.String(), "[dry run] deleting service test-rmq-old")
+	assert.NotContains(t, stdout.String(), "production")
+	assert.Len(t, cc.Instances, 3)
+	assert.Len(t, cc.Apps, 2)
+	assert.Len(t, cc.Bindings, 3)
+	for _, r := range cc.Requests() {
+		assert.NotContains(t, r, "DELETE")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	keepApp, keepInstance := seedLeftovers(cc)
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"cleanup", "-api", cc.URL, "-org", "o", "-space", "s", "-prefix", "test-", "-poll", "1ms"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+
+	require.Len(t, cc.Apps, 1)
+	assert.Contains(t, cc.Apps, keepApp.GUID)
+	require.Len(t, cc.Instances, 1)
+	assert.Contains(t, cc.Instances, keepInstance.GUID)
+	require.Len(t, cc.Bindings, 1)
+
+	requests := cc.Requests()
+	unbind := indexOf(requests, "DELETE /v3/service_credential_bindings/")
+	deleteApp := indexOf(requests, "DELETE /v3/apps/")
+	deleteInstance := indexOf(requests, "DELETE /v3/service_instances/")
+	assert.True(t, unbind >= 0 && unbind < deleteApp && deleteApp < deleteInstance, "%v", requests)
+}
+
+func TestCleanupNothingToDo(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.AddApp("production-app", nil)
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"cleanup", "-api", cc.URL, "-org", "o", "-space", "s"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	assert.Equal(t, "nothing to clean up\n", stdout.String())
+}
+
+func TestCleanupDeletesServiceKeys(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	instance := cc.AddInstance("test-psql", map[string]string{ProbeLabel: "rds"})
+	key := cc.AddBinding(cc.AddApp("unused", nil), instance)
+	key.Type = "key"
+	key.Name = "rds-key-1"
+	key.Relationships.App.Data = nil
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"cleanup", "-api", cc.URL, "-org", "o", "-space", "s", "-poll", "1ms"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Contains(t, stdout.String(), "deleting service key rds-key-1 of test-psql")
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Bindings)
+}
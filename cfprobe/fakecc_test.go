@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FakeCC is an in-memory stand-in for the Cloud Controller v3 API and UAA
+type FakeCC struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	nextID   int
+	requests []string
+
+	// Plans maps "offering/plan" to a plan GUID
+	Plans map[string]string
+	// AppURL is returned as the route of every pushed app
+	AppURL string
+	// ProvisionPolls is how many GETs an instance stays "in progress" for
+	ProvisionPolls int
+	// FailProvision makes every create end in "failed" with this description
+	FailProvision string
+	// FailPlans fails creates of the plans with these GUIDs with the given descriptions
+	FailPlans map[string]string
+	// UnavailablePlans lists plan GUIDs reported as unavailable
+	UnavailablePlans map[string]bool
+
+	// Credentials are handed out by every binding and key of an instance, by GUID
+	Credentials map[string]map[string]interface{}
+	// BindingPasswords gives every binding and key its own GUID as its
+	// password, so deleting one revokes its credentials
+	BindingPasswords bool
+
+	Instances map[string]*fakeInstance
+	Apps      map[string]*fakeApp
+	Bindings  map[string]*Binding
+}
+
+type fakeInstance struct {
+	ServiceInstance
+	polls int
+}
+
+type fakeApp struct {
+	App
+	SpaceGUID string
+	Env       map[string]string
+	Droplet   string
+	Uploaded  int
+	// Started holds the GUIDs of the app's bindings when it last started,
+	// whose credentials it runs with
+	Started []string
+}
+
+// NewFakeCC starts a fake Cloud Controller with one org, space and the
+// default probe plans
+func NewFakeCC() *FakeCC {
+	f := &FakeCC{
+		Plans: map[string]string{
+			"rds/shared-psql":          "plan-rds",
+			"elasticache-broker/small": "plan-elasticache",
+			"rabbitmq/standard":        "plan-rmq",
+		},
+		Credentials: map[string]map[string]interface{}{},
+		Instances:   map[string]*fakeInstance{},
+		Apps:        map[string]*fakeApp{},
+		Bindings:    map[string]*Binding{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Requests returns the "METHOD path" of every request seen so far
+func (f *FakeCC) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *FakeCC) id(kind string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", kind, f.nextID)
+}
+
+func (f *FakeCC) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	switch {
+	case r.URL.Path == "/":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"links": map[string]interface{}{"login": map[string]string{"href": f.URL + "/uaa"}},
+		})
+		return
+	case r.URL.Path == "/uaa/oauth/token":
+		writeJSON(w, http.StatusOK, map[string]string{"access_token": "fake-token"})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "bearer fake-token" {
+		writeCCError(w, http.StatusUnauthorized, "CF-InvalidAuthToken")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	route := r.Method + " " + strings.Join(parts[:2], "/")
+	if len(parts) > 2 {
+		route += "/:guid"
+	}
+	if len(parts) > 3 {
+		route += "/" + strings.Join(parts[3:], "/")
+	}
+
+	switch route {
+	case "GET v3/organizations":
+		writeList(w, []Resource{{GUID: "org-guid", Name: query.Get("names")}})
+	case "GET v3/spaces":
+		writeList(w, []Resource{{GUID: "space-guid", Name: query.Get("names")}})
+	case "GET v3/jobs/:guid":
+		writeJSON(w, http.StatusOK, Job{GUID: parts[2], State: "COMPLETE"})
+
+	case "GET v3/service_plans":
+		var plans []ServicePlan
+		for key, guid := range f.Plans {
+			parts := strings.SplitN(key, "/", 2)
+			if parts[0] != query.Get("service_offering_names") {
+				continue
+			}
+			if names := query.Get("names"); names != "" && names != parts[1] {
+				continue
+			}
+			plans = append(plans, ServicePlan{Resource: Resource{GUID: guid, Name: parts[1]}, Available: !f.UnavailablePlans[guid]})
+		}
+		writeList(w, plans)
+	case "POST v3/service_instances":
+		var body struct {
+			Name          string   `json:"name"`
+			Metadata      Metadata `json:"metadata"`
+			Relationships struct {
+				Space       Relationship `json:"space"`
+				ServicePlan Relationship `json:"service_plan"`
+			} `json:"relationships"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		instance := &fakeInstance{}
+		instance.GUID = f.id("instance")
+		instance.Name = body.Name
+		instance.Type = "managed"
+		instance.Metadata = body.Metadata
+		instance.Relationships.Space = body.Relationships.Space
+		instance.Relationships.ServicePlan = body.Relationships.ServicePlan
+		instance.LastOperation = LastOperation{Type: "create", State: "in progress"}
+		f.Instances[instance.GUID] = instance
+		f.accepted(w)
+	case "GET v3/service_instances":
+		var instances []ServiceInstance
+		for _, i := range f.Instances {
+			if matches(query, i.Resource) {
+				instances = append(instances, i.ServiceInstance)
+			}
+		}
+		writeList(w, instances)
+	case "GET v3/service_instances/:guid":
+		instance, ok := f.Instances[parts[2]]
+		if !ok {
+			writeCCError(w, http.StatusNotFound, "CF-ResourceNotFound")
+			return
+		}
+		f.advance(instance)
+		writeJSON(w, http.StatusOK, instance.ServiceInstance)
+	case "PATCH v3/service_instances/:guid":
+		instance, ok := f.Instances[parts[2]]
+		if !ok {
+			writeCCError(w, http.StatusNotFound, "CF-ResourceNotFound")
+			return
+		}
+		var body struct {
+			Relationships struct {
+				ServicePlan Relationship `json:"service_plan"`
+			} `json:"relationships"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		instance.Relationships.ServicePlan = body.Relationships.ServicePlan
+		instance.LastOperation = LastOperation{Type: "update", State: "in progress"}
+		instance.polls = 0
+		f.accepted(w)
+	case "DELETE v3/service_instances/:guid":
+		instance, ok := f.Instances[parts[2]]
+		if !ok {
+			writeCCError(w, http.StatusNotFound, "CF-ResourceNotFound")
+			return
+		}
+		instance.LastOperation = LastOperation{Type: "delete", State: "in progress"}
+		instance.polls = 0
+		f.accepted(w)
+
+	case "POST v3/spaces/:guid/actions/apply_manifest":
+		data, _ := ioutil.ReadAll(r.Body)
+		var manifest struct {
+			Applications []struct {
+				Name     string            `yaml:"name"`
+				Env      map[string]string `yaml:"env"`
+				Metadata Metadata          `yaml:"metadata"`
+			} `yaml:"applications"`
+		}
+		if err := yaml.Unmarshal(data, &manifest); err != nil || len(manifest.Applications) == 0 {
+			writeCCError(w, http.StatusUnprocessableEntity, "CF-UnprocessableEntity")
+			return
+		}
+		spec := manifest.Applications[0]
+		app := f.findApp(spec.Name)
+		if app == nil {
+			app = &fakeApp{SpaceGUID: parts[2]}
+			app.GUID = f.id("app")
+			app.Name = spec.Name
+			app.State = "STOPPED"
+			f.Apps[app.GUID] = app
+		}
+		app.Env = spec.Env
+		app.Metadata = spec.Metadata
+		f.accepted(w)
+	case "GET v3/apps":
+		var apps []App
+		for _, app := range f.Apps {
+			if matches(query, app.Resource) {
+				apps = append(apps, app.App)
+			}
+		}
+		writeList(w, apps)
+	case "DELETE v3/apps/:guid":
+		delete(f.Apps, parts[2])
+		for guid, b := range f.Bindings {
+			if b.Relationships.App.Data != nil && b.Relationships.App.Data.GUID == parts[2] {
+				delete(f.Bindings, guid)
+			}
+		}
+		f.accepted(w)
+	case "GET v3/apps/:guid/routes":
+		writeList(w, []Route{{Resource: Resource{GUID: "route-guid"}, URL: f.AppURL}})
+	case "PATCH v3/apps/:guid/relationships/current_droplet":
+		var body Relationship
+		json.NewDecoder(r.Body).Decode(&body)
+		if app, ok := f.Apps[parts[2]]; ok {
+			app.Droplet = body.Data.GUID
+		}
+		writeJSON(w, http.StatusOK, body)
+	case "POST v3/apps/:guid/actions/restart":
+		app, ok := f.Apps[parts[2]]
+		if !ok || app.Droplet == "" {
+			writeCCError(w, http.StatusUnprocessableEntity, "CF-UnprocessableEntity")
+			return
+		}
+		app.State = "STARTED"
+		app.Started = nil
+		for guid, b := range f.Bindings {
+			if b.Relationships.App.Data != nil && b.Relationships.App.Data.GUID == app.GUID {
+				app.Started = append(app.Started, guid)
+			}
+		}
+		writeJSON(w, http.StatusOK, app.App)
+	case "GET v3/apps/:guid/processes/web/stats":
+		writeList(w, []map[string]string{{"state": "RUNNING"}})
+
+	case "POST v3/packages":
+		writeJSON(w, http.StatusCreated, map[string]string{"guid": f.id("package"), "state": "AWAITING_UPLOAD"})
+	case "POST v3/packages/:guid/upload":
+		writeJSON(w, http.StatusOK, map[string]string{"guid": parts[2], "state": "PROCESSING_UPLOAD"})
+	case "GET v3/packages/:guid":
+		writeJSON(w, http.StatusOK, map[string]string{"guid": parts[2], "state": "READY"})
+	case "POST v3/builds":
+		writeJSON(w, http.StatusCreated, map[string]string{"guid": f.id("build"), "state": "STAGING"})
+	case "GET v3/builds/:guid":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"guid": parts[2], "state": "STAGED", "droplet": GUIDRef{GUID: "droplet-" + parts[2]},
+		})
+
+	case "POST v3/service_credential_bindings":
+		var b Binding
+		json.NewDecoder(r.Body).Decode(&b)
+		b.GUID = f.id("binding")
+		f.Bindings[b.GUID] = &b
+		f.accepted(w)
+	case "GET v3/service_credential_bindings":
+		var bindings []Binding
+		for _, b := range f.Bindings {
+			if kind := query.Get("type"); kind != "" && kind != b.Type {
+				continue
+			}
+			if names := query.Get("names"); names != "" && names != b.Name {
+				continue
+			}
+			if guids := query.Get("service_instance_guids"); guids != "" && guids != b.Relationships.ServiceInstance.Data.GUID {
+				continue
+			}
+			if guids := query.Get("app_guids"); guids != "" && (b.Relationships.App.Data == nil || guids != b.Relationships.App.Data.GUID) {
+				continue
+			}
+			bindings = append(bindings, *b)
+		}
+		writeList(w, bindings)
+	case "GET v3/service_credential_bindings/:guid/details":
+		b, ok := f.Bindings[parts[2]]
+		if !ok {
+			writeCCError(w, http.StatusNotFound, "CF-ResourceNotFound")
+			return
+		}
+		creds := f.Credentials[b.Relationships.ServiceInstance.Data.GUID]
+		if f.BindingPasswords {
+			own := map[string]interface{}{"password": b.GUID}
+			for k, v := range creds {
+				if k != "password" {
+					own[k] = v
+				}
+			}
+			creds = own
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"credentials": creds})
+	case "DELETE v3/service_credential_bindings/:guid":
+		if _, ok := f.Bindings[parts[2]]; !ok {
+			writeCCError(w, http.StatusNotFound, "CF-ResourceNotFound")
+			return
+		}
+		delete(f.Bindings, parts[2])
+		f.accepted(w)
+
+	default:
+		writeCCError(w, http.StatusNotFound, "CF-NotFound")
+	}
+}
+
+// advance moves an instance's last operation on by one poll
+func (f *FakeCC) advance(instance *fakeInstance) {
+	if instance.LastOperation.State != "in progress" {
+		return
+	}
+	instance.polls++
+	if instance.polls <= f.ProvisionPolls {
+		return
+	}
+
+	switch instance.LastOperation.Type {
+	case "create", "update":
+		failure := f.FailProvision
+		if plan := instance.Relationships.ServicePlan.Data; plan != nil && f.FailPlans[plan.GUID] != "" {
+			failure = f.FailPlans[plan.GUID]
+		}
+		if failure != "" {
+			instance.LastOperation.State = "failed"
+			instance.LastOperation.Description = failure
+			return
+		}
+		instance.LastOperation.State = "succeeded"
+	case "delete":
+		delete(f.Instances, instance.GUID)
+	}
+}
+
+// matches applies the names and label_selector filters of a list request.
+// Only "key" and "key=value" selectors are understood.
+func matches(query url.Values, r Resource) bool {
+	if names := query.Get("names"); names != "" && names != r.Name {
+		return false
+	}
+	for _, requirement := range strings.Split(query.Get("label_selector"), ",") {
+		if requirement == "" {
+			continue
+		}
+		kv := strings.SplitN(requirement, "=", 2)
+		value, ok := r.Metadata.Labels[kv[0]]
+		if !ok || (len(kv) == 2 && value != kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeCC) findApp(name string) *fakeApp {
+	for _, app := range f.Apps {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+func (f *FakeCC) accepted(w http.ResponseWriter) {
+	w.Header().Set("Location", f.URL+"/v3/jobs/"+f.id("job"))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeList(w http.ResponseWriter, resources interface{}) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pagination": map[string]interface{}{"next": nil},
+		"resources":  resources,
+	})
+}
+
+func writeCCError(w http.ResponseWriter, status int, title string) {
+	writeJSON(w, status, CCError{Errors: []CCErrorDetail{{Title: title, Detail: "fake cloud controller"}}})
+}
+
+// AddInstance seeds a provisioned service instance
+func (f *FakeCC) AddInstance(name string, labels map[string]string) *fakeInstance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance := &fakeInstance{}
+	instance.GUID = f.id("instance")
+	instance.Name = name
+	instance.Type = "managed"
+	instance.Metadata.Labels = labels
+	instance.LastOperation = LastOperation{Type: "create", State: "succeeded"}
+	f.Instances[instance.GUID] = instance
+	return instance
+}
+
+// AddApp seeds a stopped app
+func (f *FakeCC) AddApp(name string, labels map[string]string) *fakeApp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	app := &fakeApp{SpaceGUID: "space-guid"}
+	app.GUID = f.id("app")
+	app.Name = name
+	app.State = "STOPPED"
+	app.Metadata.Labels = labels
+	f.Apps[app.GUID] = app
+	return app
+}
+
+// AddBinding seeds an app binding
+func (f *FakeCC) AddBinding(app *fakeApp, instance *fakeInstance) *Binding {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := &Binding{Type: "app"}
+	b.GUID = f.id("binding")
+	b.Relationships.App = toOne(app.GUID)
+	b.Relationships.ServiceInstance = toOne(instance.GUID)
+	f.Bindings[b.GUID] = b
+	return b
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// IsolationProbe checks that two instances of the same plan cannot reach
+// each other's data. It provisions a second instance next to the probe's
+// own, binds both to the app and asks the app's /isolation endpoint to try
+// service B's credentials against service A.
+type IsolationProbe struct {
+	*Lifecycle
+}
+
+// Run creates the second instance, runs the probe with both bound and then
+// removes the second instance unless Keep is set
+func (c *IsolationProbe) Run(p Probe) (err error) {
+	if p.Offering == "" || p.IsolationEnv == "" {
+		return fmt.Errorf("%s has no isolation check", p.Name)
+	}
+
+	other := p
+	other.Instance = p.Instance + "-b"
+	second, err := c.CreateService(other)
+	if second != nil && !c.Keep {
+		defer func() { err = joinErrors(err, c.DeleteService(second)) }()
+	}
+	if err != nil {
+		return
+	}
+
+	env := map[string]string{p.IsolationEnv: other.Instance}
+	for k, v := range p.Env {
+		env[k] = v
+	}
+	p.Env = env
+	c.Also = []*ServiceInstance{second}
+	defer func() { c.Also = nil }()
+
+	return c.With(p, func(instance *ServiceInstance, app *App) error {
+		endpoint, err := c.Endpoint(p, app)
+		if err != nil {
+			return err
+		}
+		url := strings.TrimSuffix(endpoint, "/") + "/isolation"
+		c.step("checking %s cannot reach %s from %s", other.Instance, p.Instance, url)
+		return CheckEndpoint(c.HTTP, url, "")
+	})
+}
+
+func isolationCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("isolation", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	isolation := &IsolationProbe{Lifecycle: opts.Lifecycle(cc, spaceGUID, stdout)}
+
+	code := 0
+	for _, p := range probes {
+		if p.IsolationEnv == "" {
+			continue
+		}
+		isolation.Results = nil
+		if err := isolation.Run(p); err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", p.Name, err)
+			code = 1
+		} else {
+			fmt.Fprintf(stdout, "PASS %s\n", p.Name)
+		}
+		for _, op := range isolation.Results {
+			fmt.Fprintf(stdout, "  %v\n", op)
+		}
+	}
+	return code
+}
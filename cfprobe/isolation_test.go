@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// isolationApp stands in for a probe app's /isolation endpoint, recording
+// the environment and bindings the app had when it was called
+func isolationApp(cc *FakeCC, status int, body string) (*httptest.Server, *map[string]string, *int) {
+	env := map[string]string{}
+	bindings := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/isolation" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cc.mu.Lock()
+		for _, app := range cc.Apps {
+			env = app.Env
+		}
+		bindings = len(cc.Bindings)
+		cc.mu.Unlock()
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	return server, &env, &bindings
+}
+
+func TestIsolation(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	cc := NewFakeCC()
+	defer cc.Close()
+	app, env, bindings := isolationApp(cc, http.StatusOK, "PASS connect\nPASS read\n")
+	defer app.Close()
+	cc.AppURL = app.URL
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"isolation"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+
+	assert.Contains(t, stdout.String(), "PASS rds")
+	assert.Contains(t, stdout.String(), "binding test-psql-b to cf-test-rds")
+	assert.Contains(t, stdout.String(), "create test-psql-b (rds shared-psql): succeeded")
+	assert.Equal(t, "test-psql", (*env)["DB_SERVICENAME"])
+	assert.Equal(t, "test-psql-b", (*env)["DB_ISOLATION_SERVICENAME"])
+	assert.Equal(t, 2, *bindings)
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Bindings)
+	assert.Empty(t, cc.Apps)
+}
+
+func TestIsolationBreach(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	cc := NewFakeCC()
+	defer cc.Close()
+	app, _, _ := isolationApp(cc, http.StatusFailedDependency, "PASS connect\nFAIL read: security: b read the marker written to a\n")
+	defer app.Close()
+	cc.AppURL = app.URL
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"isolation"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "FAIL rds: ")
+	assert.Contains(t, stdout.String(), "returned 424")
+	assert.Contains(t, stdout.String(), "FAIL read: security: b read the marker written to a")
+	assert.Empty(t, cc.Instances)
+}
+
+func TestIsolationSecondInstanceFails(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.FailProvision = "quota exceeded"
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"isolation"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "quota exceeded")
+	assert.NotContains(t, stdout.String(), "pushing")
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Apps)
+}
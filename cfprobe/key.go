@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+)
+
+// ProbeRunner runs a probe's -local mode on this machine against a set of
+// credentials. Probes are run from BinDir when it is set and with go run in
+// the probe directory otherwise.
+type ProbeRunner struct {
+	BinDir string
+	Out    io.Writer
+
+	// Command builds the command to run the probe with args; it defaults to
+	// ProbeRunner.command
+	Command func(p Probe, args ...string) *exec.Cmd
+}
+
+// Run writes creds to a private temporary file and runs the probe against it
+func (r *ProbeRunner) Run(p Probe, creds map[string]interface{}) error {
+	if err := r.run(p, creds); err != nil {
+		return fmt.Errorf("%s probe failed: %v", p.Name, err)
+	}
+	return nil
+}
+
+// Login runs the probe's -login mode, which only logs in with creds, and
+// reports whether the server refused them. Any other failure is an error, as
+// it says nothing about whether the credentials still work.
+func (r *ProbeRunner) Login(p Probe, creds map[string]interface{}) (refused bool, err error) {
+	err = r.run(p, creds, "-login")
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == diagnose.ExitRefused {
+			return true, nil
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s login failed: %v", p.Name, err)
+	}
+	return false, nil
+}
+
+func (r *ProbeRunner) run(p Probe, creds map[string]interface{}, args ...string) error {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "cfprobe-creds")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	command := r.Command
+	if command == nil {
+		command = r.command
+	}
+	cmd := command(p, append([]string{"-local", "-creds", f.Name()}, args...)...)
+	cmd.Stdout = r.Out
+	cmd.Stderr = r.Out
+	return cmd.Run()
+}
+
+func (r *ProbeRunner) command(p Probe, args ...string) *exec.Cmd {
+	if r.BinDir != "" {
+		return exec.Command(filepath.Join(r.BinDir, p.Name), args...)
+	}
+	cmd := exec.Command("go", append([]string{"run", "."}, args...)...)
+	cmd.Dir = p.Dir
+	return cmd
+}
+
+// KeyProbe tests a service instance through a service key instead of a
+// pushed app, so broker provisioning and credentials can be checked without
+// staging anything
+type KeyProbe struct {
+	*Lifecycle
+	Runner *ProbeRunner
+	Create bool
+}
+
+// Run creates a key for the probe's instance, runs the probe locally with its
+// credentials and deletes the key again. With Create set the instance is
+// provisioned first and deprovisioned afterwards.
+func (k *KeyProbe) Run(p Probe) (err error) {
+	if p.Offering == "" {
+		return fmt.Errorf("%s has no backing service", p.Name)
+	}
+
+	var instance *ServiceInstance
+	if k.Create {
+		instance, err = k.CreateService(p)
+		if instance != nil && !k.Keep {
+			defer func() { err = joinErrors(err, k.DeleteService(instance)) }()
+		}
+	} else {
+		instance, err = k.CC.FindServiceInstance(k.SpaceGUID, p.Instance)
+	}
+	if err != nil {
+		return
+	}
+
+	keyName := fmt.Sprintf("%s-key-%d", p.Name, time.Now().Unix())
+	k.step("creating service key %s for %s", keyName, instance.Name)
+	key, err := k.CC.CreateServiceKey(instance.GUID, keyName, k.Timeout, k.Interval)
+	if err != nil {
+		return
+	}
+	defer func() {
+		k.step("deleting service key %s", keyName)
+		err = joinErrors(err, k.CC.Unbind(key.GUID, k.Timeout, k.Interval))
+	}()
+
+	creds, err := k.CC.BindingCredentials(key.GUID)
+	if err != nil {
+		return
+	}
+
+	k.step("running %s probe with the key's credentials", p.Name)
+	return k.Runner.Run(p, creds)
+}
+
+func keyCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("key", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	binDir := fs.String("bin-dir", "", "directory holding built probe binaries (default go run in each probe directory)")
+	create := fs.Bool("create", false, "provision the service instance first and deprovision it afterwards")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	keyProbe := &KeyProbe{
+		Lifecycle: opts.Lifecycle(cc, spaceGUID, stdout),
+		Runner:    &ProbeRunner{BinDir: *binDir, Out: stdout},
+		Create:    *create,
+	}
+
+	code := 0
+	for _, p := range probes {
+		if p.Offering == "" {
+			continue
+		}
+		keyProbe.Results = nil
+		if err := keyProbe.Run(p); err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", p.Name, err)
+			code = 1
+		} else {
+			fmt.Fprintf(stdout, "PASS %s\n", p.Name)
+		}
+		for _, result := range keyProbe.Results {
+			fmt.Fprintf(stdout, "  %v\n", result)
+		}
+	}
+	return code
+}
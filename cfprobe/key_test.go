@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helperCommand runs TestHelperProbe in a child process in place of a real
+// probe binary, checking keys against cc
+func helperCommand(cc *FakeCC) func(p Probe, args ...string) *exec.Cmd {
+	return func(p Probe, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProbe", "--", p.Name}, args...)...)
+		cmd.Env = append(os.Environ(), "CFPROBE_HELPER_PROBE=1", "CFPROBE_HELPER_CC="+cc.URL)
+		return cmd
+	}
+}
+
+// TestHelperProbe stands in for a probe's -local mode. It passes when the
+// credentials file holds the password "right" or that of a key the fake
+// Cloud Controller at $CFPROBE_HELPER_CC still has. With -login it exits
+// with diagnose.ExitRefused for any other password, or 1 without trying
+// when $CFPROBE_HELPER_LOGIN_DOWN is set.
+func TestHelperProbe(t *testing.T) {
+	if os.Getenv("CFPROBE_HELPER_PROBE") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	name, credsFile, login := args[1], "", false
+	for i, arg := range args {
+		switch arg {
+		case "-creds":
+			credsFile = args[i+1]
+		case "-login":
+			login = true
+		}
+	}
+	data, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	var creds map[string]interface{}
+	json.Unmarshal(data, &creds)
+	password, _ := creds["password"].(string)
+	live := password == "right" || liveKey(password)
+	switch {
+	case login && os.Getenv("CFPROBE_HELPER_LOGIN_DOWN") != "":
+		fmt.Println("Failed to log in: connection refused")
+		os.Exit(1)
+	case login && live:
+		fmt.Println("Credentials accepted")
+	case login:
+		fmt.Println("Credentials refused: authentication failed")
+		os.Exit(diagnose.ExitRefused)
+	case !live:
+		fmt.Printf("Failed to access %s: authentication failed\n", name)
+		os.Exit(1)
+	default:
+		fmt.Printf("%s service is OK\n", name)
+	}
+	os.Exit(0)
+}
+
+// liveKey reports whether password is the GUID of a key the fake Cloud
+// Controller at $CFPROBE_HELPER_CC still has, as with BindingPasswords
+func liveKey(password string) bool {
+	cc := os.Getenv("CFPROBE_HELPER_CC")
+	if cc == "" || !strings.HasPrefix(password, "binding-") {
+		return false
+	}
+	req, err := http.NewRequest("GET", cc+"/v3/service_credential_bindings/"+password+"/details", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "bearer fake-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func newKeyProbe(cc *FakeCC, out *bytes.Buffer, create bool) *KeyProbe {
+	var opts Options
+	opts.Timeout = time.Second
+	opts.Interval = time.Millisecond
+	client := NewCCClient(cc.URL, false)
+	client.Token = "fake-token"
+	return &KeyProbe{
+		Lifecycle: opts.Lifecycle(client, "space-guid", out),
+		Runner:    &ProbeRunner{Out: out, Command: helperCommand(cc)},
+		Create:    create,
+	}
+}
+
+func TestKeyProbe(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	instance := cc.AddInstance("test-psql", nil)
+	cc.Credentials[instance.GUID] = map[string]interface{}{"host": "db", "password": "right"}
+
+	var out bytes.Buffer
+	err := newKeyProbe(cc, &out, false).Run(Probes(".")["rds"])
+	require.NoError(t, err, out.String())
+	assert.Contains(t, out.String(), "rds service is OK")
+	assert.Empty(t, cc.Bindings)
+	assert.Len(t, cc.Instances, 1)
+	assert.Equal(t, 1, countPrefix(cc.Requests(), "GET /v3/service_credential_bindings/binding-"))
+}
+
+func TestKeyProbeBadCredentials(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	instance := cc.AddInstance("test-psql", nil)
+	cc.Credentials[instance.GUID] = map[string]interface{}{"password": "wrong"}
+
+	var out bytes.Buffer
+	err := newKeyProbe(cc, &out, false).Run(Probes(".")["rds"])
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "authentication failed")
+	assert.Empty(t, cc.Bindings, "key must be deleted after a failed probe")
+}
+
+func TestKeyProbeCreate(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.ProvisionPolls = 1
+
+	var out bytes.Buffer
+	keyProbe := newKeyProbe(cc, &out, true)
+	err := keyProbe.Run(Probes(".")["rmq"])
+	require.Error(t, err, "fake credentials have no password")
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Bindings)
+	require.Len(t, keyProbe.Results, 2)
+	assert.Equal(t, "create", keyProbe.Results[0].Type)
+	assert.Equal(t, -1, indexOf(cc.Requests(), "POST /v3/spaces/"), "no app is pushed")
+}
+
+func TestKeyProbeMissingInstance(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+
+	var out bytes.Buffer
+	err := newKeyProbe(cc, &out, false).Run(Probes(".")["elasticache"])
+	require.Error(t, err)
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Probe describes one probe app and the service instance it tests.
+// IsolationEnv names the variable the app reads a second instance from for
+// its isolation check, and Env adds variables to the app's manifest.
+type Probe struct {
+	Name         string
+	Offering     string
+	Plan         string
+	Instance     string
+	App          string
+	Dir          string
+	ServiceEnv   string
+	IsolationEnv string
+	Endpoint     string
+	OKText       string
+	Env          map[string]string
+}
+
+// ProbeLabel is the label cfprobe puts on everything it creates, with the
+// probe name as its value
+const ProbeLabel = "cfprobe"
+
+// Labels returns the labels for resources created for the probe
+func (p Probe) Labels() map[string]string {
+	return map[string]string{ProbeLabel: p.Name}
+}
+
+// Probes returns the known probes, with app directories under root. The
+// settings honour the same <PROBE>_SERVICE_NAME, <PROBE>_APP_NAME and
+// <PROBE>_ENDPOINT variables as the old per-service scripts.
+func Probes(root string) map[string]Probe {
+	probes := []Probe{
+		{Name: "rds", Offering: "rds", Plan: "shared-psql", Instance: "test-psql", App: "cf-test-rds",
+			ServiceEnv: "DB_SERVICENAME", IsolationEnv: "DB_ISOLATION_SERVICENAME", OKText: "RDS service is OK"},
+		{Name: "elasticache", Offering: "elasticache-broker", Plan: "small", Instance: "test-elasticache", App: "cf-test-elasticache",
+			ServiceEnv: "ELASTICACHE_SERVICE_NAME", IsolationEnv: "ELASTICACHE_ISOLATION_SERVICE_NAME", OKText: "Elasticache service is OK"},
+		{Name: "rmq", Offering: "rabbitmq", Plan: "standard", Instance: "test-rmq", App: "cf-test-rmq",
+			ServiceEnv: "RMQ_SERVICENAME", IsolationEnv: "RMQ_ISOLATION_SERVICENAME", OKText: "RMQ service is OK"},
+		{Name: "simple", App: "cf-test-simple", OKText: "Test app is OK"},
+	}
+
+	byName := make(map[string]Probe, len(probes))
+	for _, p := range probes {
+		prefix := strings.ToUpper(p.Name) + "_"
+		p.Dir = filepath.Join(root, p.Name)
+		p.Instance = getenvDefault(prefix+"SERVICE_NAME", p.Instance)
+		p.Plan = getenvDefault(prefix+"PLAN", p.Plan)
+		p.App = getenvDefault(prefix+"APP_NAME", p.App)
+		p.Endpoint = os.Getenv(prefix + "ENDPOINT")
+		byName[p.Name] = p
+	}
+	return byName
+}
+
+// ProbeNames lists the known probe names in order
+func ProbeNames(probes map[string]Probe) []string {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lifecycle drives a probe through create, push, bind, test and teardown.
+// Results collects the outcome and duration of every broker operation.
+// Also lists further service instances to bind to the app alongside the
+// probe's own, and AppEnv adds variables to every app pushed.
+type Lifecycle struct {
+	CC        *CCClient
+	SpaceGUID string
+	HTTP      *http.Client
+	Watcher   *Watcher
+	Out       io.Writer
+	Timeout   time.Duration
+	Interval  time.Duration
+	Keep      bool
+	Also      []*ServiceInstance
+	AppEnv    map[string]string
+	Results   []OperationResult
+}
+
+// Run creates the probe's service instance and app, tests the app and then
+// removes everything again. Teardown happens even when an earlier step
+// fails, unless Keep is set.
+func (l *Lifecycle) Run(p Probe) error {
+	return l.With(p, func(instance *ServiceInstance, app *App) error {
+		return l.Test(p, app)
+	})
+}
+
+// With creates the probe's service instance and app as Run does, but hands
+// them to fn in place of the plain test. The instance is nil for probes
+// without a backing service.
+func (l *Lifecycle) With(p Probe, fn func(instance *ServiceInstance, app *App) error) (err error) {
+	var instance *ServiceInstance
+	if p.Offering != "" {
+		if instance, err = l.CreateService(p); err != nil {
+			if instance != nil && !l.Keep {
+				err = joinErrors(err, l.DeleteService(instance))
+			}
+			return
+		}
+		if !l.Keep {
+			defer func() { err = joinErrors(err, l.DeleteService(instance)) }()
+		}
+	}
+
+	l.step("pushing %s from %s", p.App, p.Dir)
+	env := map[string]string{}
+	for k, v := range l.AppEnv {
+		env[k] = v
+	}
+	if p.ServiceEnv != "" {
+		env[p.ServiceEnv] = p.Instance
+	}
+	for k, v := range p.Env {
+		env[k] = v
+	}
+	manifest, bits, err := PrepareManifest(p.Dir, p.App, p.Labels(), env)
+	if err != nil {
+		return
+	}
+	app, err := l.CC.PushApp(l.SpaceGUID, p.App, bits, manifest, l.Timeout, l.Interval)
+	if app == nil {
+		if found, findErr := l.CC.FindApp(l.SpaceGUID, p.App); findErr == nil {
+			app = found
+		}
+	}
+	if app != nil && !l.Keep {
+		bound := append([]*ServiceInstance{instance}, l.Also...)
+		defer func() { err = joinErrors(err, l.DeleteApp(app, bound...)) }()
+	}
+	if err != nil {
+		return
+	}
+
+	for _, i := range append([]*ServiceInstance{instance}, l.Also...) {
+		if i == nil {
+			continue
+		}
+		l.step("binding %s to %s", i.Name, p.App)
+		if err = l.CC.Bind(app.GUID, i.GUID, l.Timeout, l.Interval); err != nil {
+			return
+		}
+	}
+
+	l.step("starting %s", p.App)
+	if err = l.CC.StartApp(app.GUID, l.Timeout, l.Interval); err != nil {
+		return
+	}
+
+	return fn(instance, app)
+}
+
+// CreateService provisions the probe's service instance and waits for the
+// broker to finish. The instance is returned even on failure so it can be
+// cleaned up.
+func (l *Lifecycle) CreateService(p Probe) (*ServiceInstance, error) {
+	l.step("creating service %s (%s %s)", p.Instance, p.Offering, p.Plan)
+	planGUID, err := l.CC.FindServicePlan(p.Offering, p.Plan)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := l.CC.CreateServiceInstance(l.SpaceGUID, planGUID, p.Instance, p.Labels())
+	if err != nil {
+		return instance, err
+	}
+
+	err = l.watch(instance, "create", p.Offering, p.Plan)
+	return instance, err
+}
+
+// watch waits for a broker operation on instance and records the result
+func (l *Lifecycle) watch(instance *ServiceInstance, operation, offering, plan string) error {
+	result, err := l.Watcher.Wait(instance.GUID, operation)
+	result.Instance = instance.Name
+	result.Offering = offering
+	result.Plan = plan
+	l.Results = append(l.Results, result)
+	return err
+}
+
+// Test checks the app's endpoint reports the service as OK
+func (l *Lifecycle) Test(p Probe, app *App) error {
+	endpoint, err := l.Endpoint(p, app)
+	if err != nil {
+		return err
+	}
+
+	l.step("testing %s", endpoint)
+	return CheckEndpoint(l.HTTP, endpoint, p.OKText)
+}
+
+// Endpoint returns the probe's configured endpoint or else the app's first route
+func (l *Lifecycle) Endpoint(p Probe, app *App) (string, error) {
+	if p.Endpoint != "" {
+		return p.Endpoint, nil
+	}
+	routes, err := l.CC.AppRoutes(app.GUID)
+	if err != nil {
+		return "", err
+	}
+	if len(routes) == 0 {
+		return "", fmt.Errorf("%s has no routes", p.App)
+	}
+	endpoint := routes[0].URL
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return endpoint, nil
+}
+
+// DeleteApp unbinds the app from the given instances, skipping nil ones,
+// and deletes it
+func (l *Lifecycle) DeleteApp(app *App, instances ...*ServiceInstance) error {
+	for _, instance := range instances {
+		if instance == nil {
+			continue
+		}
+		bindings, err := l.CC.Bindings(instance.GUID, app.GUID)
+		if err != nil {
+			return err
+		}
+		for _, b := range bindings {
+			l.step("unbinding %s from %s", instance.Name, app.Name)
+			if err := l.CC.Unbind(b.GUID, l.Timeout, l.Interval); err != nil {
+				return err
+			}
+		}
+	}
+
+	l.step("deleting app %s", app.Name)
+	return l.CC.DeleteApp(app.GUID, l.Timeout, l.Interval)
+}
+
+// DeleteService deprovisions a service instance and waits for it to disappear
+func (l *Lifecycle) DeleteService(instance *ServiceInstance) error {
+	l.step("deleting service %s", instance.Name)
+	if err := l.CC.DeleteServiceInstance(instance.GUID); err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	return l.watch(instance, "delete", "", "")
+}
+
+func (l *Lifecycle) step(format string, args ...interface{}) {
+	fmt.Fprintf(l.Out, "==> "+format+"\n", args...)
+}
+
+// CheckEndpoint fetches url and checks the response is a 200 containing okText
+func CheckEndpoint(client *http.Client, url, okText string) error {
+	return callEndpoint(client, "GET", url, okText)
+}
+
+// callEndpoint makes a bodyless request and checks the response as CheckEndpoint does
+func callEndpoint(client *http.Client, method, url, okText string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte(okText)) {
+		return fmt.Errorf("%s returned %d: %s", url, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// joinErrors keeps the first error and appends any teardown error to it
+func joinErrors(err, teardownErr error) error {
+	switch {
+	case teardownErr == nil:
+		return err
+	case err == nil:
+		return teardownErr
+	}
+	return fmt.Errorf("%v (teardown: %v)", err, teardownErr)
+}
+
+func getenvDefault(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
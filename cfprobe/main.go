@@ -0,0 +1,241 @@
+// Command cfprobe runs the probe lifecycle against a Cloud Foundry
+// foundation through the Cloud Controller v3 API: it creates the backing
+// service, waits for the broker, pushes and binds the probe app, tests it
+// and tears everything down again.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage = `usage: cfprobe <command> [flags] [probe...]
+
+commands:
+`
+
+// command is a cfprobe subcommand. run returns the process exit code.
+type command struct {
+	summary string
+	run     func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run":       {"create, push, bind, test and delete probes", runCommand},
+		"cleanup":   {"unbind and delete leftover probe apps and services", cleanupCommand},
+		"watch":     {"wait for service instance operations and report how long they took", watchCommand},
+		"plans":     {"run probes against every plan of their offering and report", plansCommand},
+		"key":       {"probe service instances through a service key without pushing an app", keyCommand},
+		"upgrade":   {"check data and availability across a service plan update", upgradeCommand},
+		"isolation": {"check two instances of a plan cannot reach each other's data", isolationCommand},
+		"rotate":    {"rebind the probe app and check the old binding's credentials are revoked", rotateCommand},
+	}
+}
+
+func main() {
+	os.Exit(Main(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Main dispatches to a subcommand and returns the exit code
+func Main(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+	return cmd.run(args[1:], stdout, stderr)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usage)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
+
+// Options holds the connection settings shared by every command
+type Options struct {
+	API               string
+	Username          string
+	Password          string
+	ClientID          string
+	ClientSecret      string
+	Org               string
+	Space             string
+	SkipSSLValidation bool
+	Timeout           time.Duration
+	Interval          time.Duration
+	MaxInterval       time.Duration
+	Backoff           float64
+	Root              string
+	ProbeToken        string
+}
+
+// Register adds the shared flags to fs, defaulting from the CF_* variables
+func (o *Options) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.API, "api", os.Getenv("CF_API"), "Cloud Controller URL (default $CF_API)")
+	fs.StringVar(&o.Username, "username", os.Getenv("CF_USERNAME"), "UAA user (default $CF_USERNAME)")
+	fs.StringVar(&o.Password, "password", os.Getenv("CF_PASSWORD"), "UAA password (default $CF_PASSWORD)")
+	fs.StringVar(&o.ClientID, "client-id", os.Getenv("CF_CLIENT_ID"), "UAA client, used without a username (default $CF_CLIENT_ID)")
+	fs.StringVar(&o.ClientSecret, "client-secret", os.Getenv("CF_CLIENT_SECRET"), "UAA client secret (default $CF_CLIENT_SECRET)")
+	fs.StringVar(&o.Org, "org", os.Getenv("CF_ORG"), "org to work in (default $CF_ORG)")
+	fs.StringVar(&o.Space, "space", os.Getenv("CF_SPACE"), "space to work in (default $CF_SPACE)")
+	fs.BoolVar(&o.SkipSSLValidation, "skip-ssl-validation", os.Getenv("CF_SKIP_SSL_VALIDATION") == "true", "skip TLS verification of the API and probe apps")
+	fs.DurationVar(&o.Timeout, "timeout", 30*time.Minute, "how long to wait for each asynchronous operation")
+	fs.DurationVar(&o.Interval, "poll", 5*time.Second, "how often to poll asynchronous operations")
+	fs.DurationVar(&o.MaxInterval, "max-poll", time.Minute, "longest interval between polls of a broker operation")
+	fs.Float64Var(&o.Backoff, "backoff", 1.5, "factor the broker poll interval grows by after each poll")
+	fs.StringVar(&o.Root, "root", ".", "directory holding the probe app directories")
+	fs.StringVar(&o.ProbeToken, "probe-token", os.Getenv("PROBE_AUTH_TOKEN"), "bearer token the probe apps require, set on pushed apps and sent to them (default $PROBE_AUTH_TOKEN)")
+}
+
+// Connect logs in to the Cloud Controller and resolves the target space
+func (o *Options) Connect() (cc *CCClient, spaceGUID string, err error) {
+	if o.API == "" || o.Org == "" || o.Space == "" {
+		return nil, "", fmt.Errorf("-api, -org and -space are required")
+	}
+
+	cc = NewCCClient(o.API, o.SkipSSLValidation)
+	if err = cc.Login(o.Username, o.Password, o.ClientID, o.ClientSecret); err != nil {
+		return nil, "", fmt.Errorf("Failed to log in: %v", err)
+	}
+	spaceGUID, err = cc.FindSpace(o.Org, o.Space)
+	return
+}
+
+// HTTPClient returns the client used to call probe apps, sending
+// -probe-token when set
+func (o *Options) HTTPClient(cc *CCClient) *http.Client {
+	transport := cc.HTTP.Transport
+	if o.ProbeToken != "" {
+		transport = &bearerTransport{Token: o.ProbeToken, Base: transport}
+	}
+	return &http.Client{Transport: transport, Timeout: time.Minute}
+}
+
+// bearerTransport adds a bearer token to every request
+type bearerTransport struct {
+	Token string
+	Base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		r2.Header[k] = v
+	}
+	r2.Header.Set("Authorization", "Bearer "+t.Token)
+	return base.RoundTrip(r2)
+}
+
+// Watcher returns a broker operation watcher using the polling flags
+func (o *Options) Watcher(cc *CCClient) *Watcher {
+	return &Watcher{
+		CC:          cc,
+		Timeout:     o.Timeout,
+		Interval:    o.Interval,
+		MaxInterval: o.MaxInterval,
+		Backoff:     o.Backoff,
+	}
+}
+
+// Lifecycle returns a Lifecycle working in the given space
+func (o *Options) Lifecycle(cc *CCClient, spaceGUID string, out io.Writer) *Lifecycle {
+	var env map[string]string
+	if o.ProbeToken != "" {
+		env = map[string]string{"PROBE_AUTH_TOKEN": o.ProbeToken}
+	}
+	return &Lifecycle{
+		CC:        cc,
+		SpaceGUID: spaceGUID,
+		HTTP:      o.HTTPClient(cc),
+		Watcher:   o.Watcher(cc),
+		Out:       out,
+		Timeout:   o.Timeout,
+		Interval:  o.Interval,
+		AppEnv:    env,
+	}
+}
+
+// selectProbes resolves probe names from the command line, defaulting to all
+func selectProbes(probes map[string]Probe, names []string) ([]Probe, error) {
+	if len(names) == 0 {
+		names = ProbeNames(probes)
+	}
+	selected := make([]Probe, 0, len(names))
+	for _, name := range names {
+		p, ok := probes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown probe %q, expected one of %s", name, strings.Join(ProbeNames(probes), ", "))
+		}
+		selected = append(selected, p)
+	}
+	return selected, nil
+}
+
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	keep := fs.Bool("keep", false, "leave the service instance and app in place after the test")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	lifecycle := opts.Lifecycle(cc, spaceGUID, stdout)
+	lifecycle.Keep = *keep
+
+	code := 0
+	for _, p := range probes {
+		lifecycle.Results = nil
+		err := lifecycle.Run(p)
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", p.Name, err)
+			code = 1
+		} else {
+			fmt.Fprintf(stdout, "PASS %s\n", p.Name)
+		}
+		for _, result := range lifecycle.Results {
+			fmt.Fprintf(stdout, "  %v\n", result)
+		}
+	}
+	return code
+}
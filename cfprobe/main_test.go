@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testManifest = `---
+applications:
+- name: cf-test-rds
+  path: ..
+  env:
+    GOVERSION: go1.8.3
+  services:
+    - test-psql
+`
+
+// setupProbeRoot creates a probe root holding an rds app directory
+func setupProbeRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "cfprobe")
+	require.NoError(t, err)
+	dir := filepath.Join(root, "rds")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "manifest.yml"), []byte(testManifest), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644))
+	return root
+}
+
+// probeApp serves a fixed status and body in place of a pushed probe app
+func probeApp(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func runArgs(cc *FakeCC, root string, args ...string) []string {
+	return append([]string{"-api", cc.URL, "-org", "o", "-space", "s", "-poll", "1ms", "-root", root}, args...)
+}
+
+// indexOf returns the position of the first request starting with prefix
+func indexOf(requests []string, prefix string) int {
+	for i, r := range requests {
+		if strings.HasPrefix(r, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRunLifecycle(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	app := probeApp(http.StatusOK, "RDS service is OK")
+	defer app.Close()
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.AppURL = app.URL
+	cc.ProvisionPolls = 2
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"run"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Contains(t, stdout.String(), "PASS rds")
+	assert.Contains(t, stdout.String(), "create test-psql (rds shared-psql): succeeded after")
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Apps)
+	assert.Empty(t, cc.Bindings)
+
+	requests := cc.Requests()
+	order := []string{
+		"POST /v3/service_instances",
+		"POST /v3/spaces/space-guid/actions/apply_manifest",
+		"POST /v3/packages",
+		"POST /v3/builds",
+		"POST /v3/service_credential_bindings",
+		"POST /v3/apps/app-",
+		"DELETE /v3/service_credential_bindings/",
+		"DELETE /v3/apps/",
+		"DELETE /v3/service_instances/",
+	}
+	last := -1
+	for _, prefix := range order {
+		i := indexOf(requests, prefix)
+		require.True(t, i > last, "%s out of order in %v", prefix, requests)
+		last = i
+	}
+}
+
+func TestRunProbeToken(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	cc := NewFakeCC()
+	defer cc.Close()
+	var pushedToken string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc.mu.Lock()
+		for _, a := range cc.Apps {
+			pushedToken = a.Env["PROBE_AUTH_TOKEN"]
+		}
+		cc.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "RDS service is OK")
+	}))
+	defer app.Close()
+	cc.AppURL = app.URL
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"run", "-probe-token", "t0ken"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Equal(t, "t0ken", pushedToken)
+
+	stdout.Reset()
+	code = Main(append([]string{"run"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "returned 401")
+}
+
+func TestRunCreateFails(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.FailProvision = "quota exceeded"
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"run"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "FAIL rds: create test-psql failed: quota exceeded")
+	assert.Equal(t, -1, indexOf(cc.Requests(), "POST /v3/spaces/"))
+	assert.Empty(t, cc.Instances)
+}
+
+func TestRunProbeFails(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	app := probeApp(http.StatusFailedDependency, "Failed to read database: timeout")
+	defer app.Close()
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.AppURL = app.URL
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"run"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "returned 424: Failed to read database: timeout")
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Apps)
+}
+
+func TestRunKeep(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+	app := probeApp(http.StatusOK, "RDS service is OK")
+	defer app.Close()
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.AppURL = app.URL
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"run", "-keep"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Len(t, cc.Instances, 1)
+	assert.Len(t, cc.Apps, 1)
+	assert.Len(t, cc.Bindings, 1)
+	for _, app := range cc.Apps {
+		assert.Equal(t, "test-psql", app.Env["DB_SERVICENAME"])
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Main(nil, &stdout, &stderr))
+	assert.Equal(t, 2, Main([]string{"nonsense"}, &stdout, &stderr))
+	assert.Equal(t, 2, Main([]string{"run", "-api", "x", "mysql"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), `unknown probe "mysql"`)
+}
+
+func TestPrepareManifest(t *testing.T) {
+	root := setupProbeRoot(t)
+	defer os.RemoveAll(root)
+
+	data, bits, err := PrepareManifest(filepath.Join(root, "rds"), "renamed", map[string]string{ProbeLabel: "rds"}, map[string]string{"DB_SERVICENAME": "other-psql"})
+	require.NoError(t, err)
+	assert.Equal(t, root, bits)
+
+	var manifest struct {
+		Applications []struct {
+			Name         string            `yaml:"name"`
+			Path         string            `yaml:"path"`
+			DefaultRoute bool              `yaml:"default-route"`
+			Env          map[string]string `yaml:"env"`
+			Services     []string          `yaml:"services"`
+			Metadata     Metadata          `yaml:"metadata"`
+		} `yaml:"applications"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &manifest))
+	require.Len(t, manifest.Applications, 1)
+	app := manifest.Applications[0]
+	assert.Equal(t, "renamed", app.Name)
+	assert.True(t, app.DefaultRoute)
+	assert.Empty(t, app.Path)
+	assert.Empty(t, app.Services)
+	assert.Equal(t, map[string]string{ProbeLabel: "rds"}, app.Metadata.Labels)
+	assert.Equal(t, map[string]string{"GOVERSION": "go1.8.3", "DB_SERVICENAME": "other-psql"}, app.Env)
+}
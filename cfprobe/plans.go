@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// PlanResult is one row of the plan compatibility report
+type PlanResult struct {
+	Probe     string        `json:"probe"`
+	Offering  string        `json:"offering"`
+	Plan      string        `json:"plan"`
+	Result    string        `json:"result"`
+	Provision time.Duration `json:"provision_ns"`
+	Total     time.Duration `json:"total_ns"`
+	Detail    string        `json:"detail,omitempty"`
+}
+
+// PlanMatrix runs a probe once against every selected plan of its offering
+type PlanMatrix struct {
+	*Lifecycle
+	Only []string
+	Skip []string
+}
+
+// Run provisions, tests and deprovisions each plan in turn. Failures are
+// recorded in the report rather than stopping the run.
+func (m *PlanMatrix) Run(p Probe) ([]PlanResult, error) {
+	plans, err := m.CC.ServicePlans(p.Offering)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(plansByName(plans))
+
+	var results []PlanResult
+	for _, plan := range plans {
+		result := PlanResult{Probe: p.Name, Offering: p.Offering, Plan: plan.Name}
+		switch {
+		case !m.selected(plan.Name):
+			continue
+		case !plan.Available:
+			result.Result = "SKIP"
+			result.Detail = "plan is not available"
+			results = append(results, result)
+			continue
+		}
+
+		planProbe := p
+		planProbe.Plan = plan.Name
+		planProbe.Instance = p.Instance + "-" + plan.Name
+
+		m.Results = nil
+		start := time.Now()
+		err := m.Lifecycle.Run(planProbe)
+		result.Total = time.Since(start)
+		for _, op := range m.Results {
+			if op.Type == "create" {
+				result.Provision = op.Duration
+			}
+		}
+
+		result.Result = "PASS"
+		if err != nil {
+			result.Result = "FAIL"
+			result.Detail = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (m *PlanMatrix) selected(plan string) bool {
+	for _, skip := range m.Skip {
+		if skip == plan {
+			return false
+		}
+	}
+	if len(m.Only) == 0 {
+		return true
+	}
+	for _, only := range m.Only {
+		if only == plan {
+			return true
+		}
+	}
+	return false
+}
+
+type plansByName []ServicePlan
+
+func (p plansByName) Len() int           { return len(p) }
+func (p plansByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p plansByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// WritePlanReport writes the results as an aligned table
+func WritePlanReport(w io.Writer, results []PlanResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBE\tOFFERING\tPLAN\tRESULT\tPROVISION\tTOTAL\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%v\t%s\n",
+			r.Probe, r.Offering, r.Plan, r.Result,
+			r.Provision-r.Provision%time.Second, r.Total-r.Total%time.Second, r.Detail)
+	}
+	return tw.Flush()
+}
+
+func plansCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("plans", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	only := fs.String("plans", "", "comma separated plans to test (default all)")
+	skip := fs.String("skip-plans", "", "comma separated plans not to test")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	progress := stderr
+	if !*asJSON {
+		progress = stdout
+	}
+	matrix := &PlanMatrix{Lifecycle: opts.Lifecycle(cc, spaceGUID, progress)}
+	if *only != "" {
+		matrix.Only = strings.Split(*only, ",")
+	}
+	if *skip != "" {
+		matrix.Skip = strings.Split(*skip, ",")
+	}
+
+	code := 0
+	var report []PlanResult
+	for _, p := range probes {
+		if p.Offering == "" {
+			continue
+		}
+		results, err := matrix.Run(p)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", p.Name, err)
+			code = 1
+			continue
+		}
+		for _, r := range results {
+			if r.Result == "FAIL" {
+				code = 1
+			}
+		}
+		report = append(report, results...)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = WritePlanReport(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return code
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupPlanMatrix(t *testing.T) (*FakeCC, string, func()) {
+	root := setupProbeRoot(t)
+	app := probeApp(http.StatusOK, "RDS service is OK")
+	cc := NewFakeCC()
+	cc.AppURL = app.URL
+	cc.Plans["rds/small-psql"] = "plan-small"
+	cc.Plans["rds/large-psql"] = "plan-large"
+	cc.Plans["rds/legacy-psql"] = "plan-legacy"
+	cc.FailPlans = map[string]string{"plan-large": "instance class not supported"}
+	cc.UnavailablePlans = map[string]bool{"plan-legacy": true}
+	return cc, root, func() {
+		cc.Close()
+		app.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestPlanMatrix(t *testing.T) {
+	cc, root, teardown := setupPlanMatrix(t)
+	defer teardown()
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"plans", "-json"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	assert.Equal(t, 1, code, stderr.String())
+
+	var report []PlanResult
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Len(t, report, 4)
+
+	results := map[string]PlanResult{}
+	for _, r := range report {
+		assert.Equal(t, "rds", r.Probe)
+		results[r.Plan] = r
+	}
+	assert.Equal(t, "FAIL", results["large-psql"].Result)
+	assert.Contains(t, results["large-psql"].Detail, "instance class not supported")
+	assert.Equal(t, "SKIP", results["legacy-psql"].Result)
+	assert.Equal(t, "PASS", results["shared-psql"].Result)
+	assert.Equal(t, "PASS", results["small-psql"].Result)
+	assert.Empty(t, cc.Instances)
+	assert.Empty(t, cc.Apps)
+}
+
+func TestPlanMatrixSelection(t *testing.T) {
+	cc, root, teardown := setupPlanMatrix(t)
+	defer teardown()
+
+	var stdout, stderr bytes.Buffer
+	code := Main(append([]string{"plans", "-plans", "small-psql,large-psql", "-skip-plans", "large-psql"}, runArgs(cc, root, "rds")...), &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Contains(t, stdout.String(), "PROBE")
+	assert.Contains(t, stdout.String(), "small-psql")
+	assert.NotContains(t, stdout.String(), "large-psql")
+	assert.Equal(t, 1, countPrefix(cc.Requests(), "POST /v3/service_instances"))
+}
+
+func countPrefix(requests []string, prefix string) int {
+	n := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
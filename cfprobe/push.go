@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest is an app manifest as read from a probe's manifest.yml
+type Manifest struct {
+	Applications []map[string]interface{} `yaml:"applications"`
+}
+
+// PrepareManifest reads dir/manifest.yml and rewrites its first application
+// with the given name, labels and extra env. Services are stripped because
+// cfprobe binds them itself so that it can unbind them again. It also returns
+// the directory to upload, which is the manifest's path relative to dir, as
+// cf push reads it, or dir itself.
+func PrepareManifest(dir, appName string, labels, env map[string]string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.yml"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("Failed to parse manifest in %s: %v", dir, err)
+	}
+	if len(manifest.Applications) == 0 {
+		return nil, "", fmt.Errorf("no applications in manifest in %s", dir)
+	}
+
+	app := manifest.Applications[0]
+	app["name"] = appName
+	app["default-route"] = true
+	if len(labels) > 0 {
+		app["metadata"] = map[string]interface{}{"labels": labels}
+	}
+	delete(app, "services")
+
+	bits := dir
+	if path, ok := app["path"].(string); ok {
+		bits = path
+		if !filepath.IsAbs(path) {
+			bits = filepath.Join(dir, path)
+		}
+		delete(app, "path")
+	}
+
+	appEnv := map[string]interface{}{}
+	if existing, ok := app["env"].(map[interface{}]interface{}); ok {
+		for k, v := range existing {
+			appEnv[fmt.Sprint(k)] = v
+		}
+	}
+	for k, v := range env {
+		appEnv[k] = v
+	}
+	if len(appEnv) > 0 {
+		app["env"] = appEnv
+	}
+
+	manifest.Applications = manifest.Applications[:1]
+	data, err = yaml.Marshal(manifest)
+	return data, bits, err
+}
+
+// PushApp applies a manifest in the space, uploads dir as the app's bits and
+// stages them. The app is left stopped with the new droplet current.
+func (c *CCClient) PushApp(spaceGUID, appName, dir string, manifest []byte, timeout, interval time.Duration) (*App, error) {
+	resp, err := c.send("POST", "/v3/spaces/"+spaceGUID+"/actions/apply_manifest", "application/x-yaml", bytes.NewReader(manifest), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.WaitForJob(resp.Header.Get("Location"), timeout, interval); err != nil {
+		return nil, err
+	}
+
+	app, err := c.FindApp(spaceGUID, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg struct {
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	}
+	body := map[string]interface{}{
+		"type":          "bits",
+		"relationships": map[string]Relationship{"app": toOne(app.GUID)},
+	}
+	if _, err := c.do("POST", "/v3/packages", body, &pkg); err != nil {
+		return nil, err
+	}
+
+	bits, contentType, err := zipDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.send("POST", "/v3/packages/"+pkg.GUID+"/upload", contentType, bits, nil); err != nil {
+		return nil, err
+	}
+	err = poll(timeout, interval, func() (bool, error) {
+		if _, err := c.do("GET", "/v3/packages/"+pkg.GUID, nil, &pkg); err != nil {
+			return false, err
+		}
+		switch pkg.State {
+		case "READY":
+			return true, nil
+		case "FAILED", "EXPIRED":
+			return false, fmt.Errorf("package for %s is %s", appName, pkg.State)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var build struct {
+		GUID    string   `json:"guid"`
+		State   string   `json:"state"`
+		Error   string   `json:"error"`
+		Droplet *GUIDRef `json:"droplet"`
+	}
+	body = map[string]interface{}{"package": GUIDRef{GUID: pkg.GUID}}
+	if _, err := c.do("POST", "/v3/builds", body, &build); err != nil {
+		return nil, err
+	}
+	err = poll(timeout, interval, func() (bool, error) {
+		if _, err := c.do("GET", "/v3/builds/"+build.GUID, nil, &build); err != nil {
+			return false, err
+		}
+		switch build.State {
+		case "STAGED":
+			return true, nil
+		case "FAILED":
+			return false, fmt.Errorf("staging %s failed: %s", appName, build.Error)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if build.Droplet == nil {
+		return nil, fmt.Errorf("staging %s produced no droplet", appName)
+	}
+
+	_, err = c.do("PATCH", "/v3/apps/"+app.GUID+"/relationships/current_droplet", toOne(build.Droplet.GUID), nil)
+	return app, err
+}
+
+// StartApp restarts an app and waits for a web instance to be running
+func (c *CCClient) StartApp(appGUID string, timeout, interval time.Duration) error {
+	if _, err := c.do("POST", "/v3/apps/"+appGUID+"/actions/restart", nil, nil); err != nil {
+		return err
+	}
+
+	return poll(timeout, interval, func() (bool, error) {
+		var stats struct {
+			Resources []struct {
+				State string `json:"state"`
+			} `json:"resources"`
+		}
+		if _, err := c.do("GET", "/v3/apps/"+appGUID+"/processes/web/stats", nil, &stats); err != nil {
+			return false, err
+		}
+		for _, instance := range stats.Resources {
+			switch instance.State {
+			case "RUNNING":
+				return true, nil
+			case "CRASHED":
+				return false, fmt.Errorf("app instance crashed")
+			}
+		}
+		return false, nil
+	})
+}
+
+// zipDir packs the regular files under dir into a multipart body for package upload
+func zipDir(dir string) (io.Reader, string, error) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("bits", "bits.zip")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(part, &archive); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, mw.FormDataContentType(), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// RotationProbe checks that rotating the probe app's service binding works:
+// credentials made for the instance afresh, as a service key, work before
+// the old binding goes; once it is deleted its credentials no longer log in;
+// and the app, bound again and restarted, passes with the new ones. An app
+// cannot hold two bindings to one instance, so the new credentials are a
+// key. The app must already be pushed and bound, as run -keep leaves it.
+type RotationProbe struct {
+	*Lifecycle
+	Runner *ProbeRunner
+	// RevokeTimeout is how long the old credentials may keep working after
+	// their binding is deleted, as brokers can revoke them asynchronously
+	RevokeTimeout time.Duration
+}
+
+// Run checks the app passes with its current binding, creates a service key
+// and runs the probe locally with its credentials, deletes the binding and
+// waits for a login with its credentials to be refused, then binds the app
+// again, restarts it and checks it passes. The app is bound again even when
+// the old credentials are not revoked, and the key is always deleted.
+func (r *RotationProbe) Run(p Probe) (err error) {
+	if p.Offering == "" {
+		return fmt.Errorf("%s has no backing service", p.Name)
+	}
+	instance, err := r.CC.FindServiceInstance(r.SpaceGUID, p.Instance)
+	if err != nil {
+		return
+	}
+	app, err := r.CC.FindApp(r.SpaceGUID, p.App)
+	if err != nil {
+		return
+	}
+	bindings, err := r.CC.Bindings(instance.GUID, app.GUID)
+	if err != nil {
+		return
+	}
+	if len(bindings) == 0 {
+		return fmt.Errorf("%s is not bound to %s", p.App, instance.Name)
+	}
+	old := bindings[0]
+	oldCreds, err := r.CC.BindingCredentials(old.GUID)
+	if err != nil {
+		return
+	}
+	if err = r.Test(p, app); err != nil {
+		return fmt.Errorf("old credentials: %v", err)
+	}
+
+	keyName := fmt.Sprintf("%s-rotate-%d", p.Name, time.Now().Unix())
+	r.step("creating service key %s for %s", keyName, instance.Name)
+	key, err := r.CC.CreateServiceKey(instance.GUID, keyName, r.Timeout, r.Interval)
+	if err != nil {
+		return
+	}
+	defer func() {
+		r.step("deleting service key %s", keyName)
+		err = joinErrors(err, r.CC.Unbind(key.GUID, r.Timeout, r.Interval))
+	}()
+	newCreds, err := r.CC.BindingCredentials(key.GUID)
+	if err != nil {
+		return
+	}
+	if reflect.DeepEqual(oldCreds, newCreds) {
+		r.step("the new key has the same credentials as the old binding")
+	}
+	r.step("running %s probe with the new key's credentials", p.Name)
+	if err = r.Runner.Run(p, newCreds); err != nil {
+		return fmt.Errorf("new credentials: %v", err)
+	}
+
+	r.step("deleting %s's binding to %s", p.App, instance.Name)
+	if err = r.CC.Unbind(old.GUID, r.Timeout, r.Interval); err != nil {
+		return
+	}
+	err = r.checkRevoked(p, oldCreds)
+	return joinErrors(err, r.rebind(p, instance, app))
+}
+
+// rebind binds the app to instance again, restarts it to pick up the new
+// binding's credentials and tests it
+func (r *RotationProbe) rebind(p Probe, instance *ServiceInstance, app *App) error {
+	r.step("binding %s to %s", p.App, instance.Name)
+	if err := r.CC.Bind(app.GUID, instance.GUID, r.Timeout, r.Interval); err != nil {
+		return err
+	}
+	r.step("restarting %s", p.App)
+	if err := r.CC.StartApp(app.GUID, r.Timeout, r.Interval); err != nil {
+		return err
+	}
+	if err := r.Test(p, app); err != nil {
+		return fmt.Errorf("new binding: %v", err)
+	}
+	return nil
+}
+
+// checkRevoked logs in with a deleted binding's credentials until the server
+// refuses them. A login failing any other way is an error, as it cannot say
+// whether the credentials were revoked.
+func (r *RotationProbe) checkRevoked(p Probe, oldCreds map[string]interface{}) error {
+	start := time.Now()
+	for {
+		r.step("logging in with the deleted binding's credentials")
+		refused, err := r.Runner.Login(p, oldCreds)
+		if err != nil {
+			return fmt.Errorf("old credentials: %v", err)
+		}
+		if refused {
+			elapsed := time.Since(start)
+			r.step("old credentials refused %v after their binding was deleted", elapsed-elapsed%time.Millisecond)
+			return nil
+		}
+		if time.Since(start) >= r.RevokeTimeout {
+			return fmt.Errorf("security: old credentials still accepted %v after their binding was deleted", r.RevokeTimeout)
+		}
+		time.Sleep(r.Interval)
+	}
+}
+
+func rotateCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	binDir := fs.String("bin-dir", "", "directory holding built probe binaries (default go run in each probe directory)")
+	revokeTimeout := fs.Duration("revoke-timeout", 5*time.Minute, "how long the old credentials may keep working after their binding is deleted")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	rotation := &RotationProbe{
+		Lifecycle:     opts.Lifecycle(cc, spaceGUID, stdout),
+		Runner:        &ProbeRunner{BinDir: *binDir, Out: stdout},
+		RevokeTimeout: *revokeTimeout,
+	}
+
+	code := 0
+	for _, p := range probes {
+		if p.Offering == "" {
+			continue
+		}
+		if err := rotation.Run(p); err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", p.Name, err)
+			code = 1
+		} else {
+			fmt.Fprintf(stdout, "PASS %s\n", p.Name)
+		}
+	}
+	return code
+}
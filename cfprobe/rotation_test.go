@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRotationProbe(cc *FakeCC, out *bytes.Buffer) *RotationProbe {
+	keyProbe := newKeyProbe(cc, out, false)
+	return &RotationProbe{Lifecycle: keyProbe.Lifecycle, Runner: keyProbe.Runner, RevokeTimeout: 50 * time.Millisecond}
+}
+
+// newProbeApp serves the endpoint of a pushed probe app. It passes while a
+// binding the app started with still exists, or always when every binding
+// shares the instance's credentials, and fails otherwise.
+func newProbeApp(cc *FakeCC, app *fakeApp, p Probe) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		live := !cc.BindingPasswords
+		for _, guid := range app.Started {
+			if _, ok := cc.Bindings[guid]; ok {
+				live = true
+			}
+		}
+		if !live {
+			w.WriteHeader(http.StatusFailedDependency)
+			return
+		}
+		w.Write([]byte(p.OKText))
+	}))
+	cc.AppURL = server.URL
+	return server
+}
+
+// addProbeApp seeds the probe's app running with a binding to instance
+func addProbeApp(cc *FakeCC, p Probe, instance *fakeInstance) (*fakeApp, *Binding) {
+	app := cc.AddApp(p.App, nil)
+	binding := cc.AddBinding(app, instance)
+	app.Droplet = "droplet-1"
+	app.State = "STARTED"
+	app.Started = []string{binding.GUID}
+	return app, binding
+}
+
+func TestRotationProbe(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.BindingPasswords = true
+	p := Probes(".")["rds"]
+	instance := cc.AddInstance(p.Instance, nil)
+	app, old := addProbeApp(cc, p, instance)
+	defer newProbeApp(cc, app, p).Close()
+
+	var out bytes.Buffer
+	err := newRotationProbe(cc, &out).Run(p)
+	require.NoError(t, err, out.String())
+	assert.Contains(t, out.String(), "rds service is OK")
+	assert.Contains(t, out.String(), "Credentials refused")
+	assert.Contains(t, out.String(), "old credentials refused")
+	assert.True(t, strings.Index(out.String(), "creating service key") < strings.Index(out.String(), "deleting cf-test-rds's binding"),
+		"the new credentials should be made before the old binding is deleted")
+	require.Len(t, cc.Bindings, 1, "the key should be deleted")
+	for guid, b := range cc.Bindings {
+		assert.NotEqual(t, old.GUID, guid, "the app should have a new binding")
+		assert.Equal(t, "app", b.Type)
+		assert.Equal(t, []string{guid}, app.Started, "the app should run with the new binding")
+	}
+	assert.Equal(t, 2, countPrefix(cc.Requests(), "POST /v3/service_credential_bindings"))
+}
+
+func TestRotationProbeNotRevoked(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	p := Probes(".")["elasticache"]
+	instance := cc.AddInstance(p.Instance, nil)
+	// every binding shares one password, as with a Redis AUTH token
+	cc.Credentials[instance.GUID] = map[string]interface{}{"password": "right"}
+	app, _ := addProbeApp(cc, p, instance)
+	defer newProbeApp(cc, app, p).Close()
+
+	var out bytes.Buffer
+	err := newRotationProbe(cc, &out).Run(p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "security: old credentials still accepted")
+	assert.Contains(t, out.String(), "the new key has the same credentials as the old binding")
+	assert.Contains(t, out.String(), "Credentials accepted")
+	assert.Len(t, cc.Bindings, 1, "the app should be bound again and the key deleted")
+	assert.Equal(t, "STARTED", app.State)
+}
+
+func TestRotationProbeNotAuth(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.BindingPasswords = true
+	p := Probes(".")["rmq"]
+	instance := cc.AddInstance(p.Instance, nil)
+	app, _ := addProbeApp(cc, p, instance)
+	defer newProbeApp(cc, app, p).Close()
+
+	var out bytes.Buffer
+	rotation := newRotationProbe(cc, &out)
+	command := rotation.Runner.Command
+	rotation.Runner.Command = func(p Probe, args ...string) *exec.Cmd {
+		cmd := command(p, args...)
+		cmd.Env = append(cmd.Env, "CFPROBE_HELPER_LOGIN_DOWN=1")
+		return cmd
+	}
+	err := rotation.Run(p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "old credentials: rmq login failed: exit status 1")
+	assert.Contains(t, out.String(), "Failed to log in: connection refused")
+	assert.Len(t, cc.Bindings, 1, "the app should be bound again and the key deleted")
+}
+
+func TestRotationProbeNotBound(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	p := Probes(".")["rds"]
+	cc.AddInstance(p.Instance, nil)
+	cc.AddApp(p.App, nil)
+
+	var out bytes.Buffer
+	err := newRotationProbe(cc, &out).Run(p)
+	assert.EqualError(t, err, "cf-test-rds is not bound to test-psql")
+	assert.Empty(t, cc.Bindings)
+}
+
+func TestRotationProbeOldBindingFails(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.BindingPasswords = true
+	p := Probes(".")["rds"]
+	instance := cc.AddInstance(p.Instance, nil)
+	app, old := addProbeApp(cc, p, instance)
+	app.Started = nil
+	defer newProbeApp(cc, app, p).Close()
+
+	var out bytes.Buffer
+	err := newRotationProbe(cc, &out).Run(p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "old credentials:")
+	assert.Contains(t, cc.Bindings, old.GUID, "nothing should be rotated when the app is already failing")
+	assert.Len(t, cc.Bindings, 1, "no key should be made")
+}
+
+func TestRotationProbeNewKeyFails(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	p := Probes(".")["rds"]
+	instance := cc.AddInstance(p.Instance, nil)
+	// the app still runs with credentials the instance no longer gives out
+	cc.Credentials[instance.GUID] = map[string]interface{}{"password": "wrong"}
+	app, old := addProbeApp(cc, p, instance)
+	defer newProbeApp(cc, app, p).Close()
+
+	var out bytes.Buffer
+	err := newRotationProbe(cc, &out).Run(p)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "new credentials: rds probe failed")
+	assert.Contains(t, cc.Bindings, old.GUID, "the old binding should stay when the new credentials fail")
+	assert.Len(t, cc.Bindings, 1, "the key should be deleted")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Availability summarises the pings made to a probe app while a broker
+// operation ran. An outage runs from the first failed ping to the next
+// successful one, or to the end of the operation.
+type Availability struct {
+	Pings       int
+	Failed      int
+	Unavailable time.Duration
+	Longest     time.Duration
+}
+
+func (a Availability) String() string {
+	if a.Failed == 0 {
+		return fmt.Sprintf("available throughout (%d pings)", a.Pings)
+	}
+	return fmt.Sprintf("%d of %d pings failed, unavailable for %v (longest outage %v)",
+		a.Failed, a.Pings, a.Unavailable-a.Unavailable%time.Millisecond, a.Longest-a.Longest%time.Millisecond)
+}
+
+// MonitorAvailability pings url every interval until stop is closed and then
+// sends what it saw
+func MonitorAvailability(client *http.Client, url string, interval time.Duration, stop <-chan struct{}) <-chan Availability {
+	done := make(chan Availability, 1)
+	go func() {
+		var a Availability
+		var down time.Time
+		recordOutage := func(end time.Time) {
+			outage := end.Sub(down)
+			a.Unavailable += outage
+			if outage > a.Longest {
+				a.Longest = outage
+			}
+			down = time.Time{}
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			a.Pings++
+			if err := CheckEndpoint(client, url, ""); err != nil {
+				a.Failed++
+				if down.IsZero() {
+					down = now
+				}
+			} else if !down.IsZero() {
+				recordOutage(now)
+			}
+
+			select {
+			case <-stop:
+				if !down.IsZero() {
+					recordOutage(time.Now())
+				}
+				done <- a
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+// UpgradeResult reports a plan update of a probe's service instance
+type UpgradeResult struct {
+	Probe        string
+	From         string
+	To           string
+	Items        int
+	Availability Availability
+}
+
+func (r UpgradeResult) String() string {
+	return fmt.Sprintf("%s %s -> %s: %d items checked, %v", r.Probe, r.From, r.To, r.Items, r.Availability)
+}
+
+// PlanUpgrade checks data written before a plan update is still there after
+// it, and how long the service was unreachable while the broker worked.
+// The probe apps keep the dataset: rows for rds, keys for elasticache and
+// persistent messages on a durable queue for rmq.
+type PlanUpgrade struct {
+	*Lifecycle
+	To           string
+	Items        int
+	PingInterval time.Duration
+}
+
+// Run deploys the probe on its own plan, writes a dataset, updates the
+// instance to the To plan while pinging the app, then verifies the dataset
+func (u *PlanUpgrade) Run(p Probe) (result UpgradeResult, err error) {
+	result = UpgradeResult{Probe: p.Name, From: p.Plan, To: u.To, Items: u.Items}
+	if p.Offering == "" {
+		return result, fmt.Errorf("%s has no backing service", p.Name)
+	}
+
+	err = u.With(p, func(instance *ServiceInstance, app *App) (err error) {
+		if err = u.Test(p, app); err != nil {
+			return
+		}
+		endpoint, err := u.Endpoint(p, app)
+		if err != nil {
+			return
+		}
+		base := strings.TrimSuffix(endpoint, "/")
+		id := fmt.Sprintf("%s-%d", p.Name, time.Now().Unix())
+		dataset := fmt.Sprintf("%s/dataset/%s?count=%d", base, id, u.Items)
+
+		u.step("writing dataset %s of %d items", id, u.Items)
+		if err = callEndpoint(u.HTTP, "PUT", dataset, ""); err != nil {
+			return
+		}
+		defer func() {
+			u.step("deleting dataset %s", id)
+			err = joinErrors(err, callEndpoint(u.HTTP, "DELETE", dataset, ""))
+		}()
+
+		planGUID, err := u.CC.FindServicePlan(p.Offering, u.To)
+		if err != nil {
+			return
+		}
+		u.step("updating %s from %s to %s", instance.Name, p.Plan, u.To)
+		if err = u.CC.UpdateServicePlan(instance.GUID, planGUID); err != nil {
+			return
+		}
+
+		stop := make(chan struct{})
+		pings := MonitorAvailability(u.HTTP, base+"/ping", u.PingInterval, stop)
+		err = u.watch(instance, "update", p.Offering, u.To)
+		close(stop)
+		result.Availability = <-pings
+		if err != nil {
+			return
+		}
+
+		u.step("verifying dataset %s", id)
+		if err = CheckEndpoint(u.HTTP, dataset, ""); err != nil {
+			return fmt.Errorf("data lost in update to %s: %v", u.To, err)
+		}
+		return
+	})
+	return
+}
+
+func upgradeCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	to := fs.String("to", "", "plan to update the service instance to")
+	items := fs.Int("items", 100, "number of items in the dataset, at most 10000")
+	ping := fs.Duration("ping", time.Second, "how often to ping the service during the update")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *to == "" || *items < 1 || *items > 10000 || fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: cfprobe upgrade -to <plan> [flags] <probe>...")
+		return 2
+	}
+
+	probes, err := selectProbes(Probes(opts.Root), fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	upgrade := &PlanUpgrade{
+		Lifecycle:    opts.Lifecycle(cc, spaceGUID, stdout),
+		To:           *to,
+		Items:        *items,
+		PingInterval: *ping,
+	}
+
+	code := 0
+	for _, p := range probes {
+		upgrade.Results = nil
+		result, err := upgrade.Run(p)
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL %v: %v\n", result, err)
+			code = 1
+		} else {
+			fmt.Fprintf(stdout, "PASS %v\n", result)
+		}
+		for _, op := range upgrade.Results {
+			fmt.Fprintf(stdout, "  %v\n", op)
+		}
+	}
+	return code
+}
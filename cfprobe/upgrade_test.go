@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// datasetApp stands in for a probe app's dataset and ping endpoints. Pings
+// fail while cc has an update in progress, and LoseData makes every dataset
+// read fail.
+type datasetApp struct {
+	*httptest.Server
+	cc       *FakeCC
+	LoseData bool
+
+	mu       sync.Mutex
+	datasets map[string]string
+	methods  []string
+}
+
+func newDatasetApp(cc *FakeCC) *datasetApp {
+	a := &datasetApp{cc: cc, datasets: map[string]string{}}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	return a
+}
+
+func (a *datasetApp) updating() bool {
+	a.cc.mu.Lock()
+	defer a.cc.mu.Unlock()
+	for _, i := range a.cc.Instances {
+		if i.LastOperation.Type == "update" && i.LastOperation.State == "in progress" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *datasetApp) serve(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/":
+		fmt.Fprint(w, "RDS service is OK")
+	case r.URL.Path == "/ping":
+		if a.updating() {
+			w.WriteHeader(http.StatusFailedDependency)
+			return
+		}
+		fmt.Fprint(w, "RDS service is reachable")
+	case strings.HasPrefix(r.URL.Path, "/dataset/"):
+		id := strings.TrimPrefix(r.URL.Path, "/dataset/")
+		a.methods = append(a.methods, r.Method)
+		switch r.Method {
+		case "PUT":
+			a.datasets[id] = r.URL.Query().Get("count")
+		case "GET":
+			if _, ok := a.datasets[id]; !ok || a.LoseData {
+				w.WriteHeader(http.StatusFailedDependency)
+				fmt.Fprintf(w, "Dataset %s: 2 of 5 items missing [1 4]", id)
+				return
+			}
+		case "DELETE":
+			delete(a.datasets, id)
+		}
+		fmt.Fprintf(w, "Dataset %s is OK", id)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func setupUpgrade(t *testing.T) (*FakeCC, *datasetApp, string, func()) {
+	root := setupProbeRoot(t)
+	cc := NewFakeCC()
+	cc.Plans["rds/large-psql"] = "plan-large"
+	app := newDatasetApp(cc)
+	cc.AppURL = app.URL
+	return cc, app, root, func() {
+		app.Close()
+		cc.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	cc, app, root, teardown := setupUpgrade(t)
+	defer teardown()
+	cc.ProvisionPolls = 3
+
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"upgrade", "-to", "large-psql", "-items", "5", "-ping", "1ms", "-max-poll", "5ms"}, runArgs(cc, root, "rds")...)
+	code := Main(args, &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+
+	assert.Contains(t, stdout.String(), "PASS rds shared-psql -> large-psql: 5 items checked, ")
+	assert.Contains(t, stdout.String(), "pings failed, unavailable for")
+	assert.Contains(t, stdout.String(), "update test-psql (rds large-psql): succeeded after")
+	assert.Equal(t, []string{"PUT", "GET", "DELETE"}, app.methods)
+	assert.Empty(t, app.datasets)
+	assert.Empty(t, cc.Instances)
+
+	requests := cc.Requests()
+	assert.True(t, indexOf(requests, "PATCH /v3/service_instances/") > indexOf(requests, "POST /v3/apps/"), "%v", requests)
+}
+
+func TestUpgradeDataLost(t *testing.T) {
+	cc, app, root, teardown := setupUpgrade(t)
+	defer teardown()
+	app.LoseData = true
+
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"upgrade", "-to", "large-psql", "-items", "5", "-ping", "1ms"}, runArgs(cc, root, "rds")...)
+	code := Main(args, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "FAIL rds shared-psql -> large-psql")
+	assert.Contains(t, stdout.String(), "data lost in update to large-psql")
+	assert.Contains(t, stdout.String(), "2 of 5 items missing [1 4]")
+	assert.Empty(t, app.datasets)
+	assert.Empty(t, cc.Instances)
+}
+
+func TestUpgradeFails(t *testing.T) {
+	cc, app, root, teardown := setupUpgrade(t)
+	defer teardown()
+	cc.FailPlans = map[string]string{"plan-large": "cannot shrink storage"}
+
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"upgrade", "-to", "large-psql", "-ping", "1ms"}, runArgs(cc, root, "rds")...)
+	code := Main(args, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout.String(), "update test-psql failed: cannot shrink storage")
+	assert.Equal(t, []string{"PUT", "DELETE"}, app.methods)
+	assert.Empty(t, cc.Instances)
+}
+
+func TestUpgradeUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Main([]string{"upgrade", "rds"}, &stdout, &stderr))
+	assert.Equal(t, 2, Main([]string{"upgrade", "-to", "large"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "usage: cfprobe upgrade -to <plan>")
+}
+
+func TestMonitorAvailability(t *testing.T) {
+	var mu sync.Mutex
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	setUp := func(value bool) {
+		mu.Lock()
+		up = value
+		mu.Unlock()
+	}
+
+	stop := make(chan struct{})
+	pings := MonitorAvailability(http.DefaultClient, server.URL, time.Millisecond, stop)
+	time.Sleep(10 * time.Millisecond)
+	setUp(false)
+	time.Sleep(30 * time.Millisecond)
+	setUp(true)
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	a := <-pings
+
+	assert.True(t, a.Failed > 0 && a.Failed < a.Pings, "%+v", a)
+	assert.True(t, a.Longest >= 20*time.Millisecond, "%+v", a)
+	assert.True(t, a.Unavailable >= a.Longest, "%+v", a)
+	assert.Contains(t, a.String(), "pings failed, unavailable for")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Watcher polls a service instance's last operation until the broker
+// finishes. Polling starts at Interval and backs off by Backoff after each
+// poll, up to MaxInterval.
+type Watcher struct {
+	CC          *CCClient
+	Timeout     time.Duration
+	Interval    time.Duration
+	MaxInterval time.Duration
+	Backoff     float64
+}
+
+// OperationResult records how a broker operation ended and how long it took
+type OperationResult struct {
+	Instance    string
+	Offering    string
+	Plan        string
+	Type        string
+	State       string
+	Description string
+	Duration    time.Duration
+}
+
+func (r OperationResult) String() string {
+	s := fmt.Sprintf("%s %s", r.Type, r.Instance)
+	if r.Offering != "" {
+		s += fmt.Sprintf(" (%s %s)", r.Offering, r.Plan)
+	}
+	s += fmt.Sprintf(": %s after %v", r.State, r.Duration)
+	if r.Description != "" {
+		s += ": " + r.Description
+	}
+	return s
+}
+
+// Wait polls the instance until the given operation (create, update or
+// delete) succeeds, fails or times out. A deleted instance counts as a
+// successful delete. The result is filled in whatever the outcome.
+func (w *Watcher) Wait(instanceGUID, operation string) (result OperationResult, err error) {
+	start := time.Now()
+	result = OperationResult{Type: operation, State: "in progress"}
+	interval := w.Interval
+	defer func() { result.Duration = time.Since(start) }()
+
+	for {
+		instance, err := w.CC.GetServiceInstance(instanceGUID)
+		switch {
+		case err != nil && IsNotFound(err) && operation == "delete":
+			result.State = "succeeded"
+			return result, nil
+		case err != nil:
+			return result, err
+		}
+
+		result.Instance = instance.Name
+		last := instance.LastOperation
+		if last.Type == operation && last.State != "in progress" {
+			result.State = last.State
+			result.Description = last.Description
+			if last.State == "failed" {
+				return result, fmt.Errorf("%s %s failed: %s", operation, instance.Name, last.Description)
+			}
+			return result, nil
+		}
+
+		if time.Since(start) > w.Timeout {
+			result.State = "timed out"
+			return result, fmt.Errorf("%s %s still in progress after %v", operation, instance.Name, w.Timeout)
+		}
+		time.Sleep(interval)
+		interval = w.next(interval)
+	}
+}
+
+func (w *Watcher) next(interval time.Duration) time.Duration {
+	if w.Backoff > 1 {
+		interval = time.Duration(float64(interval) * w.Backoff)
+	}
+	if w.MaxInterval > 0 && interval > w.MaxInterval {
+		interval = w.MaxInterval
+	}
+	return interval
+}
+
+func watchCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts Options
+	opts.Register(fs)
+	operation := fs.String("operation", "create", "operation to wait for: create, update or delete")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch *operation {
+	case "create", "update", "delete":
+	default:
+		fmt.Fprintf(stderr, "unknown operation %q\n", *operation)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: cfprobe watch [flags] <service-instance>...")
+		return 2
+	}
+
+	cc, spaceGUID, err := opts.Connect()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	watcher := opts.Watcher(cc)
+	code := 0
+	for _, name := range fs.Args() {
+		instance, err := cc.FindServiceInstance(spaceGUID, name)
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", name, err)
+			code = 1
+			continue
+		}
+		result, err := watcher.Wait(instance.GUID, *operation)
+		result.Instance = name
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL %v\n", result)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "PASS %v\n", result)
+	}
+	return code
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatcher(cc *FakeCC) *Watcher {
+	client := NewCCClient(cc.URL, false)
+	client.Token = "fake-token"
+	return &Watcher{CC: client, Timeout: time.Second, Interval: time.Millisecond}
+}
+
+func TestWatcherCreate(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.ProvisionPolls = 3
+	instance := cc.AddInstance("test-psql", nil)
+	instance.LastOperation.State = "in progress"
+
+	result, err := newTestWatcher(cc).Wait(instance.GUID, "create")
+	require.NoError(t, err)
+	assert.Equal(t, "succeeded", result.State)
+	assert.Equal(t, "test-psql", result.Instance)
+	assert.True(t, result.Duration > 0)
+	assert.Len(t, cc.Requests(), 4)
+}
+
+func TestWatcherFailedUpdate(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.FailProvision = "plan not available"
+	instance := cc.AddInstance("test-psql", nil)
+	instance.LastOperation = LastOperation{Type: "update", State: "in progress"}
+
+	result, err := newTestWatcher(cc).Wait(instance.GUID, "update")
+	require.Error(t, err)
+	assert.Equal(t, "failed", result.State)
+	assert.Equal(t, "plan not available", result.Description)
+}
+
+func TestWatcherDelete(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+
+	result, err := newTestWatcher(cc).Wait("instance-gone", "delete")
+	require.NoError(t, err)
+	assert.Equal(t, "succeeded", result.State)
+}
+
+func TestWatcherTimeout(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.ProvisionPolls = 1000
+	instance := cc.AddInstance("test-psql", nil)
+	instance.LastOperation.State = "in progress"
+
+	watcher := newTestWatcher(cc)
+	watcher.Timeout = 20 * time.Millisecond
+	result, err := watcher.Wait(instance.GUID, "create")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "still in progress")
+	assert.Equal(t, "timed out", result.State)
+}
+
+func TestWatcherBackoff(t *testing.T) {
+	w := &Watcher{Backoff: 2, MaxInterval: 5 * time.Second}
+	assert.Equal(t, 2*time.Second, w.next(time.Second))
+	assert.Equal(t, 5*time.Second, w.next(4*time.Second))
+
+	w = &Watcher{}
+	assert.Equal(t, time.Second, w.next(time.Second))
+}
+
+func TestWatchCommand(t *testing.T) {
+	cc := NewFakeCC()
+	defer cc.Close()
+	cc.ProvisionPolls = 2
+	instance := cc.AddInstance("test-elasticache", nil)
+	instance.LastOperation.State = "in progress"
+
+	var stdout, stderr bytes.Buffer
+	code := Main([]string{"watch", "-api", cc.URL, "-org", "o", "-space", "s", "-poll", "1ms", "test-elasticache"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stdout.String()+stderr.String())
+	assert.Contains(t, stdout.String(), "PASS create test-elasticache: succeeded after")
+
+	code = Main([]string{"watch", "-api", cc.URL, "-org", "o", "-space", "s", "missing"}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, 2, Main([]string{"watch", "-operation", "bind", "x"}, &stdout, &stderr))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/go-redis/redis"
+)
+
+func datasetKey(id, key string) string {
+	return "dataset:" + id + ":" + key
+}
+
+// WriteDataset stores each item as its own key so a partial loss shows up
+func (t *Tester) WriteDataset(serviceName, id string, items map[string]string) error {
+	if err := t.connect(serviceName); err != nil {
+		return err
+	}
+	for key, value := range items {
+		if err := t.dao.SetValue(datasetKey(id, key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDataset reads back the keys of a dataset written by WriteDataset.
+// Keys that no longer exist are left out. Redis holds each key once, so no
+// item comes back twice.
+func (t *Tester) ReadDataset(serviceName, id string, keys []string) ([]dataset.Item, error) {
+	if err := t.connect(serviceName); err != nil {
+		return nil, err
+	}
+	var items []dataset.Item
+	for _, key := range keys {
+		value, err := t.dao.GetValue(datasetKey(id, key))
+		switch {
+		case err == redis.Nil:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		items = append(items, dataset.Item{Key: key, Value: value})
+	}
+	return items, nil
+}
+
+// DeleteDataset removes the keys of a dataset
+func (t *Tester) DeleteDataset(serviceName, id string, keys []string) error {
+	if err := t.connect(serviceName); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := t.dao.UnsetValue(datasetKey(id, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tester) connect(serviceName string) error {
+	var uri, password string
+	if err := t.run.Step("credentials", func() (err error) {
+		uri, password, err = t.creds.GetCreds(serviceName)
+		if host, port, splitErr := net.SplitHostPort(uri); err == nil && splitErr == nil {
+			t.run.Attribute("server.address", host)
+			t.run.Attribute("server.port", port)
+		}
+		return
+	}); err != nil {
+		return err
+	}
+	return t.run.Step("connect", func() error {
+		return t.dao.Connect(uri, password)
+	})
+}
+
+// DatasetHandler writes (PUT), verifies (GET) or removes (DELETE) the dataset
+// named by the last path element. The size comes from the count parameter.
+func DatasetHandler(newDAO DAOFactory, creds Credentialiser) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		count, err := strconv.Atoi(req.URL.Query().Get("count"))
+		if !dataset.ValidID(id) || err != nil || count < 1 || count > dataset.MaxCount {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Expected /dataset/<id>?count=<n> with n from 1 to %d", dataset.MaxCount)
+			return
+		}
+
+		serviceName := os.Getenv("ELASTICACHE_SERVICE_NAME")
+		dao := newDAO()
+		defer dao.Close()
+		tester := NewTester(dao, creds)
+		keys := make([]string, count)
+		for i := range keys {
+			keys[i] = strconv.Itoa(i)
+		}
+
+		switch req.Method {
+		case "PUT":
+			err = tester.WriteDataset(serviceName, id, dataset.Generate(id, count))
+		case "GET":
+			var got []dataset.Item
+			if got, err = tester.ReadDataset(serviceName, id, keys); err == nil {
+				err = dataset.Compare(dataset.Generate(id, count), got)
+			}
+		case "DELETE":
+			err = tester.DeleteDataset(serviceName, id, keys)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Dataset %s: %v", id, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Dataset %s is OK", id)
+	}
+}
+
+// PingHandler checks ElastiCache accepts connections without touching any data
+func PingHandler(newDAO DAOFactory, creds Credentialiser) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		serviceName := os.Getenv("ELASTICACHE_SERVICE_NAME")
+		dao := newDAO()
+		defer dao.Close()
+		if err := NewTester(dao, creds).connect(serviceName); err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to reach ElastiCache: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "Elasticache service is reachable")
+	}
+}
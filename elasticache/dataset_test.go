@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func datasetRequest(dao DAO, creds Credentialiser, method, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	DatasetHandler(reuse(dao), creds)(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func TestDatasetHandler(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+
+	w := datasetRequest(dao, creds, "PUT", "http://x/dataset/upgrade-1?count=3")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, "upgrade-1-2", dao.store["dataset:upgrade-1:2"])
+	assert.Len(t, dao.store, 3)
+	assert.Equal(t, "redis_host:6379", dao.URL)
+
+	w = datasetRequest(dao, creds, "GET", "http://x/dataset/upgrade-1?count=3")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "Dataset upgrade-1 is OK", w.Body.String())
+
+	dao.store["dataset:upgrade-1:1"] = "changed"
+	w = datasetRequest(dao, creds, "GET", "http://x/dataset/upgrade-1?count=3")
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Dataset upgrade-1: 1 of 3 items changed [1]", w.Body.String())
+
+	w = datasetRequest(dao, creds, "DELETE", "http://x/dataset/upgrade-1?count=3")
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, dao.store)
+}
+
+func TestDatasetHandlerBadRequest(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+
+	for _, url := range []string{
+		"http://x/dataset/upgrade-1",
+		"http://x/dataset/upgrade-1?count=-1",
+		"http://x/dataset/upgrade-1?count=10001",
+		"http://x/dataset/bad:id?count=5",
+	} {
+		w := datasetRequest(dao, creds, "PUT", url)
+		assert.Equal(t, 400, w.Code, url)
+	}
+	assert.Empty(t, dao.store)
+}
+
+func TestPingHandler(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+
+	w := httptest.NewRecorder()
+	PingHandler(reuse(dao), creds)(w, httptest.NewRequest("GET", "http://x/ping", nil))
+	assert.Equal(t, 200, w.Code)
+
+	dao.ConnectError = errors.New("connection refused")
+	w = httptest.NewRecorder()
+	PingHandler(reuse(dao), creds)(w, httptest.NewRequest("GET", "http://x/ping", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Failed to reach ElastiCache: connection refused", w.Body.String())
+}
@@ -1,5 +1,8 @@
 #!/usr/bin/env bash
 set -eu
+: ${ELASTICACHE_APP_NAME:=cf-test-elasticache}
 : ${ELASTICACHE_SERVICE_NAME:=test-elasticache}
-# FIXME: need to unbind the application first
+if cf app "$ELASTICACHE_APP_NAME" >/dev/null 2>&1; then
+    cf unbind-service "$ELASTICACHE_APP_NAME" "$ELASTICACHE_SERVICE_NAME"
+fi
 cf delete-service "$ELASTICACHE_SERVICE_NAME" -f
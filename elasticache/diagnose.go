@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+)
+
+// diagnose reads the credentials again and diagnoses opErr against the Redis
+// node they name
+func (t *Tester) diagnose(serviceName string, opErr error) *diagnose.Diagnosis {
+	target, err := t.target(serviceName)
+	if err != nil {
+		return diagnose.CredentialsFailure(err)
+	}
+	return target.Diagnose(t.run, opErr)
+}
+
+// target reads the credentials and says how to reach the Redis node they
+// name. The probe's Redis client always connects in plaintext, so there is
+// no TLS layer to check.
+func (t *Tester) target(serviceName string) (diagnose.Target, error) {
+	uri, password, err := t.creds.GetCreds(serviceName)
+	if err != nil {
+		return diagnose.Target{}, err
+	}
+	host, port, err := net.SplitHostPort(uri)
+	if err != nil {
+		return diagnose.Target{}, err
+	}
+	return diagnose.Target{Host: host, Port: port, Auth: func() error {
+		return t.dao.Connect(uri, password)
+	}, AuthFailed: refusesLogin}, nil
+}
+
+// refusesLogin is true for the replies Redis gives a client whose password
+// it does not accept: NOAUTH without one, WRONGPASS since Redis 6 and
+// "invalid password" before
+func refusesLogin(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "NOAUTH ") || strings.HasPrefix(msg, "WRONGPASS ") || strings.HasPrefix(msg, "ERR invalid password")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func layerNames(d *diagnose.Diagnosis) []string {
+	names := make([]string, len(d.Layers))
+	for i, l := range d.Layers {
+		names[i] = l.Layer
+	}
+	return names
+}
+
+func TestWebHandlerDiagnosis(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	defer diagnose.FakeNetwork(nil, nil)()
+	dao.ConnectError = errors.New("WRONGPASS invalid username-password pair")
+
+	w := httptest.NewRecorder()
+	WebHandler(reuse(dao), creds)(w, httptest.NewRequest("GET", "http://x/", nil))
+	assert.Equal(t, http.StatusFailedDependency, w.Code)
+	assert.Equal(t, "auth", w.Header().Get(logging.ErrorCategoryHeader))
+	assert.Contains(t, w.Body.String(), "PASS dns: redis_host resolves to 10.0.0.1")
+	assert.Contains(t, w.Body.String(), "FAIL auth [auth]: WRONGPASS invalid username-password pair")
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteDAO is what a write-availability run needs from Redis
+type WriteDAO interface {
+	Connect(url, password string) error
+	Append(key, value string) error
+	List(key string) ([]string, error)
+	Role() (string, error)
+	UnsetValue(label string) error
+	Close()
+}
+
+// RoleChange records the endpoint reporting a different replication role,
+// as the old primary does when it is demoted
+type RoleChange struct {
+	At   time.Duration
+	From string
+	To   string
+}
+
+// Outage is a run of failed writes, from the first failure to the next
+// successful write, as offsets from the start of the run
+type Outage struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// WriteReport is the outcome of a write-availability run. Lost writes were
+// acknowledged but are missing afterwards; Unconfirmed ones failed but were
+// stored anyway.
+type WriteReport struct {
+	Writes      int
+	Failed      int
+	Outages     []Outage
+	RoleChanges []RoleChange
+	Lost        []int
+	Unconfirmed []int
+	OutOfOrder  int
+	FailoverErr error
+}
+
+// Unavailable totals the outages
+func (r WriteReport) Unavailable() time.Duration {
+	var total time.Duration
+	for _, o := range r.Outages {
+		total += o.End - o.Start
+	}
+	return total
+}
+
+// OK is true when every acknowledged write survived in order
+func (r WriteReport) OK() bool {
+	return len(r.Lost) == 0 && r.OutOfOrder == 0
+}
+
+func (r WriteReport) String() string {
+	ms := func(d time.Duration) time.Duration { return d - d%time.Millisecond }
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "writes: %d sent, %d failed\n", r.Writes, r.Failed)
+	fmt.Fprintf(&b, "unavailable: %v\n", ms(r.Unavailable()))
+	for _, o := range r.Outages {
+		fmt.Fprintf(&b, "outage: %v from %v to %v\n", ms(o.End-o.Start), ms(o.Start), ms(o.End))
+	}
+	for _, c := range r.RoleChanges {
+		fmt.Fprintf(&b, "role change at %v: %s -> %s\n", ms(c.At), c.From, c.To)
+	}
+	fmt.Fprintf(&b, "lost writes: %d %v\n", len(r.Lost), r.Lost)
+	fmt.Fprintf(&b, "unconfirmed writes stored: %d %v\n", len(r.Unconfirmed), r.Unconfirmed)
+	fmt.Fprintf(&b, "out of order: %d\n", r.OutOfOrder)
+	if r.FailoverErr != nil {
+		fmt.Fprintf(&b, "failover hook: %v\n", r.FailoverErr)
+	}
+	return b.String()
+}
+
+// WriteMonitor appends sequence numbers to a Redis list every Interval for
+// Duration, checking the replication role as it goes, and then reads the
+// list back to find lost and out of order writes. Failover, when set, is
+// called FailoverAfter into the run to trigger a failover; otherwise one is
+// expected to be started from outside.
+type WriteMonitor struct {
+	DAO           WriteDAO
+	Creds         Credentialiser
+	ServiceName   string
+	Interval      time.Duration
+	Duration      time.Duration
+	Failover      func() error
+	FailoverAfter time.Duration
+	Out           io.Writer
+}
+
+// Run performs the writes and returns the report. The error is only set
+// when the run could not start or the writes could not be read back.
+func (m *WriteMonitor) Run() (report WriteReport, err error) {
+	uri, password, err := m.Creds.GetCreds(m.ServiceName)
+	if err != nil {
+		return
+	}
+	if err = m.DAO.Connect(uri, password); err != nil {
+		return
+	}
+	key := fmt.Sprintf("failover:%d", time.Now().UnixNano())
+	defer m.DAO.UnsetValue(key)
+
+	start := time.Now()
+	acked := map[int]bool{}
+	var down time.Duration
+	failing := false
+	role := ""
+	var failover chan error
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		at := time.Since(start)
+		if at >= m.Duration {
+			break
+		}
+
+		if m.Failover != nil && failover == nil && at >= m.FailoverAfter {
+			m.log("%v: triggering failover", at)
+			failover = make(chan error, 1)
+			go func() { failover <- m.Failover() }()
+		}
+
+		report.Writes++
+		if err := m.DAO.Append(key, strconv.Itoa(seq)); err != nil {
+			report.Failed++
+			if !failing {
+				m.log("%v: write %d failed: %v", at, seq, err)
+				failing, down = true, at
+			}
+		} else {
+			acked[seq] = true
+			if failing {
+				m.log("%v: writes recovered", at)
+				report.Outages = append(report.Outages, Outage{Start: down, End: at})
+				failing = false
+			}
+		}
+
+		if current, err := m.DAO.Role(); err == nil && current != role {
+			if role != "" {
+				m.log("%v: role changed from %s to %s", at, role, current)
+				report.RoleChanges = append(report.RoleChanges, RoleChange{At: at, From: role, To: current})
+			}
+			role = current
+		}
+
+		<-ticker.C
+	}
+	if failing {
+		report.Outages = append(report.Outages, Outage{Start: down, End: time.Since(start)})
+	}
+	if failover != nil {
+		report.FailoverErr = <-failover
+	}
+
+	stored, err := m.DAO.List(key)
+	if err != nil {
+		return report, fmt.Errorf("Failed to read back writes: %v", err)
+	}
+	checkWrites(&report, acked, stored)
+	return report, nil
+}
+
+// checkWrites compares the stored sequence numbers with the acknowledged ones
+func checkWrites(report *WriteReport, acked map[int]bool, stored []string) {
+	seen := map[int]bool{}
+	last := 0
+	for _, value := range stored {
+		seq, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		if seq < last {
+			report.OutOfOrder++
+		}
+		last = seq
+		seen[seq] = true
+		if !acked[seq] {
+			report.Unconfirmed = append(report.Unconfirmed, seq)
+		}
+	}
+	for seq := 1; seq <= report.Writes; seq++ {
+		if acked[seq] && !seen[seq] {
+			report.Lost = append(report.Lost, seq)
+		}
+	}
+}
+
+func (m *WriteMonitor) log(format string, args ...interface{}) {
+	if m.Out != nil {
+		fmt.Fprintf(m.Out, format+"\n", args...)
+	}
+}
+
+// CommandHook returns a Failover hook that runs command with sh, such as an
+// aws elasticache test-failover invocation
+func CommandHook(command string, out io.Writer) func() error {
+	return func() error {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		return cmd.Run()
+	}
+}
+
+// parseRole picks the role out of INFO replication output
+func parseRole(info string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "role:") {
+			return strings.TrimPrefix(line, "role:"), nil
+		}
+	}
+	return "", fmt.Errorf("no role in INFO replication output")
+}
+
+// Append pushes value onto the end of the list at key
+func (r *RedisDAO) Append(key, value string) error {
+	return r.client.RPush(key, value).Err()
+}
+
+// List returns every value in the list at key
+func (r *RedisDAO) List(key string) ([]string, error) {
+	return r.client.LRange(key, 0, -1).Result()
+}
+
+// Role returns the replication role (master or slave) of the connected node
+func (r *RedisDAO) Role() (string, error) {
+	info, err := r.client.Info("replication").Result()
+	if err != nil {
+		return "", err
+	}
+	return parseRole(info)
+}
+
+// WriteOptions holds the flags for a write-availability run
+type WriteOptions struct {
+	Duration        time.Duration
+	Interval        time.Duration
+	FailoverAfter   time.Duration
+	FailoverCommand string
+}
+
+// Register adds the write-availability flags to fs
+func (o *WriteOptions) Register(fs *flag.FlagSet) {
+	fs.DurationVar(&o.Duration, "writes", 0, "write sequence numbers for this long, report outages and lost writes and exit")
+	fs.DurationVar(&o.Interval, "write-interval", 100*time.Millisecond, "time between writes")
+	fs.DurationVar(&o.FailoverAfter, "failover-after", 10*time.Second, "when to run -failover-command")
+	fs.StringVar(&o.FailoverCommand, "failover-command", "", "shell command that triggers a failover (default wait for one started elsewhere)")
+}
+
+// Monitor builds a WriteMonitor from the options, logging progress to out
+func (o WriteOptions) Monitor(dao WriteDAO, creds Credentialiser, serviceName string, out io.Writer) *WriteMonitor {
+	m := &WriteMonitor{
+		DAO:           dao,
+		Creds:         creds,
+		ServiceName:   serviceName,
+		Interval:      o.Interval,
+		Duration:      o.Duration,
+		FailoverAfter: o.FailoverAfter,
+		Out:           out,
+	}
+	if o.FailoverCommand != "" {
+		m.Failover = CommandHook(o.FailoverCommand, out)
+	}
+	return m
+}
+
+// RunWrites runs the monitor, prints the report and returns the exit code
+func RunWrites(m *WriteMonitor, out io.Writer) int {
+	defer m.DAO.Close()
+	report, err := m.Run()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to access ElastiCache: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprint(out, report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
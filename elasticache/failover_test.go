@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failoverRedis stands in for a replication group. Failover demotes the
+// primary: the next FailWrites appends fail and the role reads "slave" until
+// they recover. The last LoseWrites acknowledged writes are dropped, as if
+// they never reached the replica that took over.
+type failoverRedis struct {
+	FailWrites int
+	LoseWrites int
+
+	mu      sync.Mutex
+	URL     string
+	failing int
+	role    string
+	lists   map[string][]string
+	closed  bool
+}
+
+func newFailoverRedis() *failoverRedis {
+	return &failoverRedis{role: "master", lists: map[string][]string{}}
+}
+
+func (f *failoverRedis) Failover() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, list := range f.lists {
+		f.lists[key] = list[:len(list)-f.LoseWrites]
+	}
+	f.failing = f.FailWrites
+	f.role = "slave"
+	return nil
+}
+
+func (f *failoverRedis) Connect(url, password string) error {
+	f.URL = url
+	return nil
+}
+
+func (f *failoverRedis) Append(key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing > 0 {
+		f.failing--
+		if f.failing == 0 {
+			f.role = "master"
+		}
+		return errors.New("READONLY You can't write against a read only slave.")
+	}
+	f.lists[key] = append(f.lists[key], value)
+	return nil
+}
+
+func (f *failoverRedis) List(key string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists[key], nil
+}
+
+func (f *failoverRedis) Role() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.role, nil
+}
+
+func (f *failoverRedis) UnsetValue(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.lists, key)
+	return nil
+}
+
+func (f *failoverRedis) Close() {
+	f.closed = true
+}
+
+func newWriteMonitor(redis *failoverRedis) *WriteMonitor {
+	return &WriteMonitor{
+		DAO:           redis,
+		Creds:         LocalCredentialiser{URI: "redis_host:6379"},
+		Interval:      time.Millisecond,
+		Duration:      60 * time.Millisecond,
+		Failover:      redis.Failover,
+		FailoverAfter: 10 * time.Millisecond,
+	}
+}
+
+func TestWriteMonitorFailover(t *testing.T) {
+	redis := newFailoverRedis()
+	redis.FailWrites = 5
+	redis.LoseWrites = 2
+
+	report, err := newWriteMonitor(redis).Run()
+	require.NoError(t, err)
+	assert.Equal(t, "redis_host:6379", redis.URL)
+	assert.Equal(t, 5, report.Failed)
+	require.Len(t, report.Outages, 1)
+	assert.True(t, report.Outages[0].End > report.Outages[0].Start)
+	assert.Equal(t, report.Outages[0].End-report.Outages[0].Start, report.Unavailable())
+	require.Len(t, report.Lost, 2)
+	assert.Equal(t, report.Lost[0]+1, report.Lost[1])
+	assert.Empty(t, report.Unconfirmed)
+	assert.Zero(t, report.OutOfOrder)
+	assert.False(t, report.OK())
+
+	var roles []string
+	for _, c := range report.RoleChanges {
+		roles = append(roles, c.From+"->"+c.To)
+	}
+	assert.Equal(t, []string{"master->slave", "slave->master"}, roles)
+	assert.Empty(t, redis.lists, "the write list should be removed")
+}
+
+func TestWriteMonitorNoFailover(t *testing.T) {
+	redis := newFailoverRedis()
+	m := newWriteMonitor(redis)
+	m.Failover = nil
+	m.Duration = 10 * time.Millisecond
+
+	var out bytes.Buffer
+	code := RunWrites(m, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), ", 0 failed\n")
+	assert.Contains(t, out.String(), "lost writes: 0 []\n")
+	assert.True(t, redis.closed)
+}
+
+func TestRunWritesReportsLoss(t *testing.T) {
+	redis := newFailoverRedis()
+	redis.FailWrites = 3
+	redis.LoseWrites = 1
+
+	var out bytes.Buffer
+	code := RunWrites(newWriteMonitor(redis), &out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out.String(), "lost writes: 1 [")
+	assert.Contains(t, out.String(), "role change at ")
+}
+
+func TestCheckWrites(t *testing.T) {
+	report := WriteReport{Writes: 6}
+	acked := map[int]bool{1: true, 2: true, 4: true, 5: true, 6: true}
+	checkWrites(&report, acked, []string{"1", "3", "5", "4", "6"})
+	assert.Equal(t, []int{2}, report.Lost)
+	assert.Equal(t, []int{3}, report.Unconfirmed)
+	assert.Equal(t, 1, report.OutOfOrder)
+}
+
+func TestParseRole(t *testing.T) {
+	role, err := parseRole("# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "slave", role)
+
+	_, err = parseRole("# Replication\r\n")
+	assert.Error(t, err)
+}
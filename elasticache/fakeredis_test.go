@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/faultproxy"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RedisFault is what a FakeRedis does when a command arrives. The Delay
+// comes first, so one longer than the client's read timeout makes it time
+// out. Then Reset drops the connection with a TCP reset, or Err is sent
+// back in place of running the command.
+type RedisFault struct {
+	Delay time.Duration
+	Reset bool
+	Err   string
+}
+
+// FakeRedis is an in-process server speaking RESP on a loopback port, for
+// running RedisDAO against. It keeps strings and lists in memory and
+// answers PING, AUTH, SELECT, SET, GET, DEL, RPUSH, LRANGE, KEYS, TTL, INFO,
+// CLUSTER INFO and QUIT. With a password, commands other than AUTH fail
+// with NOAUTH until the client authenticates, and as a replica it refuses
+// writes with READONLY.
+type FakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	replica bool
+	faults  map[string]RedisFault
+	values  map[string]string
+	lists   map[string][]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *FakeRedis {
+	s := &FakeRedis{
+		password: password,
+		conns:    map[net.Conn]bool{},
+		faults:   map[string]RedisFault{},
+		values:   map[string]string{},
+		lists:    map[string][]string{},
+		expires:  map[string]time.Time{},
+	}
+	s.listener = serveRedis(t, s.serve)
+	return s
+}
+
+func (s *FakeRedis) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening and drops every connection
+func (s *FakeRedis) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// SetFault applies f to every arrival of command, such as "SET" or
+// "CLUSTER", until it is set again. The zero RedisFault clears it.
+func (s *FakeRedis) SetFault(command string, f RedisFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[command] = f
+}
+
+// SetReplica makes the server report itself as a replica and refuse writes
+func (s *FakeRedis) SetReplica(replica bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replica = replica
+}
+
+func (s *FakeRedis) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		s.mu.Lock()
+		fault := s.faults[name]
+		s.mu.Unlock()
+		time.Sleep(fault.Delay)
+		if fault.Reset {
+			conn.(*net.TCPConn).SetLinger(0)
+			return
+		}
+		reply := "-" + fault.Err + "\r\n"
+		if fault.Err == "" {
+			reply = s.command(name, args[1:], &authed)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil || name == "QUIT" {
+			return
+		}
+	}
+}
+
+// command runs one command and returns the encoded reply
+func (s *FakeRedis) command(name string, args []string, authed *bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !*authed && name != "AUTH" && name != "QUIT" {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	arity := map[string]int{"AUTH": 1, "SELECT": 1, "SET": 2, "GET": 1, "DEL": 1, "RPUSH": 2, "LRANGE": 3, "KEYS": 1, "TTL": 1, "CLUSTER": 1}
+	if len(args) < arity[name] {
+		return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(name))
+	}
+	if s.replica && (name == "SET" || name == "DEL" || name == "RPUSH") {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	}
+	for _, key := range args {
+		if at, ok := s.expires[key]; ok && !time.Now().Before(at) {
+			s.delete(key)
+		}
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			return respBulk(args[0])
+		}
+		return "+PONG\r\n"
+	case "QUIT":
+		return "+OK\r\n"
+	case "AUTH":
+		if s.password == "" {
+			return "-ERR Client sent AUTH, but no password is set\r\n"
+		}
+		if args[len(args)-1] != s.password {
+			return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case "SELECT":
+		if args[0] != "0" {
+			return "-ERR DB index is out of range\r\n"
+		}
+		return "+OK\r\n"
+	case "SET":
+		s.delete(args[0])
+		s.values[args[0]] = args[1]
+		if len(args) == 4 {
+			n, err := strconv.Atoi(args[3])
+			unit := map[string]time.Duration{"EX": time.Second, "PX": time.Millisecond}[strings.ToUpper(args[2])]
+			if err != nil || n <= 0 || unit == 0 {
+				return "-ERR syntax error\r\n"
+			}
+			s.expires[args[0]] = time.Now().Add(time.Duration(n) * unit)
+		}
+		return "+OK\r\n"
+	case "GET":
+		if _, ok := s.lists[args[0]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		if value, ok := s.values[args[0]]; ok {
+			return respBulk(value)
+		}
+		return "$-1\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if s.exists(key) {
+				s.delete(key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "RPUSH":
+		if _, ok := s.values[args[0]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		s.lists[args[0]] = append(s.lists[args[0]], args[1:]...)
+		return fmt.Sprintf(":%d\r\n", len(s.lists[args[0]]))
+	case "LRANGE":
+		list := s.lists[args[0]]
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if start < 0 {
+			start += len(list)
+		}
+		if stop < 0 {
+			stop += len(list)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= len(list) {
+			stop = len(list) - 1
+		}
+		if start > stop {
+			return respArray(nil)
+		}
+		return respArray(list[start : stop+1])
+	case "KEYS":
+		var keys []string
+		for key := range s.values {
+			if ok, _ := path.Match(args[0], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		for key := range s.lists {
+			if ok, _ := path.Match(args[0], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return respArray(keys)
+	case "TTL":
+		if !s.exists(args[0]) {
+			return ":-2\r\n"
+		}
+		at, ok := s.expires[args[0]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", (time.Until(at)+500*time.Millisecond)/time.Second)
+	case "INFO":
+		role := "master"
+		if s.replica {
+			role = "slave"
+		}
+		return respBulk("# Server\r\nredis_version:5.0.6\r\n\r\n# Replication\r\nrole:" + role + "\r\nconnected_slaves:0\r\n")
+	case "CLUSTER":
+		if strings.ToUpper(args[0]) != "INFO" {
+			return "-ERR unknown subcommand '" + args[0] + "'\r\n"
+		}
+		return respBulk("cluster_state:ok\r\ncluster_slots_assigned:16384\r\ncluster_slots_ok:16384\r\ncluster_known_nodes:1\r\ncluster_size:1\r\n")
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", strings.ToLower(name))
+}
+
+func (s *FakeRedis) exists(key string) bool {
+	_, isValue := s.values[key]
+	_, isList := s.lists[key]
+	return isValue || isList
+}
+
+func (s *FakeRedis) delete(key string) {
+	delete(s.values, key)
+	delete(s.lists, key)
+	delete(s.expires, key)
+}
+
+// readRESPCommand reads one command sent as an array of bulk strings
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil || !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected a bulk string, got %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items []string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, item := range items {
+		b.WriteString(respBulk(item))
+	}
+	return b.String()
+}
+
+func connectFakeRedis(t *testing.T, s *FakeRedis, password string) *RedisDAO {
+	dao := &RedisDAO{ReadTimeout: 100 * time.Millisecond}
+	require.NoError(t, dao.Connect(s.Addr(), password))
+	return dao
+}
+
+func TestRedisDAO(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.Close()
+	dao := &RedisDAO{}
+	defer dao.Close()
+
+	tester := NewTester(dao, LocalCredentialiser{URI: s.Addr(), Password: "secret"})
+	require.NoError(t, tester.PerformTest(""))
+	keys, err := dao.Keys("*")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, dao.Append("writes", "1"))
+	require.NoError(t, dao.Append("writes", "2"))
+	list, err := dao.List("writes")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, list)
+	role, err := dao.Role()
+	require.NoError(t, err)
+	assert.Equal(t, "master", role)
+}
+
+func TestRedisDAOWrongPassword(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.Close()
+
+	err := (&RedisDAO{}).Connect(s.Addr(), "wrong")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WRONGPASS")
+	assert.Equal(t, "auth", logging.ErrorClass(err))
+
+	err = (&RedisDAO{}).Connect(s.Addr(), "")
+	assert.EqualError(t, err, "NOAUTH Authentication required.")
+
+	tester := NewTester(&RedisDAO{}, LocalCredentialiser{URI: s.Addr(), Password: "wrong"})
+	d := tester.diagnose("", err)
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Equal(t, "auth", d.Category())
+}
+
+func TestRedisDAOTimeout(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+	dao := connectFakeRedis(t, s, "")
+	defer dao.Close()
+	s.SetFault("GET", RedisFault{Delay: 300 * time.Millisecond})
+
+	_, err := dao.GetValue("foo")
+	require.Error(t, err)
+	assert.Equal(t, "timeout", logging.ErrorClass(err))
+}
+
+func TestRedisDAOReadOnlyReplica(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+	dao := connectFakeRedis(t, s, "")
+	defer dao.Close()
+	s.SetReplica(true)
+
+	err := dao.SetValue("foo", "bar")
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "READONLY "), err.Error())
+	role, err := dao.Role()
+	require.NoError(t, err)
+	assert.Equal(t, "slave", role)
+}
+
+func TestRedisDAOConnectionReset(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+	dao := connectFakeRedis(t, s, "")
+	defer dao.Close()
+	s.SetFault("SET", RedisFault{Reset: true})
+
+	err := dao.SetValue("foo", "bar")
+	require.Error(t, err)
+	assert.Equal(t, "network", logging.ErrorClass(err))
+
+	s.SetFault("SET", RedisFault{})
+	assert.NoError(t, dao.SetValue("foo", "bar"))
+}
+
+func TestProbeHandlerConcurrent(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.Close()
+	creds := LocalCredentialiser{URI: s.Addr(), Password: "secret"}
+	open := openClients.Len()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			ProbeHandler(NewRedisDAO, creds, fmt.Sprintf("key-%d", i), "bar")(w, httptest.NewRequest("GET", "http://x/", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		assert.Equal(t, http.StatusOK, code, "request %d", i)
+	}
+	assert.Equal(t, open, openClients.Len(), "every request should close its client")
+}
+
+func TestRedisDAOThroughFaultProxy(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.Close()
+	p, err := faultproxy.New("127.0.0.1:0", s.Addr())
+	require.NoError(t, err)
+	defer p.Close()
+	creds := LocalCredentialiser{URI: p.Addr(), Password: "secret"}
+
+	for _, tc := range []struct {
+		fault    faultproxy.Fault
+		category string
+	}{
+		{faultproxy.Fault{Latency: 20 * time.Millisecond}, ""},
+		{faultproxy.Fault{Blackhole: true}, "timeout"},
+		{faultproxy.Fault{HalfOpen: true}, "timeout"},
+		{faultproxy.Fault{Reset: true}, "network"},
+	} {
+		p.Set(tc.fault)
+		dao := &RedisDAO{ReadTimeout: 100 * time.Millisecond}
+		start := time.Now()
+		w := httptest.NewRecorder()
+		WebHandler(reuse(dao), creds)(w, httptest.NewRequest("GET", "http://x/", nil))
+		assert.True(t, time.Since(start) < 2*time.Second, "%+v took %v", tc.fault, time.Since(start))
+		if tc.category == "" {
+			assert.Equal(t, http.StatusOK, w.Code, "%+v: %s", tc.fault, w.Body)
+			continue
+		}
+		assert.Equal(t, http.StatusFailedDependency, w.Code)
+		assert.Equal(t, tc.category, w.Header().Get(logging.ErrorCategoryHeader), "%+v: %s", tc.fault, w.Body)
+	}
+}
+
+func TestFakeRedisTTLAndCluster(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	require.NoError(t, client.Set("short", "x", 50*time.Second).Err())
+	require.NoError(t, client.Set("forever", "x", 0).Err())
+	assert.Equal(t, 50*time.Second, client.TTL("short").Val())
+	assert.Equal(t, -time.Second, client.TTL("forever").Val())
+	assert.Equal(t, -2*time.Second, client.TTL("missing").Val())
+
+	require.NoError(t, client.Set("brief", "x", time.Millisecond).Err())
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, redis.Nil, client.Get("brief").Err())
+
+	info, err := client.ClusterInfo().Result()
+	require.NoError(t, err)
+	assert.Contains(t, info, "cluster_state:ok")
+	s.SetFault("CLUSTER", RedisFault{Err: "ERR This instance has cluster support disabled"})
+	assert.EqualError(t, client.ClusterInfo().Err(), "ERR This instance has cluster support disabled")
+}
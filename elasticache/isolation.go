@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// IsolationDAO can also list the keys the connection is able to see
+type IsolationDAO interface {
+	DAO
+	Keys(pattern string) ([]string, error)
+}
+
+// IsolationResult is one attempt to reach tenant A's data as tenant B
+type IsolationResult struct {
+	Check    string
+	Isolated bool
+	Detail   string
+}
+
+func (r IsolationResult) String() string {
+	if r.Isolated {
+		return "PASS " + r.Check
+	}
+	return fmt.Sprintf("FAIL %s: security: %s", r.Check, r.Detail)
+}
+
+// IsolationDAOFactory makes an IsolationDAO for each connection
+type IsolationDAOFactory func() IsolationDAO
+
+// CheckIsolation writes a secret key through service A and then tries to
+// connect to A, read the key or list it with service B's credentials. Each
+// connection is made on a DAO of its own.
+func CheckIsolation(newDAO IsolationDAOFactory, creds Credentialiser, serviceA, serviceB string) (results []IsolationResult, err error) {
+	if serviceB == "" {
+		return nil, fmt.Errorf("no second service to check isolation against")
+	}
+	uriA, passwordA, err := creds.GetCreds(serviceA)
+	if err != nil {
+		return nil, err
+	}
+	uriB, passwordB, err := creds.GetCreds(serviceB)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("isolation:%d", time.Now().UnixNano())
+	a := newDAO()
+	defer a.Close()
+	if err = a.Connect(uriA, passwordA); err != nil {
+		return nil, err
+	}
+	if err = a.SetValue(key, key); err != nil {
+		return nil, err
+	}
+	defer a.UnsetValue(key)
+
+	connect := IsolationResult{Check: "connect", Detail: fmt.Sprintf("%s accepted service B's credentials", uriA)}
+	if passwordA == "" {
+		connect.Detail = fmt.Sprintf("%s needs no password", uriA)
+	} else {
+		aAsB := newDAO()
+		connect.Isolated = aAsB.Connect(uriA, passwordB) != nil
+		aAsB.Close()
+	}
+	results = append(results, connect)
+
+	b := newDAO()
+	defer b.Close()
+	if err = b.Connect(uriB, passwordB); err != nil {
+		return nil, err
+	}
+	value, readErr := b.GetValue(key)
+	results = append(results, IsolationResult{
+		Check:    "read",
+		Isolated: readErr != nil || value != key,
+		Detail:   fmt.Sprintf("service B read the key %s written through service A", key),
+	})
+
+	keys, err := b.Keys("isolation:*")
+	if err != nil {
+		return nil, err
+	}
+	visible := false
+	for _, k := range keys {
+		visible = visible || k == key
+	}
+	results = append(results, IsolationResult{
+		Check:    "list keys",
+		Isolated: !visible,
+		Detail:   fmt.Sprintf("service B can list the key %s written through service A", key),
+	})
+	return results, nil
+}
+
+// IsolationHandler checks the service named by ELASTICACHE_SERVICE_NAME is
+// isolated from the one named by ELASTICACHE_ISOLATION_SERVICE_NAME, both
+// bound to this app
+func IsolationHandler(newDAO IsolationDAOFactory, creds Credentialiser) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		results, err := CheckIsolation(newDAO, creds,
+			os.Getenv("ELASTICACHE_SERVICE_NAME"), os.Getenv("ELASTICACHE_ISOLATION_SERVICE_NAME"))
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check isolation: %v", err)
+			return
+		}
+		status := http.StatusOK
+		for _, result := range results {
+			if !result.Isolated {
+				status = http.StatusFailedDependency
+			}
+		}
+		w.WriteHeader(status)
+		for _, result := range results {
+			fmt.Fprintln(w, result)
+		}
+	}
+}
+
+// Keys lists the keys matching pattern
+func (r *RedisDAO) Keys(pattern string) ([]string, error) {
+	return r.client.Keys(pattern).Result()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantRedis stands in for separate Redis endpoints, each with its own
+// password and keys. Shared makes every endpoint serve the same keys.
+type tenantRedis struct {
+	Shared bool
+
+	passwords map[string]string
+	stores    map[string]map[string]string
+	open      int
+}
+
+func newTenantRedis() *tenantRedis {
+	return &tenantRedis{
+		passwords: map[string]string{"a:6379": "secret-a", "b:6379": "secret-b"},
+		stores:    map[string]map[string]string{"a:6379": {}, "b:6379": {}},
+	}
+}
+
+// Open is the IsolationDAOFactory for connections to the endpoints
+func (f *tenantRedis) Open() IsolationDAO {
+	return &tenantConn{redis: f}
+}
+
+// tenantConn is one connection to a tenantRedis
+type tenantConn struct {
+	redis   *tenantRedis
+	current string
+}
+
+func (c *tenantConn) store() map[string]string {
+	if c.redis.Shared {
+		return c.redis.stores["a:6379"]
+	}
+	return c.redis.stores[c.current]
+}
+
+func (c *tenantConn) Connect(url, password string) error {
+	c.Close()
+	if c.redis.passwords[url] != password {
+		return errors.New("WRONGPASS invalid password")
+	}
+	c.current = url
+	c.redis.open++
+	return nil
+}
+
+func (c *tenantConn) SetValue(label, value string) error {
+	c.store()[label] = value
+	return nil
+}
+
+func (c *tenantConn) GetValue(label string) (string, error) {
+	value, ok := c.store()[label]
+	if !ok {
+		return "", redis.Nil
+	}
+	return value, nil
+}
+
+func (c *tenantConn) UnsetValue(label string) error {
+	delete(c.store(), label)
+	return nil
+}
+
+func (c *tenantConn) Keys(pattern string) ([]string, error) {
+	var keys []string
+	for key := range c.store() {
+		if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *tenantConn) Close() {
+	if c.current != "" {
+		c.redis.open--
+	}
+	c.current = ""
+}
+
+func setupTenants() Credentialiser {
+	os.Setenv("VCAP_SERVICES", `{
+		"elasticache": [
+			{"credentials": {"host": "a", "port": 6379, "password": "secret-a"}, "label": "elasticache", "name": "tenant-a"},
+			{"credentials": {"host": "b", "port": 6379, "password": "secret-b"}, "label": "elasticache", "name": "tenant-b"}
+		]
+	}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+	return CFCredentialiser{}
+}
+
+func TestCheckIsolation(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	dao := newTenantRedis()
+
+	results, err := CheckIsolation(dao.Open, creds, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for _, r := range results {
+		assert.True(t, r.Isolated, r.String())
+	}
+	assert.Empty(t, dao.stores["a:6379"], "the marker should be removed")
+	assert.Equal(t, 0, dao.open, "every connection should be closed")
+}
+
+func TestCheckIsolationShared(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	dao := newTenantRedis()
+	dao.Shared = true
+	dao.passwords["a:6379"] = "secret-b"
+	os.Setenv("VCAP_SERVICES", strings.Replace(os.Getenv("VCAP_SERVICES"), `"secret-a"`, `"secret-b"`, 1))
+
+	results, err := CheckIsolation(dao.Open, creds, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	for _, r := range results {
+		assert.False(t, r.Isolated, r.Check)
+	}
+	assert.Equal(t, "FAIL connect: security: a:6379 accepted service B's credentials", results[0].String())
+	assert.Contains(t, results[1].String(), "FAIL read: security: service B read the key isolation:")
+	assert.Empty(t, dao.stores["a:6379"])
+}
+
+func TestIsolationHandler(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	os.Setenv("ELASTICACHE_SERVICE_NAME", "tenant-a")
+	os.Setenv("ELASTICACHE_ISOLATION_SERVICE_NAME", "tenant-b")
+	defer os.Unsetenv("ELASTICACHE_ISOLATION_SERVICE_NAME")
+	defer os.Unsetenv("ELASTICACHE_SERVICE_NAME")
+
+	w := httptest.NewRecorder()
+	IsolationHandler(newTenantRedis().Open, creds)(w, httptest.NewRequest("GET", "http://x/isolation", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "PASS connect\nPASS read\nPASS list keys\n", w.Body.String())
+}
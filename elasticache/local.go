@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LocalCredentialiser supplies fixed credentials when running outside Cloud Foundry
+type LocalCredentialiser struct {
+	URI      string
+	Password string
+}
+
+// GetCreds ignores the service name and returns the configured credentials
+func (l LocalCredentialiser) GetCreds(_ string) (uri, password string, err error) {
+	return l.URI, l.Password, nil
+}
+
+// LocalOptions gathers connection details for a local run. A credentials file
+// is read first, then REDIS_URL or -url, and individual flags win over both.
+type LocalOptions struct {
+	File     string
+	URL      string
+	Host     string
+	Port     string
+	Password string
+}
+
+// Register adds the local run flags to fs
+func (o *LocalOptions) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.File, "creds", "", "YAML or JSON file holding service credentials")
+	fs.StringVar(&o.URL, "url", os.Getenv("REDIS_URL"), "redis URL (default $REDIS_URL)")
+	fs.StringVar(&o.Host, "host", "", "redis host")
+	fs.StringVar(&o.Port, "port", "", "redis port")
+	fs.StringVar(&o.Password, "password", "", "redis password")
+}
+
+// localCredentials mirrors the credentials block of an ElastiCache service binding
+type localCredentials struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Password string `yaml:"password"`
+}
+
+// Credentials resolves the options into a LocalCredentialiser
+func (o LocalOptions) Credentials() (creds LocalCredentialiser, err error) {
+	host, port := "", "6379"
+	if o.File != "" {
+		var file localCredentials
+		if file, err = readCredentialsFile(o.File); err != nil {
+			return
+		}
+		host, creds.Password = file.Host, file.Password
+		if file.Port != 0 {
+			port = strconv.Itoa(file.Port)
+		}
+	}
+
+	if o.URL != "" {
+		var u *url.URL
+		if u, err = url.Parse(o.URL); err != nil {
+			return
+		}
+		if u.Scheme != "redis" {
+			err = fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+			return
+		}
+		host = u.Hostname()
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		if u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				creds.Password = password
+			}
+		}
+	}
+
+	if o.Host != "" {
+		host = o.Host
+	}
+	if o.Port != "" {
+		port = o.Port
+	}
+	if o.Password != "" {
+		creds.Password = o.Password
+	}
+
+	if host == "" {
+		err = fmt.Errorf("no redis host given, use -host, -url, -creds or REDIS_URL")
+		return
+	}
+	creds.URI = net.JoinHostPort(host, port)
+	return
+}
+
+func readCredentialsFile(path string) (creds localCredentials, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(data, &creds); err != nil {
+		err = fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return
+}
+
+// RunLocal runs the probe once, prints the result and returns the exit code
+func RunLocal(dao DAO, creds Credentialiser, out io.Writer) int {
+	defer dao.Close()
+	tester := NewTester(dao, creds)
+	if err := tester.PerformTest(""); err != nil {
+		fmt.Fprintf(out, "Failed to access ElastiCache: %v\n%v\n", err, tester.diagnose("", err))
+		return 1
+	}
+
+	fmt.Fprintln(out, "Elasticache service is OK")
+	return 0
+}
+
+// RunLogin only logs in with the credentials, prints the result and returns
+// the exit code, which is diagnose.ExitRefused when the server refuses them
+func RunLogin(dao DAO, creds Credentialiser, out io.Writer) int {
+	defer dao.Close()
+	t, err := NewTester(dao, creds).target("")
+	if err != nil {
+		fmt.Fprintf(out, "Failed to read credentials: %v\n", err)
+		return 1
+	}
+	return t.Login(out)
+}
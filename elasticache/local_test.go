@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCredentialsFromURL(t *testing.T) {
+	creds, err := LocalOptions{URL: "redis://:secret@cache.local:6380/0"}.Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, LocalCredentialiser{URI: "cache.local:6380", Password: "secret"}, creds)
+
+	creds, err = LocalOptions{URL: "redis://cache.local", Port: "7000"}.Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, LocalCredentialiser{URI: "cache.local:7000"}, creds)
+}
+
+func TestLocalCredentialsFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "creds")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "host: redis_host\nport: 6379\npassword: redis_password\n")
+	f.Close()
+
+	creds, err := LocalOptions{File: f.Name()}.Credentials()
+	require.NoError(t, err)
+	assert.Equal(t, LocalCredentialiser{URI: "redis_host:6379", Password: "redis_password"}, creds)
+}
+
+func TestLocalCredentialsMissingHost(t *testing.T) {
+	_, err := LocalOptions{}.Credentials()
+	require.Error(t, err)
+}
+
+func TestRunLocal(t *testing.T) {
+	dao := NewFakeDAO()
+	var out bytes.Buffer
+	code := RunLocal(dao, LocalCredentialiser{URI: "h:6379", Password: "p"}, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "Elasticache service is OK\n", out.String())
+	assert.Equal(t, "h:6379", dao.URL)
+
+	out.Reset()
+	defer diagnose.FakeNetwork(nil, errors.New("connection refused"))()
+	dao.ConnectError = errors.New("connection refused")
+	code = RunLocal(dao, LocalCredentialiser{URI: "h:6379"}, &out)
+	assert.Equal(t, 1, code)
+	assert.Regexp(t, `^Failed to access ElastiCache: connection refused
+PASS dns: h resolves to 10\.0\.0\.1 \([^)]+\)
+FAIL tcp \[network\]: connection refused
+$`, out.String())
+}
+
+func TestRunLogin(t *testing.T) {
+	dao := NewFakeDAO()
+	creds := LocalCredentialiser{URI: "h:6379", Password: "p"}
+	var out bytes.Buffer
+	assert.Equal(t, 0, RunLogin(dao, creds, &out))
+	assert.Equal(t, "Credentials accepted\n", out.String())
+
+	dao.ConnectError = errors.New("WRONGPASS invalid username-password pair")
+	assert.Equal(t, diagnose.ExitRefused, RunLogin(dao, creds, &out))
+	dao.ConnectError = errors.New("NOAUTH Authentication required.")
+	assert.Equal(t, diagnose.ExitRefused, RunLogin(dao, creds, &out))
+
+	out.Reset()
+	dao.ConnectError = errors.New("ERR Client sent AUTH, but no password is set")
+	assert.Equal(t, 1, RunLogin(dao, creds, &out))
+	assert.Equal(t, "Failed to log in: ERR Client sent AUTH, but no password is set\n", out.String())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeLog(t *testing.T, out *bytes.Buffer) []logging.LogEntry {
+	var entries []logging.LogEntry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e logging.LogEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLogRequests(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	dao.ConnectError = errors.New("NOAUTH Authentication required.")
+	defer diagnose.FakeNetwork(nil, nil)()
+
+	var out bytes.Buffer
+	handler := logging.LogRequests(&logging.Logger{Out: &out, Service: "test-elasticache"}, WebHandler(reuse(dao), creds))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://x/", nil))
+	assert.Equal(t, http.StatusFailedDependency, w.Code)
+	runID := w.Header().Get(logging.RunIDHeader)
+	assert.Len(t, runID, 16)
+
+	entries := decodeLog(t, &out)
+	var steps []string
+	for _, e := range entries {
+		assert.Equal(t, runID, e.RunID)
+		assert.Equal(t, "test-elasticache", e.Service)
+		steps = append(steps, e.Step)
+	}
+	assert.Equal(t, []string{"credentials", "connect", "probe", "dns", "tcp", "auth", "diagnose", "request"}, steps)
+	assert.Equal(t, "auth", entries[1].ErrorClass)
+	assert.Equal(t, "auth", entries[6].ErrorClass)
+	assert.NotContains(t, out.String(), "redis_password")
+}
+
+func TestTesterWithoutRun(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	assert.NoError(t, NewTester(dao, creds).PerformTest("test-elasticache"))
+}
@@ -1,15 +1,33 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/ONSdigital/cf-tests/probe/auth"
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/health"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/serve"
+	"github.com/ONSdigital/cf-tests/probe/testplan"
+	"github.com/ONSdigital/cf-tests/probe/tracing"
 	"github.com/go-redis/redis"
 )
 
+// Credentialiser is an abstraction for reading credentials from VCAP services
+type Credentialiser interface {
+	GetCreds(serviceName string) (uri, password string, err error)
+}
+
 type DAO interface {
 	Connect(url, password string) error
 	SetValue(label, value string) error
@@ -18,28 +36,155 @@ type DAO interface {
 	Close()
 }
 
+// DAOFactory makes a DAO for each request, so requests never share a
+// connection
+type DAOFactory func() DAO
+
+// NewRedisDAO is the DAOFactory for Redis
+func NewRedisDAO() DAO {
+	return &RedisDAO{}
+}
+
 func main() {
+	local := flag.Bool("local", false, "run the probe once outside Cloud Foundry and exit")
+	requireTLS := flag.Bool("require-tls", false, "with -local, also check the server refuses a plaintext connection")
+	login := flag.Bool("login", false, "with -local, only log in, exiting 3 if the server refuses the credentials")
+	var opts LocalOptions
+	opts.Register(flag.CommandLine)
+	var writes WriteOptions
+	writes.Register(flag.CommandLine)
+	flag.Parse()
+
 	dao := &RedisDAO{}
-	creds := CFCredentialiser{}
+	cf := CFCredentialiser{
+		Label: discovery.Getenv("ELASTICACHE_SERVICE_LABEL", "elasticache"),
+		Tag:   discovery.Getenv("ELASTICACHE_SERVICE_TAG", "redis"),
+	}
+	var creds Credentialiser = cf
+	if *local {
+		localCreds, err := opts.Credentials()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		creds = localCreds
+	}
+
+	if writes.Duration > 0 {
+		os.Exit(RunWrites(writes.Monitor(dao, creds, os.Getenv("ELASTICACHE_SERVICE_NAME"), os.Stderr), os.Stdout))
+	}
+	if *local && *login {
+		os.Exit(RunLogin(dao, creds, os.Stdout))
+	}
+	if *local {
+		code := RunLocal(dao, creds, os.Stdout)
+		if *requireTLS && RunTransport(DialPlaintext, creds, os.Stdout) != 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	access, err := auth.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	plan, err := testplan.Load("elasticache", checks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	payload := plan["probe"].Payload
+	minInterval, err := coalesce.MinIntervalFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grace, err := serve.GraceFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 	port := os.Getenv("PORT")
-	log.Fatal(http.ListenAndServe(":"+port, WebHandler(dao, creds)))
+	probe := coalesce.New(ProbeHandler(NewRedisDAO, creds, payload["key"], payload["value"]), minInterval)
+	mux := http.NewServeMux()
+	mux.Handle("/", plan["probe"].Wrap(probe))
+	plan.Handle(mux, "probe", probe)
+	mux.Handle("/dataset/", DatasetHandler(NewRedisDAO, creds))
+	plan.Handle(mux, "ping", PingHandler(NewRedisDAO, creds))
+	plan.Handle(mux, "isolation", IsolationHandler(func() IsolationDAO { return &RedisDAO{} }, creds))
+	plan.Handle(mux, "transport", TransportHandler(DialPlaintext, creds))
+	mux.Handle("/healthz", health.Healthz())
+	mux.Handle("/readyz", health.Readyz(func() error {
+		_, _, err := creds.GetCreds(os.Getenv("ELASTICACHE_SERVICE_NAME"))
+		return err
+	}, probe))
+	logger := &logging.Logger{Out: os.Stdout, Service: os.Getenv("ELASTICACHE_SERVICE_NAME")}
+	tracer := tracing.FromEnv("cf-test-elasticache", discovery.Attributes(os.Getenv("ELASTICACHE_SERVICE_NAME"), cf.Label, cf.Tag))
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go probe.Refresh()
+	plan.Schedule(logging.LogRequests(logger, tracing.TraceRequests(tracer, mux)), nil)
+	if err := serve.Serve(&http.Server{Handler: logging.LogRequests(logger, tracing.TraceRequests(tracer, access.Wrap(mux)))}, l, signals, grace, &openClients, tracer); err != nil {
+		log.Fatal(err)
+	}
 }
 
+// checks are the probe's checks as they run without a test plan
+var checks = testplan.Plan{
+	"probe":     {Path: "/probe", Enabled: true, Severity: testplan.SeverityCritical, Payload: map[string]string{"key": "foo", "value": "bar"}},
+	"ping":      {Path: "/ping", Enabled: true, Severity: testplan.SeverityCritical},
+	"isolation": {Path: "/isolation", Enabled: true, Severity: testplan.SeverityCritical},
+	"transport": {Path: "/transport", Enabled: true, Severity: testplan.SeverityCritical},
+}
+
+// Tester runs the probe, logging each step to run when it is set. It writes
+// Value to Key, reads it back and removes it.
 type Tester struct {
+	Key   string
+	Value string
+
 	dao   DAO
-	creds CFCredentialiser
+	creds Credentialiser
+	run   *logging.Run
 }
 
-func NewTester(dao DAO, creds CFCredentialiser) *Tester {
-	return &Tester{dao: dao, creds: creds}
+// NewTester makes a Tester with the default key and value
+func NewTester(dao DAO, creds Credentialiser) *Tester {
+	payload := checks["probe"].Payload
+	return &Tester{Key: payload["key"], Value: payload["value"], dao: dao, creds: creds}
 }
 
-func WebHandler(dao DAO, creds CFCredentialiser) http.HandlerFunc {
+// WebHandler probes with the default key and value
+func WebHandler(newDAO DAOFactory, creds Credentialiser) http.HandlerFunc {
+	payload := checks["probe"].Payload
+	return ProbeHandler(newDAO, creds, payload["key"], payload["value"])
+}
+
+// ProbeHandler provides a test endpoint that writes value to key, on a DAO of
+// its own for each request
+func ProbeHandler(newDAO DAOFactory, creds Credentialiser, key, value string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		serviceName := os.Getenv("ELASTICACHE_SERVICE_NAME")
-		if err := NewTester(dao, creds).PerformTest(serviceName); err != nil {
+		dao := newDAO()
+		defer dao.Close()
+		tester := NewTester(dao, creds)
+		tester.Key, tester.Value = key, value
+		tester.run = logging.RunFrom(req.Context())
+		if tester.run != nil {
+			w.Header().Set(logging.RunIDHeader, tester.run.ID)
+		}
+		if err := tester.run.Step("probe", func() error {
+			return tester.PerformTest(serviceName)
+		}); err != nil {
+			var d *diagnose.Diagnosis
+			tester.run.Step("diagnose", func() error {
+				d = tester.diagnose(serviceName, err)
+				return d.Err()
+			})
+			w.Header().Set(logging.ErrorCategoryHeader, d.Category())
 			w.WriteHeader(http.StatusFailedDependency)
-			fmt.Fprintf(w, "Failed to access ElastiCache: %v", err)
+			fmt.Fprintf(w, "Failed to access ElastiCache: %v\n%v\n", err, d)
 			return
 		}
 
@@ -49,57 +194,70 @@ func WebHandler(dao DAO, creds CFCredentialiser) http.HandlerFunc {
 }
 
 func (t *Tester) PerformTest(serviceName string) error {
-	uri, password, err := t.creds.GetCreds(serviceName)
-	if err != nil {
-		return err
-	}
-	if err := t.dao.Connect(uri, password); err != nil {
+	if err := t.connect(serviceName); err != nil {
 		return err
 	}
-	if err := t.dao.SetValue("foo", "bar"); err != nil {
+	if err := t.run.Step("write", func() error {
+		return t.dao.SetValue(t.Key, t.Value)
+	}); err != nil {
 		return err
 	}
-	defer t.dao.UnsetValue("foo")
-	if value, err := t.dao.GetValue("foo"); err != nil {
-		return err
-	} else if value != "bar" {
-		return fmt.Errorf("Value set but not retrieved")
-	}
-	return nil
+	defer t.run.Step("cleanup", func() error {
+		return t.dao.UnsetValue(t.Key)
+	})
+	return t.run.Step("read", func() error {
+		if value, err := t.dao.GetValue(t.Key); err != nil {
+			return err
+		} else if value != t.Value {
+			return fmt.Errorf("Value set but not retrieved")
+		}
+		return nil
+	})
 }
 
+// CFCredentialiser reads credentials from VCAP_SERVICES. When no service name
+// is given the binding is found by Label or Tag instead.
 type CFCredentialiser struct {
+	Label string
+	Tag   string
 }
 
-func (CFCredentialiser) GetCreds(serviceName string) (uri, password string, err error) {
-	app, err := cfenv.Current()
-	if err != nil {
-		return
-	}
-
-	pg, err := app.Services.WithName(serviceName)
+func (c CFCredentialiser) GetCreds(serviceName string) (uri, password string, err error) {
+	pg, err := discovery.Find(serviceName, c.Label, c.Tag)
 	if err != nil {
 		return
 	}
 
 	host, _ := pg.CredentialString("host")
 	port, _ := pg.Credentials["port"].(float64)
-	uri = fmt.Sprintf("%s:%0.0f", host, port)
+	uri = discovery.BackendAddress(pg.Name, serviceName == os.Getenv("ELASTICACHE_SERVICE_NAME"), fmt.Sprintf("%s:%0.0f", host, port))
 	password, _ = pg.CredentialString("password")
 
 	return
 }
 
 type RedisDAO struct {
+	// ReadTimeout bounds each reply. Zero keeps go-redis's default of 3
+	// seconds.
+	ReadTimeout time.Duration
+
 	client *redis.Client
 }
 
+// openClients holds the clients RedisDAOs have connected and not yet closed
+var openClients serve.CloserSet
+
+// Connect closes any client the DAO already has and connects a new one. A
+// RedisDAO holds one client, so it is not for sharing between requests.
 func (r *RedisDAO) Connect(uri, password string) error {
+	r.Close()
 	r.client = redis.NewClient(&redis.Options{
-		Addr:     uri,
-		Password: password,
-		DB:       0,
+		Addr:        uri,
+		Password:    password,
+		DB:          0,
+		ReadTimeout: r.ReadTimeout,
 	})
+	openClients.Add(r.client)
 	_, err := r.client.Ping().Result()
 	return err
 }
@@ -119,6 +277,8 @@ func (r *RedisDAO) UnsetValue(label string) error {
 
 func (r *RedisDAO) Close() {
 	if r.client != nil {
+		openClients.Remove(r.client)
 		r.client.Close()
+		r.client = nil
 	}
 }
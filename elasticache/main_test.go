@@ -6,6 +6,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/testplan"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -16,6 +18,7 @@ type FakeDAO struct {
 	ConnectError error
 	SetError     error
 	GetError     error
+	Written      []string
 
 	store map[string]string
 }
@@ -31,6 +34,7 @@ func (f *FakeDAO) Connect(url, password string) error {
 }
 
 func (f *FakeDAO) SetValue(label, value string) error {
+	f.Written = append(f.Written, label+"="+value)
 	f.store[label] = value
 	return f.SetError
 }
@@ -46,6 +50,12 @@ func (f *FakeDAO) UnsetValue(label string) error {
 
 func (f *FakeDAO) Close() {}
 
+// reuse is a DAOFactory that hands out dao every time, so tests can look at
+// what requests did with it
+func reuse(dao DAO) DAOFactory {
+	return func() DAO { return dao }
+}
+
 func setupFake() (*FakeDAO, CFCredentialiser) {
 	dao := NewFakeDAO()
 	vcap_services := `
@@ -58,7 +68,8 @@ func setupFake() (*FakeDAO, CFCredentialiser) {
               "password": "redis_password"
             },
             "label": "elasticache",
-            "name": "test-elasticache"
+            "name": "test-elasticache",
+            "plan": "small-redis"
           }
         ]
     }
@@ -88,7 +99,7 @@ func TestWeb(t *testing.T) {
 	dao, creds := setupFake()
 	defer teardownFake()
 	w := httptest.NewRecorder()
-	handler := WebHandler(dao, creds)
+	handler := WebHandler(reuse(dao), creds)
 	req := httptest.NewRequest("GET", "http://x/", nil)
 	handler(w, req)
 	resp := w.Result()
@@ -96,3 +107,73 @@ func TestWeb(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, "Elasticache service is OK", string(body))
 }
+
+func TestProbeHandlerPayload(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	plan, err := testplan.Parse([]byte("elasticache: {probe: {payload: {key: probe-key}}, ping: {enabled: false}}"), "elasticache", checks)
+	require.NoError(t, err)
+	payload := plan["probe"].Payload
+
+	w := httptest.NewRecorder()
+	ProbeHandler(reuse(dao), creds, payload["key"], payload["value"])(w, httptest.NewRequest("GET", "http://x/", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"probe-key=bar"}, dao.Written)
+	assert.False(t, plan["ping"].Enabled)
+}
+
+func TestGetCredsByLabel(t *testing.T) {
+	setupFake()
+	defer teardownFake()
+	uri, password, err := CFCredentialiser{Label: "elasticache"}.GetCreds("")
+	require.NoError(t, err)
+	assert.Equal(t, "redis_host:6379", uri)
+	assert.Equal(t, "redis_password", password)
+}
+
+func TestGetCredsBackendAddress(t *testing.T) {
+	setupFake()
+	defer teardownFake()
+	os.Setenv(discovery.BackendAddressEnv, "127.0.0.1:7000")
+	defer os.Unsetenv(discovery.BackendAddressEnv)
+
+	uri, password, err := CFCredentialiser{Label: "elasticache"}.GetCreds("test-elasticache")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", uri)
+	assert.Equal(t, "redis_password", password)
+
+	creds := setupTenants()
+	os.Setenv("ELASTICACHE_SERVICE_NAME", "tenant-a")
+	defer os.Unsetenv("ELASTICACHE_SERVICE_NAME")
+	uri, _, err = creds.GetCreds("tenant-a")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", uri)
+	uri, _, err = creds.GetCreds("tenant-b")
+	require.NoError(t, err)
+	assert.Equal(t, "b:6379", uri, "only the probe's own service should be redirected")
+
+	os.Setenv(discovery.BackendServiceEnv, "tenant-b")
+	defer os.Unsetenv(discovery.BackendServiceEnv)
+	uri, _, err = creds.GetCreds("tenant-a")
+	require.NoError(t, err)
+	assert.Equal(t, "a:6379", uri)
+	uri, _, err = creds.GetCreds("tenant-b")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", uri)
+}
+
+func TestGetCredsAmbiguousTag(t *testing.T) {
+	os.Setenv("VCAP_SERVICES", `{
+		"elasticache": [
+			{"credentials": {"host": "a"}, "label": "elasticache", "name": "cache-a", "tags": ["redis"]}
+		],
+		"user-provided": [
+			{"credentials": {"host": "b"}, "label": "user-provided", "name": "cache-b", "tags": ["redis"]}
+		]
+	}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+	defer teardownFake()
+	_, _, err := CFCredentialiser{Tag: "redis"}.GetCreds("")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 services bound with tag \"redis\"")
+}
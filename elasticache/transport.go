@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// PlaintextDialer sends PING to uri without TLS and returns nil if the server
+// answered in RESP
+type PlaintextDialer func(uri string) error
+
+// TransportResult is the outcome of the transport policy check. Refused is
+// the error the plaintext exchange failed with, if it did. Only a server that
+// takes the TCP connection and then fails the RESP exchange passes: any other
+// error says nothing about the policy.
+type TransportResult struct {
+	URI     string
+	Refused error
+}
+
+// OK is true when the server refused the plaintext exchange
+func (r TransportResult) OK() bool {
+	return refusesPlaintext(r.Refused)
+}
+
+func (r TransportResult) String() string {
+	switch {
+	case r.Refused == nil:
+		return fmt.Sprintf("FAIL transport policy: security: %s accepted a plaintext connection", r.URI)
+	case r.OK():
+		return fmt.Sprintf("PASS transport policy: plaintext connection refused: %v", r.Refused)
+	}
+	return fmt.Sprintf("ERROR transport policy: could not tell whether %s refuses plaintext: %v", r.URI, r.Refused)
+}
+
+// handshakeError is a RESP exchange that failed after the TCP connection was
+// made
+type handshakeError struct {
+	err error
+}
+
+func (e handshakeError) Error() string {
+	return e.err.Error()
+}
+
+// refusesPlaintext is true when a TLS listener failed the plain exchange,
+// which it does by closing the connection or answering with a TLS alert
+// rather than RESP. An exchange that timed out is not a refusal.
+func refusesPlaintext(err error) bool {
+	h, ok := err.(handshakeError)
+	if !ok {
+		return false
+	}
+	ne, ok := h.err.(net.Error)
+	return !ok || !ne.Timeout()
+}
+
+// CheckTransport tries plain Redis against the service's endpoint
+func CheckTransport(dial PlaintextDialer, creds Credentialiser, serviceName string) (TransportResult, error) {
+	uri, _, err := creds.GetCreds(serviceName)
+	if err != nil {
+		return TransportResult{}, err
+	}
+	return TransportResult{URI: uri, Refused: dial(uri)}, nil
+}
+
+// TransportHandler reports the transport policy check for the service named
+// by ELASTICACHE_SERVICE_NAME
+func TransportHandler(dial PlaintextDialer, creds Credentialiser) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		result, err := CheckTransport(dial, creds, os.Getenv("ELASTICACHE_SERVICE_NAME"))
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check transport policy: %v", err)
+			return
+		}
+		if !result.OK() {
+			w.WriteHeader(http.StatusFailedDependency)
+		}
+		fmt.Fprintln(w, result)
+	}
+}
+
+// RunTransport runs the check once, prints the result and returns the exit code
+func RunTransport(dial PlaintextDialer, creds Credentialiser, out io.Writer) int {
+	result, err := CheckTransport(dial, creds, "")
+	if err != nil {
+		fmt.Fprintf(out, "Failed to check transport policy: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(out, result)
+	if !result.OK() {
+		return 1
+	}
+	return 0
+}
+
+// DialPlaintext sends PING on a connection of its own, never a DAO's, so the
+// check cannot close or replace the probe's client. It gives up after ten
+// seconds. It does not send AUTH, so the
+// password never crosses the plaintext connection: any RESP answer, even
+// NOAUTH, shows the server speaks Redis without TLS. Errors after the TCP
+// connection is made are handshakeErrors.
+func DialPlaintext(uri string) error {
+	conn, err := net.DialTimeout("tcp", uri, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return handshakeError{err}
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return handshakeError{err}
+	}
+	if !strings.HasSuffix(reply, "\r\n") || !strings.ContainsAny(reply[:1], "+-:$*") {
+		return handshakeError{fmt.Errorf("not a RESP reply: %q", reply)}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plaintextDialer answers plaintext connections with err
+func plaintextDialer(err error) PlaintextDialer {
+	return func(string) error { return err }
+}
+
+// timeoutError is a net.Error for a deadline that passed
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCheckTransportRefused(t *testing.T) {
+	var out bytes.Buffer
+	code := RunTransport(plaintextDialer(handshakeError{io.EOF}), LocalCredentialiser{URI: "redis:6379"}, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "PASS transport policy: plaintext connection refused: EOF\n", out.String())
+}
+
+func TestCheckTransportInconclusive(t *testing.T) {
+	for _, err := range []error{
+		errors.New("dial tcp: lookup redis: no such host"),
+		handshakeError{timeoutError{}},
+	} {
+		var out bytes.Buffer
+		code := RunTransport(plaintextDialer(err), LocalCredentialiser{URI: "redis:6379"}, &out)
+		assert.Equal(t, 1, code, "%v", err)
+		assert.Contains(t, out.String(), "ERROR transport policy: could not tell whether redis:6379 refuses plaintext")
+	}
+}
+
+func TestCheckTransportDialFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	result, err := CheckTransport(DialPlaintext, LocalCredentialiser{URI: addr}, "")
+	require.NoError(t, err)
+	require.Error(t, result.Refused)
+	assert.False(t, result.OK(), "a connection that was never made refuses nothing")
+}
+
+func TestCheckTransportAccepted(t *testing.T) {
+	var out bytes.Buffer
+	code := RunTransport(plaintextDialer(nil), LocalCredentialiser{URI: "redis:6379"}, &out)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "FAIL transport policy: security: redis:6379 accepted a plaintext connection\n", out.String())
+}
+
+func TestTransportHandler(t *testing.T) {
+	_, creds := setupFake()
+	defer teardownFake()
+
+	w := httptest.NewRecorder()
+	TransportHandler(plaintextDialer(nil), creds)(w, httptest.NewRequest("GET", "http://x/transport", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "FAIL transport policy: security: redis_host:6379 accepted a plaintext connection\n", w.Body.String())
+}
+
+// serveRedis accepts connections on a local port and hands each to serve
+func serveRedis(t *testing.T, serve func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l
+}
+
+func TestConnectPlaintext(t *testing.T) {
+	refusing := serveRedis(t, func(conn net.Conn) { conn.Close() })
+	defer refusing.Close()
+	err := DialPlaintext(refusing.Addr().String())
+	assert.True(t, refusesPlaintext(err), "%v", err)
+
+	// a TLS listener answers the plaintext bytes with an alert
+	alerting := serveRedis(t, func(conn net.Conn) {
+		conn.Write([]byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x46})
+		conn.Close()
+	})
+	defer alerting.Close()
+	err = DialPlaintext(alerting.Addr().String())
+	assert.True(t, refusesPlaintext(err), "%v", err)
+
+	accepting := newFakeRedis(t, "secret")
+	defer accepting.Close()
+	assert.NoError(t, DialPlaintext(accepting.Addr()), "NOAUTH is still a plaintext answer")
+}
@@ -0,0 +1,121 @@
+// Command faultproxy sits between a probe and its backend as a TCP proxy
+// that causes network faults on demand, to check the probe reports a failure
+// rather than hanging. It forwards to -target, or to the address in a bound
+// service's credentials, and serves a control API for setting faults.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/faultproxy"
+)
+
+func main() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	os.Exit(Main(os.Args[1:], signals, os.Stderr))
+}
+
+// Main forwards until a signal arrives, serving the control API and running
+// any schedule, and returns the exit code
+func Main(args []string, signals <-chan os.Signal, out io.Writer) int {
+	fs := flag.NewFlagSet("faultproxy", flag.ContinueOnError)
+	fs.SetOutput(out)
+	listen := fs.String("listen", "127.0.0.1:7000", "address to listen on")
+	target := fs.String("target", "", "host:port to forward to (default the bound service's)")
+	service := fs.String("service", "", "name of the bound service to forward to")
+	label := fs.String("label", "", "label of the bound service to forward to, when no name is given")
+	tag := fs.String("tag", "", "tag of the bound service to forward to, when no name or label is given")
+	control := fs.String("control", "127.0.0.1:8081", "address for the control API")
+	schedule := fs.String("schedule", "", `faults to apply on a schedule, as JSON such as '[{"at":"1m","for":"30s","fault":{"blackhole":true}}]'`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var steps []faultproxy.ScheduledFault
+	if *schedule != "" {
+		if err := json.Unmarshal([]byte(*schedule), &steps); err != nil {
+			fmt.Fprintf(out, "Bad -schedule: %v\n", err)
+			return 2
+		}
+	}
+	if *target == "" {
+		svc, err := discovery.Find(*service, *label, *tag)
+		if err == nil {
+			*target, err = ServiceAddress(svc)
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 2
+		}
+	}
+
+	p, err := faultproxy.New(*listen, *target)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to start fault proxy: %v\n", err)
+		return 1
+	}
+	defer p.Close()
+	l, err := net.Listen("tcp", *control)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to start fault proxy control API: %v\n", err)
+		return 1
+	}
+	server := &http.Server{Handler: faultproxy.Handler(p)}
+	go server.Serve(l)
+	defer server.Close()
+
+	fmt.Fprintf(out, "Forwarding %s to %s, control API on %s\n", p.Addr(), *target, l.Addr())
+	if len(steps) > 0 {
+		p.Schedule(steps)
+	}
+	<-signals
+	return 0
+}
+
+// defaultPorts are the ports of the backends' URI schemes
+var defaultPorts = map[string]string{
+	"postgres":   "5432",
+	"postgresql": "5432",
+	"redis":      "6379",
+	"rediss":     "6379",
+	"amqp":       "5672",
+	"amqps":      "5671",
+}
+
+// ServiceAddress reads the host:port a service's credentials point at: host
+// with port, host on its own when it already holds a port, or else the host
+// of uri with the port its scheme defaults to
+func ServiceAddress(svc *discovery.Service) (string, error) {
+	host, _ := svc.CredentialString("host")
+	if port, ok := svc.Credentials["port"].(float64); ok && host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	uri, _ := svc.CredentialString("uri")
+	u, err := url.Parse(uri)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("service %s has no host and port or uri credentials, set -target", svc.Name)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	if port == "" {
+		return "", fmt.Errorf("service %s's uri has no port and %s has no default, set -target", svc.Name, u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
@@ -0,0 +1,100 @@
+// Package auth guards the probe endpoints with basic auth or a bearer token.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+)
+
+// Credentials holds what callers must present to reach the probe endpoints:
+// basic auth with Username and Password, or Token as a bearer token. With
+// neither set the endpoints are open.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Enabled is true when any credential is configured
+func (a Credentials) Enabled() bool {
+	return a.Username != "" || a.Password != "" || a.Token != ""
+}
+
+// Load reads PROBE_AUTH_USERNAME, PROBE_AUTH_PASSWORD and PROBE_AUTH_TOKEN.
+// When PROBE_AUTH_SERVICE names a bound user-provided service its username,
+// password and token credentials are used instead.
+func Load() (Credentials, error) {
+	auth := Credentials{
+		Username: os.Getenv("PROBE_AUTH_USERNAME"),
+		Password: os.Getenv("PROBE_AUTH_PASSWORD"),
+		Token:    os.Getenv("PROBE_AUTH_TOKEN"),
+	}
+	name := os.Getenv("PROBE_AUTH_SERVICE")
+	if name == "" {
+		return auth, nil
+	}
+
+	svc, err := discovery.Named(name)
+	if err != nil {
+		return auth, err
+	}
+	auth.Username, _ = svc.CredentialString("username")
+	auth.Password, _ = svc.CredentialString("password")
+	auth.Token, _ = svc.CredentialString("token")
+	if !auth.Enabled() {
+		return auth, fmt.Errorf("service %s has no username, password or token credentials", name)
+	}
+	return auth, nil
+}
+
+// Wrap makes next require the configured credentials. /healthz and /readyz
+// never touch the backing service and are always let through so the
+// platform can check the app without them.
+func (a Credentials) Wrap(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || a.allows(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.Username != "" || a.Password != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cf-tests"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized")
+	})
+}
+
+func (a Credentials) allows(r *http.Request) bool {
+	if header := r.Header.Get("Authorization"); a.Token != "" && strings.HasPrefix(header, "Bearer ") {
+		return secureEqual(strings.TrimPrefix(header, "Bearer "), a.Token)
+	}
+	if a.Username == "" && a.Password == "" {
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// check both so the time taken does not say which was wrong
+	userOK := secureEqual(user, a.Username)
+	passwordOK := secureEqual(password, a.Password)
+	return userOK && passwordOK
+}
+
+// secureEqual compares in constant time. Hashing first hides the lengths.
+func secureEqual(given, want string) bool {
+	g := sha256.Sum256([]byte(given))
+	w := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveAuth(auth Credentials, path string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("probed")) }))
+	mux.Handle("/healthz", health.Healthz())
+	r := httptest.NewRequest("GET", "http://x"+path, nil)
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	auth.Wrap(mux).ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthOpenByDefault(t *testing.T) {
+	w := serveAuth(Credentials{}, "/", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "probed", w.Body.String())
+}
+
+func TestAuthBasic(t *testing.T) {
+	auth := Credentials{Username: "probe", Password: "secret"}
+
+	w := serveAuth(auth, "/", nil)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `Basic realm="cf-tests"`, w.Header().Get("WWW-Authenticate"))
+
+	w = serveAuth(auth, "/", func(r *http.Request) { r.SetBasicAuth("probe", "wrong") })
+	assert.Equal(t, 401, w.Code)
+	w = serveAuth(auth, "/", func(r *http.Request) { r.SetBasicAuth("other", "secret") })
+	assert.Equal(t, 401, w.Code)
+
+	w = serveAuth(auth, "/", func(r *http.Request) { r.SetBasicAuth("probe", "secret") })
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "probed", w.Body.String())
+}
+
+func TestAuthBearer(t *testing.T) {
+	auth := Credentials{Token: "t0ken"}
+
+	w := serveAuth(auth, "/dataset/x", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") })
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	w = serveAuth(auth, "/", func(r *http.Request) { r.SetBasicAuth("probe", "t0ken") })
+	assert.Equal(t, 401, w.Code)
+
+	w = serveAuth(auth, "/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") })
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestAuthHealthzOpen(t *testing.T) {
+	w := serveAuth(Credentials{Token: "t0ken"}, "/healthz", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+}
+
+func TestAuthReadyzOpen(t *testing.T) {
+	w := serveAuth(Credentials{Token: "t0ken"}, "/readyz", nil)
+	assert.NotEqual(t, 401, w.Code)
+}
+
+func TestLoadAuthFromEnv(t *testing.T) {
+	os.Setenv("PROBE_AUTH_TOKEN", "t0ken")
+	defer os.Unsetenv("PROBE_AUTH_TOKEN")
+
+	auth, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Token: "t0ken"}, auth)
+}
+
+func TestLoadAuthFromService(t *testing.T) {
+	os.Setenv("VCAP_SERVICES", `{"user-provided": [
+		{"credentials": {"username": "probe", "password": "secret"}, "label": "user-provided", "name": "probe-auth"},
+		{"credentials": {"url": "https://example.com"}, "label": "user-provided", "name": "other"}
+	]}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+	os.Setenv("PROBE_AUTH_SERVICE", "probe-auth")
+	defer os.Unsetenv("PROBE_AUTH_SERVICE")
+
+	auth, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "probe", Password: "secret"}, auth)
+
+	os.Setenv("PROBE_AUTH_SERVICE", "other")
+	_, err = Load()
+	assert.EqualError(t, err, "service other has no username, password or token credentials")
+
+	os.Setenv("PROBE_AUTH_SERVICE", "missing")
+	_, err = Load()
+	assert.Error(t, err)
+}
@@ -0,0 +1,168 @@
+// Package coalesce shares one run of a probe handler between the requests
+// that arrive while it is in flight.
+package coalesce
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Coalescer runs Handler at most once at a time. Requests that arrive while
+// a run is in flight wait for it and share its response, and for MinInterval
+// after a run finishes its response is served from cache. Handler must answer
+// every request the same way, as the probe handlers do. A run belongs to no
+// one request, so a caller that times out or goes away is answered 503 and
+// the run carries on for the others.
+//
+// Responses carry X-Probe-Result, one of fresh, shared or cached, and Age,
+// the seconds since the result was produced.
+type Coalescer struct {
+	Handler     http.Handler
+	MinInterval time.Duration
+
+	mu       sync.Mutex
+	last     *coalescedRun
+	finished *coalescedRun
+}
+
+// coalescedRun is one run of the handler; the other fields are set before
+// done is closed
+type coalescedRun struct {
+	done   chan struct{}
+	at     time.Time
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (run *coalescedRun) finished() bool {
+	select {
+	case <-run.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// New wraps h in a Coalescer
+func New(h http.Handler, minInterval time.Duration) *Coalescer {
+	return &Coalescer{Handler: h, MinInterval: minInterval}
+}
+
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	run := c.last
+	result := "cached"
+	switch {
+	case run == nil || run.finished() && time.Since(run.at) >= c.MinInterval:
+		run = &coalescedRun{done: make(chan struct{}), status: http.StatusOK, header: http.Header{}}
+		c.last = run
+		result = "fresh"
+		c.mu.Unlock()
+		go c.run(run, r.WithContext(detachedContext{r.Context()}))
+	case !run.finished():
+		result = "shared"
+		c.mu.Unlock()
+	default:
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-run.done:
+	case <-r.Context().Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Gave up waiting for the probe: %v", r.Context().Err())
+		return
+	}
+
+	for k, v := range run.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Probe-Result", result)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(run.at)/time.Second)))
+	w.WriteHeader(run.status)
+	w.Write(run.body.Bytes())
+}
+
+func (c *Coalescer) run(run *coalescedRun, r *http.Request) {
+	defer func() {
+		c.mu.Lock()
+		run.at = time.Now()
+		c.finished = run
+		c.mu.Unlock()
+		close(run.done)
+	}()
+	c.Handler.ServeHTTP((*runRecorder)(run), r)
+}
+
+// detachedContext keeps the values of the request that started a run, such
+// as its trace, but not its deadline or cancellation, so one caller timing
+// out or going away does not fail the run for the others sharing it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Last returns the status of the most recent finished run and when it
+// finished. ok is false until a run has finished.
+func (c *Coalescer) Last() (status int, at time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished == nil {
+		return 0, time.Time{}, false
+	}
+	return c.finished.status, c.finished.at, true
+}
+
+// Refresh runs Handler as a request would, such as to have a result ready
+// before the first request arrives
+func (c *Coalescer) Refresh() {
+	r, _ := http.NewRequest("GET", "/", nil)
+	c.ServeHTTP((*runRecorder)(&coalescedRun{header: http.Header{}}), r)
+}
+
+// runRecorder captures a handler's response into a coalescedRun
+type runRecorder coalescedRun
+
+func (rec *runRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *runRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *runRecorder) Write(p []byte) (int, error) {
+	return rec.body.Write(p)
+}
+
+// MinIntervalFromEnv reads PROBE_MIN_INTERVAL, such as 30s, defaulting to no
+// caching beyond sharing in-flight runs
+func MinIntervalFromEnv() (time.Duration, error) {
+	value := os.Getenv("PROBE_MIN_INTERVAL")
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("PROBE_MIN_INTERVAL: %v", err)
+	}
+	return d, nil
+}
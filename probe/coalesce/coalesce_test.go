@@ -0,0 +1,125 @@
+package coalesce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowHandler counts its runs and holds each open until release is closed
+type slowHandler struct {
+	runs    int32
+	release chan struct{}
+}
+
+func (h *slowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&h.runs, 1)
+	if h.release != nil {
+		<-h.release
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusFailedDependency)
+	fmt.Fprintf(w, "run %d", n)
+}
+
+func get(h http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://x/", nil))
+	return w
+}
+
+func TestCoalesceShares(t *testing.T) {
+	inner := &slowHandler{release: make(chan struct{})}
+	c := New(inner, 0)
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- get(c) }()
+	for atomic.LoadInt32(&inner.runs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	shared := make([]*httptest.ResponseRecorder, 5)
+	for i := range shared {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shared[i] = get(c)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+
+	w := <-first
+	assert.Equal(t, "fresh", w.Header().Get("X-Probe-Result"))
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	for _, w := range shared {
+		assert.Equal(t, 424, w.Code)
+		assert.Equal(t, "run 1", w.Body.String())
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, "shared", w.Header().Get("X-Probe-Result"))
+	}
+	assert.Equal(t, int32(1), inner.runs)
+
+	w = get(c)
+	assert.Equal(t, "run 2", w.Body.String())
+	assert.Equal(t, "fresh", w.Header().Get("X-Probe-Result"))
+}
+
+func TestCoalesceCallerGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	var runErr error
+	c := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		runErr = r.Context().Err()
+		fmt.Fprint(w, "OK")
+	}), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest("GET", "http://x/", nil).WithContext(ctx))
+		first <- w
+	}()
+	time.Sleep(10 * time.Millisecond)
+	shared := make(chan *httptest.ResponseRecorder)
+	go func() { shared <- get(c) }()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	w := <-first
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Gave up waiting for the probe: context canceled", w.Body.String())
+
+	close(release)
+	w = <-shared
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+	assert.Equal(t, "shared", w.Header().Get("X-Probe-Result"))
+	assert.NoError(t, runErr, "the run should not see the first caller's cancellation")
+}
+
+func TestCoalesceMinInterval(t *testing.T) {
+	inner := &slowHandler{}
+	c := New(inner, 50*time.Millisecond)
+
+	assert.Equal(t, "fresh", get(c).Header().Get("X-Probe-Result"))
+	w := get(c)
+	assert.Equal(t, "cached", w.Header().Get("X-Probe-Result"))
+	assert.Equal(t, "run 1", w.Body.String())
+	assert.Equal(t, 424, w.Code)
+
+	time.Sleep(60 * time.Millisecond)
+	w = get(c)
+	assert.Equal(t, "fresh", w.Header().Get("X-Probe-Result"))
+	assert.Equal(t, "run 2", w.Body.String())
+}
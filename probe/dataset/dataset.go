@@ -0,0 +1,102 @@
+// Package dataset generates the datasets cfprobe writes before a plan update
+// and checks what the probe apps read back afterwards.
+package dataset
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxCount bounds the count a dataset request may ask for, as every item is
+// generated in memory
+const MaxCount = 10000
+
+var id = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidID is true for ids of 1 to 64 letters, digits, dashes and
+// underscores, which every backend can use in a name
+func ValidID(s string) bool {
+	return id.MatchString(s)
+}
+
+// Item is one item read back from a backend. A backend may hold the same key
+// more than once, as a queue can, so reads return a list rather than a map.
+type Item struct {
+	Key   string
+	Value string
+}
+
+// Generate makes count items identified by id. The same id and count always
+// give the same items.
+func Generate(id string, count int) map[string]string {
+	items := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		items[strconv.Itoa(i)] = fmt.Sprintf("%s-%d", id, i)
+	}
+	return items
+}
+
+// Items lists items sorted by key, as a backend that cannot hold a key twice
+// reads them back
+func Items(items map[string]string) []Item {
+	list := make([]Item, 0, len(items))
+	for key, value := range items {
+		list = append(list, Item{Key: key, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// Compare counts each item in got and reports items of want that are
+// missing, changed or there more than once, and items want does not have
+func Compare(want map[string]string, got []Item) error {
+	counts := map[string]int{}
+	changed, unexpected := map[string]bool{}, map[string]bool{}
+	for _, item := range got {
+		counts[item.Key]++
+		value, ok := want[item.Key]
+		switch {
+		case !ok:
+			unexpected[item.Key] = true
+		case item.Value != value:
+			changed[item.Key] = true
+		}
+	}
+	var missing, duplicated []string
+	for key := range want {
+		switch n := counts[key]; {
+		case n == 0:
+			missing = append(missing, key)
+		case n > 1:
+			duplicated = append(duplicated, fmt.Sprintf("%s x%d", key, n))
+		}
+	}
+
+	var problems []string
+	report := func(list []string, format string, args ...interface{}) {
+		if len(list) > 0 {
+			sort.Strings(list)
+			problems = append(problems, fmt.Sprintf(format, append(args, list)...))
+		}
+	}
+	report(missing, "%d of %d items missing %v", len(missing), len(want))
+	report(keys(changed), "%d of %d items changed %v", len(changed), len(want))
+	report(duplicated, "%d of %d items duplicated %v", len(duplicated), len(want))
+	report(keys(unexpected), "%d unexpected items %v", len(unexpected))
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func keys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	return list
+}
@@ -0,0 +1,32 @@
+package dataset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	assert.Equal(t, map[string]string{"0": "a-0", "1": "a-1"}, Generate("a", 2))
+	assert.Equal(t, Generate("a", 3), Generate("a", 3))
+}
+
+func TestValidID(t *testing.T) {
+	assert.True(t, ValidID("upgrade_1-a"))
+	for _, id := range []string{"", "bad:id", "a/b", string(make([]byte, 65))} {
+		assert.False(t, ValidID(id), "%q", id)
+	}
+}
+
+func TestItems(t *testing.T) {
+	assert.Equal(t, []Item{{"0", "a-0"}, {"1", "a-1"}}, Items(Generate("a", 2)))
+}
+
+func TestCompare(t *testing.T) {
+	want := Generate("a", 4)
+	assert.NoError(t, Compare(want, Items(want)))
+
+	got := []Item{{"1", "a-1"}, {"1", "a-1"}, {"3", "changed"}, {"3", "a-3"}, {"9", "a-9"}}
+	assert.EqualError(t, Compare(want, got),
+		"2 of 4 items missing [0 2]; 1 of 4 items changed [3]; 2 of 4 items duplicated [1 x2 3 x2]; 1 unexpected items [9]")
+}
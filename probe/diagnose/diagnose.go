@@ -0,0 +1,277 @@
+// Package diagnose breaks a probe failure down by layer, from DNS through to
+// the credentials, so the layer at fault can be reported.
+package diagnose
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/logging"
+)
+
+// Diagnosis layers, in the order Diagnose checks them
+const (
+	LayerCredentials = "credentials"
+	LayerDNS         = "dns"
+	LayerTCP         = "tcp"
+	LayerTLS         = "tls"
+	LayerAuth        = "auth"
+	LayerOperation   = "operation"
+)
+
+// LayerTimeout bounds each network layer. Tests shorten it.
+var LayerTimeout = 10 * time.Second
+
+// lookupHost and dialTCP are how Diagnose reaches the network
+var (
+	lookupHost = func(host string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), LayerTimeout)
+		defer cancel()
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	dialTCP = func(addr string) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, LayerTimeout)
+	}
+)
+
+// LayerError is a failure Diagnose put down to one layer. Category is one
+// of config, dns, timeout, network, certificate, tls, auth, operation or
+// backend.
+type LayerError struct {
+	Layer    string
+	Category string
+	Err      error
+}
+
+func (e *LayerError) Error() string {
+	return e.Layer + ": " + e.Err.Error()
+}
+
+// ErrorCategory makes logging.ErrorClass keep the category Diagnose gave
+func (e *LayerError) ErrorCategory() string {
+	return e.Category
+}
+
+// LayerResult is the outcome of checking one layer
+type LayerResult struct {
+	Layer    string
+	Detail   string
+	Skipped  bool
+	Err      *LayerError
+	Duration time.Duration
+}
+
+func (r LayerResult) String() string {
+	switch {
+	case r.Skipped:
+		return fmt.Sprintf("SKIP %s: %s", r.Layer, r.Detail)
+	case r.Err != nil:
+		return fmt.Sprintf("FAIL %s [%s]: %s", r.Layer, r.Err.Category, logging.Redact(r.Err.Err.Error()))
+	}
+	return fmt.Sprintf("PASS %s: %s (%v)", r.Layer, r.Detail, r.Duration-r.Duration%time.Millisecond)
+}
+
+// Diagnosis holds the layers checked, up to and including the first that
+// failed
+type Diagnosis struct {
+	Layers []LayerResult
+}
+
+// Err returns the first failing layer's error, or nil
+func (d *Diagnosis) Err() error {
+	for _, l := range d.Layers {
+		if l.Err != nil {
+			return l.Err
+		}
+	}
+	return nil
+}
+
+// Category returns the first failing layer's category, or ""
+func (d *Diagnosis) Category() string {
+	if err, ok := d.Err().(*LayerError); ok {
+		return err.Category
+	}
+	return ""
+}
+
+func (d *Diagnosis) String() string {
+	lines := make([]string, len(d.Layers))
+	for i, l := range d.Layers {
+		lines[i] = l.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Target says how Diagnose reaches a backing service. TLS is nil when the
+// service is used without TLS, and StartTLS, when set, asks the server to
+// switch the connection to TLS before the handshake. Via is the address the
+// TCP layer connects to when it is not Host and Port. Auth connects with the
+// service's credentials, and AuthFailed says whether its error is the server
+// refusing them, in place of logging.ErrorClass.
+type Target struct {
+	Host       string
+	Port       string
+	Via        string
+	TLS        *tls.Config
+	StartTLS   func(conn net.Conn) error
+	Auth       func() error
+	AuthFailed func(err error) bool
+}
+
+// Diagnose breaks a probe failure down by layer. It resolves the host, opens
+// a TCP connection, does the TLS handshake when the target uses TLS and
+// authenticates, stopping at the first layer that fails. When they all pass
+// opErr, the error the probe itself hit, is put down to the operation. Each
+// layer runs as a step of run.
+func (t Target) Diagnose(run *logging.Run, opErr error) *Diagnosis {
+	d := &Diagnosis{}
+	check := func(layer string, fn func() (string, error), category func(error) string) bool {
+		result := LayerResult{Layer: layer}
+		start := time.Now()
+		err := run.Step(layer, func() (err error) {
+			if result.Detail, err = fn(); err != nil {
+				err = &LayerError{Layer: layer, Category: category(err), Err: err}
+			}
+			return
+		})
+		result.Duration = time.Since(start)
+		if err != nil {
+			result.Err = err.(*LayerError)
+		}
+		d.Layers = append(d.Layers, result)
+		return err == nil
+	}
+
+	addr := net.JoinHostPort(t.Host, t.Port)
+	if !check(LayerDNS, func() (string, error) {
+		ips, err := lookupHost(t.Host)
+		return fmt.Sprintf("%s resolves to %s", t.Host, strings.Join(ips, ", ")), err
+	}, func(error) string { return "dns" }) {
+		return d
+	}
+
+	var conn net.Conn
+	if !check(LayerTCP, func() (detail string, err error) {
+		dialAddr := addr
+		if t.Via != "" {
+			dialAddr = t.Via
+		}
+		if conn, err = dialTCP(dialAddr); err != nil {
+			return
+		}
+		return "connected to " + conn.RemoteAddr().String(), nil
+	}, networkCategory) {
+		return d
+	}
+	defer conn.Close()
+
+	if t.TLS == nil {
+		d.Layers = append(d.Layers, LayerResult{Layer: LayerTLS, Detail: "not configured", Skipped: true})
+	} else if !check(LayerTLS, func() (string, error) {
+		conn.SetDeadline(time.Now().Add(LayerTimeout))
+		if t.StartTLS != nil {
+			if err := t.StartTLS(conn); err != nil {
+				return "", err
+			}
+		}
+		config := t.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName = t.Host
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			return "", err
+		}
+		return "certificate for " + tc.ConnectionState().PeerCertificates[0].Subject.CommonName + " accepted", nil
+	}, tlsCategory) {
+		return d
+	}
+
+	if !check(LayerAuth, func() (string, error) {
+		return "credentials accepted", t.Auth()
+	}, t.authCategory) {
+		return d
+	}
+
+	if opErr != nil {
+		d.Layers = append(d.Layers, LayerResult{Layer: LayerOperation, Err: &LayerError{Layer: LayerOperation, Category: logging.ErrorClass(opErr), Err: opErr}})
+	}
+	return d
+}
+
+// CredentialsFailure is the diagnosis when the credentials cannot be read
+func CredentialsFailure(err error) *Diagnosis {
+	return &Diagnosis{Layers: []LayerResult{{Layer: LayerCredentials, Err: &LayerError{Layer: LayerCredentials, Category: "config", Err: err}}}}
+}
+
+func networkCategory(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	return "network"
+}
+
+func tlsCategory(err error) string {
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+		return "certificate"
+	}
+	if strings.Contains(err.Error(), "x509: ") {
+		return "certificate"
+	}
+	switch class := logging.ErrorClass(err); class {
+	case "timeout", "network":
+		return class
+	}
+	return "tls"
+}
+
+// authCategory keeps timeouts and dropped connections apart from refused
+// credentials. Only an error the server gave for the credentials is an auth
+// failure; anything else at this layer is put down to the operation.
+func (t Target) authCategory(err error) string {
+	switch class := logging.ErrorClass(err); {
+	case class == "timeout" || class == "network":
+		return class
+	case t.refused(err):
+		return "auth"
+	}
+	return "operation"
+}
+
+// refused says whether err from Auth is the server refusing the credentials
+func (t Target) refused(err error) bool {
+	if t.AuthFailed != nil {
+		return t.AuthFailed(err)
+	}
+	return logging.ErrorClass(err) == "auth"
+}
+
+// ExitRefused is the exit code of a login the server refused, kept apart
+// from 1 for any other failure so that revoked credentials can be told from
+// an outage
+const ExitRefused = 3
+
+// Login logs in with the target's credentials and nothing else, prints the
+// outcome and returns the exit code: 0 when the credentials are accepted,
+// ExitRefused when the server refuses them and 1 for any other failure
+func (t Target) Login(out io.Writer) int {
+	err := t.Auth()
+	switch {
+	case err == nil:
+		fmt.Fprintln(out, "Credentials accepted")
+		return 0
+	case t.refused(err):
+		fmt.Fprintf(out, "Credentials refused: %s\n", logging.Redact(err.Error()))
+		return ExitRefused
+	}
+	fmt.Fprintf(out, "Failed to log in: %s\n", logging.Redact(err.Error()))
+	return 1
+}
@@ -0,0 +1,155 @@
+package diagnose
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func layerNames(d *Diagnosis) []string {
+	names := make([]string, len(d.Layers))
+	for i, l := range d.Layers {
+		names[i] = l.Layer
+	}
+	return names
+}
+
+func authOK() error { return nil }
+
+func TestDiagnoseDNS(t *testing.T) {
+	defer FakeNetwork(errors.New("lookup nowhere: no such host"), nil)()
+	d := Target{Host: "nowhere", Port: "5432", Auth: authOK}.Diagnose(nil, errors.New("dial tcp: lookup nowhere: no such host"))
+	assert.Equal(t, []string{"dns"}, layerNames(d))
+	assert.Equal(t, "dns", d.Category())
+	assert.Equal(t, "FAIL dns [dns]: lookup nowhere: no such host", d.String())
+}
+
+func TestDiagnoseTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	d := Target{Host: host, Port: port, Auth: authOK}.Diagnose(nil, errors.New("connection refused"))
+	assert.Equal(t, []string{"dns", "tcp"}, layerNames(d))
+	assert.Equal(t, "network", d.Category())
+	assert.Contains(t, d.Layers[0].String(), "PASS dns: 127.0.0.1 resolves to 127.0.0.1")
+}
+
+func TestDiagnoseTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	d := Target{Host: host, Port: port, TLS: &tls.Config{}, Auth: authOK}.Diagnose(nil, errors.New("x509: certificate signed by unknown authority"))
+	assert.Equal(t, []string{"dns", "tcp", "tls"}, layerNames(d))
+	assert.Equal(t, "certificate", d.Category())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	auth := errors.New(`pq: password authentication failed for user "u" password=s3cret`)
+	d = Target{Host: host, Port: port, TLS: &tls.Config{RootCAs: roots}, Auth: func() error { return auth }}.Diagnose(nil, auth)
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Contains(t, d.Layers[2].String(), "PASS tls: certificate for")
+	assert.Equal(t, "auth", d.Category())
+	assert.Equal(t, `FAIL auth [auth]: pq: password authentication failed for user "u" password=REDACTED`, d.Layers[3].String())
+}
+
+func TestDiagnoseOperation(t *testing.T) {
+	defer FakeNetwork(nil, nil)()
+	d := Target{Host: "db", Port: "5432", Auth: authOK}.Diagnose(nil, errors.New("No rows found"))
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth", "operation"}, layerNames(d))
+	assert.True(t, d.Layers[2].Skipped)
+	assert.Equal(t, "SKIP tls: not configured", d.Layers[2].String())
+	assert.Equal(t, "backend", d.Category())
+	assert.Equal(t, "backend", logging.ErrorClass(d.Err()))
+
+	d = Target{Host: "db", Port: "5432", Auth: func() error { return errors.New("dial tcp 10.0.0.1:5432: i/o timeout") }}.Diagnose(nil, nil)
+	assert.Equal(t, "timeout", d.Category())
+}
+
+func TestDiagnoseAuthCategory(t *testing.T) {
+	defer FakeNetwork(nil, nil)()
+	failing := func(msg string) func() error {
+		return func() error { return errors.New(msg) }
+	}
+
+	d := Target{Host: "db", Port: "5432", Auth: failing("pq: SSL is not enabled on the server")}.Diagnose(nil, nil)
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Equal(t, "operation", d.Category())
+
+	d = Target{Host: "db", Port: "5432", Auth: failing("NOAUTH Authentication required.")}.Diagnose(nil, nil)
+	assert.Equal(t, "auth", d.Category())
+
+	refused := func(err error) bool { return err.Error() == "28P01" }
+	d = Target{Host: "db", Port: "5432", Auth: failing("28P01"), AuthFailed: refused}.Diagnose(nil, nil)
+	assert.Equal(t, "auth", d.Category())
+	d = Target{Host: "db", Port: "5432", Auth: failing("pq: password=s3cret is not a database"), AuthFailed: refused}.Diagnose(nil, nil)
+	assert.Equal(t, "operation", d.Category())
+}
+
+func TestDiagnoseStartTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	started := false
+	startTLS := func(conn net.Conn) error {
+		started = true
+		return nil
+	}
+	d := Target{Host: host, Port: port, TLS: &tls.Config{InsecureSkipVerify: true}, StartTLS: startTLS, Auth: authOK}.Diagnose(nil, nil)
+	assert.True(t, started)
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.NoError(t, d.Err())
+
+	refuse := func(net.Conn) error { return errors.New("SSL is not enabled on the server") }
+	d = Target{Host: host, Port: port, TLS: &tls.Config{}, StartTLS: refuse, Auth: authOK}.Diagnose(nil, nil)
+	assert.Equal(t, []string{"dns", "tcp", "tls"}, layerNames(d))
+	assert.Equal(t, "tls", d.Category())
+	assert.Equal(t, "FAIL tls [tls]: SSL is not enabled on the server", d.Layers[2].String())
+}
+
+func TestDiagnoseVia(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	d := Target{Host: "localhost", Port: "1", Via: l.Addr().String(), Auth: authOK}.Diagnose(nil, errors.New("No rows found"))
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth", "operation"}, layerNames(d))
+	assert.Contains(t, d.Layers[1].String(), "PASS tcp: connected to "+l.Addr().String())
+}
+
+func TestCredentialsFailure(t *testing.T) {
+	d := CredentialsFailure(errors.New("no service bound with label \"rds\""))
+	assert.Equal(t, []string{"credentials"}, layerNames(d))
+	assert.Equal(t, "config", d.Category())
+	assert.Equal(t, `FAIL credentials [config]: no service bound with label "rds"`, d.String())
+}
+
+func TestLogin(t *testing.T) {
+	refused := func(err error) bool { return err.Error() == "28P01 password=s3cret" }
+	var out bytes.Buffer
+	assert.Equal(t, 0, Target{Auth: authOK, AuthFailed: refused}.Login(&out))
+	assert.Equal(t, "Credentials accepted\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, ExitRefused, Target{Auth: func() error { return errors.New("28P01 password=s3cret") }, AuthFailed: refused}.Login(&out))
+	assert.Equal(t, "Credentials refused: 28P01 password=REDACTED\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 1, Target{Auth: func() error { return errors.New("pq: SSL is not enabled on the server") }, AuthFailed: refused}.Login(&out))
+	assert.Equal(t, "Failed to log in: pq: SSL is not enabled on the server\n", out.String())
+}
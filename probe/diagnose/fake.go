@@ -0,0 +1,27 @@
+package diagnose
+
+import (
+	"net"
+)
+
+// FakeNetwork makes Diagnose resolve every host to 10.0.0.1 and connect over
+// a pipe, failing with lookupErr or dialErr when they are set, for testing the
+// apps' diagnoses. It returns a function that restores the real network.
+func FakeNetwork(lookupErr, dialErr error) func() {
+	realLookup, realDial := lookupHost, dialTCP
+	lookupHost = func(string) ([]string, error) {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	dialTCP = func(string) (net.Conn, error) {
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	return func() { lookupHost, dialTCP = realLookup, realDial }
+}
@@ -0,0 +1,142 @@
+// Package discovery finds the services bound to a probe app in
+// VCAP_SERVICES.
+package discovery
+
+import (
+	"fmt"
+	"os"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+)
+
+// Service is a service bound to the app
+type Service struct {
+	Name        string
+	Label       string
+	Plan        string
+	Tags        []string
+	Credentials map[string]interface{}
+}
+
+// CredentialString returns the credential called key when it is a string
+func (s *Service) CredentialString(key string) (string, bool) {
+	value, ok := s.Credentials[key].(string)
+	return value, ok
+}
+
+// Getenv returns the environment variable key, or def when it is unset or
+// empty, as for the overrides of the label and tag Find looks for
+func Getenv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Find locates the bound service to test. An explicit name always wins;
+// without one the binding is looked up by label and then by tag, and more
+// than one match is treated as an error rather than guessed at.
+func Find(name, label, tag string) (*Service, error) {
+	app, err := cfenv.Current()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := find(app.Services, name, label, tag)
+	if err != nil {
+		return nil, err
+	}
+	return newService(svc), nil
+}
+
+// Named returns the bound service called name
+func Named(name string) (*Service, error) {
+	app, err := cfenv.Current()
+	if err != nil {
+		return nil, err
+	}
+	svc, err := app.Services.WithName(name)
+	if err != nil {
+		return nil, err
+	}
+	return newService(svc), nil
+}
+
+// Attributes describes the bound service for traces by its instance name
+// and plan. It is empty when the service cannot be found.
+func Attributes(name, label, tag string) map[string]string {
+	attrs := map[string]string{}
+	svc, err := Find(name, label, tag)
+	if err != nil {
+		return attrs
+	}
+	attrs["cf.service.instance"] = svc.Name
+	attrs["cf.service.plan"] = svc.Plan
+	return attrs
+}
+
+func newService(svc *cfenv.Service) *Service {
+	return &Service{
+		Name:        svc.Name,
+		Label:       svc.Label,
+		Plan:        svc.Plan,
+		Tags:        svc.Tags,
+		Credentials: svc.Credentials,
+	}
+}
+
+func find(services cfenv.Services, name, label, tag string) (*cfenv.Service, error) {
+	if name != "" {
+		return services.WithName(name)
+	}
+
+	if label != "" {
+		if svcs, err := services.WithLabel(label); err == nil && len(svcs) > 0 {
+			return onlyService(svcs, "label", label)
+		}
+	}
+
+	if tag != "" {
+		if svcs, err := services.WithTag(tag); err == nil {
+			return onlyService(svcs, "tag", tag)
+		}
+	}
+
+	return nil, fmt.Errorf("no service name configured and no service bound with label %q or tag %q", label, tag)
+}
+
+func onlyService(svcs []cfenv.Service, kind, value string) (*cfenv.Service, error) {
+	if len(svcs) > 1 {
+		names := make([]string, len(svcs))
+		for i, svc := range svcs {
+			names[i] = svc.Name
+		}
+		return nil, fmt.Errorf("%d services bound with %s %q %v, set a service name to choose one", len(svcs), kind, value, names)
+	}
+	return &svcs[0], nil
+}
+
+// BackendAddressEnv names a host:port the probe connects to in place of a
+// bound service's, such as a fault proxy running alongside it
+const BackendAddressEnv = "PROBE_BACKEND_ADDRESS"
+
+// BackendServiceEnv names the bound service BackendAddressEnv stands in for.
+// Without it the address stands in for the probe's own service only, so the
+// other service an isolation check reaches is never redirected.
+const BackendServiceEnv = "PROBE_BACKEND_SERVICE"
+
+// BackendAddress returns the address set in BackendAddressEnv when the
+// service called name is the one it stands in for, and addr otherwise. own
+// says whether the service is the probe's own.
+func BackendAddress(name string, own bool, addr string) string {
+	proxy := os.Getenv(BackendAddressEnv)
+	if proxy == "" {
+		return addr
+	}
+	if service := os.Getenv(BackendServiceEnv); service != "" {
+		own = name == service
+	}
+	if !own {
+		return addr
+	}
+	return proxy
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"os"
+	"testing"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindService(t *testing.T) {
+	services := cfenv.Services{
+		"rds": []cfenv.Service{
+			{Name: "psql-a", Label: "rds", Tags: []string{"postgres"}},
+			{Name: "psql-b", Label: "rds", Tags: []string{"postgres"}},
+		},
+		"user-provided": []cfenv.Service{
+			{Name: "ups", Label: "user-provided", Tags: []string{"legacy-db"}},
+		},
+	}
+
+	svc, err := find(services, "psql-b", "rds", "postgres")
+	require.NoError(t, err)
+	assert.Equal(t, "psql-b", svc.Name)
+
+	svc, err = find(services, "", "missing", "legacy-db")
+	require.NoError(t, err)
+	assert.Equal(t, "ups", svc.Name)
+
+	_, err = find(services, "", "rds", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 services bound with label \"rds\"")
+
+	_, err = find(services, "", "missing", "")
+	require.Error(t, err)
+}
+
+func TestFind(t *testing.T) {
+	os.Setenv("VCAP_SERVICES", `{"rds": [{"name": "test-psql", "label": "rds", "plan": "shared-psql", "credentials": {"host": "test_host", "port": 5432}}]}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+	defer os.Unsetenv("VCAP_SERVICES")
+	defer os.Unsetenv("VCAP_APPLICATION")
+
+	svc, err := Find("", "rds", "")
+	require.NoError(t, err)
+	assert.Equal(t, "test-psql", svc.Name)
+	host, ok := svc.CredentialString("host")
+	assert.True(t, ok)
+	assert.Equal(t, "test_host", host)
+	_, ok = svc.CredentialString("port")
+	assert.False(t, ok)
+
+	svc, err = Named("test-psql")
+	require.NoError(t, err)
+	assert.Equal(t, "shared-psql", svc.Plan)
+	_, err = Named("missing")
+	assert.Error(t, err)
+
+	assert.Equal(t, map[string]string{"cf.service.instance": "test-psql", "cf.service.plan": "shared-psql"}, Attributes("", "rds", ""))
+	assert.Empty(t, Attributes("missing", "", ""))
+}
+
+func TestBackendAddress(t *testing.T) {
+	assert.Equal(t, "db:5432", BackendAddress("tenant-a", true, "db:5432"))
+
+	os.Setenv(BackendAddressEnv, "127.0.0.1:7000")
+	defer os.Unsetenv(BackendAddressEnv)
+	assert.Equal(t, "127.0.0.1:7000", BackendAddress("tenant-a", true, "db:5432"))
+	assert.Equal(t, "db:5432", BackendAddress("tenant-b", false, "db:5432"))
+
+	os.Setenv(BackendServiceEnv, "tenant-b")
+	defer os.Unsetenv(BackendServiceEnv)
+	assert.Equal(t, "db:5432", BackendAddress("tenant-a", true, "db:5432"))
+	assert.Equal(t, "127.0.0.1:7000", BackendAddress("tenant-b", false, "db:5432"))
+}
+
+func TestGetenv(t *testing.T) {
+	defer os.Unsetenv("PROBE_TEST_LABEL")
+	os.Unsetenv("PROBE_TEST_LABEL")
+	assert.Equal(t, "rds", Getenv("PROBE_TEST_LABEL", "rds"))
+	os.Setenv("PROBE_TEST_LABEL", "aws-rds")
+	assert.Equal(t, "aws-rds", Getenv("PROBE_TEST_LABEL", "rds"))
+}
@@ -0,0 +1,464 @@
+// Package faultproxy forwards TCP connections to a backend while causing
+// network faults on demand.
+package faultproxy
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fault is the trouble a Proxy causes. Latency delays every chunk it
+// forwards and Bandwidth caps each direction in bytes per second. Reset
+// drops connections with a TCP reset. HalfOpen abandons them: the backend
+// side is closed but the client's is left open and never answered, as if the
+// far end had vanished. Blackhole stops forwarding in both directions until
+// it is lifted, as if packets were being dropped. Reset and HalfOpen apply to
+// connections made while they are set as well as those already open.
+type Fault struct {
+	Latency   time.Duration
+	Bandwidth int
+	Reset     bool
+	HalfOpen  bool
+	Blackhole bool
+}
+
+type faultJSON struct {
+	Latency   string `json:"latency,omitempty"`
+	Bandwidth int    `json:"bandwidth,omitempty"`
+	Reset     bool   `json:"reset,omitempty"`
+	HalfOpen  bool   `json:"half_open,omitempty"`
+	Blackhole bool   `json:"blackhole,omitempty"`
+}
+
+// MarshalJSON writes the latency as a duration string such as "200ms"
+func (f Fault) MarshalJSON() ([]byte, error) {
+	j := faultJSON{Bandwidth: f.Bandwidth, Reset: f.Reset, HalfOpen: f.HalfOpen, Blackhole: f.Blackhole}
+	if f.Latency > 0 {
+		j.Latency = f.Latency.String()
+	}
+	return json.Marshal(j)
+}
+
+func (f *Fault) UnmarshalJSON(b []byte) (err error) {
+	var j faultJSON
+	if err = json.Unmarshal(b, &j); err != nil {
+		return
+	}
+	*f = Fault{Bandwidth: j.Bandwidth, Reset: j.Reset, HalfOpen: j.HalfOpen, Blackhole: j.Blackhole}
+	if j.Latency != "" {
+		f.Latency, err = time.ParseDuration(j.Latency)
+	}
+	return
+}
+
+// ScheduledFault sets Fault At into a schedule and clears it For later.
+// With no For it lasts until the next step.
+type ScheduledFault struct {
+	At    time.Duration
+	For   time.Duration
+	Fault Fault
+}
+
+type scheduledFaultJSON struct {
+	At    string `json:"at"`
+	For   string `json:"for,omitempty"`
+	Fault Fault  `json:"fault"`
+}
+
+func (s ScheduledFault) MarshalJSON() ([]byte, error) {
+	j := scheduledFaultJSON{At: s.At.String(), Fault: s.Fault}
+	if s.For > 0 {
+		j.For = s.For.String()
+	}
+	return json.Marshal(j)
+}
+
+func (s *ScheduledFault) UnmarshalJSON(b []byte) (err error) {
+	var j scheduledFaultJSON
+	if err = json.Unmarshal(b, &j); err != nil {
+		return
+	}
+	*s = ScheduledFault{Fault: j.Fault}
+	if s.At, err = time.ParseDuration(j.At); err != nil {
+		return
+	}
+	if j.For != "" {
+		s.For, err = time.ParseDuration(j.For)
+	}
+	return
+}
+
+// Stats counts the connections a Proxy has accepted and those still open,
+// abandoned ones included
+type Stats struct {
+	Active int `json:"active"`
+	Total  int `json:"total"`
+}
+
+// Proxy forwards TCP connections to Target, causing the Fault that is set.
+// It sits between a probe and its backend to check the probe reports trouble
+// rather than hanging.
+type Proxy struct {
+	Target string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	fault    Fault
+	changed  chan struct{}
+	schedule chan struct{}
+	conns    map[*proxyConn]bool
+	total    int
+}
+
+// proxyConn is one client connection and its backend connection, which is
+// nil until dialled
+type proxyConn struct {
+	client  net.Conn
+	backend net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// New listens on addr and forwards each connection to target
+func New(addr, target string) (*Proxy, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		Target:   target,
+		listener: l,
+		changed:  make(chan struct{}),
+		conns:    map[*proxyConn]bool{},
+	}
+	p.wg.Add(1)
+	go p.accept()
+	return p, nil
+}
+
+// Addr is the address the proxy listens on
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Fault returns the fault currently set
+func (p *Proxy) Fault() Fault {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fault
+}
+
+// Set replaces the fault, stopping any schedule. The zero Fault clears it.
+func (p *Proxy) Set(f Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopSchedule()
+	p.set(f)
+}
+
+// Schedule sets each step's fault in turn, counting from now, and replaces
+// any schedule still running
+func (p *Proxy) Schedule(steps []ScheduledFault) {
+	type change struct {
+		at    time.Duration
+		fault Fault
+	}
+	var changes []change
+	for _, s := range steps {
+		changes = append(changes, change{s.At, s.Fault})
+		if s.For > 0 {
+			changes = append(changes, change{s.At + s.For, Fault{}})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].at < changes[j].at })
+
+	p.mu.Lock()
+	p.stopSchedule()
+	stop := make(chan struct{})
+	p.schedule = stop
+	p.mu.Unlock()
+
+	start := time.Now()
+	go func() {
+		for _, c := range changes {
+			select {
+			case <-time.After(c.at - time.Since(start)):
+			case <-stop:
+				return
+			}
+			p.mu.Lock()
+			select {
+			case <-stop:
+			default:
+				p.set(c.fault)
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Stats counts the proxy's connections
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{Active: len(p.conns), Total: p.total}
+}
+
+// Close stops listening and closes every connection, abandoned ones included
+func (p *Proxy) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	p.stopSchedule()
+	for c := range p.conns {
+		c.close(false)
+		c.client.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+// set changes the fault with p.mu held, waking blackholed connections and
+// resetting or abandoning open ones
+func (p *Proxy) set(f Fault) {
+	p.fault = f
+	close(p.changed)
+	p.changed = make(chan struct{})
+	if f.Reset || f.HalfOpen {
+		for c := range p.conns {
+			p.drop(c, f)
+		}
+	}
+}
+
+func (p *Proxy) stopSchedule() {
+	if p.schedule != nil {
+		close(p.schedule)
+		p.schedule = nil
+	}
+}
+
+// drop resets a connection, or abandons it leaving the client's side open
+func (p *Proxy) drop(c *proxyConn, f Fault) {
+	if f.Reset {
+		if tc, ok := c.client.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		c.close(true)
+		delete(p.conns, c)
+		return
+	}
+	c.close(false)
+}
+
+func (p *Proxy) accept() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &proxyConn{client: client, done: make(chan struct{})}
+		p.mu.Lock()
+		p.total++
+		p.conns[c] = true
+		if p.fault.Reset || p.fault.HalfOpen {
+			p.drop(c, p.fault)
+		}
+		p.mu.Unlock()
+		p.wg.Add(1)
+		go p.serve(c)
+	}
+}
+
+func (p *Proxy) serve(c *proxyConn) {
+	defer p.wg.Done()
+	if !p.wait(c) {
+		p.discard(c)
+		return
+	}
+	backend, err := net.DialTimeout("tcp", p.Target, 10*time.Second)
+	p.mu.Lock()
+	if c.abandoned() {
+		p.mu.Unlock()
+		if backend != nil {
+			backend.Close()
+		}
+		p.discard(c)
+		return
+	}
+	if err != nil {
+		c.close(true)
+		delete(p.conns, c)
+		p.mu.Unlock()
+		return
+	}
+	c.backend = backend
+	p.mu.Unlock()
+
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go p.pipe(c, backend, c.client, &pipes)
+	go p.pipe(c, c.client, backend, &pipes)
+	pipes.Wait()
+}
+
+// pipe copies src to dst through the fault until either side fails or the
+// connection is done. The client's side is then drained until it closes.
+func (p *Proxy) pipe(c *proxyConn, dst, src net.Conn, pipes *sync.WaitGroup) {
+	defer pipes.Done()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !p.forward(c, dst, buf[:n]) {
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	if src == c.client {
+		p.discard(c)
+		return
+	}
+	p.mu.Lock()
+	if !c.abandoned() {
+		c.close(true)
+		delete(p.conns, c)
+	}
+	p.mu.Unlock()
+}
+
+// discard reads and drops whatever the client sends until its side closes,
+// so an abandoned connection is counted until the client gives up on it
+func (p *Proxy) discard(c *proxyConn) {
+	io.Copy(ioutil.Discard, c.client)
+	p.mu.Lock()
+	c.close(true)
+	delete(p.conns, c)
+	p.mu.Unlock()
+}
+
+// forward writes b to dst once any blackhole lifts, after the latency and at
+// no more than the bandwidth. It returns false once the connection is done.
+func (p *Proxy) forward(c *proxyConn, dst net.Conn, b []byte) bool {
+	for len(b) > 0 {
+		if !p.wait(c) {
+			return false
+		}
+		f := p.Fault()
+		chunk := b
+		if f.Bandwidth > 0 && len(chunk) > f.Bandwidth {
+			chunk = chunk[:f.Bandwidth]
+		}
+		delay := f.Latency
+		if f.Bandwidth > 0 {
+			delay += time.Duration(len(chunk)) * time.Second / time.Duration(f.Bandwidth)
+		}
+		time.Sleep(delay)
+		if _, err := dst.Write(chunk); err != nil {
+			return false
+		}
+		b = b[len(chunk):]
+	}
+	return true
+}
+
+// wait blocks while the proxy is blackholed, returning false once the
+// connection is done
+func (p *Proxy) wait(c *proxyConn) bool {
+	for {
+		p.mu.Lock()
+		blackhole, changed := p.fault.Blackhole, p.changed
+		p.mu.Unlock()
+		if c.abandoned() {
+			return false
+		}
+		if !blackhole {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+// abandoned reports whether forwarding has ended with the client's side
+// left open
+func (c *proxyConn) abandoned() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends forwarding on the connection and closes the backend side, and
+// the client side too unless it is to be left open
+func (c *proxyConn) close(client bool) {
+	c.once.Do(func() {
+		close(c.done)
+		if c.backend != nil {
+			c.backend.Close()
+		}
+	})
+	if client {
+		c.client.Close()
+	}
+}
+
+// Handler serves the fault proxy's control API. GET /fault shows
+// the fault, PUT /fault sets it from a JSON body and DELETE /fault clears
+// it. PUT /schedule starts a schedule from a JSON list of steps, and GET
+// /stats counts connections.
+func Handler(p *Proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fault", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "PUT":
+			var f Fault
+			if err := json.NewDecoder(req.Body).Decode(&f); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.Set(f)
+		case "DELETE":
+			p.Set(Fault{})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Fault())
+	})
+	mux.HandleFunc("/schedule", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var steps []ScheduledFault
+		if err := json.NewDecoder(req.Body).Decode(&steps); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Schedule(steps)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Stats())
+	})
+	return mux
+}
@@ -0,0 +1,256 @@
+package faultproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoProxy starts a backend that echoes what it reads and a Proxy
+// in front of it
+func newEchoProxy(t *testing.T) (*Proxy, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	p, err := New("127.0.0.1:0", l.Addr().String())
+	require.NoError(t, err)
+	return p, func() {
+		p.Close()
+		l.Close()
+	}
+}
+
+func dialProxy(t *testing.T, p *Proxy) net.Conn {
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	return conn
+}
+
+// echo writes msg and reads it back, giving up after timeout
+func echo(conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(msg))
+	n, err := io.ReadFull(conn, buf)
+	return string(buf[:n]), err
+}
+
+// waitForStats polls until the proxy's stats match want or a second passes
+func waitForStats(p *Proxy, want Stats) Stats {
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := p.Stats()
+		if got == want || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProxyForwards(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+
+	conn := dialProxy(t, p)
+	got, err := echo(conn, "hello", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+	assert.Equal(t, Stats{Active: 1, Total: 1}, p.Stats())
+
+	conn.Close()
+	assert.Equal(t, Stats{Active: 0, Total: 1}, waitForStats(p, Stats{Total: 1}))
+}
+
+func TestProxyLatency(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+	p.Set(Fault{Latency: 30 * time.Millisecond})
+
+	conn := dialProxy(t, p)
+	defer conn.Close()
+	start := time.Now()
+	got, err := echo(conn, "hello", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+	assert.True(t, time.Since(start) >= 60*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+	p.Set(Fault{Bandwidth: 1000})
+
+	conn := dialProxy(t, p)
+	defer conn.Close()
+	start := time.Now()
+	msg := strings.Repeat("x", 50)
+	got, err := echo(conn, msg, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestProxyReset(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+
+	open := dialProxy(t, p)
+	defer open.Close()
+	_, err := echo(open, "hello", time.Second)
+	require.NoError(t, err)
+
+	p.Set(Fault{Reset: true})
+	_, err = echo(open, "hello", time.Second)
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "open connection timed out rather than being reset: %v", err)
+
+	conn := dialProxy(t, p)
+	defer conn.Close()
+	_, err = echo(conn, "hello", time.Second)
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "new connection timed out rather than being reset: %v", err)
+	assert.Equal(t, Stats{Active: 0, Total: 2}, waitForStats(p, Stats{Total: 2}))
+}
+
+func TestProxyHalfOpen(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+
+	open := dialProxy(t, p)
+	defer open.Close()
+	_, err := echo(open, "hello", time.Second)
+	require.NoError(t, err)
+
+	p.Set(Fault{HalfOpen: true})
+	_, err = echo(open, "hello", 50*time.Millisecond)
+	assert.True(t, isTimeout(err), "expected a timeout, got %v", err)
+
+	conn := dialProxy(t, p)
+	_, err = echo(conn, "hello", 50*time.Millisecond)
+	assert.True(t, isTimeout(err), "expected a timeout, got %v", err)
+	assert.Equal(t, Stats{Active: 2, Total: 2}, p.Stats())
+
+	conn.Close()
+	assert.Equal(t, Stats{Active: 1, Total: 2}, waitForStats(p, Stats{Active: 1, Total: 2}))
+}
+
+func TestProxyBlackhole(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+	p.Set(Fault{Blackhole: true})
+
+	conn := dialProxy(t, p)
+	defer conn.Close()
+	_, err := echo(conn, "hello", 50*time.Millisecond)
+	assert.True(t, isTimeout(err), "expected a timeout, got %v", err)
+
+	p.Set(Fault{})
+	conn.SetDeadline(time.Now().Add(time.Second))
+	got, err := bufio.NewReader(conn).ReadString('o')
+	require.NoError(t, err)
+	assert.Equal(t, "hello", got)
+}
+
+func TestProxySchedule(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+
+	p.Schedule([]ScheduledFault{
+		{At: 0, For: 60 * time.Millisecond, Fault: Fault{Blackhole: true}},
+		{At: 100 * time.Millisecond, Fault: Fault{Latency: time.Millisecond}},
+	})
+	conn := dialProxy(t, p)
+	defer conn.Close()
+	_, err := echo(conn, "hello", 30*time.Millisecond)
+	assert.True(t, isTimeout(err), "expected a timeout, got %v", err)
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, Fault{Latency: time.Millisecond}, p.Fault())
+
+	p.Schedule([]ScheduledFault{{At: 50 * time.Millisecond, Fault: Fault{Reset: true}}})
+	p.Set(Fault{})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, Fault{}, p.Fault(), "Set should stop the schedule")
+}
+
+func TestFaultJSON(t *testing.T) {
+	var steps []ScheduledFault
+	require.NoError(t, json.Unmarshal([]byte(`[{"at":"1m","for":"30s","fault":{"latency":"200ms","bandwidth":1024,"half_open":true}}]`), &steps))
+	assert.Equal(t, []ScheduledFault{{At: time.Minute, For: 30 * time.Second, Fault: Fault{Latency: 200 * time.Millisecond, Bandwidth: 1024, HalfOpen: true}}}, steps)
+
+	data, err := json.Marshal(steps)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"at":"1m0s","for":"30s","fault":{"latency":"200ms","bandwidth":1024,"half_open":true}}]`, string(data))
+
+	var f Fault
+	assert.Error(t, json.Unmarshal([]byte(`{"latency":"soon"}`), &f))
+}
+
+func TestHandler(t *testing.T) {
+	p, stop := newEchoProxy(t)
+	defer stop()
+	server := httptest.NewServer(Handler(p))
+	defer server.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	code, body := do("PUT", "/fault", `{"blackhole":true}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"blackhole":true}`, body)
+	assert.Equal(t, Fault{Blackhole: true}, p.Fault())
+
+	code, _ = do("PUT", "/fault", `{"latency":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body = do("DELETE", "/fault", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{}`, body)
+
+	code, _ = do("PUT", "/schedule", `[{"at":"0s","fault":{"reset":true}}]`)
+	assert.Equal(t, http.StatusAccepted, code)
+	time.Sleep(20 * time.Millisecond)
+	_, body = do("GET", "/fault", "")
+	assert.Equal(t, `{"reset":true}`, body)
+
+	code, _ = do("POST", "/fault", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	_, body = do("GET", "/stats", "")
+	assert.Equal(t, `{"active":0,"total":0}`, body)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,40 @@
+// Package health serves the health and readiness checks the platform polls.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+)
+
+// Healthz reports the app is up without touching the backing service
+func Healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// Readyz reports ready once config, which checks the service
+// credentials can be read, passes and probe has a result. It never runs the
+// probe itself, so a backing service outage does not make the app unready.
+func Readyz(config func() error, probe *coalesce.Coalescer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := config(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Not ready: %v", err)
+			return
+		}
+		status, at, ok := probe.Last()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "Not ready: no probe has finished yet")
+			return
+		}
+		age := time.Since(at)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ready: last probe returned %d %v ago", status, age-age%time.Second)
+	}
+}
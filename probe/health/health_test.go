@@ -0,0 +1,49 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	Healthz()(w, httptest.NewRequest("GET", "http://x/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	runs := 0
+	probe := coalesce.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.WriteHeader(http.StatusFailedDependency)
+	}), 0)
+	configErr := errors.New("no service name configured")
+	readyz := Readyz(func() error { return configErr }, probe)
+	check := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", "http://x/readyz", nil))
+		return w
+	}
+
+	w := check()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Not ready: no service name configured", w.Body.String())
+
+	configErr = nil
+	w = check()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Not ready: no probe has finished yet", w.Body.String())
+	assert.Equal(t, 0, runs, "readiness must not run the probe")
+
+	probe.Refresh()
+	w = check()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Ready: last probe returned 424 0s ago", w.Body.String())
+	assert.Equal(t, 1, runs)
+}
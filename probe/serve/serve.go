@@ -0,0 +1,101 @@
+// Package serve runs a probe app's HTTP server and shuts it down cleanly.
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Serve runs srv on l until a signal arrives. It then stops accepting
+// connections, gives in-flight requests up to grace to finish and closes
+// the backends, in that order. The error is from serving or, when requests
+// outlast the grace period, from the shutdown.
+func Serve(srv *http.Server, l net.Listener, signals <-chan os.Signal, grace time.Duration, backends ...io.Closer) error {
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("requests still running after %v: %v", grace, err)
+	}
+	for _, b := range backends {
+		if closeErr := b.Close(); closeErr != nil {
+			log.Printf("closing backend: %v", closeErr)
+		}
+	}
+	return err
+}
+
+// GraceFromEnv reads PROBE_SHUTDOWN_GRACE, defaulting to 8s so backends are
+// closed before Cloud Foundry's 10 second kill
+func GraceFromEnv() (time.Duration, error) {
+	value := os.Getenv("PROBE_SHUTDOWN_GRACE")
+	if value == "" {
+		return 8 * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("PROBE_SHUTDOWN_GRACE: %v", err)
+	}
+	return d, nil
+}
+
+// CloserSet tracks backend clients that requests have open, so shutdown can
+// close any a request did not get to
+type CloserSet struct {
+	mu   sync.Mutex
+	open map[io.Closer]bool
+}
+
+// Add tracks c until Remove
+func (s *CloserSet) Add(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open == nil {
+		s.open = map[io.Closer]bool{}
+	}
+	s.open[c] = true
+}
+
+// Remove stops tracking c, which its owner has closed or is about to
+func (s *CloserSet) Remove(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.open, c)
+}
+
+// Close closes every client still open and returns the first error
+func (s *CloserSet) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.open {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+		delete(s.open, c)
+	}
+	return
+}
+
+// Len is the number of clients still open
+func (s *CloserSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.open)
+}
@@ -0,0 +1,140 @@
+package serve
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shutdownLog records the order things happen in during a shutdown
+type shutdownLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *shutdownLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *shutdownLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+type loggedBackend struct {
+	log  *shutdownLog
+	name string
+}
+
+func (b loggedBackend) Close() error {
+	b.log.add(b.name + " closed")
+	return nil
+}
+
+// startServe serves a handler that blocks until release is closed
+func startServe(t *testing.T, grace time.Duration, events *shutdownLog, release chan struct{}) (string, chan os.Signal, chan struct{}, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{}, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("probed"))
+		events.add("request finished")
+	})}
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- Serve(srv, l, signals, grace, loggedBackend{events, "backend"}) }()
+	return "http://" + l.Addr().String(), signals, started, done
+}
+
+func noKeepAlive() *http.Client {
+	return &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+}
+
+func TestServeShutdownOrder(t *testing.T) {
+	events := &shutdownLog{}
+	release := make(chan struct{})
+	url, signals, started, done := startServe(t, time.Second, events, release)
+
+	inFlight := make(chan string, 1)
+	go func() {
+		resp, err := noKeepAlive().Get(url)
+		if err != nil {
+			inFlight <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		inFlight <- string(body)
+	}()
+	<-started
+
+	signals <- syscall.SIGTERM
+	time.Sleep(20 * time.Millisecond)
+	_, err := noKeepAlive().Get(url)
+	assert.Error(t, err, "new requests should be refused once shutdown starts")
+	assert.Empty(t, events.get())
+
+	close(release)
+	assert.Equal(t, "probed", <-inFlight)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"request finished", "backend closed"}, events.get())
+}
+
+func TestServeGraceExpires(t *testing.T) {
+	events := &shutdownLog{}
+	release := make(chan struct{})
+	defer close(release)
+	url, signals, started, done := startServe(t, 20*time.Millisecond, events, release)
+
+	go noKeepAlive().Get(url)
+	<-started
+	signals <- syscall.SIGTERM
+
+	assert.Error(t, <-done)
+	assert.Equal(t, []string{"backend closed"}, events.get())
+}
+
+func TestCloserSet(t *testing.T) {
+	events := &shutdownLog{}
+	var set CloserSet
+	a, b := loggedBackend{events, "a"}, loggedBackend{events, "b"}
+	set.Add(a)
+	set.Add(b)
+	set.Remove(a)
+	assert.Equal(t, 1, set.Len())
+	require.NoError(t, set.Close())
+	assert.Equal(t, 0, set.Len())
+	assert.Equal(t, []string{"b closed"}, events.get())
+	require.NoError(t, set.Close())
+	assert.Len(t, events.get(), 1)
+}
+
+func TestGraceFromEnv(t *testing.T) {
+	defer os.Unsetenv("PROBE_SHUTDOWN_GRACE")
+	os.Unsetenv("PROBE_SHUTDOWN_GRACE")
+	grace, err := GraceFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 8*time.Second, grace)
+
+	os.Setenv("PROBE_SHUTDOWN_GRACE", "2s")
+	grace, err = GraceFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, grace)
+
+	os.Setenv("PROBE_SHUTDOWN_GRACE", "soon")
+	_, err = GraceFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,335 @@
+// Package testplan reads the test plans that set how a probe's checks run.
+package testplan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SeverityHeader carries the severity of the check that answered, so
+// monitors can page on critical checks and only warn on the others
+const SeverityHeader = "X-Probe-Severity"
+
+// Severities a check can have
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// Check is how one of a probe's checks runs. Payload holds the values it
+// writes and reads back, and Rules any a plan's values must keep to. A check
+// taking longer than Timeout is abandoned and one answering OK but slower
+// than Threshold fails; zero leaves either off. A Schedule runs the check in
+// the background that often.
+type Check struct {
+	Path      string
+	Enabled   bool
+	Payload   map[string]string
+	Rules     map[string]PayloadRule
+	Timeout   time.Duration
+	Threshold time.Duration
+	Schedule  time.Duration
+	Severity  string
+}
+
+// PayloadRule is a pattern a payload value must match, such as a table name
+// that is put into SQL, and a description of it for errors
+type PayloadRule struct {
+	Pattern  *regexp.Regexp
+	Expected string
+}
+
+// Plan holds a probe's checks by name
+type Plan map[string]Check
+
+// planServices are the sections a test plan may have, one per probe
+var planServices = map[string]bool{"elasticache": true, "rds": true, "rmq": true}
+
+// checkPlan is a check as written in a test plan file
+type checkPlan struct {
+	Enabled   *bool             `yaml:"enabled"`
+	Payload   map[string]string `yaml:"payload"`
+	Timeout   string            `yaml:"timeout"`
+	Threshold string            `yaml:"threshold"`
+	Schedule  string            `yaml:"schedule"`
+	Severity  string            `yaml:"severity"`
+}
+
+// Parse reads a YAML or JSON test plan and applies the section for
+// service to defaults, which name the checks the probe has. Every section
+// is checked for unknown keys and bad values, but only the probe's own
+// check names are known, so the others' are left to their probes.
+func Parse(data []byte, service string, defaults Plan) (Plan, error) {
+	var file map[string]map[string]checkPlan
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("test plan: %v", err)
+	}
+	plan := Plan{}
+	for name, c := range defaults {
+		plan[name] = c
+	}
+	for _, section := range sectionNames(file) {
+		if !planServices[section] {
+			return nil, fmt.Errorf("test plan: unknown service %q, expected elasticache, rds or rmq", section)
+		}
+		for _, name := range checkNames(file[section]) {
+			c, ok := defaults[name]
+			if section == service && !ok {
+				return nil, fmt.Errorf("test plan: %s: unknown check %q, expected one of %s", section, name, strings.Join(defaults.Names(), ", "))
+			}
+			c, err := file[section][name].apply(c, section == service)
+			if err == nil && section == service && name == "probe" && !c.Enabled {
+				err = fmt.Errorf("enabled: the probe check cannot be disabled, readiness depends on it")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("test plan: %s.%s.%v", section, name, err)
+			}
+			if section == service {
+				plan[name] = c
+			}
+		}
+	}
+	return plan, nil
+}
+
+// apply overrides c with the values set in p. Payload keys are only checked
+// against c's when known is set.
+func (p checkPlan) apply(c Check, known bool) (Check, error) {
+	if p.Enabled != nil {
+		c.Enabled = *p.Enabled
+	}
+	if len(p.Payload) > 0 {
+		payload := map[string]string{}
+		for k, v := range c.Payload {
+			payload[k] = v
+		}
+		for _, k := range payloadKeys(p.Payload) {
+			if _, ok := c.Payload[k]; known && !ok {
+				if len(c.Payload) == 0 {
+					return c, fmt.Errorf("payload: the check takes no payload")
+				}
+				return c, fmt.Errorf("payload: unknown key %q, expected one of %s", k, strings.Join(payloadKeys(c.Payload), ", "))
+			}
+			if p.Payload[k] == "" {
+				return c, fmt.Errorf("payload.%s: must not be empty", k)
+			}
+			if rule, ok := c.Rules[k]; known && ok && !rule.Pattern.MatchString(p.Payload[k]) {
+				return c, fmt.Errorf("payload.%s: %q is not %s", k, p.Payload[k], rule.Expected)
+			}
+			payload[k] = p.Payload[k]
+		}
+		c.Payload = payload
+	}
+	for _, d := range []struct {
+		key   string
+		value string
+		to    *time.Duration
+	}{
+		{"timeout", p.Timeout, &c.Timeout},
+		{"threshold", p.Threshold, &c.Threshold},
+		{"schedule", p.Schedule, &c.Schedule},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return c, fmt.Errorf("%s: %v", d.key, err)
+		}
+		if v <= 0 {
+			return c, fmt.Errorf("%s: must be positive, got %s", d.key, d.value)
+		}
+		*d.to = v
+	}
+	if c.Timeout > 0 && c.Threshold >= c.Timeout {
+		return c, fmt.Errorf("threshold: %v must be less than the %v timeout", c.Threshold, c.Timeout)
+	}
+	switch p.Severity {
+	case "":
+	case SeverityCritical, SeverityWarning:
+		c.Severity = p.Severity
+	default:
+		return c, fmt.Errorf("severity: %q is not %s or %s", p.Severity, SeverityCritical, SeverityWarning)
+	}
+	return c, nil
+}
+
+// Load reads the test plan file named by PROBE_PLAN and applies it to
+// defaults for service. When PROBE_PLAN_SERVICE names a bound user-provided
+// service its credentials are used as the plan instead. With neither set
+// the defaults are returned as they are.
+func Load(service string, defaults Plan) (Plan, error) {
+	var data []byte
+	if name := os.Getenv("PROBE_PLAN_SERVICE"); name != "" {
+		svc, err := discovery.Named(name)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(svc.Credentials); err != nil {
+			return nil, err
+		}
+	} else if path := os.Getenv("PROBE_PLAN"); path != "" {
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		return defaults, nil
+	}
+	return Parse(data, service, defaults)
+}
+
+// Handle serves the named check on its path when it is enabled
+func (p Plan) Handle(mux *http.ServeMux, name string, h http.Handler) {
+	if c := p[name]; c.Enabled {
+		mux.Handle(c.Path, c.Wrap(h))
+	}
+}
+
+// Schedule requests the path of every enabled check with a schedule from h
+// that often, until stop is closed. h should be the logged handler, so
+// scheduled runs are logged and traced as requests are.
+func (p Plan) Schedule(h http.Handler, stop <-chan struct{}) {
+	for _, c := range p {
+		if c.Enabled && c.Schedule > 0 {
+			go c.every(h, stop)
+		}
+	}
+}
+
+func (c Check) every(h http.Handler, stop <-chan struct{}) {
+	ticker := time.NewTicker(c.Schedule)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		r, _ := http.NewRequest("GET", c.Path, nil)
+		h.ServeHTTP(newCheckRecorder(), r)
+	}
+}
+
+// Wrap sets SeverityHeader on h's responses and applies the check's timeout
+// and threshold. A check that times out answers 504 and one over its
+// threshold 424, both with a logging.ErrorCategoryHeader, and h is left to
+// finish in the background.
+func (c Check) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SeverityHeader, c.Severity)
+		var timeout <-chan time.Time
+		if c.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), c.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+			timeout = time.After(c.Timeout)
+		}
+
+		rec := newCheckRecorder()
+		done := make(chan struct{})
+		start := time.Now()
+		go func() {
+			defer close(done)
+			h.ServeHTTP(rec, r)
+		}()
+		select {
+		case <-done:
+		case <-timeout:
+			w.Header().Set(logging.ErrorCategoryHeader, "timeout")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintf(w, "Check timed out after %v\n", c.Timeout)
+			return
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		took := time.Since(start)
+		if rec.status == http.StatusOK && c.Threshold > 0 && took > c.Threshold {
+			w.Header().Set(logging.ErrorCategoryHeader, "slow")
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Check took %v, over its %v threshold\n", took-took%time.Millisecond, c.Threshold)
+			w.Write(rec.body.Bytes())
+			return
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// checkRecorder captures a check's response so Wrap can replace it
+type checkRecorder struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newCheckRecorder() *checkRecorder {
+	return &checkRecorder{status: http.StatusOK, header: http.Header{}}
+}
+
+func (rec *checkRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *checkRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *checkRecorder) Write(p []byte) (int, error) {
+	return rec.body.Write(p)
+}
+
+// Names returns the names of the plan's checks in order
+func (p Plan) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sectionNames, checkNames and payloadKeys return the keys of the maps a
+// plan is read into in order, so the first problem in a plan is always the
+// one reported
+func sectionNames(file map[string]map[string]checkPlan) []string {
+	names := make([]string, 0, len(file))
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkNames(section map[string]checkPlan) []string {
+	names := make([]string, 0, len(section))
+	for name := range section {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func payloadKeys(payload map[string]string) []string {
+	keys := make([]string, 0, len(payload))
+	for k := range payload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
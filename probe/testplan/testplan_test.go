@@ -0,0 +1,206 @@
+package testplan
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKeyRules = map[string]PayloadRule{"key": {regexp.MustCompile(`^[a-z]+$`), "lower case letters"}}
+
+var testChecks = Plan{
+	"probe": {Path: "/probe", Enabled: true, Severity: SeverityCritical, Payload: map[string]string{"key": "foo", "value": "bar"}, Rules: testKeyRules},
+	"ping":  {Path: "/ping", Enabled: true, Severity: SeverityCritical},
+}
+
+const testPlan = `
+rds:
+  probe:
+    payload:
+      value: baz
+    timeout: 20s
+    threshold: 2s
+    schedule: 1m
+  ping:
+    enabled: false
+    severity: warning
+rmq:
+  routing:
+    severity: warning
+`
+
+func TestParse(t *testing.T) {
+	plan, err := Parse([]byte(testPlan), "rds", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, Plan{
+		"probe": {Path: "/probe", Enabled: true, Severity: SeverityCritical, Payload: map[string]string{"key": "foo", "value": "baz"}, Rules: testKeyRules,
+			Timeout: 20 * time.Second, Threshold: 2 * time.Second, Schedule: time.Minute},
+		"ping": {Path: "/ping", Enabled: false, Severity: SeverityWarning},
+	}, plan)
+	assert.Equal(t, "bar", testChecks["probe"].Payload["value"], "defaults should be left alone")
+
+	plan, err = Parse([]byte(`{"elasticache": {"ping": {"timeout": "5s"}}}`), "elasticache", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, plan["ping"].Timeout)
+
+	plan, err = Parse([]byte(testPlan), "elasticache", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, testChecks, plan)
+	assert.Equal(t, []string{"ping", "probe"}, plan.Names())
+}
+
+func TestParseErrors(t *testing.T) {
+	for plan, want := range map[string]string{
+		"rds: [probe]":                                      "test plan: yaml: unmarshal errors:",
+		"redis: {}":                                         `test plan: unknown service "redis", expected elasticache, rds or rmq`,
+		"rds: {pign: {}}":                                   `test plan: rds: unknown check "pign", expected one of ping, probe`,
+		"rds: {probe: {timout: 1s}}":                        "field timout not found",
+		"rmq: {routing: {timout: 1s}}":                      "field timout not found",
+		"rds: {probe: {timeout: soon}}":                     "test plan: rds.probe.timeout: time: invalid duration",
+		"rds: {ping: {schedule: -1m}}":                      "test plan: rds.ping.schedule: must be positive, got -1m",
+		"rds: {probe: {timeout: 1s, threshold: 2s}}":        "test plan: rds.probe.threshold: 2s must be less than the 1s timeout",
+		"rds: {probe: {severity: page}}":                    `test plan: rds.probe.severity: "page" is not critical or warning`,
+		"rds: {probe: {payload: {tabel: t}}}":               `test plan: rds.probe.payload: unknown key "tabel", expected one of key, value`,
+		"rds: {probe: {payload: {key: ''}}}":                "test plan: rds.probe.payload.key: must not be empty",
+		"rds: {probe: {payload: {key: 'a;b'}}}":             `test plan: rds.probe.payload.key: "a;b" is not lower case letters`,
+		"rds: {ping: {payload: {key: k}}}":                  "test plan: rds.ping.payload: the check takes no payload",
+		"rds: {probe: {enabled: false}}":                    "test plan: rds.probe.enabled: the probe check cannot be disabled, readiness depends on it",
+		"rmq: {routing: {severity: page}}":                  `test plan: rmq.routing.severity: "page" is not critical or warning`,
+		"elasticache: {ping: {timeout: 1s, threshold: 1s}}": "test plan: elasticache.ping.threshold: 1s must be less than the 1s timeout",
+	} {
+		_, err := Parse([]byte(plan), "rds", testChecks)
+		if assert.Error(t, err, plan) {
+			assert.Contains(t, err.Error(), want, plan)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	plan, err := Load("rds", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, testChecks, plan)
+
+	f, err := ioutil.TempFile("", "plan")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(testPlan)
+	f.Close()
+	os.Setenv("PROBE_PLAN", f.Name())
+	defer os.Unsetenv("PROBE_PLAN")
+	plan, err = Load("rds", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, "baz", plan["probe"].Payload["value"])
+
+	os.Setenv("VCAP_APPLICATION", "{}")
+	os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "probe-plan", "label": "user-provided",
+		"credentials": {"rds": {"probe": {"threshold": "500ms"}}}}]}`)
+	os.Setenv("PROBE_PLAN_SERVICE", "probe-plan")
+	defer func() {
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("VCAP_SERVICES")
+		os.Unsetenv("PROBE_PLAN_SERVICE")
+	}()
+	plan, err = Load("rds", testChecks)
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, plan["probe"].Threshold)
+	assert.Equal(t, "bar", plan["probe"].Payload["value"], "the service should be used instead of the file")
+
+	os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "probe-plan", "label": "user-provided",
+		"credentials": {"rds": {"probe": {"retries": 3}}}}]}`)
+	_, err = Load("rds", testChecks)
+	assert.Contains(t, err.Error(), "field retries not found")
+}
+
+func TestCheckWrap(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("X-From", "check")
+		w.Write([]byte("OK"))
+	})
+
+	w := httptest.NewRecorder()
+	Check{Severity: SeverityWarning}.Wrap(slow).ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+	assert.Equal(t, SeverityWarning, w.Header().Get(SeverityHeader))
+	assert.Equal(t, "check", w.Header().Get("X-From"))
+
+	w = httptest.NewRecorder()
+	Check{Severity: SeverityCritical, Threshold: 10 * time.Millisecond}.Wrap(slow).ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, http.StatusFailedDependency, w.Code)
+	assert.Equal(t, "slow", w.Header().Get(logging.ErrorCategoryHeader))
+	assert.Contains(t, w.Body.String(), "over its 10ms threshold\nOK")
+
+	w = httptest.NewRecorder()
+	start := time.Now()
+	Check{Severity: SeverityCritical, Timeout: 10 * time.Millisecond}.Wrap(slow).ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "took %v", time.Since(start))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "timeout", w.Header().Get(logging.ErrorCategoryHeader))
+	assert.Equal(t, "Check timed out after 10ms\n", w.Body.String())
+	time.Sleep(60 * time.Millisecond)
+}
+
+func TestCheckWrapTimeoutTraced(t *testing.T) {
+	exporter := &tracing.InMemoryExporter{}
+	release, finished := make(chan struct{}), make(chan struct{})
+	check := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		run := logging.RunFrom(r.Context())
+		run.Step("quick", func() error { return nil })
+		run.Step("slow", func() error {
+			<-release
+			run.Attribute("late", "true")
+			return errors.New("abandoned")
+		})
+	})
+	handler := logging.LogRequests(&logging.Logger{Out: ioutil.Discard}, tracing.TraceRequests(&tracing.Tracer{Exporter: exporter},
+		Check{Timeout: 10 * time.Millisecond}.Wrap(check)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	close(release)
+	<-finished
+	var names []string
+	for _, s := range exporter.Spans() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"quick", "GET /ping"}, names)
+}
+
+func TestPlanSchedule(t *testing.T) {
+	var runs int32
+	mux := http.NewServeMux()
+	plan := Plan{
+		"probe": {Path: "/probe", Enabled: true, Schedule: 5 * time.Millisecond},
+		"ping":  {Path: "/ping", Enabled: false, Schedule: 5 * time.Millisecond},
+	}
+	plan.Handle(mux, "probe", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		atomic.AddInt32(&runs, 1)
+	}))
+	plan.Handle(mux, "ping", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("disabled check was run")
+	}))
+
+	stop := make(chan struct{})
+	plan.Schedule(mux, stop)
+	time.Sleep(30 * time.Millisecond)
+	close(stop)
+	assert.True(t, atomic.LoadInt32(&runs) >= 2, "ran %d times", atomic.LoadInt32(&runs))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,406 @@
+// Package tracing records a trace of each probe request and exports it to an
+// OpenTelemetry collector.
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/logging"
+)
+
+// TraceparentHeader carries W3C trace context into and out of the probe
+const TraceparentHeader = "traceparent"
+
+// Span is one timed request or probe step, in the shape OpenTelemetry uses.
+// IDs are lower-case hex and ParentID is empty for the root of a trace.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Server     bool
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// SpanExporter sends on the spans of one finished request
+type SpanExporter interface {
+	ExportSpans(spans []Span) error
+}
+
+// InMemoryExporter keeps every span it is given
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (e *InMemoryExporter) ExportSpans(spans []Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far
+func (e *InMemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Tracer records a trace for each request. Attributes, such as the service
+// instance and plan, are set on every span.
+type Tracer struct {
+	Exporter   SpanExporter
+	Attributes map[string]string
+}
+
+// FromEnv builds a Tracer exporting to the OTLP/HTTP endpoint in
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces added. Headers for the collector come from
+// OTEL_EXPORTER_OTLP_HEADERS as key=value pairs separated by commas. The
+// service.name is OTEL_SERVICE_NAME, defaulting to appName. Without an
+// endpoint tracing is off and the Tracer is nil.
+func FromEnv(appName string, attributes map[string]string) *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = appName
+	}
+	headers := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if i := strings.Index(pair, "="); i > 0 {
+			headers[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+	}
+	return &Tracer{
+		Exporter: &OTLPExporter{
+			Endpoint: endpoint,
+			Headers:  headers,
+			Resource: map[string]string{"service.name": serviceName},
+		},
+		Attributes: attributes,
+	}
+}
+
+// Close waits for the exporter to finish, if it can be closed. A nil Tracer
+// is fine to close, so one can always be passed to Serve.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	if c, ok := t.Exporter.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// runTrace collects the spans of one run. Steps run one after another, so
+// parent is the span a new step belongs to. A check abandoned at its timeout
+// can still be running steps when the request ends, so the trace is locked
+// and steps that end once it is finished are dropped.
+type runTrace struct {
+	root *Span
+
+	mu       sync.Mutex
+	parent   string
+	attrs    map[string]string
+	spans    []Span
+	finished bool
+}
+
+// Start begins a span for a step and returns the function that ends it
+func (t *runTrace) Start(name string) func(error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := Span{TraceID: t.root.TraceID, SpanID: logging.NewID(8), ParentID: t.parent, Name: name, Start: time.Now()}
+	parent := t.parent
+	t.parent = span.SpanID
+	return func(err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.finished {
+			return
+		}
+		t.parent = parent
+		span.End = time.Now()
+		span.Attributes = copyAttributes(t.attrs)
+		if err != nil {
+			span.Error = logging.Redact(err.Error())
+		}
+		t.spans = append(t.spans, span)
+	}
+}
+
+// finish ends the trace, returning its attributes and the spans of the
+// steps that ended in time
+func (t *runTrace) finish() (map[string]string, []Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+	return copyAttributes(t.attrs), t.spans
+}
+
+// Attribute records a detail of the run. It applies to the request span
+// and to steps that end afterwards.
+func (t *runTrace) Attribute(key, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attrs[key] = value
+}
+
+// TraceRequests records a trace for every request logging.LogRequests gave a run: a
+// server span for the request with a child for each step. A valid incoming
+// traceparent makes the request part of the caller's trace, and the response
+// carries the request span's traceparent. With a nil tracer it returns next.
+func TraceRequests(tracer *Tracer, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		run := logging.RunFrom(r.Context())
+		if run == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		root := &Span{SpanID: logging.NewID(8), Name: r.Method + " " + r.URL.Path, Server: true, Start: time.Now()}
+		if traceID, parentID, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			root.TraceID, root.ParentID = traceID, parentID
+		} else {
+			root.TraceID = logging.NewID(16)
+		}
+		trace := &runTrace{root: root, parent: root.SpanID, attrs: copyAttributes(tracer.Attributes)}
+		run.Trace = trace
+		w.Header().Set(TraceparentHeader, "00-"+root.TraceID+"-"+root.SpanID+"-01")
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		root.End = time.Now()
+		attrs, spans := trace.finish()
+		root.Attributes = attrs
+		root.Attributes["http.request.method"] = r.Method
+		root.Attributes["url.path"] = r.URL.Path
+		root.Attributes["http.response.status_code"] = strconv.Itoa(rec.status)
+		root.Attributes["probe.run_id"] = w.Header().Get(logging.RunIDHeader)
+		if result := w.Header().Get("X-Probe-Result"); result != "" {
+			root.Attributes["probe.result"] = result
+		}
+		if rec.status >= http.StatusBadRequest {
+			root.Error = http.StatusText(rec.status)
+		}
+		if err := tracer.Exporter.ExportSpans(append(spans, *root)); err != nil {
+			log.Printf("exporting trace %s: %s", root.TraceID, logging.Redact(err.Error()))
+		}
+	})
+}
+
+// statusRecorder remembers the status a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// parseTraceparent reads the trace and parent span IDs from a W3C
+// traceparent header such as 00-<32 hex>-<16 hex>-01
+func parseTraceparent(value string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	traceID, parentID = parts[1], parts[2]
+	if !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(parts[3], 2) ||
+		traceID == strings.Repeat("0", 32) || parentID == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return traceID, parentID, true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func copyAttributes(attrs map[string]string) map[string]string {
+	c := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector with OTLP over HTTP
+// in its JSON encoding. Exports run in the background so a slow collector
+// does not hold up the probe; failures are logged and Close waits for any
+// still in flight.
+type OTLPExporter struct {
+	Endpoint string
+	Headers  map[string]string
+	Resource map[string]string
+	Client   *http.Client
+
+	wg sync.WaitGroup
+}
+
+func (e *OTLPExporter) ExportSpans(spans []Span) error {
+	body, err := json.Marshal(otlpRequest(e.Resource, spans))
+	if err != nil {
+		return err
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		if err := e.post(body); err != nil {
+			log.Printf("exporting %d spans: %s", len(spans), logging.Redact(err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (e *OTLPExporter) post(body []byte) error {
+	req, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %d", e.Endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// Close waits for exports in flight
+func (e *OTLPExporter) Close() error {
+	e.wg.Wait()
+	return nil
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpRequest builds an ExportTraceServiceRequest holding spans
+func otlpRequest(resource map[string]string, spans []Span) interface{} {
+	converted := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		kind := otlpKindInternal
+		if s.Server {
+			kind = otlpKindServer
+		}
+		converted[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			converted[i].Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+	}
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{{Spans: converted}}}
+	rs.Resource.Attributes = otlpAttributes(resource)
+	rs.ScopeSpans[0].Scope.Name = "github.com/ONSdigital/cf-tests"
+	return map[string][]resourceSpans{"resourceSpans": {rs}}
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	converted := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		converted[i].Key = k
+		converted[i].Value.StringValue = attrs[k]
+	}
+	return converted
+}
@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceRequests(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	tracer := &Tracer{Exporter: exporter, Attributes: map[string]string{"cf.service.plan": "shared-psql"}}
+	handler := logging.LogRequests(&logging.Logger{Out: ioutil.Discard}, TraceRequests(tracer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		run := logging.RunFrom(r.Context())
+		run.Step("probe", func() error {
+			run.Attribute("server.address", "db")
+			return run.Step("connect", func() error { return errors.New("password=s3cret rejected") })
+		})
+		w.WriteHeader(http.StatusFailedDependency)
+	})))
+	r := httptest.NewRequest("GET", "http://x/probe", nil)
+	r.Header.Set(TraceparentHeader, incomingTraceparent)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 3)
+	connect, probe, root := spans[0], spans[1], spans[2]
+	assert.Equal(t, "connect", connect.Name)
+	assert.Equal(t, "probe", probe.Name)
+	assert.Equal(t, "GET /probe", root.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentID)
+	assert.True(t, root.Server)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+root.SpanID+"-01", w.Header().Get(TraceparentHeader))
+	assert.Equal(t, root.SpanID, probe.ParentID)
+	assert.Equal(t, probe.SpanID, connect.ParentID)
+	assert.Equal(t, "password=REDACTED rejected", connect.Error)
+	assert.Equal(t, "db", connect.Attributes["server.address"])
+	assert.Equal(t, "shared-psql", connect.Attributes["cf.service.plan"])
+	assert.Equal(t, "424", root.Attributes["http.response.status_code"])
+	assert.Equal(t, w.Header().Get(logging.RunIDHeader), root.Attributes["probe.run_id"])
+	assert.Equal(t, "Failed Dependency", root.Error)
+}
+
+func TestTraceRequestsUntraced(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	logging.LogRequests(&logging.Logger{Out: ioutil.Discard}, TraceRequests(nil, next)).ServeHTTP(w, httptest.NewRequest("GET", "http://x/probe", nil))
+	assert.Empty(t, w.Header().Get(TraceparentHeader))
+
+	// without a run from LogRequests there is nothing to trace
+	exporter := &InMemoryExporter{}
+	w = httptest.NewRecorder()
+	TraceRequests(&Tracer{Exporter: exporter}, next).ServeHTTP(w, httptest.NewRequest("GET", "http://x/probe", nil))
+	assert.Empty(t, w.Header().Get(TraceparentHeader))
+	assert.Empty(t, exporter.Spans())
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, ok := parseTraceparent(incomingTraceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", parentID)
+
+	_, _, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future")
+	assert.True(t, ok)
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, _, ok := parseTraceparent(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_SERVICE_NAME"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+	}
+	assert.Nil(t, FromEnv("cf-test-rds", nil))
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=abc, x-team = probes")
+	tracer := FromEnv("cf-test-rds", map[string]string{"cf.service.plan": "shared-psql"})
+	require.NotNil(t, tracer)
+	exporter := tracer.Exporter.(*OTLPExporter)
+	assert.Equal(t, "http://collector:4318/v1/traces", exporter.Endpoint)
+	assert.Equal(t, map[string]string{"x-api-key": "abc", "x-team": "probes"}, exporter.Headers)
+	assert.Equal(t, "cf-test-rds", exporter.Resource["service.name"])
+	assert.Equal(t, "shared-psql", tracer.Attributes["cf.service.plan"])
+
+	os.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://traces:4318/custom")
+	os.Setenv("OTEL_SERVICE_NAME", "rds-probe")
+	exporter = FromEnv("cf-test-rds", nil).Exporter.(*OTLPExporter)
+	assert.Equal(t, "http://traces:4318/custom", exporter.Endpoint)
+	assert.Equal(t, "rds-probe", exporter.Resource["service.name"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var apiKey string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		apiKey = r.Header.Get("x-api-key")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer collector.Close()
+
+	exporter := &OTLPExporter{
+		Endpoint: collector.URL + "/v1/traces",
+		Headers:  map[string]string{"x-api-key": "abc"},
+		Resource: map[string]string{"service.name": "cf-test-rds"},
+	}
+	start := time.Unix(1500000000, 0)
+	require.NoError(t, exporter.ExportSpans([]Span{
+		{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", ParentID: "a3ce929d0e0e4736", Name: "connect",
+			Start: start, End: start.Add(time.Second), Attributes: map[string]string{"server.address": "db"}, Error: "refused"},
+	}))
+	require.NoError(t, (&Tracer{Exporter: exporter}).Close())
+
+	assert.Equal(t, "abc", apiKey)
+	rs := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := rs["resource"].(map[string]interface{})["attributes"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "cf-test-rds"}}, resource[0])
+	span := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span["traceId"])
+	assert.Equal(t, "a3ce929d0e0e4736", span["parentSpanId"])
+	assert.Equal(t, "connect", span["name"])
+	assert.Equal(t, float64(otlpKindInternal), span["kind"])
+	assert.Equal(t, "1500000000000000000", span["startTimeUnixNano"])
+	assert.Equal(t, "1500000001000000000", span["endTimeUnixNano"])
+	assert.Equal(t, map[string]interface{}{"code": float64(otlpStatusError), "message": "refused"}, span["status"])
+
+	var nilTracer *Tracer
+	assert.NoError(t, nilTracer.Close())
+}
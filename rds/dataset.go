@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+)
+
+const datasetTable = "probe_dataset"
+
+// DatasetDAO stores uniquely identified datasets so that cfprobe can check
+// data survives a plan update
+type DatasetDAO interface {
+	Open(host, user, password, dbName string) (*sql.DB, error)
+	Ping(db *sql.DB) error
+	WriteDataset(db *sql.DB, id string, items map[string]string) error
+	ReadDataset(db *sql.DB, id string) ([]dataset.Item, error)
+	DeleteDataset(db *sql.DB, id string) error
+}
+
+// DatasetHandler writes (PUT), verifies (GET) or removes (DELETE) the dataset
+// named by the last path element. The size comes from the count parameter.
+func DatasetHandler(dao DatasetDAO, creds Credentialiser, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if !dataset.ValidID(id) || err != nil || count < 1 || count > dataset.MaxCount {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Expected /dataset/<id>?count=<n> with n from 1 to %d", dataset.MaxCount)
+			return
+		}
+
+		db, err := openDB(dao, creds, serviceName)
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to open database: %v", err)
+			return
+		}
+		defer closeDB(db)
+
+		switch r.Method {
+		case "PUT":
+			err = dao.WriteDataset(db, id, dataset.Generate(id, count))
+		case "GET":
+			var got []dataset.Item
+			if got, err = dao.ReadDataset(db, id); err == nil {
+				err = dataset.Compare(dataset.Generate(id, count), got)
+			}
+		case "DELETE":
+			err = dao.DeleteDataset(db, id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Dataset %s: %v", id, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Dataset %s is OK", id)
+	}
+}
+
+// PingHandler checks the database accepts connections without touching any data
+func PingHandler(dao DatasetDAO, creds Credentialiser, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := openDB(dao, creds, serviceName)
+		if err == nil {
+			err = dao.Ping(db)
+			closeDB(db)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to reach database: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "RDS service is reachable")
+	}
+}
+
+// openDB opens the bound database
+func openDB(dao DatasetDAO, creds Credentialiser, serviceName string) (*sql.DB, error) {
+	host, user, password, dbName, err := creds.GetCreds(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return dao.Open(host, user, password, dbName)
+}
+
+// closeDB closes a database opened by the DAO, which may be nil
+func closeDB(db *sql.DB) error {
+	if db == nil {
+		return nil
+	}
+	openDBs.Remove(db)
+	return db.Close()
+}
+
+// Ping checks the connection to the database
+func (PostgresDAO) Ping(db *sql.DB) error {
+	return db.Ping()
+}
+
+// WriteDataset stores the items under id, replacing any earlier copy
+func (PostgresDAO) WriteDataset(db *sql.DB, id string, items map[string]string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS " + datasetTable + "(id VARCHAR(64), key VARCHAR(64), value VARCHAR(128), PRIMARY KEY(id, key))"); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM "+datasetTable+" WHERE id = $1", id); err != nil {
+		return
+	}
+
+	for key, value := range items {
+		if _, err = tx.Exec("INSERT INTO "+datasetTable+"(id, key, value) VALUES($1, $2, $3)", id, key, value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadDataset returns the items stored under id
+func (PostgresDAO) ReadDataset(db *sql.DB, id string) ([]dataset.Item, error) {
+	rows, err := db.Query("SELECT key, value FROM "+datasetTable+" WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []dataset.Item
+	for rows.Next() {
+		var item dataset.Item
+		if err := rows.Scan(&item.Key, &item.Value); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// DeleteDataset removes the items stored under id
+func (PostgresDAO) DeleteDataset(db *sql.DB, id string) error {
+	_, err := db.Exec("DELETE FROM "+datasetTable+" WHERE id = $1", id)
+	return err
+}
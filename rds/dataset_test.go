@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+type FakeDatasetDAO struct {
+	FakeDAO
+	Datasets  map[string]map[string]string
+	PingError error
+}
+
+func (f *FakeDatasetDAO) Ping(_ *sql.DB) error {
+	return f.PingError
+}
+
+func (f *FakeDatasetDAO) WriteDataset(_ *sql.DB, id string, items map[string]string) error {
+	copied := map[string]string{}
+	for k, v := range items {
+		copied[k] = v
+	}
+	f.Datasets[id] = copied
+	return nil
+}
+
+func (f *FakeDatasetDAO) ReadDataset(_ *sql.DB, id string) ([]dataset.Item, error) {
+	return dataset.Items(f.Datasets[id]), nil
+}
+
+func (f *FakeDatasetDAO) DeleteDataset(_ *sql.DB, id string) error {
+	delete(f.Datasets, id)
+	return nil
+}
+
+func datasetRequest(dao *FakeDatasetDAO, creds Credentialiser, method, url string) (int, string) {
+	w := httptest.NewRecorder()
+	DatasetHandler(dao, creds, "test-psql")(w, httptest.NewRequest(method, url, nil))
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestDatasetHandler(t *testing.T) {
+	_, creds := setupFake()
+	defer teardownFake()
+	dao := &FakeDatasetDAO{Datasets: map[string]map[string]string{}}
+
+	status, body := datasetRequest(dao, creds, "PUT", "http://x/dataset/upgrade-1?count=5")
+	require.Equal(t, 200, status, body)
+	assert.Len(t, dao.Datasets["upgrade-1"], 5)
+	assert.Equal(t, "test_db", dao.DBName)
+
+	status, body = datasetRequest(dao, creds, "GET", "http://x/dataset/upgrade-1?count=5")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Dataset upgrade-1 is OK", body)
+
+	delete(dao.Datasets["upgrade-1"], "3")
+	dao.Datasets["upgrade-1"]["1"] = "changed"
+	status, body = datasetRequest(dao, creds, "GET", "http://x/dataset/upgrade-1?count=5")
+	assert.Equal(t, 424, status)
+	assert.Equal(t, "Dataset upgrade-1: 1 of 5 items missing [3]; 1 of 5 items changed [1]", body)
+
+	status, _ = datasetRequest(dao, creds, "DELETE", "http://x/dataset/upgrade-1?count=5")
+	assert.Equal(t, 200, status)
+	assert.Empty(t, dao.Datasets)
+}
+
+func TestDatasetHandlerBadRequest(t *testing.T) {
+	_, creds := setupFake()
+	defer teardownFake()
+	dao := &FakeDatasetDAO{Datasets: map[string]map[string]string{}}
+
+	for _, url := range []string{
+		"http://x/dataset/upgrade-1",
+		"http://x/dataset/upgrade-1?count=0",
+		"http://x/dataset/upgrade-1?count=10001",
+		"http://x/dataset/?count=5",
+		"http://x/dataset/bad;id?count=5",
+	} {
+		status, _ := datasetRequest(dao, creds, "PUT", url)
+		assert.Equal(t, 400, status, url)
+	}
+	assert.Empty(t, dao.Datasets)
+}
+
+func TestPingHandler(t *testing.T) {
+	_, creds := setupFake()
+	defer teardownFake()
+	dao := &FakeDatasetDAO{}
+
+	w := httptest.NewRecorder()
+	PingHandler(dao, creds, "test-psql")(w, httptest.NewRequest("GET", "http://x/ping", nil))
+	assert.Equal(t, 200, w.Code)
+
+	dao.PingError = errors.New("connection refused")
+	w = httptest.NewRecorder()
+	PingHandler(dao, creds, "test-psql")(w, httptest.NewRequest("GET", "http://x/ping", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Failed to reach database: connection refused", w.Body.String())
+}
+
+func TestDAOWriteDataset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS probe_dataset").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM probe_dataset").WithArgs("upgrade-1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO probe_dataset").WithArgs("upgrade-1", "0", "upgrade-1-0").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	dao := &PostgresDAO{}
+	require.NoError(t, dao.WriteDataset(db, "upgrade-1", dataset.Generate("upgrade-1", 1)))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDAOReadDataset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"key", "value"}).AddRow("0", "upgrade-1-0").AddRow("1", "upgrade-1-1")
+	mock.ExpectQuery("SELECT key, value FROM probe_dataset").WithArgs("upgrade-1").WillReturnRows(rows)
+
+	dao := &PostgresDAO{}
+	items, err := dao.ReadDataset(db, "upgrade-1")
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, dataset.Items(dataset.Generate("upgrade-1", 2)), items)
+}
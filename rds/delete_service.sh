@@ -1,5 +1,8 @@
 #!/usr/bin/env bash
 set -eu
+: ${RDS_APP_NAME:=cf-test-rds}
 : ${RDS_SERVICE_NAME:=test-psql}
-# FIXME: need to unbind the application first
+if cf app "$RDS_APP_NAME" >/dev/null 2>&1; then
+    cf unbind-service "$RDS_APP_NAME" "$RDS_SERVICE_NAME"
+fi
 cf delete-service "$RDS_SERVICE_NAME" -f
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/lib/pq"
+)
+
+// pinger is the part of DatasetDAO that checks a connection authenticates
+type pinger interface {
+	Ping(db *sql.DB) error
+}
+
+// diagnoseDatabase reads the credentials again and diagnoses opErr against the
+// database they name
+func diagnoseDatabase(run *logging.Run, dao DAO, creds Credentialiser, serviceName string, opErr error) *diagnose.Diagnosis {
+	t, err := databaseTarget(dao, creds, serviceName)
+	if err != nil {
+		return diagnose.CredentialsFailure(err)
+	}
+	return t.Diagnose(run, opErr)
+}
+
+// databaseTarget reads the credentials and says how to reach the database
+// they name. The TLS layer asks for TLS as Postgres clients do and checks the
+// certificate as the sslmode dao connects with would.
+func databaseTarget(dao DAO, creds Credentialiser, serviceName string) (diagnose.Target, error) {
+	host, user, password, dbName, err := creds.GetCreds(serviceName)
+	if err != nil {
+		return diagnose.Target{}, err
+	}
+	t := diagnose.Target{Host: host, Port: "5432", TLS: postgresTLS(dao), StartTLS: startPostgresTLS, Auth: func() error {
+		db, err := dao.Open(host, user, password, dbName)
+		if err != nil {
+			return err
+		}
+		defer closeDB(db)
+		if p, ok := dao.(pinger); ok {
+			return p.Ping(db)
+		}
+		return nil
+	}, AuthFailed: refusesLogin}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		t.Host, t.Port = h, port
+	}
+	return t, nil
+}
+
+// postgresTLS is the TLS config matching the sslmode dao connects with: none
+// for disable, the certificate chain checked for verify-ca, the host name too
+// for verify-full and nothing checked for require, as pq does. A DAO that is
+// not a PostgresDAO says nothing about TLS, so there is none to check.
+func postgresTLS(dao DAO) *tls.Config {
+	var pg PostgresDAO
+	switch d := dao.(type) {
+	case PostgresDAO:
+		pg = d
+	case *PostgresDAO:
+		pg = *d
+	default:
+		return nil
+	}
+	switch pg.SSLMode {
+	case "disable":
+		return nil
+	case "verify-full":
+		return &tls.Config{}
+	case "verify-ca":
+		return &tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verifyChain}
+	}
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// verifyChain checks the server's certificate chain without its host name
+func verifyChain(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("x509: server sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Intermediates: intermediates})
+	return err
+}
+
+// sslRequest is the Postgres SSLRequest message: its length, 8, and the
+// request code 80877103
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// startPostgresTLS sends an SSLRequest. The server answers S to go on with
+// the TLS handshake or N when it does not support TLS.
+func startPostgresTLS(conn net.Conn) error {
+	if _, err := conn.Write(sslRequest); err != nil {
+		return err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if answer[0] != 'S' {
+		return errors.New("SSL is not enabled on the server")
+	}
+	return nil
+}
+
+// refusesLogin is true when Postgres refused the login itself, with
+// invalid_password (28P01) or invalid_authorization_specification (28000)
+func refusesLogin(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == "28P01" || pqErr.Code == "28000")
+}
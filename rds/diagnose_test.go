@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func layerNames(d *diagnose.Diagnosis) []string {
+	names := make([]string, len(d.Layers))
+	for i, l := range d.Layers {
+		names[i] = l.Layer
+	}
+	return names
+}
+
+func TestWebHandlerDiagnosis(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	defer diagnose.FakeNetwork(nil, nil)()
+	dao.OpenError = &pq.Error{Code: "28P01", Message: `password authentication failed for user "test_user"`}
+
+	w := httptest.NewRecorder()
+	WebHandler(dao, creds, "test-psql", "test_data", "Fred")(w, httptest.NewRequest("GET", "http://x/", nil))
+	assert.Equal(t, http.StatusFailedDependency, w.Code)
+	assert.Equal(t, "auth", w.Header().Get(logging.ErrorCategoryHeader))
+	assert.Contains(t, w.Body.String(), "PASS tcp: connected to pipe")
+	assert.Contains(t, w.Body.String(), "FAIL auth [auth]: pq: password authentication failed")
+
+	teardownFake()
+	w = httptest.NewRecorder()
+	WebHandler(dao, creds, "test-psql", "test_data", "Fred")(w, httptest.NewRequest("GET", "http://x/", nil))
+	assert.Equal(t, "config", w.Header().Get(logging.ErrorCategoryHeader))
+	assert.Contains(t, w.Body.String(), "FAIL credentials [config]:")
+}
+
+// fakePostgres answers every connection's SSLRequest with answer and, after
+// the TLS handshake, its startup message with a FATAL error of code. It
+// returns the address it listens on.
+func fakePostgres(t *testing.T, answer byte, code string) (string, func()) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request := make([]byte, 8)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				conn.Write([]byte{answer})
+				if answer != 'S' {
+					return
+				}
+				tc := tls.Server(conn, &tls.Config{Certificates: server.TLS.Certificates})
+				length := make([]byte, 4)
+				if _, err := io.ReadFull(tc, length); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(tc, make([]byte, binary.BigEndian.Uint32(length)-4)); err != nil {
+					return
+				}
+				fields := "SFATAL\x00C" + code + "\x00Mlogin refused\x00\x00"
+				msg := []byte{'E', 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(msg[1:], uint32(4+len(fields)))
+				tc.Write(append(msg, fields...))
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		server.Close()
+	}
+}
+
+func TestDiagnoseDatabaseTLS(t *testing.T) {
+	addr, stop := fakePostgres(t, 'N', "")
+	defer stop()
+	creds := LocalCredentialiser{Host: addr, User: "u", Password: "p", DBName: "d"}
+	d := diagnoseDatabase(nil, PostgresDAO{}, creds, "", errors.New("pq: SSL is not enabled on the server"))
+	assert.Equal(t, []string{"dns", "tcp", "tls"}, layerNames(d))
+	assert.Equal(t, "tls", d.Category())
+	assert.Equal(t, "FAIL tls [tls]: SSL is not enabled on the server", d.Layers[2].String())
+
+	d = diagnoseDatabase(nil, PostgresDAO{SSLMode: "disable"}, creds, "", errors.New("No rows found"))
+	assert.True(t, d.Layers[2].Skipped)
+
+	d = diagnoseDatabase(nil, PostgresDAO{SSLMode: "verify-full"}, creds, "", errors.New("pq: SSL is not enabled on the server"))
+	assert.Equal(t, "tls", d.Category())
+}
+
+func TestDiagnoseDatabaseAuth(t *testing.T) {
+	addr, stop := fakePostgres(t, 'S', "28P01")
+	defer stop()
+	creds := LocalCredentialiser{Host: addr, User: "u", Password: "p", DBName: "d"}
+	d := diagnoseDatabase(nil, PostgresDAO{}, creds, "", errors.New("pq: login refused"))
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Contains(t, d.Layers[2].String(), "PASS tls: certificate for")
+	assert.Equal(t, "auth", d.Category())
+
+	addr, stop = fakePostgres(t, 'S', "3D000")
+	defer stop()
+	creds.Host = addr
+	d = diagnoseDatabase(nil, PostgresDAO{}, creds, "", errors.New("pq: login refused"))
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Equal(t, "operation", d.Category())
+
+	d = diagnoseDatabase(nil, PostgresDAO{SSLMode: "verify-ca"}, creds, "", errors.New("pq: login refused"))
+	assert.Equal(t, "certificate", d.Category())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// IsolationDAO can also list what a login is able to see on the server
+type IsolationDAO interface {
+	DatasetDAO
+	Databases(db *sql.DB) ([]string, error)
+	Roles(db *sql.DB) ([]string, error)
+}
+
+// IsolationResult is one attempt to reach tenant A's data as tenant B
+type IsolationResult struct {
+	Check    string
+	Isolated bool
+	Detail   string
+}
+
+func (r IsolationResult) String() string {
+	if r.Isolated {
+		return "PASS " + r.Check
+	}
+	return fmt.Sprintf("FAIL %s: security: %s", r.Check, r.Detail)
+}
+
+// CheckIsolation writes a secret marker to service A's database and then
+// tries to connect to, read or list it with service B's credentials
+func CheckIsolation(dao IsolationDAO, creds Credentialiser, serviceA, serviceB string) ([]IsolationResult, error) {
+	if serviceB == "" {
+		return nil, fmt.Errorf("no second service to check isolation against")
+	}
+	hostA, userA, passwordA, dbNameA, err := creds.GetCreds(serviceA)
+	if err != nil {
+		return nil, err
+	}
+	hostB, userB, passwordB, dbNameB, err := creds.GetCreds(serviceB)
+	if err != nil {
+		return nil, err
+	}
+
+	dbA, err := dao.Open(hostA, userA, passwordA, dbNameA)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB(dbA)
+	id := fmt.Sprintf("isolation-%d", time.Now().UnixNano())
+	if err := dao.WriteDataset(dbA, id, map[string]string{"secret": id}); err != nil {
+		return nil, err
+	}
+	defer dao.DeleteDataset(dbA, id)
+
+	dbB, err := dao.Open(hostB, userB, passwordB, dbNameB)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB(dbB)
+
+	var results []IsolationResult
+
+	cross, err := dao.Open(hostA, userB, passwordB, dbNameA)
+	if err == nil {
+		err = dao.Ping(cross)
+		closeDB(cross)
+	}
+	results = append(results, IsolationResult{
+		Check:    "connect",
+		Isolated: err != nil,
+		Detail:   fmt.Sprintf("%s could connect to database %s", userB, dbNameA),
+	})
+
+	items, err := dao.ReadDataset(dbB, id)
+	results = append(results, IsolationResult{
+		Check:    "read",
+		Isolated: err != nil || len(items) == 0,
+		Detail:   fmt.Sprintf("%s read the marker written to %s", userB, dbNameA),
+	})
+
+	databases, err := dao.Databases(dbB)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, IsolationResult{
+		Check:    "list databases",
+		Isolated: !contains(databases, dbNameA),
+		Detail:   fmt.Sprintf("%s can see database %s", userB, dbNameA),
+	})
+
+	roles, err := dao.Roles(dbB)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, IsolationResult{
+		Check:    "list roles",
+		Isolated: !contains(roles, userA),
+		Detail:   fmt.Sprintf("%s can see role %s", userB, userA),
+	})
+	return results, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// IsolationHandler checks the service named by DB_SERVICENAME is isolated
+// from the one named by DB_ISOLATION_SERVICENAME, both bound to this app
+func IsolationHandler(dao IsolationDAO, creds Credentialiser, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := CheckIsolation(dao, creds, serviceName, os.Getenv("DB_ISOLATION_SERVICENAME"))
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check isolation: %v", err)
+			return
+		}
+		status := http.StatusOK
+		for _, result := range results {
+			if !result.Isolated {
+				status = http.StatusFailedDependency
+			}
+		}
+		w.WriteHeader(status)
+		for _, result := range results {
+			fmt.Fprintln(w, result)
+		}
+	}
+}
+
+// Databases lists the databases the login can see
+func (PostgresDAO) Databases(db *sql.DB) ([]string, error) {
+	return queryNames(db, "SELECT datname FROM pg_database")
+}
+
+// Roles lists the roles the login can see
+func (PostgresDAO) Roles(db *sql.DB) ([]string, error) {
+	return queryNames(db, "SELECT rolname FROM pg_roles")
+}
+
+func queryNames(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantServer stands in for a Postgres server shared by several logins,
+// each owning one database. Unless Leaky is set a login can only connect to
+// and list its own database and role.
+type tenantServer struct {
+	Leaky bool
+
+	owners map[string]string
+	data   map[string]map[string]map[string]string
+	conns  map[*sql.DB]tenantConn
+}
+
+type tenantConn struct {
+	user   string
+	dbName string
+}
+
+func newTenantServer() *tenantServer {
+	return &tenantServer{
+		owners: map[string]string{"db_a": "user_a", "db_b": "user_b"},
+		data:   map[string]map[string]map[string]string{"db_a": {}, "db_b": {}},
+		conns:  map[*sql.DB]tenantConn{},
+	}
+}
+
+func (s *tenantServer) Open(host, user, password, dbName string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s user=%s dbname=%s", host, user, dbName))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[db] = tenantConn{user: user, dbName: dbName}
+	return db, nil
+}
+
+func (s *tenantServer) Ping(db *sql.DB) error {
+	conn := s.conns[db]
+	if !s.Leaky && s.owners[conn.dbName] != conn.user {
+		return errors.New("pq: permission denied for database " + conn.dbName)
+	}
+	return nil
+}
+
+func (s *tenantServer) WriteDataset(db *sql.DB, id string, items map[string]string) error {
+	s.data[s.conns[db].dbName][id] = items
+	return nil
+}
+
+func (s *tenantServer) ReadDataset(db *sql.DB, id string) ([]dataset.Item, error) {
+	if s.Leaky {
+		return dataset.Items(s.data["db_a"][id]), nil
+	}
+	return dataset.Items(s.data[s.conns[db].dbName][id]), nil
+}
+
+func (s *tenantServer) DeleteDataset(db *sql.DB, id string) error {
+	delete(s.data[s.conns[db].dbName], id)
+	return nil
+}
+
+func (s *tenantServer) Databases(db *sql.DB) ([]string, error) {
+	if s.Leaky {
+		return []string{"db_a", "db_b", "postgres"}, nil
+	}
+	return []string{s.conns[db].dbName}, nil
+}
+
+func (s *tenantServer) Roles(db *sql.DB) ([]string, error) {
+	if s.Leaky {
+		return []string{"user_a", "user_b"}, nil
+	}
+	return []string{s.conns[db].user}, nil
+}
+
+func setupTenants() Credentialiser {
+	os.Setenv("VCAP_SERVICES", `{
+		"rds": [
+			{"credentials": {"host": "shared", "username": "user_a", "password": "a", "db_name": "db_a"}, "label": "rds", "name": "tenant-a"},
+			{"credentials": {"host": "shared", "username": "user_b", "password": "b", "db_name": "db_b"}, "label": "rds", "name": "tenant-b"}
+		]
+	}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+	return &CFCredentialiser{}
+}
+
+func TestCheckIsolation(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	server := newTenantServer()
+
+	results, err := CheckIsolation(server, creds, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	for _, r := range results {
+		assert.True(t, r.Isolated, r.String())
+	}
+	assert.Empty(t, server.data["db_a"], "the marker should be removed")
+}
+
+func TestCheckIsolationLeaky(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	server := newTenantServer()
+	server.Leaky = true
+
+	results, err := CheckIsolation(server, creds, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, r.String())
+	}
+	assert.Equal(t, []string{
+		"FAIL connect: security: user_b could connect to database db_a",
+		"FAIL read: security: user_b read the marker written to db_a",
+		"FAIL list databases: security: user_b can see database db_a",
+		"FAIL list roles: security: user_b can see role user_a",
+	}, lines)
+}
+
+func TestIsolationHandler(t *testing.T) {
+	creds := setupTenants()
+	defer teardownFake()
+	defer os.Unsetenv("DB_ISOLATION_SERVICENAME")
+	server := newTenantServer()
+
+	w := httptest.NewRecorder()
+	IsolationHandler(server, creds, "tenant-a")(w, httptest.NewRequest("GET", "http://x/isolation", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Failed to check isolation: no second service to check isolation against", w.Body.String())
+
+	os.Setenv("DB_ISOLATION_SERVICENAME", "tenant-b")
+	w = httptest.NewRecorder()
+	IsolationHandler(server, creds, "tenant-a")(w, httptest.NewRequest("GET", "http://x/isolation", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "PASS connect\nPASS read\nPASS list databases\nPASS list roles\n", w.Body.String())
+
+	server.Leaky = true
+	w = httptest.NewRecorder()
+	IsolationHandler(server, creds, "tenant-a")(w, httptest.NewRequest("GET", "http://x/isolation", nil))
+	assert.Equal(t, 424, w.Code)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeLog(t *testing.T, out *bytes.Buffer) []logging.LogEntry {
+	var entries []logging.LogEntry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e logging.LogEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLogRequests(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	dao.QueryError = errors.New("pq: relation \"test_data\" does not exist")
+	defer diagnose.FakeNetwork(nil, nil)()
+
+	var out bytes.Buffer
+	logger := &logging.Logger{Out: &out, Service: "test-psql"}
+	probe := coalesce.New(WebHandler(dao, creds, "test-psql", "test_data", "Fred"), time.Minute)
+	handler := logging.LogRequests(logger, probe)
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://x/probe", nil))
+		return w
+	}
+	first := get()
+	assert.Equal(t, http.StatusFailedDependency, first.Code)
+	runID := first.Header().Get(logging.RunIDHeader)
+	assert.Len(t, runID, 16)
+
+	entries := decodeLog(t, &out)
+	var steps []string
+	for _, e := range entries {
+		assert.Equal(t, runID, e.RunID)
+		steps = append(steps, e.Step)
+	}
+	assert.Equal(t, []string{"credentials", "connect", "write", "read", "cleanup", "probe", "dns", "tcp", "auth", "diagnose", "request"}, steps)
+	assert.Equal(t, "backend", entries[3].ErrorClass)
+	assert.Empty(t, entries[4].Error)
+	assert.Equal(t, "backend", entries[9].ErrorClass)
+	assert.Equal(t, "/probe", entries[10].Path)
+	assert.Equal(t, 424, entries[10].Status)
+
+	// a cached response carries the ID of the run that produced it
+	out.Reset()
+	cached := get()
+	assert.Equal(t, "cached", cached.Header().Get("X-Probe-Result"))
+	assert.Equal(t, runID, cached.Header().Get(logging.RunIDHeader))
+	entries = decodeLog(t, &out)
+	require.Len(t, entries, 1)
+	assert.Equal(t, runID, entries[0].RunID)
+}
@@ -3,14 +3,27 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
 
 	_ "github.com/lib/pq"
 
-	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/ONSdigital/cf-tests/probe/auth"
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/health"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/serve"
+	"github.com/ONSdigital/cf-tests/probe/testplan"
+	"github.com/ONSdigital/cf-tests/probe/tracing"
 )
 
 // DAO is the database layer access interface
@@ -26,21 +39,117 @@ type Credentialiser interface {
 }
 
 func main() {
-	dao := &PostgresDAO{}
+	local := flag.Bool("local", false, "run the probe once outside Cloud Foundry and exit")
+	requireTLS := flag.Bool("require-tls", false, "with -local, also check the server refuses a plaintext connection")
+	login := flag.Bool("login", false, "with -local, only log in, exiting 3 if the server refuses the credentials")
+	sslMode := flag.String("sslmode", "require", "postgres sslmode to connect with, such as disable for a local server without TLS")
+	var opts LocalOptions
+	opts.Register(flag.CommandLine)
+	flag.Parse()
+
+	dao := &PostgresDAO{SSLMode: *sslMode}
+	if *local {
+		creds, err := opts.Credentials()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if *login {
+			os.Exit(RunLogin(dao, creds, os.Stdout))
+		}
+		code := RunLocal(dao, creds, "test_table", "Fred", os.Stdout)
+		if *requireTLS && RunTransport(dao, creds, os.Stdout) != 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	access, err := auth.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	plan, err := testplan.Load("rds", checks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	payload := plan["probe"].Payload
+	minInterval, err := coalesce.MinIntervalFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grace, err := serve.GraceFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 	port := os.Getenv("PORT")
 	serviceName := os.Getenv("DB_SERVICENAME")
-	creds := &CFCredentialiser{}
-	handler := WebHandler(dao, creds, serviceName, "test_table", "Fred")
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	creds := &CFCredentialiser{
+		Label: discovery.Getenv("DB_SERVICELABEL", "rds"),
+		Tag:   discovery.Getenv("DB_SERVICETAG", "postgres"),
+	}
+	probe := coalesce.New(WebHandler(dao, creds, serviceName, payload["table"], payload["name"]), minInterval)
+	mux := http.NewServeMux()
+	mux.Handle("/", plan["probe"].Wrap(probe))
+	plan.Handle(mux, "probe", probe)
+	mux.Handle("/dataset/", DatasetHandler(dao, creds, serviceName))
+	plan.Handle(mux, "ping", PingHandler(dao, creds, serviceName))
+	plan.Handle(mux, "isolation", IsolationHandler(dao, creds, serviceName))
+	plan.Handle(mux, "transport", TransportHandler(dao, creds, serviceName))
+	mux.Handle("/healthz", health.Healthz())
+	mux.Handle("/readyz", health.Readyz(func() error {
+		_, _, _, _, err := creds.GetCreds(serviceName)
+		return err
+	}, probe))
+
+	logger := &logging.Logger{Out: os.Stdout, Service: serviceName}
+	tracer := tracing.FromEnv("cf-test-rds", discovery.Attributes(serviceName, creds.Label, creds.Tag))
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go probe.Refresh()
+	plan.Schedule(logging.LogRequests(logger, tracing.TraceRequests(tracer, mux)), nil)
+	if err := serve.Serve(&http.Server{Handler: logging.LogRequests(logger, tracing.TraceRequests(tracer, access.Wrap(mux)))}, l, signals, grace, &openDBs, tracer); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checks are the probe's checks as they run without a test plan
+var checks = testplan.Plan{
+	"probe": {Path: "/probe", Enabled: true, Severity: testplan.SeverityCritical, Payload: map[string]string{"table": "test_table", "name": "Fred"},
+		Rules: map[string]testplan.PayloadRule{"table": {Pattern: sqlIdentifier, Expected: "a plain SQL identifier"}, "name": {Pattern: nameColumn, Expected: "1 to 30 characters"}}},
+	"ping":      {Path: "/ping", Enabled: true, Severity: testplan.SeverityCritical},
+	"isolation": {Path: "/isolation", Enabled: true, Severity: testplan.SeverityCritical},
+	"transport": {Path: "/transport", Enabled: true, Severity: testplan.SeverityCritical},
 }
 
+// The probe's table name is put into its SQL as it is, so a plan may only
+// name a plain identifier, and the name must fit the table's VARCHAR(30)
+var (
+	sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+	nameColumn    = regexp.MustCompile(`^(?s).{1,30}$`)
+)
+
 // WebHandler provides a test endpoint
 func WebHandler(dao DAO, creds Credentialiser, serviceName, tableName, name string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		result, err := Query(dao, creds, serviceName, tableName, name)
-		if err != nil || name != result {
+		run := logging.RunFrom(r.Context())
+		if run != nil {
+			w.Header().Set(logging.RunIDHeader, run.ID)
+		}
+		if err := run.Step("probe", func() error {
+			return probe(run, dao, creds, serviceName, tableName, name)
+		}); err != nil {
+			var d *diagnose.Diagnosis
+			run.Step("diagnose", func() error {
+				d = diagnoseDatabase(run, dao, creds, serviceName, err)
+				return d.Err()
+			})
+			w.Header().Set(logging.ErrorCategoryHeader, d.Category())
 			w.WriteHeader(http.StatusFailedDependency)
-			fmt.Fprintf(w, "Failed to read database: %v", err)
+			fmt.Fprintf(w, "Failed to read database: %v\n%v\n", err, d)
 			return
 		}
 
@@ -49,20 +158,19 @@ func WebHandler(dao DAO, creds Credentialiser, serviceName, tableName, name stri
 	}
 }
 
-type CFCredentialiser struct{}
-
-func (CFCredentialiser) GetCreds(serviceName string) (host, user, password, dbName string, err error) {
-	app, err := cfenv.Current()
-	if err != nil {
-		return
-	}
+type CFCredentialiser struct {
+	Label string
+	Tag   string
+}
 
-	pg, err := app.Services.WithName(serviceName)
+func (c CFCredentialiser) GetCreds(serviceName string) (host, user, password, dbName string, err error) {
+	pg, err := discovery.Find(serviceName, c.Label, c.Tag)
 	if err != nil {
 		return
 	}
 
 	host, _ = pg.CredentialString("host")
+	host = discovery.BackendAddress(pg.Name, serviceName == os.Getenv("DB_SERVICENAME"), host)
 	user, _ = pg.CredentialString("username")
 	password, _ = pg.CredentialString("password")
 	dbName, _ = pg.CredentialString("db_name")
@@ -72,31 +180,90 @@ func (CFCredentialiser) GetCreds(serviceName string) (host, user, password, dbNa
 
 // Query connects to a postgres services and runs a basic query on the test table
 func Query(dao DAO, creds Credentialiser, serviceName, tableName, name string) (string, error) {
-	host, user, password, dbName, err := creds.GetCreds(serviceName)
-	if err != nil {
-		return "", err
+	return query(nil, dao, creds, serviceName, tableName, name)
+}
+
+func query(run *logging.Run, dao DAO, creds Credentialiser, serviceName, tableName, name string) (result string, err error) {
+	var host, user, password, dbName string
+	if err = run.Step("credentials", func() (err error) {
+		host, user, password, dbName, err = creds.GetCreds(serviceName)
+		if err == nil {
+			run.Attribute("server.address", host)
+		}
+		return
+	}); err != nil {
+		return
 	}
 
-	db, err := dao.Open(host, user, password, dbName)
-	if err != nil {
-		return "", err
+	var db *sql.DB
+	if err = run.Step("connect", func() (err error) {
+		db, err = dao.Open(host, user, password, dbName)
+		return
+	}); err != nil {
+		return
+	}
+	defer run.Step("cleanup", func() error {
+		return closeDB(db)
+	})
+
+	if err = run.Step("write", func() error {
+		return dao.CreateTable(db, tableName, name)
+	}); err != nil {
+		return
 	}
 
-	if err := dao.CreateTable(db, tableName, name); err != nil {
-		return "", err
+	err = run.Step("read", func() (err error) {
+		result, err = dao.QueryTable(db, tableName)
+		return
+	})
+	return
+}
+
+// Probe runs Query and checks the expected name was read back
+func Probe(dao DAO, creds Credentialiser, serviceName, tableName, name string) error {
+	return probe(nil, dao, creds, serviceName, tableName, name)
+}
+
+func probe(run *logging.Run, dao DAO, creds Credentialiser, serviceName, tableName, name string) error {
+	result, err := query(run, dao, creds, serviceName, tableName, name)
+	if err != nil {
+		return err
+	}
+	if result != name {
+		return fmt.Errorf("read %q back from %s, expected %q", result, tableName, name)
 	}
+	return nil
+}
 
-	return dao.QueryTable(db, tableName)
+// PostgresDAO is a specific dao for postgres. SSLMode is the sslmode it
+// connects with, require when empty.
+type PostgresDAO struct {
+	SSLMode string
 }
 
-// PostgresDAO is a specific dao for postgres
-type PostgresDAO struct{}
+// openDBs holds the databases PostgresDAO has opened and closeDB has not
+// yet closed
+var openDBs serve.CloserSet
 
-// Open creates a connection to a postgres instance
-func (PostgresDAO) Open(host, user, password, dbName string) (*sql.DB, error) {
-	dbinfo := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, user, password, dbName)
-	return sql.Open("postgres", dbinfo)
+// Open creates a connection to a postgres instance. The host may carry a
+// port as host:port. Connecting, reading and writing give up after
+// dbTimeout.
+func (d PostgresDAO) Open(host, user, password, dbName string) (*sql.DB, error) {
+	sslMode := d.SSLMode
+	if sslMode == "" {
+		sslMode = "require"
+	}
+	dbinfo := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s",
+		host, user, password, dbName, sslMode)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		dbinfo = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+			h, port, user, password, dbName, sslMode)
+	}
+	db, err := sql.Open("postgres-timeout", dbinfo)
+	if err == nil {
+		openDBs.Add(db)
+	}
+	return db, err
 }
 
 // CreateTable creates a simple test table in the attached database
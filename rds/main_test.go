@@ -7,6 +7,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/ONSdigital/cf-tests/probe/testplan"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	sqlmock "gopkg.in/DATA-DOG/go-sqlmock.v1"
@@ -89,7 +90,8 @@ func setupFake() (*FakeDAO, Credentialiser) {
 			  "username": "test_user"
 			},
 			"label": "rds",
-			"name": "test-psql"
+			"name": "test-psql",
+			"plan": "shared-psql"
 		  }
 		]
 	}
@@ -132,3 +134,34 @@ func TestWeb(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, "RDS service is OK", string(body))
 }
+
+func TestGetCredsByLabel(t *testing.T) {
+	setupFake()
+	defer teardownFake()
+	creds := &CFCredentialiser{Label: "rds"}
+	host, _, _, dbName, err := creds.GetCreds("")
+	require.NoError(t, err)
+	assert.Equal(t, "test_host", host)
+	assert.Equal(t, "test_db", dbName)
+}
+
+func TestChecks(t *testing.T) {
+	plan, err := testplan.Parse([]byte("rds: {probe: {payload: {table: probe_table}}, isolation: {enabled: false}}"), "rds", checks)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"table": "probe_table", "name": "Fred"}, plan["probe"].Payload)
+	assert.False(t, plan["isolation"].Enabled)
+	assert.True(t, plan["transport"].Enabled)
+
+	for plan, want := range map[string]string{
+		"rds: {probe: {payload: {table: 'users; DROP TABLE users'}}}":       `rds.probe.payload.table: "users; DROP TABLE users" is not a plain SQL identifier`,
+		"rds: {probe: {payload: {table: 1st}}}":                             `rds.probe.payload.table: "1st" is not a plain SQL identifier`,
+		"rds: {probe: {payload: {name: Hubert Blaine Wolfeschlegelstein}}}": `rds.probe.payload.name: "Hubert Blaine Wolfeschlegelstein" is not 1 to 30 characters`,
+	} {
+		_, err := testplan.Parse([]byte(plan), "rds", checks)
+		if assert.Error(t, err, plan) {
+			assert.Contains(t, err.Error(), want, plan)
+		}
+	}
+	_, err = testplan.Parse([]byte("rds: {probe: {payload: {name: Zoë Fredericka Smith-Jonessons}}}"), "rds", checks)
+	assert.NoError(t, err, "the name limit counts characters, not bytes")
+}
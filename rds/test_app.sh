@@ -1,4 +1,4 @@
 #!/usr/bin/env bash
 set -eux
 : ${RDS_ENDPOINT:=https://cf-test-rds.apps.devtest.onsclofo.uk}
-curl -s -k "$RDS_ENDPOINT" | grep "RDS service is OK"
+curl -s -k -D /dev/stderr "$RDS_ENDPOINT" | grep "RDS service is OK"
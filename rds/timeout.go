@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dbTimeout bounds connecting to postgres and each read and write once
+// connected, so a backend that stops answering fails the probe rather than
+// hanging it. Tests shorten it.
+var dbTimeout = 10 * time.Second
+
+func init() {
+	sql.Register("postgres-timeout", timeoutDriver{})
+}
+
+// timeoutDriver opens postgres connections through timeoutDialer
+type timeoutDriver struct{}
+
+func (timeoutDriver) Open(name string) (driver.Conn, error) {
+	return pq.DialOpen(timeoutDialer{}, name)
+}
+
+// timeoutDialer dials with dbTimeout and returns connections that give up on
+// any read or write taking longer
+type timeoutDialer struct{}
+
+func (timeoutDialer) Dial(network, addr string) (net.Conn, error) {
+	return timeoutDialer{}.DialTimeout(network, addr, dbTimeout)
+}
+
+func (timeoutDialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 || timeout > dbTimeout {
+		timeout = dbTimeout
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: conn, timeout: dbTimeout}, nil
+}
+
+// timeoutConn sets a fresh deadline before every read and write
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
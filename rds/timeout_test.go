@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/faultproxy"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFaultyBackend starts a fault proxy in front of a server that accepts
+// connections and never answers, and points the probe at it through
+// discovery.BackendAddressEnv. It returns the proxy and a function that
+// stops both.
+func newFaultyBackend(t *testing.T, f faultproxy.Fault) (*faultproxy.Proxy, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	p, err := faultproxy.New("127.0.0.1:0", l.Addr().String())
+	require.NoError(t, err)
+	p.Set(f)
+	os.Setenv(discovery.BackendAddressEnv, p.Addr())
+	realTimeout, realLayerTimeout := dbTimeout, diagnose.LayerTimeout
+	dbTimeout, diagnose.LayerTimeout = 100*time.Millisecond, 100*time.Millisecond
+	return p, func() {
+		dbTimeout, diagnose.LayerTimeout = realTimeout, realLayerTimeout
+		os.Unsetenv(discovery.BackendAddressEnv)
+		p.Close()
+		l.Close()
+	}
+}
+
+func TestGetCredsBackendAddress(t *testing.T) {
+	setupFake()
+	defer teardownFake()
+	os.Setenv(discovery.BackendAddressEnv, "127.0.0.1:7000")
+	defer os.Unsetenv(discovery.BackendAddressEnv)
+
+	host, user, _, _, err := CFCredentialiser{}.GetCreds("test-psql")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", host)
+	assert.Equal(t, "test_user", user)
+
+	creds := setupTenants()
+	os.Setenv("DB_SERVICENAME", "tenant-a")
+	host, _, _, _, err = creds.GetCreds("tenant-a")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", host)
+	host, _, _, _, err = creds.GetCreds("tenant-b")
+	require.NoError(t, err)
+	assert.Equal(t, "shared", host, "only the probe's own service should be redirected")
+
+	os.Setenv(discovery.BackendServiceEnv, "tenant-b")
+	defer os.Unsetenv(discovery.BackendServiceEnv)
+	host, _, _, _, err = creds.GetCreds("tenant-a")
+	require.NoError(t, err)
+	assert.Equal(t, "shared", host)
+	host, _, _, _, err = creds.GetCreds("tenant-b")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7000", host)
+}
+
+func TestProbeFaults(t *testing.T) {
+	for _, tc := range []struct {
+		fault    faultproxy.Fault
+		category string
+	}{
+		{faultproxy.Fault{Blackhole: true}, "timeout"},
+		{faultproxy.Fault{HalfOpen: true}, "timeout"},
+		{faultproxy.Fault{Reset: true}, "network"},
+	} {
+		_, creds := setupFake()
+		_, stop := newFaultyBackend(t, tc.fault)
+
+		start := time.Now()
+		err := Probe(PostgresDAO{}, creds, "test-psql", "test_data", "Fred")
+		if assert.Error(t, err, "%+v", tc.fault) {
+			assert.Equal(t, tc.category, logging.ErrorClass(err), "%+v: %v", tc.fault, err)
+		}
+		assert.True(t, time.Since(start) < time.Second, "%+v took %v", tc.fault, time.Since(start))
+
+		w := httptest.NewRecorder()
+		WebHandler(PostgresDAO{}, creds, "test-psql", "test_data", "Fred")(w, httptest.NewRequest("GET", "http://x/", nil))
+		assert.Equal(t, http.StatusFailedDependency, w.Code)
+		assert.Equal(t, tc.category, w.Header().Get(logging.ErrorCategoryHeader), "%+v: %s", tc.fault, w.Body)
+
+		stop()
+		teardownFake()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// traceProbe runs one traced /probe request against the fake service
+func traceProbe(t *testing.T, dao *FakeDAO, creds Credentialiser, header http.Header) (*httptest.ResponseRecorder, []tracing.Span) {
+	exporter := &tracing.InMemoryExporter{}
+	tracer := &tracing.Tracer{Exporter: exporter, Attributes: discovery.Attributes("test-psql", "", "")}
+	handler := logging.LogRequests(&logging.Logger{Out: ioutil.Discard}, tracing.TraceRequests(tracer, WebHandler(dao, creds, "test-psql", "test_data", "Fred")))
+	r := httptest.NewRequest("GET", "http://x/probe", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w, exporter.Spans()
+}
+
+func spanNames(spans []tracing.Span) []string {
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func TestTraceRequests(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+
+	w, spans := traceProbe(t, dao, creds, http.Header{"Traceparent": {incomingTraceparent}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []string{"credentials", "connect", "write", "read", "cleanup", "probe", "GET /probe"}, spanNames(spans))
+
+	root, probe := spans[6], spans[5]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentID)
+	assert.True(t, root.Server)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+root.SpanID+"-01", w.Header().Get(tracing.TraceparentHeader))
+	assert.Equal(t, root.SpanID, probe.ParentID)
+	for _, s := range spans[:5] {
+		assert.Equal(t, root.TraceID, s.TraceID)
+		assert.Equal(t, probe.SpanID, s.ParentID, s.Name)
+		assert.Empty(t, s.Error)
+		assert.False(t, s.End.Before(s.Start))
+		assert.Equal(t, "test-psql", s.Attributes["cf.service.instance"], s.Name)
+		assert.Equal(t, "shared-psql", s.Attributes["cf.service.plan"], s.Name)
+		assert.Equal(t, "test_host", s.Attributes["server.address"], s.Name)
+	}
+	assert.Equal(t, "test_host", root.Attributes["server.address"])
+	assert.Equal(t, "200", root.Attributes["http.response.status_code"])
+	assert.Equal(t, w.Header().Get(logging.RunIDHeader), root.Attributes["probe.run_id"])
+}
+
+func TestTraceRequestsFailure(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	dao.QueryError = errors.New("pq: password=s3cret rejected")
+	defer diagnose.FakeNetwork(errors.New("no such host"), nil)()
+
+	w, spans := traceProbe(t, dao, creds, nil)
+	require.Equal(t, http.StatusFailedDependency, w.Code)
+	require.Equal(t, []string{"credentials", "connect", "write", "read", "cleanup", "probe", "dns", "diagnose", "GET /probe"}, spanNames(spans))
+	assert.Equal(t, "pq: password=REDACTED rejected", spans[3].Error)
+	assert.Empty(t, spans[4].Error)
+	assert.Equal(t, spans[7].SpanID, spans[6].ParentID)
+	assert.Equal(t, "dns: no such host", spans[7].Error)
+	assert.Equal(t, "Failed Dependency", spans[8].Error)
+	assert.Len(t, spans[8].TraceID, 32)
+	assert.Empty(t, spans[8].ParentID)
+}
+
+func TestTraceRequestsUntraced(t *testing.T) {
+	dao, creds := setupFake()
+	defer teardownFake()
+	handler := logging.LogRequests(&logging.Logger{Out: ioutil.Discard}, tracing.TraceRequests(nil, WebHandler(dao, creds, "test-psql", "test_data", "Fred")))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://x/probe", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(tracing.TraceparentHeader))
+}
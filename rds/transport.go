@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// TransportDAO can make a connection that deliberately skips TLS
+type TransportDAO interface {
+	// OpenPlaintext logs in without TLS and returns nil if the server let it
+	OpenPlaintext(host, user, password, dbName string) error
+}
+
+// TransportResult is the outcome of the transport policy check. Refused is
+// the error the plaintext login failed with, if it did. Only the error a
+// server gives when pg_hba.conf allows the user in over TLS alone passes:
+// any other is an error that says nothing about the policy.
+type TransportResult struct {
+	Host    string
+	Refused error
+}
+
+// OK is true when the server refused the plaintext connection for being
+// plaintext
+func (r TransportResult) OK() bool {
+	return refusesPlaintext(r.Refused)
+}
+
+func (r TransportResult) String() string {
+	switch {
+	case r.Refused == nil:
+		return fmt.Sprintf("FAIL transport policy: security: %s accepted a plaintext connection", r.Host)
+	case r.OK():
+		return fmt.Sprintf("PASS transport policy: plaintext connection refused: %v", r.Refused)
+	}
+	return fmt.Sprintf("ERROR transport policy: could not tell whether %s refuses plaintext: %v", r.Host, r.Refused)
+}
+
+// refusesPlaintext is true for the FATAL 28000 postgres answers a login with
+// when no pg_hba.conf entry allows it without TLS. The message ends "SSL off"
+// before PostgreSQL 14 and "no encryption" since.
+func refusesPlaintext(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "28000" &&
+		(strings.Contains(pqErr.Message, "SSL off") || strings.Contains(pqErr.Message, "no encryption"))
+}
+
+// CheckTransport tries to log in to the service with sslmode=disable
+func CheckTransport(dao TransportDAO, creds Credentialiser, serviceName string) (TransportResult, error) {
+	host, user, password, dbName, err := creds.GetCreds(serviceName)
+	if err != nil {
+		return TransportResult{}, err
+	}
+	return TransportResult{Host: host, Refused: dao.OpenPlaintext(host, user, password, dbName)}, nil
+}
+
+// TransportHandler reports the transport policy check
+func TransportHandler(dao TransportDAO, creds Credentialiser, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := CheckTransport(dao, creds, serviceName)
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check transport policy: %v", err)
+			return
+		}
+		if !result.OK() {
+			w.WriteHeader(http.StatusFailedDependency)
+		}
+		fmt.Fprintln(w, result)
+	}
+}
+
+// RunTransport runs the check once, prints the result and returns the exit code
+func RunTransport(dao TransportDAO, creds Credentialiser, out io.Writer) int {
+	result, err := CheckTransport(dao, creds, "")
+	if err != nil {
+		fmt.Fprintf(out, "Failed to check transport policy: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(out, result)
+	if !result.OK() {
+		return 1
+	}
+	return 0
+}
+
+// OpenPlaintext connects with sslmode=disable and pings, so the login itself
+// is what the server has to refuse
+func (PostgresDAO) OpenPlaintext(host, user, password, dbName string) error {
+	dbinfo := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable connect_timeout=10",
+		host, user, password, dbName)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		dbinfo = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable connect_timeout=10",
+			h, port, user, password, dbName)
+	}
+	db, err := sql.Open("postgres", dbinfo)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plaintextDAO answers plaintext logins with err
+type plaintextDAO struct {
+	err  error
+	host string
+}
+
+func (d *plaintextDAO) OpenPlaintext(host, user, password, dbName string) error {
+	d.host = host
+	return d.err
+}
+
+// sslOff is how postgres refuses a login pg_hba.conf only allows over TLS
+var sslOff = &pq.Error{Severity: "FATAL", Code: "28000", Message: `no pg_hba.conf entry for host "10.0.0.1", user "u", database "d", SSL off`}
+
+func TestCheckTransportRefused(t *testing.T) {
+	dao := &plaintextDAO{err: sslOff}
+	var out bytes.Buffer
+	code := RunTransport(dao, LocalCredentialiser{Host: "db:5432"}, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "db:5432", dao.host)
+	assert.Equal(t, "PASS transport policy: plaintext connection refused: pq: no pg_hba.conf entry for host \"10.0.0.1\", user \"u\", database \"d\", SSL off\n", out.String())
+
+	out.Reset()
+	dao.err = &pq.Error{Code: "28000", Message: `no pg_hba.conf entry for host "10.0.0.1", user "u", database "d", no encryption`}
+	assert.Equal(t, 0, RunTransport(dao, LocalCredentialiser{Host: "db:5432"}, &out), "PostgreSQL 14 and later")
+}
+
+func TestCheckTransportError(t *testing.T) {
+	for _, err := range []error{
+		errors.New("dial tcp: lookup db: no such host"),
+		&pq.Error{Code: "28P01", Message: `password authentication failed for user "u"`},
+		&pq.Error{Code: "28000", Message: `role "u" does not exist`},
+	} {
+		var out bytes.Buffer
+		code := RunTransport(&plaintextDAO{err: err}, LocalCredentialiser{Host: "db:5432"}, &out)
+		assert.Equal(t, 1, code, "%v", err)
+		assert.Equal(t, fmt.Sprintf("ERROR transport policy: could not tell whether db:5432 refuses plaintext: %v\n", err), out.String())
+	}
+}
+
+func TestCheckTransportAccepted(t *testing.T) {
+	var out bytes.Buffer
+	code := RunTransport(&plaintextDAO{}, LocalCredentialiser{Host: "db:5432"}, &out)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "FAIL transport policy: security: db:5432 accepted a plaintext connection\n", out.String())
+}
+
+func TestTransportHandler(t *testing.T) {
+	_, creds := setupFake()
+	w := httptest.NewRecorder()
+	TransportHandler(&plaintextDAO{}, creds, "test-psql")(w, httptest.NewRequest("GET", "http://x/transport", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Contains(t, w.Body.String(), "FAIL transport policy: security:")
+
+	w = httptest.NewRecorder()
+	TransportHandler(&plaintextDAO{err: sslOff}, creds, "test-psql")(w, httptest.NewRequest("GET", "http://x/transport", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "PASS transport policy: plaintext connection refused:")
+
+	w = httptest.NewRecorder()
+	TransportHandler(&plaintextDAO{err: errors.New("connection refused")}, creds, "test-psql")(w, httptest.NewRequest("GET", "http://x/transport", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Contains(t, w.Body.String(), "ERROR transport policy:")
+}
+
+// newRefusingPostgres starts a server that answers every startup message
+// with the error postgres gives a login without TLS that pg_hba.conf only
+// allows with it
+func newRefusingPostgres(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var size int32
+			binary.Read(conn, binary.BigEndian, &size)
+			io.CopyN(ioutil.Discard, conn, int64(size-4))
+			fields := "SFATAL\x00C28000\x00M" + sslOff.Message + "\x00\x00"
+			msg := append([]byte{'E', 0, 0, 0, 0}, fields...)
+			binary.BigEndian.PutUint32(msg[1:], uint32(len(fields)+4))
+			conn.Write(msg)
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestOpenPlaintextRefused(t *testing.T) {
+	l := newRefusingPostgres(t)
+	defer l.Close()
+
+	err := PostgresDAO{}.OpenPlaintext(l.Addr().String(), "u", "p", "d")
+	assert.True(t, refusesPlaintext(err), "%v", err)
+}
+
+func TestOpenPlaintextClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	err = PostgresDAO{}.OpenPlaintext(l.Addr().String(), "u", "p", "d")
+	assert.Error(t, err)
+	assert.False(t, refusesPlaintext(err), "a dropped connection says nothing about TLS: %v", err)
+}
+
+func TestOpenRequiresTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	codes := make(chan int32, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var startup [2]int32
+		binary.Read(conn, binary.BigEndian, &startup)
+		codes <- startup[1]
+		conn.Close()
+	}()
+
+	db, err := PostgresDAO{}.Open(l.Addr().String(), "u", "p", "d")
+	require.NoError(t, err)
+	defer closeDB(db)
+	assert.Error(t, db.Ping())
+	assert.Equal(t, int32(80877103), <-codes, "expected an SSLRequest before anything else")
+}
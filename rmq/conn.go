@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/serve"
+	"github.com/streadway/amqp"
+)
+
+// openConns holds the broker connections requests have open
+var openConns serve.CloserSet
+
+// amqpTimeout bounds connecting to the broker and waiting on it once
+// connected. Heartbeats are sent at a third of it, so a broker that stops
+// answering closes the connection rather than hanging the probe. Tests
+// shorten it.
+var amqpTimeout = 30 * time.Second
+
+// dial connects to uri and tracks the connection until closeConn
+func dial(uri string) (*amqp.Connection, error) {
+	heartbeat := amqpTimeout / 3
+	if heartbeat < time.Second {
+		heartbeat = time.Second
+	}
+	conn, err := amqp.DialConfig(uri, amqp.Config{
+		Heartbeat: heartbeat,
+		Locale:    "en_US",
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := dialBroker(uri, network, addr, amqpTimeout)
+			if err != nil {
+				return nil, err
+			}
+			// cleared by the library once the handshake completes
+			return conn, conn.SetDeadline(time.Now().Add(amqpTimeout))
+		},
+	})
+	if err == nil {
+		openConns.Add(conn)
+	}
+	return conn, err
+}
+
+// closeConn closes a connection made by dial, which may be nil
+func closeConn(conn *amqp.Connection) {
+	if conn != nil {
+		openConns.Remove(conn)
+		conn.Close()
+	}
+}
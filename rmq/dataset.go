@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/streadway/amqp"
+)
+
+// DatasetClient keeps a dataset on the broker so that cfprobe can check
+// messages survive a plan update
+type DatasetClient interface {
+	Connect(uri string) error
+	WriteDataset(id string, items map[string]string) error
+	ReadDataset(id string) ([]dataset.Item, error)
+	DeleteDataset(id string) error
+	Close()
+}
+
+type DatasetClientFactory func() DatasetClient
+
+// DatasetHandler writes (PUT), verifies (GET) or removes (DELETE) the dataset
+// named by the last path element. The size comes from the count parameter.
+func DatasetHandler(fac DatasetClientFactory, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		count, err := strconv.Atoi(req.URL.Query().Get("count"))
+		if !dataset.ValidID(id) || err != nil || count < 1 || count > dataset.MaxCount {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Expected /dataset/<id>?count=<n> with n from 1 to %d", dataset.MaxCount)
+			return
+		}
+
+		client := fac()
+		defer client.Close()
+		_, uri, err := GetURI(serviceName)
+		if err == nil {
+			err = client.Connect(uri)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to access RMQ: %v", err)
+			return
+		}
+
+		switch req.Method {
+		case "PUT":
+			err = client.WriteDataset(id, dataset.Generate(id, count))
+		case "GET":
+			var got []dataset.Item
+			if got, err = client.ReadDataset(id); err == nil {
+				err = dataset.Compare(dataset.Generate(id, count), got)
+			}
+		case "DELETE":
+			err = client.DeleteDataset(id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Dataset %s: %v", id, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Dataset %s is OK", id)
+	}
+}
+
+// PingHandler checks the broker accepts connections without touching any queues
+func PingHandler(fac DatasetClientFactory, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		client := fac()
+		defer client.Close()
+		_, uri, err := GetURI(serviceName)
+		if err == nil {
+			err = client.Connect(uri)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to reach RMQ: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "RMQ service is reachable")
+	}
+}
+
+// RMQDatasetClient stores a dataset as persistent messages on a durable queue
+// named after the dataset. Each message carries its item key as MessageId.
+type RMQDatasetClient struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func NewRMQDatasetClient() DatasetClient {
+	return &RMQDatasetClient{}
+}
+
+func datasetQueue(id string) string {
+	return "dataset." + id
+}
+
+func (c *RMQDatasetClient) Connect(uri string) (err error) {
+	c.conn, err = dial(uri)
+	if err != nil {
+		return
+	}
+	c.ch, err = c.conn.Channel()
+	return
+}
+
+// WriteDataset replaces the dataset's queue and publishes every item with
+// publisher confirms, so a nil error means the broker has taken them all
+func (c *RMQDatasetClient) WriteDataset(id string, items map[string]string) error {
+	queue := datasetQueue(id)
+	if _, err := c.ch.QueueDelete(queue, false, false, false); err != nil {
+		return err
+	}
+	if _, err := c.ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := c.ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := c.ch.NotifyPublish(make(chan amqp.Confirmation, len(items)))
+
+	for key, value := range items {
+		err := c.ch.Publish("", queue, false, false, amqp.Publishing{
+			ContentType:  "text/plain",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    key,
+			Body:         []byte(value),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	nacked := 0
+	for range items {
+		confirm, ok := <-confirms
+		if !ok {
+			return errors.New("channel closed before all messages were confirmed")
+		}
+		if !confirm.Ack {
+			nacked++
+		}
+	}
+	if nacked > 0 {
+		return fmt.Errorf("broker rejected %d of %d messages", nacked, len(items))
+	}
+	return nil
+}
+
+// ReadDataset gets every message on the dataset's queue and then puts them
+// all back, so the dataset can be read again. A message delivered twice
+// comes back as two items.
+func (c *RMQDatasetClient) ReadDataset(id string) ([]dataset.Item, error) {
+	queue := datasetQueue(id)
+	if _, err := c.ch.QueueDeclarePassive(queue, true, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("queue %s is gone: %v", queue, err)
+	}
+
+	var items []dataset.Item
+	var last uint64
+	for {
+		msg, ok, err := c.ch.Get(queue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		items = append(items, dataset.Item{Key: msg.MessageId, Value: string(msg.Body)})
+		last = msg.DeliveryTag
+	}
+	if last > 0 {
+		if err := c.ch.Nack(last, true, true); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (c *RMQDatasetClient) DeleteDataset(id string) error {
+	_, err := c.ch.QueueDelete(datasetQueue(id), false, false, false)
+	return err
+}
+
+func (c *RMQDatasetClient) Close() {
+	closeConn(c.conn)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FakeDatasetClient keeps datasets in Queues, which is shared between all the
+// clients a FakeDatasetFactory makes
+type FakeDatasetClient struct {
+	URI    string
+	Queues map[string]map[string]string
+}
+
+func FakeDatasetFactory(queues map[string]map[string]string) DatasetClientFactory {
+	return func() DatasetClient {
+		return &FakeDatasetClient{Queues: queues}
+	}
+}
+
+func (f *FakeDatasetClient) Connect(uri string) error {
+	f.URI = uri
+	return nil
+}
+
+func (f *FakeDatasetClient) WriteDataset(id string, items map[string]string) error {
+	queue := map[string]string{}
+	for key, value := range items {
+		queue[key] = value
+	}
+	f.Queues[datasetQueue(id)] = queue
+	return nil
+}
+
+func (f *FakeDatasetClient) ReadDataset(id string) ([]dataset.Item, error) {
+	queue, ok := f.Queues[datasetQueue(id)]
+	if !ok {
+		return nil, fmt.Errorf("queue %s is gone", datasetQueue(id))
+	}
+	return dataset.Items(queue), nil
+}
+
+func (f *FakeDatasetClient) DeleteDataset(id string) error {
+	delete(f.Queues, datasetQueue(id))
+	return nil
+}
+
+func (f *FakeDatasetClient) Close() {}
+
+func datasetRequest(fac DatasetClientFactory, method, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	DatasetHandler(fac, "test-rmq")(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func TestDatasetHandler(t *testing.T) {
+	SetEnv()
+	queues := map[string]map[string]string{}
+	fac := FakeDatasetFactory(queues)
+
+	w := datasetRequest(fac, "PUT", "http://x/dataset/upgrade-1?count=4")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, dataset.Generate("upgrade-1", 4), queues["dataset.upgrade-1"])
+
+	w = datasetRequest(fac, "GET", "http://x/dataset/upgrade-1?count=4")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "Dataset upgrade-1 is OK", w.Body.String())
+
+	delete(queues["dataset.upgrade-1"], "0")
+	delete(queues["dataset.upgrade-1"], "3")
+	w = datasetRequest(fac, "GET", "http://x/dataset/upgrade-1?count=4")
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Dataset upgrade-1: 2 of 4 items missing [0 3]", w.Body.String())
+
+	w = datasetRequest(fac, "DELETE", "http://x/dataset/upgrade-1?count=4")
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, queues)
+
+	w = datasetRequest(fac, "GET", "http://x/dataset/upgrade-1?count=4")
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "Dataset upgrade-1: queue dataset.upgrade-1 is gone", w.Body.String())
+}
+
+func TestDatasetHandlerBadRequest(t *testing.T) {
+	SetEnv()
+	queues := map[string]map[string]string{}
+	for _, url := range []string{
+		"http://x/dataset/a.b?count=4",
+		"http://x/dataset/upgrade-1?count=10001",
+	} {
+		w := datasetRequest(FakeDatasetFactory(queues), "PUT", url)
+		assert.Equal(t, 400, w.Code, url)
+	}
+	assert.Empty(t, queues)
+}
+
+func TestPingHandler(t *testing.T) {
+	SetEnv()
+	w := httptest.NewRecorder()
+	PingHandler(FakeDatasetFactory(nil), "test-rmq")(w, httptest.NewRequest("GET", "http://x/ping", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "RMQ service is reachable", w.Body.String())
+}
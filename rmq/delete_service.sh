@@ -1,5 +1,8 @@
 #!/usr/bin/env bash
 set -eu
+: ${RMQ_APP_NAME:=cf-test-rmq}
 : ${RMQ_SERVICE_NAME:=test-rmq}
-# FIXME: need to unbind the application first
+if cf app "$RMQ_APP_NAME" >/dev/null 2>&1; then
+    cf unbind-service "$RMQ_APP_NAME" "$RMQ_SERVICE_NAME"
+fi
 cf delete-service "$RMQ_SERVICE_NAME" -f
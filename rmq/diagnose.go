@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/url"
+
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/streadway/amqp"
+)
+
+// diagnoseService reads the URI again and diagnoses opErr against its broker
+// and the queue the probe used
+func diagnoseService(run *logging.Run, fac RMQClientFactory, serviceName, queue string, opErr error) *diagnose.Diagnosis {
+	_, uri, err := GetURI(serviceName)
+	if err != nil {
+		return diagnose.CredentialsFailure(err)
+	}
+	return diagnoseBroker(run, fac, uri, queue, opErr)
+}
+
+// diagnoseBroker diagnoses opErr against the broker uri names and queue
+func diagnoseBroker(run *logging.Run, fac RMQClientFactory, uri, queue string, opErr error) *diagnose.Diagnosis {
+	t, err := brokerTarget(fac, uri, queue)
+	if err != nil {
+		return diagnose.CredentialsFailure(err)
+	}
+	return t.Diagnose(run, opErr)
+}
+
+// brokerTarget says how to reach the broker uri names, with the TLS
+// handshake for amqps URIs. Its auth layer connects as the probe does,
+// declaring queue.
+func brokerTarget(fac RMQClientFactory, uri, queue string) (diagnose.Target, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return diagnose.Target{}, err
+	}
+	t := diagnose.Target{Host: u.Hostname(), Port: u.Port(), Auth: func() error {
+		client := fac()
+		defer client.Close()
+		return client.Connect(uri, queue)
+	}, AuthFailed: refusesLogin}
+	switch {
+	case u.Scheme == "amqps":
+		t.TLS = &tls.Config{}
+		if t.Port == "" {
+			t.Port = "5671"
+		}
+	case t.Port == "":
+		t.Port = "5672"
+	}
+	t.Via = redirects.get(uri, "")
+	return t, nil
+}
+
+// refusesLogin is true when the broker refused the login: ACCESS_REFUSED
+// for the username and password, or NOT_ALLOWED for the user's vhost
+func refusesLogin(err error) bool {
+	amqpErr, ok := err.(*amqp.Error)
+	return ok && (amqpErr.Code == amqp.AccessRefused || amqpErr.Code == amqp.NotAllowed)
+}
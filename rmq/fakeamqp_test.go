@@ -0,0 +1,1417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/cf-tests/probe/dataset"
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/faultproxy"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/testplan"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// AMQPFault is what a FakeAMQPServer does when a method arrives. The Delay
+// comes first. Then Drop closes the socket as a crashed broker would, or Err
+// closes the channel, or the whole connection for connection methods and
+// hard error codes. Nack has a publish on a confirming channel nacked rather
+// than acked. Without Drop or Err the method is then handled as normal.
+type AMQPFault struct {
+	Delay time.Duration
+	Drop  bool
+	Err   *amqp.Error
+	Nack  bool
+}
+
+// FakeAMQPServer is an in-process AMQP 0-9-1 broker on a loopback port, so
+// the real client can be tested without RabbitMQ. It speaks enough of the
+// protocol for this package: the handshake with PLAIN auth, channels,
+// exchange declare and delete, queue declare, bind and delete, basic publish,
+// consume, get, ack, nack and reject, and publisher confirms. It routes
+// through the default exchange and direct, fanout, topic and headers
+// exchanges, expires messages by per-message TTL into a queue's
+// x-dead-letter-exchange and hands out the highest priority message first
+// from queues with x-max-priority. Queues and exchanges last until deleted
+// whatever their flags, and prefetch limits are accepted but not applied.
+// Faults set with SetFault are applied to methods as they arrive.
+type FakeAMQPServer struct {
+	user     string
+	password string
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	conns     map[*fakeAMQPConn]bool
+	exchanges map[string]*fakeAMQPExchange
+	queues    map[string]*fakeAMQPQueue
+	faults    map[string]AMQPFault
+	names     int
+}
+
+// NewFakeAMQPServer starts a server that accepts user and password
+func NewFakeAMQPServer(user, password string) (*FakeAMQPServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeAMQPServer{
+		user:      user,
+		password:  password,
+		listener:  l,
+		conns:     map[*fakeAMQPConn]bool{},
+		exchanges: map[string]*fakeAMQPExchange{},
+		queues:    map[string]*fakeAMQPQueue{},
+		faults:    map[string]AMQPFault{},
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// URI is the address of the server with its credentials
+func (s *FakeAMQPServer) URI() string {
+	return fmt.Sprintf("amqp://%s:%s@%s/", s.user, s.password, s.listener.Addr())
+}
+
+// SetFault applies f to every arrival of method, such as "queue.declare" or
+// "basic.publish", until it is set again. The zero AMQPFault clears it.
+func (s *FakeAMQPServer) SetFault(method string, f AMQPFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[method] = f
+}
+
+// Drop closes every client connection without a close handshake, as a
+// broker restart would
+func (s *FakeAMQPServer) Drop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// Connections is the number of client connections open
+func (s *FakeAMQPServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Queue returns the bodies of the messages ready on a queue, and whether the
+// queue exists
+func (s *FakeAMQPServer) Queue(name string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		return nil, false
+	}
+	bodies := []string{}
+	for _, m := range q.messages {
+		bodies = append(bodies, string(m.body))
+	}
+	return bodies, true
+}
+
+// Declared returns the names of the exchanges and queues that exist, sorted
+func (s *FakeAMQPServer) Declared() (exchanges, queues []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.exchanges {
+		exchanges = append(exchanges, name)
+	}
+	for name := range s.queues {
+		queues = append(queues, name)
+	}
+	sort.Strings(exchanges)
+	sort.Strings(queues)
+	return
+}
+
+// Close stops listening, drops every connection and waits for them to finish
+func (s *FakeAMQPServer) Close() {
+	s.listener.Close()
+	s.Drop()
+	s.wg.Wait()
+}
+
+func (s *FakeAMQPServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeAMQPConn{
+			server:   s,
+			conn:     conn,
+			r:        bufio.NewReader(conn),
+			channels: map[uint16]*fakeAMQPChannel{},
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go c.serve()
+	}
+}
+
+func (s *FakeAMQPServer) fault(method string) AMQPFault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults[method]
+}
+
+// AMQP framing, from the 0-9-1 specification
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+	amqpFrameMax       = 131072
+	amqpProtocol       = "AMQP\x00\x00\x09\x01"
+)
+
+// amqpMethods names the methods the server handles or may be sent
+var amqpMethods = map[[2]uint16]string{
+	{10, 11}: "connection.start-ok", {10, 31}: "connection.tune-ok", {10, 40}: "connection.open",
+	{10, 50}: "connection.close", {10, 51}: "connection.close-ok",
+	{20, 10}: "channel.open", {20, 20}: "channel.flow", {20, 40}: "channel.close", {20, 41}: "channel.close-ok",
+	{40, 10}: "exchange.declare", {40, 20}: "exchange.delete", {40, 30}: "exchange.bind", {40, 40}: "exchange.unbind",
+	{50, 10}: "queue.declare", {50, 20}: "queue.bind", {50, 30}: "queue.purge", {50, 40}: "queue.delete", {50, 50}: "queue.unbind",
+	{60, 10}: "basic.qos", {60, 20}: "basic.consume", {60, 30}: "basic.cancel", {60, 40}: "basic.publish",
+	{60, 70}: "basic.get", {60, 80}: "basic.ack", {60, 90}: "basic.reject", {60, 110}: "basic.recover", {60, 120}: "basic.nack",
+	{85, 10}: "confirm.select",
+	{90, 10}: "tx.select", {90, 20}: "tx.commit", {90, 30}: "tx.rollback",
+}
+
+var fakeAMQPProperties = map[string]interface{}{
+	"product": "FakeAMQPServer",
+	"capabilities": map[string]interface{}{
+		"publisher_confirms":     true,
+		"basic.nack":             true,
+		"consumer_cancel_notify": true,
+	},
+}
+
+// hardError reports whether an error code closes the connection rather than
+// the channel
+func hardError(code int) bool {
+	switch code {
+	case 320, 402, 501, 502, 503, 504, 505, 506, 530, 540, 541:
+		return true
+	}
+	return false
+}
+
+type fakeAMQPExchange struct {
+	kind     string
+	bindings []fakeBinding
+}
+
+// fakeBinding binds a queue to an exchange by key, or by args for a headers
+// exchange
+type fakeBinding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type fakeAMQPQueue struct {
+	name      string
+	args      amqp.Table
+	messages  []*fakeAMQPMessage
+	consumers []*fakeAMQPConsumer
+	next      int
+}
+
+// fakeAMQPMessage keeps the content header's property flags and list as
+// they arrived, to be sent on unchanged, along with the properties routing
+// reads from them
+type fakeAMQPMessage struct {
+	properties  []byte
+	body        []byte
+	redelivered bool
+
+	key        string
+	headers    amqp.Table
+	priority   uint8
+	expiration string
+	expires    time.Time
+}
+
+type fakeAMQPConsumer struct {
+	ch    *fakeAMQPChannel
+	tag   string
+	queue string
+	noAck bool
+}
+
+type fakeAMQPUnacked struct {
+	queue string
+	msg   *fakeAMQPMessage
+}
+
+// fakeAMQPPublish is a message whose content is still arriving
+type fakeAMQPPublish struct {
+	exchange string
+	key      string
+	nack     bool
+	msg      *fakeAMQPMessage
+	size     uint64
+}
+
+type fakeAMQPChannel struct {
+	conn       *fakeAMQPConn
+	id         uint16
+	closing    bool
+	confirming bool
+	published  uint64
+	tag        uint64
+	unacked    map[uint64]fakeAMQPUnacked
+	consumers  map[string]*fakeAMQPConsumer
+	publishing *fakeAMQPPublish
+}
+
+type fakeAMQPConn struct {
+	server   *FakeAMQPServer
+	conn     net.Conn
+	r        *bufio.Reader
+	wmu      sync.Mutex
+	channels map[uint16]*fakeAMQPChannel
+}
+
+func (c *fakeAMQPConn) serve() {
+	defer c.server.wg.Done()
+	defer c.close()
+	header := make([]byte, len(amqpProtocol))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	if string(header) != amqpProtocol {
+		c.conn.Write([]byte(amqpProtocol))
+		return
+	}
+	start := amqpMethod(10, 10)
+	start.octet(0)
+	start.octet(9)
+	start.table(fakeAMQPProperties)
+	start.longstr("PLAIN")
+	start.longstr("en_US")
+	c.send(0, start)
+
+	for {
+		typ, channel, payload, err := readAMQPFrame(c.r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case amqpFrameMethod:
+			if !c.handleMethod(channel, payload) {
+				return
+			}
+		case amqpFrameHeader, amqpFrameBody:
+			if !c.handleContent(typ, channel, payload) {
+				return
+			}
+		case amqpFrameHeartbeat:
+			c.write(amqpFrame(amqpFrameHeartbeat, 0, nil))
+		}
+	}
+}
+
+// close forgets the connection, requeueing anything its channels had not
+// acknowledged
+func (c *fakeAMQPConn) close() {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range c.channels {
+		c.release(ch)
+	}
+	delete(s.conns, c)
+	c.conn.Close()
+}
+
+// handleMethod handles one method frame, returning false once the
+// connection is to be closed
+func (c *fakeAMQPConn) handleMethod(channel uint16, payload []byte) bool {
+	args := &amqpReader{b: payload}
+	class, id := args.short(), args.short()
+	name, ok := amqpMethods[[2]uint16{class, id}]
+	if !ok {
+		name = fmt.Sprintf("method %d.%d", class, id)
+	}
+	s := c.server
+	fault := s.fault(name)
+	time.Sleep(fault.Delay)
+	if fault.Drop {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ch *fakeAMQPChannel
+	if class != 10 {
+		if ch = c.channels[channel]; ch == nil && name != "channel.open" {
+			return c.fail(nil, class, id, &amqp.Error{Code: amqp.ChannelError, Reason: fmt.Sprintf("CHANNEL_ERROR - channel %d is not open", channel)})
+		}
+		if ch != nil && ch.closing && name != "channel.close" && name != "channel.close-ok" {
+			return true
+		}
+	}
+	if fault.Err != nil {
+		return c.fail(ch, class, id, fault.Err)
+	}
+
+	switch name {
+	case "connection.start-ok":
+		args.table()
+		mechanism := args.shortstr()
+		response := args.longstr()
+		if mechanism != "PLAIN" || response != "\x00"+s.user+"\x00"+s.password {
+			return c.fail(nil, class, id, &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - Login was refused using authentication mechanism " + mechanism})
+		}
+		tune := amqpMethod(10, 30)
+		tune.short(0)
+		tune.long(amqpFrameMax)
+		tune.short(0)
+		c.send(0, tune)
+	case "connection.tune-ok":
+	case "connection.open":
+		reply := amqpMethod(10, 41)
+		reply.shortstr("")
+		c.send(0, reply)
+	case "connection.close":
+		// forgotten before the reply, so Connections counts it gone as soon
+		// as the client's Close returns
+		delete(s.conns, c)
+		c.send(0, amqpMethod(10, 51))
+		return false
+	case "connection.close-ok":
+		return false
+
+	case "channel.open":
+		if ch != nil {
+			return c.fail(nil, class, id, &amqp.Error{Code: amqp.ChannelError, Reason: fmt.Sprintf("CHANNEL_ERROR - channel %d is already open", channel)})
+		}
+		c.channels[channel] = &fakeAMQPChannel{
+			conn:      c,
+			id:        channel,
+			unacked:   map[uint64]fakeAMQPUnacked{},
+			consumers: map[string]*fakeAMQPConsumer{},
+		}
+		reply := amqpMethod(20, 11)
+		reply.longstr("")
+		c.send(channel, reply)
+	case "channel.close":
+		c.release(ch)
+		c.send(channel, amqpMethod(20, 41))
+	case "channel.close-ok":
+		c.release(ch)
+
+	case "exchange.declare":
+		args.short()
+		exchange := args.shortstr()
+		kind := args.shortstr()
+		bits := args.octet()
+		args.table()
+		x, exists := s.exchanges[exchange]
+		switch {
+		case !exists && bits&1 != 0:
+			return c.fail(ch, class, id, notFound("exchange", exchange))
+		case !exists:
+			switch kind {
+			case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+			default:
+				return c.fail(nil, class, id, &amqp.Error{Code: amqp.CommandInvalid, Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind)})
+			}
+			s.exchanges[exchange] = &fakeAMQPExchange{kind: kind}
+		case bits&1 == 0 && x.kind != kind:
+			return c.fail(ch, class, id, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s' in vhost '/': received '%s' but current is '%s'", exchange, kind, x.kind)})
+		}
+		if bits&16 == 0 {
+			c.send(channel, amqpMethod(40, 11))
+		}
+	case "exchange.delete":
+		args.short()
+		exchange := args.shortstr()
+		bits := args.octet()
+		delete(s.exchanges, exchange)
+		if bits&2 == 0 {
+			c.send(channel, amqpMethod(40, 21))
+		}
+
+	case "queue.declare":
+		args.short()
+		queue := args.shortstr()
+		bits := args.octet()
+		arguments := args.table()
+		if queue == "" {
+			s.names++
+			queue = fmt.Sprintf("amq.gen-%d", s.names)
+		}
+		q, exists := s.queues[queue]
+		if !exists {
+			if bits&1 != 0 {
+				return c.fail(ch, class, id, notFound("queue", queue))
+			}
+			q = &fakeAMQPQueue{name: queue, args: arguments}
+			s.queues[queue] = q
+		}
+		if bits&16 == 0 {
+			reply := amqpMethod(50, 11)
+			reply.shortstr(queue)
+			reply.long(uint32(len(q.messages)))
+			reply.long(uint32(len(q.consumers)))
+			c.send(channel, reply)
+		}
+	case "queue.bind":
+		args.short()
+		queue := args.shortstr()
+		exchange := args.shortstr()
+		key := args.shortstr()
+		bits := args.octet()
+		arguments := args.table()
+		x, ok := s.exchanges[exchange]
+		if !ok {
+			return c.fail(ch, class, id, notFound("exchange", exchange))
+		}
+		if _, ok := s.queues[queue]; !ok {
+			return c.fail(ch, class, id, notFound("queue", queue))
+		}
+		x.bindings = append(x.bindings, fakeBinding{queue: queue, key: key, args: arguments})
+		if bits&1 == 0 {
+			c.send(channel, amqpMethod(50, 21))
+		}
+	case "queue.delete":
+		args.short()
+		queue := args.shortstr()
+		bits := args.octet()
+		count := 0
+		if q, ok := s.queues[queue]; ok {
+			count = len(q.messages)
+			for _, consumer := range q.consumers {
+				delete(consumer.ch.consumers, consumer.tag)
+				cancel := amqpMethod(60, 30)
+				cancel.shortstr(consumer.tag)
+				cancel.octet(1)
+				consumer.ch.conn.send(consumer.ch.id, cancel)
+			}
+			delete(s.queues, queue)
+			for _, x := range s.exchanges {
+				x.unbind(queue)
+			}
+		}
+		if bits&4 == 0 {
+			reply := amqpMethod(50, 41)
+			reply.long(uint32(count))
+			c.send(channel, reply)
+		}
+
+	case "basic.qos":
+		c.send(channel, amqpMethod(60, 11))
+	case "basic.consume":
+		args.short()
+		queue := args.shortstr()
+		tag := args.shortstr()
+		bits := args.octet()
+		args.table()
+		q, ok := s.queues[queue]
+		if !ok {
+			return c.fail(ch, class, id, notFound("queue", queue))
+		}
+		if tag == "" {
+			s.names++
+			tag = fmt.Sprintf("amq.ctag-%d", s.names)
+		}
+		consumer := &fakeAMQPConsumer{ch: ch, tag: tag, queue: queue, noAck: bits&2 != 0}
+		ch.consumers[tag] = consumer
+		q.consumers = append(q.consumers, consumer)
+		if bits&8 == 0 {
+			reply := amqpMethod(60, 21)
+			reply.shortstr(tag)
+			c.send(channel, reply)
+		}
+		s.dispatch(q)
+	case "basic.cancel":
+		tag := args.shortstr()
+		bits := args.octet()
+		if consumer, ok := ch.consumers[tag]; ok {
+			s.removeConsumer(consumer)
+		}
+		if bits&1 == 0 {
+			reply := amqpMethod(60, 31)
+			reply.shortstr(tag)
+			c.send(channel, reply)
+		}
+	case "basic.publish":
+		args.short()
+		exchange := args.shortstr()
+		key := args.shortstr()
+		if _, ok := s.exchanges[exchange]; !ok && exchange != "" {
+			return c.fail(ch, class, id, notFound("exchange", exchange))
+		}
+		ch.publishing = &fakeAMQPPublish{exchange: exchange, key: key, nack: fault.Nack}
+	case "basic.get":
+		args.short()
+		queue := args.shortstr()
+		noAck := args.octet()&1 != 0
+		q, ok := s.queues[queue]
+		if !ok {
+			return c.fail(ch, class, id, notFound("queue", queue))
+		}
+		s.expire()
+		if len(q.messages) == 0 {
+			empty := amqpMethod(60, 72)
+			empty.shortstr("")
+			c.send(channel, empty)
+			break
+		}
+		msg := q.pop()
+		ch.tag++
+		if !noAck {
+			ch.unacked[ch.tag] = fakeAMQPUnacked{queue: queue, msg: msg}
+		}
+		reply := amqpMethod(60, 71)
+		reply.longlong(ch.tag)
+		reply.bit(msg.redelivered)
+		reply.shortstr("")
+		reply.shortstr(queue)
+		reply.long(uint32(len(q.messages)))
+		c.deliver(channel, reply, msg)
+	case "basic.ack":
+		tag := args.longlong()
+		multiple := args.octet()&1 != 0
+		return c.settle(ch, class, id, tag, multiple, false)
+	case "basic.reject":
+		tag := args.longlong()
+		requeue := args.octet()&1 != 0
+		return c.settle(ch, class, id, tag, false, requeue)
+	case "basic.nack":
+		tag := args.longlong()
+		bits := args.octet()
+		return c.settle(ch, class, id, tag, bits&1 != 0, bits&2 != 0)
+
+	case "confirm.select":
+		ch.confirming = true
+		if args.octet()&1 == 0 {
+			c.send(channel, amqpMethod(85, 11))
+		}
+
+	default:
+		return c.fail(nil, class, id, &amqp.Error{Code: amqp.NotImplemented, Reason: "NOT_IMPLEMENTED - " + name})
+	}
+	if args.err != nil {
+		return c.fail(nil, class, id, &amqp.Error{Code: amqp.SyntaxError, Reason: "SYNTAX_ERROR - " + name + ": " + args.err.Error()})
+	}
+	return true
+}
+
+// handleContent collects the header and body of a message being published
+// and routes it once it is all there
+func (c *fakeAMQPConn) handleContent(typ byte, channel uint16, payload []byte) bool {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := c.channels[channel]
+	if ch == nil || ch.publishing == nil || (typ == amqpFrameHeader) != (ch.publishing.msg == nil) {
+		return c.fail(nil, 60, 40, &amqp.Error{Code: amqp.UnexpectedFrame, Reason: "UNEXPECTED_FRAME - content without a publish"})
+	}
+	p := ch.publishing
+	if typ == amqpFrameHeader {
+		args := &amqpReader{b: payload}
+		args.short()
+		args.short()
+		p.size = args.longlong()
+		p.msg = &fakeAMQPMessage{properties: args.b, key: p.key}
+		if err := p.msg.readProperties(); err != nil {
+			return c.fail(nil, 60, 40, &amqp.Error{Code: amqp.SyntaxError, Reason: "SYNTAX_ERROR - content header: " + err.Error()})
+		}
+	} else {
+		p.msg.body = append(p.msg.body, payload...)
+	}
+	if uint64(len(p.msg.body)) < p.size {
+		return true
+	}
+
+	ch.publishing = nil
+	if !p.nack {
+		s.route(p.exchange, p.msg)
+	}
+	if ch.confirming {
+		ch.published++
+		confirm := amqpMethod(60, 80)
+		if p.nack {
+			confirm = amqpMethod(60, 120)
+		}
+		confirm.longlong(ch.published)
+		confirm.octet(0)
+		c.send(channel, confirm)
+	}
+	return true
+}
+
+// settle acks, or rejects and maybe requeues, a delivery or all of them up
+// to and including tag
+func (c *fakeAMQPConn) settle(ch *fakeAMQPChannel, class, id uint16, tag uint64, multiple, requeue bool) bool {
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag || tag == 0 {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = []uint64{tag}
+	} else {
+		return c.fail(ch, class, id, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)})
+	}
+	settled := ch.take(tags)
+	if requeue {
+		c.server.requeue(settled)
+	}
+	return true
+}
+
+// fail closes the channel with err, or the connection if there is no
+// channel or err is a hard error. It returns false when the connection is
+// to be closed.
+func (c *fakeAMQPConn) fail(ch *fakeAMQPChannel, class, id uint16, err *amqp.Error) bool {
+	method := amqpMethod(10, 50)
+	if ch != nil && !hardError(err.Code) {
+		method = amqpMethod(20, 40)
+	}
+	method.short(uint16(err.Code))
+	method.shortstr(err.Reason)
+	method.short(class)
+	method.short(id)
+	if ch == nil || hardError(err.Code) {
+		c.send(0, method)
+		return false
+	}
+	ch.closing = true
+	c.send(ch.id, method)
+	return true
+}
+
+// release forgets a channel, cancelling its consumers and requeueing what
+// it had not acknowledged
+func (c *fakeAMQPConn) release(ch *fakeAMQPChannel) {
+	if ch == nil {
+		return
+	}
+	delete(c.channels, ch.id)
+	for _, consumer := range ch.consumers {
+		c.server.removeConsumer(consumer)
+	}
+	var tags []uint64
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	c.server.requeue(ch.take(tags))
+}
+
+// take removes deliveries from the unacknowledged set in tag order
+func (ch *fakeAMQPChannel) take(tags []uint64) []fakeAMQPUnacked {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	taken := make([]fakeAMQPUnacked, len(tags))
+	for i, t := range tags {
+		taken[i] = ch.unacked[t]
+		delete(ch.unacked, t)
+	}
+	return taken
+}
+
+// requeue puts messages back at the head of their queues, in order
+func (s *FakeAMQPServer) requeue(messages []fakeAMQPUnacked) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		q, ok := s.queues[messages[i].queue]
+		if !ok {
+			continue
+		}
+		msg := *messages[i].msg
+		msg.redelivered = true
+		q.messages = append([]*fakeAMQPMessage{&msg}, q.messages...)
+	}
+	for _, q := range s.queues {
+		s.dispatch(q)
+	}
+}
+
+func (s *FakeAMQPServer) removeConsumer(consumer *fakeAMQPConsumer) {
+	delete(consumer.ch.consumers, consumer.tag)
+	q, ok := s.queues[consumer.queue]
+	if !ok {
+		return
+	}
+	for i, other := range q.consumers {
+		if other == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+}
+
+// route puts a copy of msg on each queue exchange routes its key to
+func (s *FakeAMQPServer) route(exchange string, msg *fakeAMQPMessage) {
+	var queues []string
+	if x, ok := s.exchanges[exchange]; ok {
+		for _, b := range x.bindings {
+			if bindingMatches(x.kind, b, msg.key, msg.headers) {
+				queues = append(queues, b.queue)
+			}
+		}
+	} else if exchange == "" {
+		queues = []string{msg.key}
+	}
+
+	routed := map[string]bool{}
+	for _, name := range queues {
+		q, ok := s.queues[name]
+		if !ok || routed[name] {
+			continue
+		}
+		routed[name] = true
+		m := *msg
+		if ms, err := strconv.Atoi(m.expiration); err == nil {
+			m.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		q.messages = append(q.messages, &m)
+		s.dispatch(q)
+	}
+}
+
+func bindingMatches(kind string, b fakeBinding, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(b.key, "."), strings.Split(key, "."))
+	case amqp.ExchangeHeaders:
+		all := b.args["x-match"] != "any"
+		for name, want := range b.args {
+			if strings.HasPrefix(name, "x-") {
+				continue
+			}
+			if headers[name] == want {
+				if !all {
+					return true
+				}
+			} else if all {
+				return false
+			}
+		}
+		return all
+	}
+	return b.key == key
+}
+
+// topicMatches matches dotted words, with * standing for one word and # for any number
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && words[0] == pattern[0] && topicMatches(pattern[1:], words[1:])
+}
+
+// unbind drops the exchange's bindings to a queue
+func (x *fakeAMQPExchange) unbind(queue string) {
+	kept := x.bindings[:0]
+	for _, b := range x.bindings {
+		if b.queue != queue {
+			kept = append(kept, b)
+		}
+	}
+	x.bindings = kept
+}
+
+// expire dead letters or drops every waiting message whose TTL has passed
+func (s *FakeAMQPServer) expire() {
+	now := time.Now()
+	for _, q := range s.queues {
+		var kept, expired []*fakeAMQPMessage
+		for _, m := range q.messages {
+			if m.expires.IsZero() || now.Before(m.expires) {
+				kept = append(kept, m)
+			} else {
+				expired = append(expired, m)
+			}
+		}
+		q.messages = kept
+		dlx, ok := q.args["x-dead-letter-exchange"].(string)
+		if !ok {
+			continue
+		}
+		for _, m := range expired {
+			m.expiration = ""
+			m.expires = time.Time{}
+			s.route(dlx, m)
+		}
+	}
+}
+
+// pop takes the next message off q, the first of the highest priority when
+// q has x-max-priority
+func (q *fakeAMQPQueue) pop() *fakeAMQPMessage {
+	next := 0
+	if _, ok := q.args["x-max-priority"]; ok {
+		for i, m := range q.messages {
+			if m.priority > q.messages[next].priority {
+				next = i
+			}
+		}
+	}
+	msg := q.messages[next]
+	q.messages = append(q.messages[:next], q.messages[next+1:]...)
+	return msg
+}
+
+// readProperties reads the properties routing needs from the content
+// header's property list
+func (m *fakeAMQPMessage) readProperties() error {
+	r := &amqpReader{b: m.properties}
+	flags := r.short()
+	if flags&(1<<15) != 0 {
+		r.shortstr() // content-type
+	}
+	if flags&(1<<14) != 0 {
+		r.shortstr() // content-encoding
+	}
+	if flags&(1<<13) != 0 {
+		m.headers = r.table()
+	}
+	if flags&(1<<12) != 0 {
+		r.octet() // delivery-mode
+	}
+	if flags&(1<<11) != 0 {
+		m.priority = r.octet()
+	}
+	if flags&(1<<10) != 0 {
+		r.shortstr() // correlation-id
+	}
+	if flags&(1<<9) != 0 {
+		r.shortstr() // reply-to
+	}
+	if flags&(1<<8) != 0 {
+		m.expiration = r.shortstr()
+	}
+	return r.err
+}
+
+// dispatch hands a queue's messages to its consumers in turn
+func (s *FakeAMQPServer) dispatch(q *fakeAMQPQueue) {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		q.next = (q.next + 1) % len(q.consumers)
+		consumer := q.consumers[q.next]
+		msg := q.pop()
+		ch := consumer.ch
+		ch.tag++
+		if !consumer.noAck {
+			ch.unacked[ch.tag] = fakeAMQPUnacked{queue: q.name, msg: msg}
+		}
+		deliver := amqpMethod(60, 60)
+		deliver.shortstr(consumer.tag)
+		deliver.longlong(ch.tag)
+		deliver.bit(msg.redelivered)
+		deliver.shortstr("")
+		deliver.shortstr(q.name)
+		ch.conn.deliver(ch.id, deliver, msg)
+	}
+}
+
+func notFound(kind, name string) *amqp.Error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no %s '%s' in vhost '/'", kind, name)}
+}
+
+func (c *fakeAMQPConn) send(channel uint16, method *amqpWriter) {
+	c.write(amqpFrame(amqpFrameMethod, channel, method.Bytes()))
+}
+
+// deliver sends a method followed by a message's content
+func (c *fakeAMQPConn) deliver(channel uint16, method *amqpWriter, msg *fakeAMQPMessage) {
+	frames := [][]byte{amqpFrame(amqpFrameMethod, channel, method.Bytes())}
+	header := &amqpWriter{}
+	header.short(60)
+	header.short(0)
+	header.longlong(uint64(len(msg.body)))
+	header.Write(msg.properties)
+	frames = append(frames, amqpFrame(amqpFrameHeader, channel, header.Bytes()))
+	for body := msg.body; len(body) > 0; {
+		n := len(body)
+		if n > amqpFrameMax-8 {
+			n = amqpFrameMax - 8
+		}
+		frames = append(frames, amqpFrame(amqpFrameBody, channel, body[:n]))
+		body = body[n:]
+	}
+	c.write(frames...)
+}
+
+// write sends whole frames, ignoring errors as a dead connection is noticed
+// by its reader
+func (c *fakeAMQPConn) write(frames ...[]byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for _, f := range frames {
+		if _, err := c.conn.Write(f); err != nil {
+			return
+		}
+	}
+}
+
+func amqpFrame(typ byte, channel uint16, payload []byte) []byte {
+	f := make([]byte, 7, 8+len(payload))
+	f[0] = typ
+	binary.BigEndian.PutUint16(f[1:3], channel)
+	binary.BigEndian.PutUint32(f[3:7], uint32(len(payload)))
+	f = append(f, payload...)
+	return append(f, amqpFrameEnd)
+}
+
+func readAMQPFrame(r io.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	typ = header[0]
+	channel = binary.BigEndian.Uint16(header[1:3])
+	size := binary.BigEndian.Uint32(header[3:7])
+	if size > amqpFrameMax {
+		err = fmt.Errorf("frame of %d bytes is over the maximum", size)
+		return
+	}
+	payload = make([]byte, size+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[size] != amqpFrameEnd {
+		err = errors.New("frame end missing")
+	}
+	payload = payload[:size]
+	return
+}
+
+// amqpReader reads method arguments, recording the first error and
+// returning zero values after it
+type amqpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err == nil && len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *amqpReader) octet() byte {
+	return r.next(1)[0]
+}
+
+func (r *amqpReader) short() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *amqpReader) long() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *amqpReader) longlong() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *amqpReader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func (r *amqpReader) longstr() string {
+	return string(r.next(int(r.long())))
+}
+
+// table reads a field table
+func (r *amqpReader) table() amqp.Table {
+	fields := &amqpReader{b: r.next(int(r.long()))}
+	t := amqp.Table{}
+	for len(fields.b) > 0 && fields.err == nil {
+		name := fields.shortstr()
+		t[name] = fields.field()
+	}
+	if r.err == nil {
+		r.err = fields.err
+	}
+	return t
+}
+
+// field reads a field table value as the client library would
+func (r *amqpReader) field() interface{} {
+	switch typ := r.octet(); typ {
+	case 't':
+		return r.octet() != 0
+	case 'b':
+		return r.octet()
+	case 's':
+		return int16(r.short())
+	case 'I':
+		return int32(r.long())
+	case 'l':
+		return int64(r.longlong())
+	case 'f':
+		return math.Float32frombits(r.long())
+	case 'd':
+		return math.Float64frombits(r.longlong())
+	case 'D':
+		return amqp.Decimal{Scale: r.octet(), Value: int32(r.long())}
+	case 'S':
+		return r.longstr()
+	case 'A':
+		values := &amqpReader{b: r.next(int(r.long()))}
+		var array []interface{}
+		for len(values.b) > 0 && values.err == nil {
+			array = append(array, values.field())
+		}
+		if r.err == nil {
+			r.err = values.err
+		}
+		return array
+	case 'T':
+		return time.Unix(int64(r.longlong()), 0)
+	case 'F':
+		return r.table()
+	case 'V':
+		return nil
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown field type %q", typ)
+		}
+		return nil
+	}
+}
+
+// amqpWriter builds a frame payload
+type amqpWriter struct {
+	bytes.Buffer
+}
+
+func amqpMethod(class, id uint16) *amqpWriter {
+	w := &amqpWriter{}
+	w.short(class)
+	w.short(id)
+	return w
+}
+
+func (w *amqpWriter) octet(v byte) {
+	w.WriteByte(v)
+}
+
+func (w *amqpWriter) bit(v bool) {
+	if v {
+		w.octet(1)
+	} else {
+		w.octet(0)
+	}
+}
+
+func (w *amqpWriter) short(v uint16) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *amqpWriter) long(v uint32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *amqpWriter) longlong(v uint64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *amqpWriter) shortstr(s string) {
+	w.octet(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *amqpWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+// table writes a field table of strings, booleans and nested tables
+func (w *amqpWriter) table(t map[string]interface{}) {
+	var fields amqpWriter
+	for k, v := range t {
+		fields.shortstr(k)
+		switch v := v.(type) {
+		case string:
+			fields.octet('S')
+			fields.longstr(v)
+		case bool:
+			fields.octet('t')
+			fields.bit(v)
+		case map[string]interface{}:
+			fields.octet('F')
+			fields.table(v)
+		}
+	}
+	w.long(uint32(fields.Len()))
+	w.Write(fields.Bytes())
+}
+
+func newFakeAMQPServer(t *testing.T) *FakeAMQPServer {
+	server, err := NewFakeAMQPServer("guest", "s3cret")
+	require.NoError(t, err)
+	return server
+}
+
+func TestRMQClientImpl(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+
+	require.NoError(t, TestURI(NewRMQClient, server.URI()))
+	messages, ok := server.Queue("aChannel")
+	assert.True(t, ok)
+	assert.Empty(t, messages)
+	assert.Equal(t, 0, server.Connections())
+}
+
+func TestRMQClientImplRefused(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+
+	uri := strings.Replace(server.URI(), "s3cret", "wrong", 1)
+	err := TestURI(NewRMQClient, uri)
+	assert.Equal(t, amqp.ErrCredentials, err)
+	d := diagnoseBroker(nil, NewRMQClient, uri, "aChannel", err)
+	assert.Equal(t, []string{"dns", "tcp", "tls", "auth"}, layerNames(d))
+	assert.Equal(t, "auth", d.Category())
+}
+
+func TestRunLogin(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, RunLogin(NewRMQClient, server.URI(), &out))
+	assert.Equal(t, "Credentials accepted\n", out.String())
+	assert.Equal(t, diagnose.ExitRefused, RunLogin(NewRMQClient, strings.Replace(server.URI(), "s3cret", "wrong", 1), &out))
+
+	out.Reset()
+	failing := func() RMQClient { return &failingRMQClient{} }
+	assert.Equal(t, 1, RunLogin(failing, server.URI(), &out))
+	assert.Equal(t, "Failed to log in: connection refused\n", out.String())
+}
+
+func TestRMQClientImplPayload(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	plan, err := testplan.Parse([]byte("rmq: {probe: {payload: {queue: probe-queue}}, routing: {severity: warning}}"), "rmq", checks)
+	require.NoError(t, err)
+	payload := plan["probe"].Payload
+
+	require.NoError(t, testURI(nil, NewRMQClient, server.URI(), payload["queue"], payload["message"]))
+	_, ok := server.Queue("probe-queue")
+	assert.True(t, ok)
+	_, ok = server.Queue("aChannel")
+	assert.False(t, ok)
+	assert.Equal(t, testplan.SeverityWarning, plan["routing"].Severity)
+}
+
+func TestRMQClientImplChannelError(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	server.SetFault("queue.declare", AMQPFault{Err: &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - access to queue 'aChannel' refused"}})
+
+	err := TestURI(NewRMQClient, server.URI())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ACCESS_REFUSED")
+	assert.Equal(t, "auth", logging.ErrorClass(err))
+
+	server.SetFault("queue.declare", AMQPFault{})
+	assert.NoError(t, TestURI(NewRMQClient, server.URI()))
+}
+
+func TestRMQClientImplDropped(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	server.SetFault("basic.consume", AMQPFault{Drop: true})
+
+	err := TestURI(NewRMQClient, server.URI())
+	require.Error(t, err)
+	messages, _ := server.Queue("aChannel")
+	assert.Equal(t, []string{"a value"}, messages)
+}
+
+func TestRMQClientImplDelayed(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	server.SetFault("basic.publish", AMQPFault{Delay: 30 * time.Millisecond})
+
+	start := time.Now()
+	require.NoError(t, TestURI(NewRMQClient, server.URI()))
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+}
+
+func TestRMQClientImplReceive(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	defer func(timeout time.Duration) { amqpTimeout = timeout }(amqpTimeout)
+	amqpTimeout = 50 * time.Millisecond
+
+	client := NewRMQClient()
+	require.NoError(t, client.Connect(server.URI(), "aChannel"))
+	_, err := client.Receive()
+	assert.EqualError(t, err, "timed out after 50ms waiting for a message on aChannel")
+	assert.Equal(t, "timeout", logging.ErrorClass(err))
+	client.Close()
+
+	amqpTimeout = time.Second
+	client = NewRMQClient()
+	require.NoError(t, client.Connect(server.URI(), "aChannel"))
+	defer client.Close()
+	time.AfterFunc(20*time.Millisecond, func() { server.Drop() })
+	_, err = client.Receive()
+	assert.Error(t, err)
+}
+
+func TestRMQClientImplThroughFaultProxy(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	u, _ := url.Parse(server.URI())
+	p, err := faultproxy.New("127.0.0.1:0", u.Host)
+	require.NoError(t, err)
+	defer p.Close()
+	u.Host = p.Addr()
+	defer func(timeout time.Duration) { amqpTimeout = timeout }(amqpTimeout)
+	amqpTimeout = 100 * time.Millisecond
+
+	for _, tc := range []struct {
+		fault    faultproxy.Fault
+		category string
+	}{
+		{faultproxy.Fault{Latency: 5 * time.Millisecond}, ""},
+		{faultproxy.Fault{Blackhole: true}, "timeout"},
+		{faultproxy.Fault{HalfOpen: true}, "timeout"},
+		{faultproxy.Fault{Reset: true}, "network"},
+	} {
+		p.Set(tc.fault)
+		start := time.Now()
+		err := TestURI(NewRMQClient, u.String())
+		assert.True(t, time.Since(start) < 2*time.Second, "%+v took %v", tc.fault, time.Since(start))
+		if tc.category == "" {
+			assert.NoError(t, err, "%+v", tc.fault)
+			continue
+		}
+		if assert.Error(t, err, "%+v", tc.fault) {
+			assert.Equal(t, tc.category, logging.ErrorClass(err), "%+v: %v", tc.fault, err)
+		}
+	}
+}
+
+func TestRMQDatasetClient(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	client := NewRMQDatasetClient()
+	require.NoError(t, client.Connect(server.URI()))
+	defer client.Close()
+
+	want := dataset.Generate("plan", 5)
+	require.NoError(t, client.WriteDataset("plan", want))
+	for i := 0; i < 2; i++ {
+		got, err := client.ReadDataset("plan")
+		require.NoError(t, err)
+		assert.NoError(t, dataset.Compare(want, got))
+	}
+
+	require.NoError(t, client.DeleteDataset("plan"))
+	_, ok := server.Queue("dataset.plan")
+	assert.False(t, ok)
+	_, err := client.ReadDataset("plan")
+	assert.Contains(t, err.Error(), "NOT_FOUND")
+}
+
+func TestRMQDatasetClientDuplicate(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	client := NewRMQDatasetClient()
+	require.NoError(t, client.Connect(server.URI()))
+	defer client.Close()
+
+	want := dataset.Generate("plan", 3)
+	require.NoError(t, client.WriteDataset("plan", want))
+	// a redelivered message, as a publisher retrying after a lost confirm sends
+	ch := client.(*RMQDatasetClient).ch
+	require.NoError(t, ch.Publish("", datasetQueue("plan"), false, false, amqp.Publishing{MessageId: "1", Body: []byte("plan-1")}))
+	require.NoError(t, ch.Publish("", datasetQueue("plan"), false, false, amqp.Publishing{MessageId: "7", Body: []byte("plan-7")}))
+
+	got, err := client.ReadDataset("plan")
+	require.NoError(t, err)
+	assert.EqualError(t, dataset.Compare(want, got), "1 of 3 items duplicated [1 x2]; 1 unexpected items [7]")
+}
+
+func TestRMQDatasetClientNacked(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	server.SetFault("basic.publish", AMQPFault{Nack: true})
+	client := NewRMQDatasetClient()
+	require.NoError(t, client.Connect(server.URI()))
+	defer client.Close()
+
+	err := client.WriteDataset("plan", dataset.Generate("plan", 3))
+	assert.EqualError(t, err, "broker rejected 3 of 3 messages")
+}
+
+func TestResilienceAgainstFakeServer(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+
+	report, err := (&ResilienceMonitor{
+		Dial:         DialSession,
+		URI:          server.URI(),
+		Interval:     2 * time.Millisecond,
+		Duration:     150 * time.Millisecond,
+		Drain:        time.Second,
+		MinBackoff:   2 * time.Millisecond,
+		MaxBackoff:   10 * time.Millisecond,
+		Disrupt:      server.Drop,
+		DisruptAfter: 40 * time.Millisecond,
+	}).Run()
+	require.NoError(t, err)
+	require.Len(t, report.Disruptions, 1)
+	assert.NotZero(t, report.Disruptions[0].Recovered)
+	assert.Empty(t, report.Lost)
+	assert.True(t, report.OK(), report.String())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// IsolationResult is one attempt to reach tenant A's data as tenant B
+type IsolationResult struct {
+	Check    string
+	Isolated bool
+	Detail   string
+}
+
+func (r IsolationResult) String() string {
+	if r.Isolated {
+		return "PASS " + r.Check
+	}
+	return fmt.Sprintf("FAIL %s: security: %s", r.Check, r.Detail)
+}
+
+// CheckIsolation leaves a secret message on a queue in service A's vhost and
+// then tries to connect to that vhost and read the queue with service B's
+// credentials
+func CheckIsolation(fac DatasetClientFactory, serviceA, serviceB string) ([]IsolationResult, error) {
+	if serviceB == "" {
+		return nil, fmt.Errorf("no second service to check isolation against")
+	}
+	_, uriA, err := GetURI(serviceA)
+	if err != nil {
+		return nil, err
+	}
+	_, uriB, err := GetURI(serviceB)
+	if err != nil {
+		return nil, err
+	}
+	cross, err := crossURI(uriA, uriB)
+	if err != nil {
+		return nil, err
+	}
+
+	a := fac()
+	defer a.Close()
+	if err := a.Connect(uriA); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("isolation-%d", time.Now().UnixNano())
+	if err := a.WriteDataset(id, map[string]string{"secret": id}); err != nil {
+		return nil, err
+	}
+	defer a.DeleteDataset(id)
+
+	var results []IsolationResult
+
+	intruder := fac()
+	connectErr := intruder.Connect(cross)
+	intruder.Close()
+	results = append(results, IsolationResult{
+		Check:    "connect",
+		Isolated: connectErr != nil,
+		Detail:   "service B's credentials opened service A's vhost",
+	})
+
+	b := fac()
+	defer b.Close()
+	if err := b.Connect(uriB); err != nil {
+		return nil, err
+	}
+	items, readErr := b.ReadDataset(id)
+	results = append(results, IsolationResult{
+		Check:    "read",
+		Isolated: readErr != nil || len(items) == 0,
+		Detail:   fmt.Sprintf("service B read queue %s in service A's vhost", datasetQueue(id)),
+	})
+	return results, nil
+}
+
+// crossURI returns service A's broker and vhost with service B's user
+func crossURI(uriA, uriB string) (string, error) {
+	a, err := url.Parse(uriA)
+	if err != nil {
+		return "", err
+	}
+	b, err := url.Parse(uriB)
+	if err != nil {
+		return "", err
+	}
+	a.User = b.User
+	return a.String(), nil
+}
+
+// IsolationHandler checks the service named by RMQ_SERVICENAME is isolated
+// from the one named by RMQ_ISOLATION_SERVICENAME, both bound to this app
+func IsolationHandler(fac DatasetClientFactory, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		results, err := CheckIsolation(fac, serviceName, os.Getenv("RMQ_ISOLATION_SERVICENAME"))
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check isolation: %v", err)
+			return
+		}
+		status := http.StatusOK
+		for _, result := range results {
+			if !result.Isolated {
+				status = http.StatusFailedDependency
+			}
+		}
+		w.WriteHeader(status)
+		for _, result := range results {
+			fmt.Fprintln(w, result)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantBroker stands in for a broker with a vhost per user. Unless Open is
+// set users may only connect to their own vhost.
+type tenantBroker struct {
+	Open bool
+
+	vhosts map[string]map[string]map[string]string
+	owners map[string]string
+}
+
+func newTenantBroker() *tenantBroker {
+	return &tenantBroker{
+		vhosts: map[string]map[string]map[string]string{"vhost-a": {}, "vhost-b": {}},
+		owners: map[string]string{"user-a": "vhost-a", "user-b": "vhost-b"},
+	}
+}
+
+type tenantClient struct {
+	broker *tenantBroker
+	FakeDatasetClient
+}
+
+func (b *tenantBroker) Client() DatasetClient {
+	return &tenantClient{broker: b}
+}
+
+func (c *tenantClient) Connect(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	vhost := u.Path[1:]
+	if !c.broker.Open && c.broker.owners[u.User.Username()] != vhost {
+		return errors.New("Exception (403) Reason: \"no access to this vhost\"")
+	}
+	c.Queues = c.broker.vhosts[vhost]
+	if c.broker.Open {
+		c.Queues = c.broker.vhosts["vhost-a"]
+	}
+	return nil
+}
+
+func setupTenants() {
+	os.Setenv("VCAP_SERVICES", `{
+		"rabbitmq": [
+			{"credentials": {"uri": "amqp://user-a:a@broker/vhost-a"}, "label": "rabbitmq", "name": "tenant-a"},
+			{"credentials": {"uri": "amqp://user-b:b@broker/vhost-b"}, "label": "rabbitmq", "name": "tenant-b"}
+		]
+	}`)
+	os.Setenv("VCAP_APPLICATION", "{}")
+}
+
+func TestCheckIsolation(t *testing.T) {
+	setupTenants()
+	broker := newTenantBroker()
+
+	results, err := CheckIsolation(broker.Client, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, r := range results {
+		assert.True(t, r.Isolated, r.String())
+	}
+	assert.Empty(t, broker.vhosts["vhost-a"], "the marker queue should be removed")
+}
+
+func TestCheckIsolationOpen(t *testing.T) {
+	setupTenants()
+	broker := newTenantBroker()
+	broker.Open = true
+
+	results, err := CheckIsolation(broker.Client, "tenant-a", "tenant-b")
+	require.NoError(t, err)
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, r.String())
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, "FAIL connect: security: service B's credentials opened service A's vhost", lines[0])
+	assert.Contains(t, lines[1], "FAIL read: security: service B read queue dataset.isolation-")
+}
+
+func TestCrossURI(t *testing.T) {
+	uri, err := crossURI("amqps://user-a:a@broker:5671/vhost-a", "amqps://user-b:b@other:5671/vhost-b")
+	require.NoError(t, err)
+	assert.Equal(t, "amqps://user-b:b@broker:5671/vhost-a", uri)
+}
+
+func TestIsolationHandler(t *testing.T) {
+	setupTenants()
+	os.Setenv("RMQ_ISOLATION_SERVICENAME", "tenant-b")
+	defer os.Unsetenv("RMQ_ISOLATION_SERVICENAME")
+
+	w := httptest.NewRecorder()
+	IsolationHandler(newTenantBroker().Client, "tenant-a")(w, httptest.NewRequest("GET", "http://x/isolation", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "PASS connect\nPASS read\n", w.Body.String())
+}
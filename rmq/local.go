@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LocalOptions gathers connection details for a local run. A credentials file
+// is read first and AMQP_URL or -url wins over it.
+type LocalOptions struct {
+	File string
+	URL  string
+}
+
+// Register adds the local run flags to fs
+func (o *LocalOptions) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.File, "creds", "", "YAML or JSON file holding service credentials")
+	fs.StringVar(&o.URL, "url", os.Getenv("AMQP_URL"), "AMQP URL (default $AMQP_URL)")
+}
+
+// localCredentials mirrors the credentials block of a RabbitMQ service binding
+type localCredentials struct {
+	URI string `yaml:"uri"`
+	SSL bool   `yaml:"ssl"`
+}
+
+// URI resolves the options into an AMQP URI
+func (o LocalOptions) URI() (uri string, err error) {
+	if o.File != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(o.File); err != nil {
+			return
+		}
+		var creds localCredentials
+		if err = yaml.Unmarshal(data, &creds); err != nil {
+			err = fmt.Errorf("Failed to parse %s: %v", o.File, err)
+			return
+		}
+		uri = creds.URI
+	}
+
+	if o.URL != "" {
+		uri = o.URL
+	}
+
+	if uri == "" {
+		err = fmt.Errorf("no AMQP URL given, use -url, -creds or AMQP_URL")
+		return
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "amqp" && u.Scheme != "amqps" {
+		err = fmt.Errorf("unsupported AMQP URL scheme %q", u.Scheme)
+	}
+	return
+}
+
+// RunLocal runs the probe once, prints the result and returns the exit code
+func RunLocal(fac RMQClientFactory, uri string, out io.Writer) int {
+	if err := TestURI(fac, uri); err != nil {
+		fmt.Fprintf(out, "Failed to access RMQ: %v\n%v\n", err, diagnoseBroker(nil, fac, uri, checks["probe"].Payload["queue"], err))
+		return 1
+	}
+
+	fmt.Fprintln(out, "RMQ service is OK")
+	return 0
+}
+
+// RunLogin only logs in to the broker, as the probe does with its default
+// queue, prints the result and returns the exit code, which is
+// diagnose.ExitRefused when the broker refuses the credentials
+func RunLogin(fac RMQClientFactory, uri string, out io.Writer) int {
+	t, err := brokerTarget(fac, uri, checks["probe"].Payload["queue"])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to read credentials: %v\n", err)
+		return 1
+	}
+	return t.Login(out)
+}
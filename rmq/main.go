@@ -2,21 +2,122 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/ONSdigital/cf-tests/probe/auth"
+	"github.com/ONSdigital/cf-tests/probe/coalesce"
+	"github.com/ONSdigital/cf-tests/probe/diagnose"
+	"github.com/ONSdigital/cf-tests/probe/discovery"
+	"github.com/ONSdigital/cf-tests/probe/health"
+	"github.com/ONSdigital/cf-tests/probe/logging"
+	"github.com/ONSdigital/cf-tests/probe/serve"
+	"github.com/ONSdigital/cf-tests/probe/testplan"
+	"github.com/ONSdigital/cf-tests/probe/tracing"
 	"github.com/streadway/amqp"
 )
 
 func main() {
-	port := os.Getenv("PORT")
+	local := flag.Bool("local", false, "run the probe once outside Cloud Foundry and exit")
+	var opts LocalOptions
+	opts.Register(flag.CommandLine)
+	var resilience ResilienceOptions
+	resilience.Register(flag.CommandLine)
+	routing := flag.Bool("routing", false, "with -local, run the exchange and routing checks instead of the basic probe")
+	routingChecks := flag.String("routing-checks", "", "comma separated routing checks to run (default all)")
+	requireTLS := flag.Bool("require-tls", false, "with -local, also check the broker refuses a plaintext connection")
+	login := flag.Bool("login", false, "with -local, only log in, exiting 3 if the broker refuses the credentials")
+	flag.Parse()
+
 	serviceName := os.Getenv("RMQ_SERVICENAME")
-	handler := WebHandler(NewRMQClient, serviceName)
+	if *local || resilience.Duration > 0 {
+		var uri string
+		var err error
+		if *local {
+			uri, err = opts.URI()
+		} else {
+			_, uri, err = GetURI(serviceName)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if resilience.Duration > 0 {
+			os.Exit(RunResilience(resilience.Monitor(DialSession, uri, os.Stderr), os.Stdout))
+		}
+		if *local && *login {
+			os.Exit(RunLogin(NewRMQClient, uri, os.Stdout))
+		}
+		if *routing {
+			var names []string
+			if *routingChecks != "" {
+				names = strings.Split(*routingChecks, ",")
+			}
+			os.Exit(RunRouting(DialRoutingBroker(uri), names, os.Stdout))
+		}
+		code := RunLocal(NewRMQClient, uri, os.Stdout)
+		if *requireTLS && RunTransport(DialPlaintext, uri, os.Stdout) != 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	access, err := auth.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	plan, err := testplan.Load("rmq", checks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	payload := plan["probe"].Payload
+	minInterval, err := coalesce.MinIntervalFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grace, err := serve.GraceFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	port := os.Getenv("PORT")
+	probe := coalesce.New(ProbeHandler(NewRMQClient, serviceName, payload["queue"], payload["message"]), minInterval)
+	mux := http.NewServeMux()
+	mux.Handle("/", plan["probe"].Wrap(probe))
+	plan.Handle(mux, "probe", probe)
+	mux.Handle("/dataset/", DatasetHandler(NewRMQDatasetClient, serviceName))
+	plan.Handle(mux, "ping", PingHandler(NewRMQDatasetClient, serviceName))
+	plan.Handle(mux, "routing", RoutingHandler(serviceName, DialRoutingBroker))
+	plan.Handle(mux, "isolation", IsolationHandler(NewRMQDatasetClient, serviceName))
+	plan.Handle(mux, "transport", TransportHandler(DialPlaintext, serviceName))
+	mux.Handle("/healthz", health.Healthz())
+	mux.Handle("/readyz", health.Readyz(func() error {
+		_, _, err := GetURI(serviceName)
+		return err
+	}, probe))
 
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	logger := &logging.Logger{Out: os.Stdout, Service: serviceName}
+	tracer := tracing.FromEnv("cf-test-rmq", discovery.Attributes(serviceName, discovery.Getenv("RMQ_SERVICELABEL", "rabbitmq"), discovery.Getenv("RMQ_SERVICETAG", "rabbitmq")))
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go probe.Refresh()
+	plan.Schedule(logging.LogRequests(logger, tracing.TraceRequests(tracer, mux)), nil)
+	if err := serve.Serve(&http.Server{Handler: logging.LogRequests(logger, tracing.TraceRequests(tracer, access.Wrap(mux)))}, l, signals, grace, &openConns, tracer); err != nil {
+		log.Fatal(err)
+	}
 }
 
 type RMQClient interface {
@@ -28,11 +129,39 @@ type RMQClient interface {
 
 type RMQClientFactory func() RMQClient
 
+// checks are the probe's checks as they run without a test plan
+var checks = testplan.Plan{
+	"probe":     {Path: "/probe", Enabled: true, Severity: testplan.SeverityCritical, Payload: map[string]string{"queue": "aChannel", "message": "a value"}},
+	"ping":      {Path: "/ping", Enabled: true, Severity: testplan.SeverityCritical},
+	"routing":   {Path: "/routing", Enabled: true, Severity: testplan.SeverityCritical},
+	"isolation": {Path: "/isolation", Enabled: true, Severity: testplan.SeverityCritical},
+	"transport": {Path: "/transport", Enabled: true, Severity: testplan.SeverityCritical},
+}
+
+// WebHandler probes with the default queue and message
 func WebHandler(fac RMQClientFactory, serviceName string) http.HandlerFunc {
+	payload := checks["probe"].Payload
+	return ProbeHandler(fac, serviceName, payload["queue"], payload["message"])
+}
+
+// ProbeHandler provides a test endpoint that sends message through queue
+func ProbeHandler(fac RMQClientFactory, serviceName, queue, message string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if err := PerformTest(fac, serviceName); err != nil {
+		run := logging.RunFrom(req.Context())
+		if run != nil {
+			w.Header().Set(logging.RunIDHeader, run.ID)
+		}
+		if err := run.Step("probe", func() error {
+			return performTest(run, fac, serviceName, queue, message)
+		}); err != nil {
+			var d *diagnose.Diagnosis
+			run.Step("diagnose", func() error {
+				d = diagnoseService(run, fac, serviceName, queue, err)
+				return d.Err()
+			})
+			w.Header().Set(logging.ErrorCategoryHeader, d.Category())
 			w.WriteHeader(http.StatusFailedDependency)
-			fmt.Fprintf(w, "Failed to access RMQ: %v", err)
+			fmt.Fprintf(w, "Failed to access RMQ: %v\n%v\n", err, d)
 			return
 		}
 
@@ -41,50 +170,143 @@ func WebHandler(fac RMQClientFactory, serviceName string) http.HandlerFunc {
 	}
 }
 
+// PerformTest looks up the bound service and runs TestURI against it
 func PerformTest(fac RMQClientFactory, serviceName string) error {
-	client := fac()
-	defer client.Close()
-	_, uri, err := GetURI(serviceName)
-	if err != nil {
-		return err
-	}
-	channelName := "aChannel"
-	value := "a value"
-	if err := client.Connect(uri, channelName); err != nil {
+	payload := checks["probe"].Payload
+	return performTest(nil, fac, serviceName, payload["queue"], payload["message"])
+}
+
+func performTest(run *logging.Run, fac RMQClientFactory, serviceName, queue, message string) error {
+	var uri string
+	if err := run.Step("credentials", func() (err error) {
+		_, uri, err = GetURI(serviceName)
+		if u, parseErr := url.Parse(uri); err == nil && parseErr == nil {
+			run.Attribute("server.address", u.Hostname())
+			if port := u.Port(); port != "" {
+				run.Attribute("server.port", port)
+			}
+		}
+		return
+	}); err != nil {
 		return err
 	}
-	if err := client.Send(value); err != nil {
+	return testURI(run, fac, uri, queue, message)
+}
+
+// TestURI sends a value through a queue on the broker at uri and checks it comes back
+func TestURI(fac RMQClientFactory, uri string) error {
+	payload := checks["probe"].Payload
+	return testURI(nil, fac, uri, payload["queue"], payload["message"])
+}
+
+func testURI(run *logging.Run, fac RMQClientFactory, uri, queue, value string) error {
+	client := fac()
+	if err := run.Step("connect", func() error {
+		return client.Connect(uri, queue)
+	}); err != nil {
+		client.Close()
 		return err
 	}
-	if newValue, err := client.Receive(); err != nil {
+	defer run.Step("cleanup", func() error {
+		client.Close()
+		return nil
+	})
+	if err := run.Step("write", func() error {
+		return client.Send(value)
+	}); err != nil {
 		return err
-	} else if newValue != value {
-		return errors.New("Did not receive back the value I sent")
 	}
-	return nil
+	return run.Step("read", func() error {
+		if newValue, err := client.Receive(); err != nil {
+			return err
+		} else if newValue != value {
+			return errors.New("Did not receive back the value I sent")
+		}
+		return nil
+	})
 }
 
-func GetURI(serviceName string) (ssl bool, uri string, err error) {
-	app, err := cfenv.Current()
+// brokerAddress is the host:port an AMQP URI connects to, with the default
+// port for its scheme when it leaves one out
+func brokerAddress(uri string) (string, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
-		return
+		return "", err
 	}
+	port := u.Port()
+	switch {
+	case port != "":
+	case u.Scheme == "amqps":
+		port = "5671"
+	default:
+		port = "5672"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
 
-	svc, err := app.Services.WithName(serviceName)
+// GetURI reads the AMQP URI from VCAP_SERVICES. Without a service name the
+// binding is found by RMQ_SERVICELABEL or RMQ_SERVICETAG instead.
+func GetURI(serviceName string) (ssl bool, uri string, err error) {
+	label := discovery.Getenv("RMQ_SERVICELABEL", "rabbitmq")
+	tag := discovery.Getenv("RMQ_SERVICETAG", "rabbitmq")
+	svc, err := discovery.Find(serviceName, label, tag)
 	if err != nil {
 		return
 	}
 
 	ssl, _ = svc.Credentials["ssl"].(bool)
 	uri, _ = svc.CredentialString("uri")
+	if addr, aerr := brokerAddress(uri); aerr == nil {
+		redirects.set(uri, discovery.BackendAddress(svc.Name, serviceName == os.Getenv("RMQ_SERVICENAME"), addr))
+	}
 
 	return
 }
 
+// redirects maps URIs to the address connections for them are made to, as
+// GetURI finds it in BackendAddressEnv. The URI keeps the broker's own host,
+// so TLS still checks the broker's certificate.
+var redirects = redirectMap{to: map[string]string{}}
+
+type redirectMap struct {
+	mu sync.Mutex
+	to map[string]string
+}
+
+// set records that connections for uri go to addr, dropping the entry when
+// addr is the broker's own
+func (m *redirectMap) set(uri, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if own, err := brokerAddress(uri); err == nil && own == addr {
+		delete(m.to, uri)
+		return
+	}
+	m.to[uri] = addr
+}
+
+// get returns where connections for uri go, or addr when they are not
+// redirected
+func (m *redirectMap) get(uri, addr string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if to, ok := m.to[uri]; ok {
+		return to
+	}
+	return addr
+}
+
+// dialBroker makes the TCP connection for an AMQP connection to uri, which
+// the library asks for by the broker's address addr
+func dialBroker(uri, network, addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, redirects.get(uri, addr), timeout)
+}
+
 type RMQClientImpl struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
-	q    amqp.Queue
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+	q      amqp.Queue
+	closes chan *amqp.Error
 }
 
 func NewRMQClient() RMQClient {
@@ -92,7 +314,7 @@ func NewRMQClient() RMQClient {
 }
 
 func (c *RMQClientImpl) Connect(uri string, channelName string) (err error) {
-	c.conn, err = amqp.Dial(uri)
+	c.conn, err = dial(uri)
 	if err != nil {
 		return
 	}
@@ -100,6 +322,7 @@ func (c *RMQClientImpl) Connect(uri string, channelName string) (err error) {
 	if err != nil {
 		return
 	}
+	c.closes = c.ch.NotifyClose(make(chan *amqp.Error, 1))
 	c.q, err = c.ch.QueueDeclare(channelName, false, false, false, false, nil)
 	if err != nil {
 		return
@@ -125,15 +348,24 @@ func (c *RMQClientImpl) Receive() (value string, err error) {
 	if err != nil {
 		return
 	}
-	msg := <-msgs
-	value = string(msg.Body)
+	select {
+	case msg, ok := <-msgs:
+		if !ok {
+			// the channel's close error, if any, is sent before consumers close
+			if e := <-c.closes; e != nil {
+				return "", e
+			}
+			return "", amqp.ErrClosed
+		}
+		value = string(msg.Body)
+	case <-time.After(amqpTimeout):
+		err = fmt.Errorf("timed out after %v waiting for a message on %s", amqpTimeout, c.q.Name)
+	}
 	return
 }
 
 func (c *RMQClientImpl) Close() {
-	if c.conn != nil {
-		c.conn.Close()
-	}
+	closeConn(c.conn)
 	if c.ch != nil {
 		c.ch.Close()
 	}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Session is one connection to the broker with the resilience queue declared
+// and a consumer on it
+type Session interface {
+	// Publish sends seq and returns once the broker has confirmed it
+	Publish(seq int) error
+	// Deliveries yields the sequence numbers consumed from the queue
+	Deliveries() <-chan int
+	// Closed yields an error when the connection goes away
+	Closed() <-chan error
+	DeleteQueue() error
+	Close()
+}
+
+// SessionDialer connects to uri and declares queue, which must survive
+// reconnects, so that dialling again redeclares the same topology
+type SessionDialer func(uri, queue string) (Session, error)
+
+// Disruption is one loss of the connection, as offsets from the start of
+// the run. Recovered is zero if the session never came back.
+type Disruption struct {
+	At        time.Duration
+	Recovered time.Duration
+	Attempts  int
+	Err       error
+}
+
+// ResilienceReport is the outcome of a resilience run. Lost messages were
+// confirmed by the broker but never consumed; duplicated ones were consumed
+// more than once.
+type ResilienceReport struct {
+	Published   int
+	Failed      int
+	Disruptions []Disruption
+	Lost        []int
+	Duplicated  []int
+	DisruptErr  error
+}
+
+// OK is true when every disruption was recovered and no confirmed message was lost
+func (r ResilienceReport) OK() bool {
+	for _, d := range r.Disruptions {
+		if d.Recovered == 0 {
+			return false
+		}
+	}
+	return len(r.Lost) == 0
+}
+
+func (r ResilienceReport) String() string {
+	ms := func(d time.Duration) time.Duration { return d - d%time.Millisecond }
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "messages: %d published, %d failed\n", r.Published, r.Failed)
+	for _, d := range r.Disruptions {
+		if d.Recovered == 0 {
+			fmt.Fprintf(&b, "disconnected at %v and not recovered after %d attempts: %v\n", ms(d.At), d.Attempts, d.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "disconnected at %v, recovered in %v after %d attempts: %v\n", ms(d.At), ms(d.Recovered-d.At), d.Attempts, d.Err)
+	}
+	fmt.Fprintf(&b, "lost messages: %d %v\n", len(r.Lost), r.Lost)
+	fmt.Fprintf(&b, "duplicated messages: %d %v\n", len(r.Duplicated), r.Duplicated)
+	if r.DisruptErr != nil {
+		fmt.Fprintf(&b, "disrupt hook: %v\n", r.DisruptErr)
+	}
+	return b.String()
+}
+
+// ResilienceMonitor holds a long-lived connection and consumer, publishing a
+// sequence number every Interval for Duration. When the connection closes it
+// reconnects with exponential backoff from MinBackoff to MaxBackoff and
+// redeclares its queue. Afterwards it waits up to Drain for outstanding
+// messages and works out which were lost or duplicated. Disrupt, when set,
+// is called DisruptAfter into the run to break the connection, such as by
+// restarting the broker.
+type ResilienceMonitor struct {
+	Dial         SessionDialer
+	URI          string
+	Interval     time.Duration
+	Duration     time.Duration
+	Drain        time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	Disrupt      func() error
+	DisruptAfter time.Duration
+	Out          io.Writer
+}
+
+// Run performs the test and returns the report. The error is only set when
+// the first connection fails.
+func (m *ResilienceMonitor) Run() (report ResilienceReport, err error) {
+	queue := fmt.Sprintf("resilience.%d", time.Now().UnixNano())
+	session, err := m.Dial(m.URI, queue)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if session != nil {
+			session.DeleteQueue()
+			session.Close()
+		}
+	}()
+
+	start := time.Now()
+	confirmed := map[int]bool{}
+	received := map[int]int{}
+	deliveries, closed := session.Deliveries(), session.Closed()
+	var disrupt chan error
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	deadline := time.After(m.Duration)
+	seq := 0
+
+run:
+	for {
+		select {
+		case <-deadline:
+			break run
+		case n, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			received[n]++
+		case err := <-closed:
+			at := time.Since(start)
+			m.log("%v: connection closed: %v", at, err)
+			session.Close()
+			session = nil
+			disruption := m.reconnect(queue, start, err, &session)
+			report.Disruptions = append(report.Disruptions, disruption)
+			if session == nil {
+				break run
+			}
+			m.log("%v: reconnected after %d attempts", disruption.Recovered, disruption.Attempts)
+			deliveries, closed = session.Deliveries(), session.Closed()
+		case <-ticker.C:
+			if m.Disrupt != nil && disrupt == nil && time.Since(start) >= m.DisruptAfter {
+				m.log("%v: disrupting the connection", time.Since(start))
+				disrupt = make(chan error, 1)
+				go func() { disrupt <- m.Disrupt() }()
+			}
+			seq++
+			report.Published++
+			if err := session.Publish(seq); err != nil {
+				report.Failed++
+				continue
+			}
+			confirmed[seq] = true
+		}
+	}
+
+	if disrupt != nil {
+		report.DisruptErr = <-disrupt
+	}
+	if session != nil {
+		m.drain(deliveries, confirmed, received)
+	}
+
+	for n := 1; n <= seq; n++ {
+		if confirmed[n] && received[n] == 0 {
+			report.Lost = append(report.Lost, n)
+		}
+		if received[n] > 1 {
+			report.Duplicated = append(report.Duplicated, n)
+		}
+	}
+	return report, nil
+}
+
+// reconnect dials with backoff until a session is made or the run's time is up
+func (m *ResilienceMonitor) reconnect(queue string, start time.Time, cause error, session *Session) Disruption {
+	d := Disruption{At: time.Since(start), Err: cause}
+	backoff := m.MinBackoff
+	for time.Since(start) < m.Duration {
+		time.Sleep(backoff)
+		d.Attempts++
+		s, err := m.Dial(m.URI, queue)
+		if err == nil {
+			*session = s
+			d.Recovered = time.Since(start)
+			return d
+		}
+		m.log("%v: reconnect failed: %v", time.Since(start), err)
+		if backoff *= 2; backoff > m.MaxBackoff {
+			backoff = m.MaxBackoff
+		}
+	}
+	return d
+}
+
+// drain consumes until every confirmed message has arrived or Drain passes
+func (m *ResilienceMonitor) drain(deliveries <-chan int, confirmed map[int]bool, received map[int]int) {
+	outstanding := 0
+	for n := range confirmed {
+		if received[n] == 0 {
+			outstanding++
+		}
+	}
+	timeout := time.After(m.Drain)
+	for outstanding > 0 && deliveries != nil {
+		select {
+		case n, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			if confirmed[n] && received[n] == 0 {
+				outstanding--
+			}
+			received[n]++
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (m *ResilienceMonitor) log(format string, args ...interface{}) {
+	if m.Out != nil {
+		fmt.Fprintf(m.Out, format+"\n", args...)
+	}
+}
+
+// amqpSession is a Session on a real broker, with separate channels for
+// publishing and consuming
+type amqpSession struct {
+	conn       *amqp.Connection
+	pub        *amqp.Channel
+	confirms   chan amqp.Confirmation
+	queue      string
+	deliveries chan int
+	closed     chan error
+	done       chan struct{}
+}
+
+// DialSession connects to uri and declares queue as a durable queue
+func DialSession(uri, queue string) (Session, error) {
+	conn, err := amqp.DialConfig(uri, amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+		Dial: func(network, addr string) (net.Conn, error) {
+			return dialBroker(uri, network, addr, 30*time.Second)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &amqpSession{
+		conn:       conn,
+		queue:      queue,
+		deliveries: make(chan int, 64),
+		closed:     make(chan error, 1),
+		done:       make(chan struct{}),
+	}
+	if err := s.setup(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *amqpSession) setup() error {
+	var err error
+	if s.pub, err = s.conn.Channel(); err != nil {
+		return err
+	}
+	if _, err = s.pub.QueueDeclare(s.queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err = s.pub.Confirm(false); err != nil {
+		return err
+	}
+	s.confirms = s.pub.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	sub, err := s.conn.Channel()
+	if err != nil {
+		return err
+	}
+	msgs, err := sub.Consume(s.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	notify := s.conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if e, ok := <-notify; ok {
+			s.closed <- e
+			return
+		}
+		s.closed <- errors.New("connection closed")
+	}()
+
+	go func() {
+		defer close(s.deliveries)
+		for d := range msgs {
+			if seq, err := strconv.Atoi(d.MessageId); err == nil {
+				select {
+				case s.deliveries <- seq:
+				case <-s.done:
+					return
+				}
+			}
+			d.Ack(false)
+		}
+	}()
+	return nil
+}
+
+func (s *amqpSession) Publish(seq int) error {
+	err := s.pub.Publish("", s.queue, false, false, amqp.Publishing{
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    strconv.Itoa(seq),
+		Body:         []byte(strconv.Itoa(seq)),
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case confirm, ok := <-s.confirms:
+		if !ok {
+			return errors.New("channel closed before the message was confirmed")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected message %d", seq)
+		}
+		return nil
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("message %d not confirmed", seq)
+	}
+}
+
+func (s *amqpSession) Deliveries() <-chan int {
+	return s.deliveries
+}
+
+func (s *amqpSession) Closed() <-chan error {
+	return s.closed
+}
+
+func (s *amqpSession) DeleteQueue() error {
+	_, err := s.pub.QueueDelete(s.queue, false, false, false)
+	return err
+}
+
+func (s *amqpSession) Close() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.conn.Close()
+}
+
+// ResilienceOptions holds the flags for a resilience run
+type ResilienceOptions struct {
+	Duration       time.Duration
+	Interval       time.Duration
+	MaxBackoff     time.Duration
+	DisruptAfter   time.Duration
+	DisruptCommand string
+}
+
+// Register adds the resilience flags to fs
+func (o *ResilienceOptions) Register(fs *flag.FlagSet) {
+	fs.DurationVar(&o.Duration, "resilience", 0, "hold a connection open for this long, reconnecting when it drops, report lost and duplicated messages and exit")
+	fs.DurationVar(&o.Interval, "publish-interval", 100*time.Millisecond, "time between messages")
+	fs.DurationVar(&o.MaxBackoff, "max-backoff", 10*time.Second, "longest wait between reconnect attempts")
+	fs.DurationVar(&o.DisruptAfter, "disrupt-after", 10*time.Second, "when to run -disrupt-command")
+	fs.StringVar(&o.DisruptCommand, "disrupt-command", "", "shell command that breaks the connection, such as a broker restart (default wait for one started elsewhere)")
+}
+
+// Monitor builds a ResilienceMonitor from the options, logging progress to out
+func (o ResilienceOptions) Monitor(dial SessionDialer, uri string, out io.Writer) *ResilienceMonitor {
+	m := &ResilienceMonitor{
+		Dial:         dial,
+		URI:          uri,
+		Interval:     o.Interval,
+		Duration:     o.Duration,
+		Drain:        10 * time.Second,
+		MinBackoff:   100 * time.Millisecond,
+		MaxBackoff:   o.MaxBackoff,
+		DisruptAfter: o.DisruptAfter,
+		Out:          out,
+	}
+	if o.DisruptCommand != "" {
+		command := o.DisruptCommand
+		m.Disrupt = func() error {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Stdout = out
+			cmd.Stderr = out
+			return cmd.Run()
+		}
+	}
+	return m
+}
+
+// RunResilience runs the monitor, prints the report and returns the exit code
+func RunResilience(m *ResilienceMonitor, out io.Writer) int {
+	report, err := m.Run()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to access RMQ: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprint(out, report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
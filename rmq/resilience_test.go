@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FaultyBroker is an in-memory stand-in for a broker whose connections can
+// be dropped on purpose. Messages not yet consumed when a connection drops
+// are delivered again on the next one. After each Drop the next RefuseDials
+// dials fail, the last DuplicateOnDrop delivered messages are delivered again
+// and the next LoseOnDrop confirmed messages are never delivered.
+type FaultyBroker struct {
+	RefuseDials     int
+	DuplicateOnDrop int
+	LoseOnDrop      int
+
+	mu        sync.Mutex
+	Dials     int
+	Queues    map[string]bool
+	session   *faultySession
+	delivered []int
+	requeued  []int
+	refusing  int
+	losing    int
+}
+
+func NewFaultyBroker() *FaultyBroker {
+	return &FaultyBroker{Queues: map[string]bool{}}
+}
+
+// Dial is a SessionDialer
+func (b *FaultyBroker) Dial(uri, queue string) (Session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Dials++
+	if b.refusing > 0 {
+		b.refusing--
+		return nil, errors.New("connection refused")
+	}
+	b.Queues[queue] = true
+	s := &faultySession{
+		broker:     b,
+		queue:      queue,
+		deliveries: make(chan int, 1024),
+		closed:     make(chan error, 1),
+	}
+	for _, seq := range b.requeued {
+		s.deliveries <- seq
+	}
+	b.requeued = nil
+	b.session = s
+	return s, nil
+}
+
+// Drop closes the current connection as a broker restart would
+func (b *FaultyBroker) Drop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.session
+	if s == nil {
+		return errors.New("no connection to drop")
+	}
+	b.session = nil
+	s.dropped = true
+	s.closed <- errors.New("CONNECTION_FORCED - broker forced connection closure")
+	close(s.deliveries)
+	for seq := range s.deliveries {
+		b.requeued = append(b.requeued, seq)
+	}
+
+	if n := b.DuplicateOnDrop; n > 0 && n <= len(b.delivered) {
+		b.requeued = append(b.requeued, b.delivered[len(b.delivered)-n:]...)
+	}
+	b.refusing = b.RefuseDials
+	b.losing = b.LoseOnDrop
+	return nil
+}
+
+type faultySession struct {
+	broker     *FaultyBroker
+	queue      string
+	deliveries chan int
+	closed     chan error
+	dropped    bool
+}
+
+func (s *faultySession) Publish(seq int) error {
+	b := s.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.dropped {
+		return errors.New("channel/connection is not open")
+	}
+	if b.losing > 0 {
+		b.losing--
+		return nil
+	}
+	b.delivered = append(b.delivered, seq)
+	s.deliveries <- seq
+	return nil
+}
+
+func (s *faultySession) Deliveries() <-chan int {
+	return s.deliveries
+}
+
+func (s *faultySession) Closed() <-chan error {
+	return s.closed
+}
+
+func (s *faultySession) DeleteQueue() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	delete(s.broker.Queues, s.queue)
+	return nil
+}
+
+func (s *faultySession) Close() {}
+
+func newResilienceMonitor(broker *FaultyBroker) *ResilienceMonitor {
+	return &ResilienceMonitor{
+		Dial:         broker.Dial,
+		URI:          "amqp://foobar",
+		Interval:     time.Millisecond,
+		Duration:     80 * time.Millisecond,
+		Drain:        50 * time.Millisecond,
+		MinBackoff:   2 * time.Millisecond,
+		MaxBackoff:   10 * time.Millisecond,
+		Disrupt:      broker.Drop,
+		DisruptAfter: 20 * time.Millisecond,
+	}
+}
+
+func TestResilienceRecovers(t *testing.T) {
+	broker := NewFaultyBroker()
+	broker.RefuseDials = 2
+
+	report, err := newResilienceMonitor(broker).Run()
+	require.NoError(t, err)
+	require.Len(t, report.Disruptions, 1)
+	d := report.Disruptions[0]
+	assert.Equal(t, 3, d.Attempts)
+	assert.True(t, d.Recovered-d.At >= 14*time.Millisecond, "recovered in %v", d.Recovered-d.At)
+	assert.Contains(t, d.Err.Error(), "CONNECTION_FORCED")
+	assert.Empty(t, report.Lost)
+	assert.Empty(t, report.Duplicated)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, broker.Dials)
+	assert.Empty(t, broker.Queues, "the queue should be deleted")
+}
+
+func TestResilienceLostAndDuplicated(t *testing.T) {
+	broker := NewFaultyBroker()
+	broker.DuplicateOnDrop = 3
+	broker.LoseOnDrop = 2
+
+	report, err := newResilienceMonitor(broker).Run()
+	require.NoError(t, err)
+	require.Len(t, report.Disruptions, 1)
+	assert.Len(t, report.Lost, 2)
+	assert.Len(t, report.Duplicated, 3)
+	assert.True(t, report.Lost[0] > report.Duplicated[2])
+	assert.False(t, report.OK())
+}
+
+func TestResilienceNotRecovered(t *testing.T) {
+	broker := NewFaultyBroker()
+	broker.RefuseDials = 1000
+
+	var out bytes.Buffer
+	code := RunResilience(newResilienceMonitor(broker), &out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out.String(), "not recovered after")
+	assert.Contains(t, out.String(), "lost messages: 0 []")
+}
+
+func TestResilienceDialFails(t *testing.T) {
+	broker := NewFaultyBroker()
+	broker.refusing = 1
+
+	var out bytes.Buffer
+	code := RunResilience(newResilienceMonitor(broker), &out)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Failed to access RMQ: connection refused\n", out.String())
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RoutingBroker is the part of an AMQP channel the routing checks use
+type RoutingBroker interface {
+	ExchangeDeclare(name, kind string) error
+	QueueDeclare(name string, args amqp.Table) error
+	QueueBind(queue, key, exchange string, args amqp.Table) error
+	Publish(exchange, key string, msg amqp.Publishing) error
+	// Get takes the next message off queue, if there is one, and returns its body
+	Get(queue string) (body string, ok bool, err error)
+	ExchangeDelete(name string) error
+	QueueDelete(name string) error
+	Close()
+}
+
+// RoutingCheck declares a topology, publishes routed messages and checks
+// where they land
+type RoutingCheck struct {
+	Name string
+	Run  func(t *Topology) error
+}
+
+// RoutingChecks returns the checks in the order they run
+func RoutingChecks() []RoutingCheck {
+	return []RoutingCheck{
+		{"topic", checkTopic},
+		{"fanout", checkFanout},
+		{"headers", checkHeaders},
+		{"ttl", checkTTL},
+		{"dead-letter", checkDeadLetter},
+		{"priority", checkPriority},
+	}
+}
+
+// RoutingResult is the outcome of one check
+type RoutingResult struct {
+	Name string
+	Err  error
+}
+
+func (r RoutingResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("FAIL %s: %v", r.Name, r.Err)
+	}
+	return "PASS " + r.Name
+}
+
+// RoutingSuite runs routing checks, each on a broker from Open, and deletes
+// everything a check declared once it finishes. Names are prefixed with
+// Prefix so runs don't collide. Timeout bounds waits for messages to expire.
+type RoutingSuite struct {
+	Open    func() (RoutingBroker, error)
+	Prefix  string
+	Timeout time.Duration
+}
+
+// Run runs the named checks, or all of them when names is empty
+func (s *RoutingSuite) Run(names []string) ([]RoutingResult, error) {
+	checks, err := selectChecks(names)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]RoutingResult, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, RoutingResult{Name: check.Name, Err: s.run(check)})
+	}
+	return results, nil
+}
+
+func (s *RoutingSuite) run(check RoutingCheck) (err error) {
+	broker, err := s.Open()
+	if err != nil {
+		return err
+	}
+	t := &Topology{broker: broker, prefix: s.Prefix + "." + check.Name, timeout: s.Timeout}
+	defer func() {
+		broker.Close()
+		if cleanupErr := s.cleanup(t); cleanupErr != nil && err == nil {
+			err = fmt.Errorf("cleanup: %v", cleanupErr)
+		}
+	}()
+	return check.Run(t)
+}
+
+// cleanup deletes what the check declared on a fresh broker, as a failed
+// declaration closes the channel it was made on
+func (s *RoutingSuite) cleanup(t *Topology) error {
+	if len(t.queues) == 0 && len(t.exchanges) == 0 {
+		return nil
+	}
+	broker, err := s.Open()
+	if err != nil {
+		return err
+	}
+	defer broker.Close()
+	for _, q := range t.queues {
+		if err := broker.QueueDelete(q); err != nil {
+			return err
+		}
+	}
+	for _, x := range t.exchanges {
+		if err := broker.ExchangeDelete(x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func selectChecks(names []string) ([]RoutingCheck, error) {
+	all := RoutingChecks()
+	if len(names) == 0 {
+		return all, nil
+	}
+	var selected []RoutingCheck
+	for _, name := range names {
+		found := false
+		for _, check := range all {
+			if check.Name == name {
+				selected = append(selected, check)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown routing check %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// Topology declares exchanges and queues for a check under the check's
+// prefix and remembers them for cleanup
+type Topology struct {
+	broker    RoutingBroker
+	prefix    string
+	timeout   time.Duration
+	exchanges []string
+	queues    []string
+}
+
+// Name returns the full name of a check's exchange or queue
+func (t *Topology) Name(name string) string {
+	return t.prefix + "." + name
+}
+
+func (t *Topology) Exchange(name, kind string) error {
+	if err := t.broker.ExchangeDeclare(t.Name(name), kind); err != nil {
+		return err
+	}
+	t.exchanges = append(t.exchanges, t.Name(name))
+	return nil
+}
+
+func (t *Topology) Queue(name string, args amqp.Table) error {
+	if err := t.broker.QueueDeclare(t.Name(name), args); err != nil {
+		return err
+	}
+	t.queues = append(t.queues, t.Name(name))
+	return nil
+}
+
+func (t *Topology) Bind(queue, key, exchange string, args amqp.Table) error {
+	return t.broker.QueueBind(t.Name(queue), key, t.Name(exchange), args)
+}
+
+func (t *Topology) Publish(exchange, key string, msg amqp.Publishing) error {
+	return t.broker.Publish(t.Name(exchange), key, msg)
+}
+
+// Send publishes straight to a queue through the default exchange
+func (t *Topology) Send(queue string, msg amqp.Publishing) error {
+	return t.broker.Publish("", t.Name(queue), msg)
+}
+
+// Drain takes every message off a queue and returns the bodies in order
+func (t *Topology) Drain(queue string) ([]string, error) {
+	var bodies []string
+	for {
+		body, ok, err := t.broker.Get(t.Name(queue))
+		if err != nil || !ok {
+			return bodies, err
+		}
+		bodies = append(bodies, body)
+	}
+}
+
+// Expect drains a queue and checks it held exactly the given bodies in order
+func (t *Topology) Expect(queue string, bodies ...string) error {
+	got, err := t.Drain(queue)
+	if err != nil {
+		return err
+	}
+	if len(got) == 0 && len(bodies) == 0 || reflect.DeepEqual(got, bodies) {
+		return nil
+	}
+	return fmt.Errorf("%s received %q, expected %q", queue, got, bodies)
+}
+
+// WaitFor polls a queue until a message arrives or the timeout passes
+func (t *Topology) WaitFor(queue string) (string, error) {
+	deadline := time.Now().Add(t.timeout)
+	for {
+		body, ok, err := t.broker.Get(t.Name(queue))
+		if err != nil || ok {
+			return body, err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("nothing reached %s within %v", queue, t.timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func message(body string) amqp.Publishing {
+	return amqp.Publishing{ContentType: "text/plain", Body: []byte(body)}
+}
+
+// checkTopic routes on dotted keys with * and # wildcards
+func checkTopic(t *Topology) error {
+	if err := t.Exchange("events", amqp.ExchangeTopic); err != nil {
+		return err
+	}
+	bindings := map[string]string{"created": "orders.*.created", "all": "#", "eu": "*.eu.#"}
+	for queue, key := range bindings {
+		if err := t.Queue(queue, nil); err != nil {
+			return err
+		}
+		if err := t.Bind(queue, key, "events", nil); err != nil {
+			return err
+		}
+	}
+	keys := []string{"orders.eu.created", "orders.us.created", "payments.eu.card.failed"}
+	for _, key := range keys {
+		if err := t.Publish("events", key, message(key)); err != nil {
+			return err
+		}
+	}
+	if err := t.Expect("created", "orders.eu.created", "orders.us.created"); err != nil {
+		return err
+	}
+	if err := t.Expect("all", keys...); err != nil {
+		return err
+	}
+	return t.Expect("eu", "orders.eu.created", "payments.eu.card.failed")
+}
+
+// checkFanout copies every message to every bound queue whatever its key
+func checkFanout(t *Topology) error {
+	if err := t.Exchange("broadcast", amqp.ExchangeFanout); err != nil {
+		return err
+	}
+	queues := []string{"a", "b", "c"}
+	for _, queue := range queues {
+		if err := t.Queue(queue, nil); err != nil {
+			return err
+		}
+		if err := t.Bind(queue, "", "broadcast", nil); err != nil {
+			return err
+		}
+	}
+	if err := t.Publish("broadcast", "ignored", message("hello")); err != nil {
+		return err
+	}
+	for _, queue := range queues {
+		if err := t.Expect(queue, "hello"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeaders routes on message headers with x-match all and any
+func checkHeaders(t *Topology) error {
+	if err := t.Exchange("documents", amqp.ExchangeHeaders); err != nil {
+		return err
+	}
+	bindings := map[string]amqp.Table{
+		"all": {"x-match": "all", "format": "pdf", "type": "report"},
+		"any": {"x-match": "any", "format": "pdf", "type": "log"},
+	}
+	for queue, args := range bindings {
+		if err := t.Queue(queue, nil); err != nil {
+			return err
+		}
+		if err := t.Bind(queue, "", "documents", args); err != nil {
+			return err
+		}
+	}
+	messages := []struct {
+		body    string
+		headers amqp.Table
+	}{
+		{"pdf-report", amqp.Table{"format": "pdf", "type": "report"}},
+		{"zip-log", amqp.Table{"format": "zip", "type": "log"}},
+		{"zip-other", amqp.Table{"format": "zip", "type": "other"}},
+	}
+	for _, m := range messages {
+		msg := message(m.body)
+		msg.Headers = m.headers
+		if err := t.Publish("documents", "", msg); err != nil {
+			return err
+		}
+	}
+	if err := t.Expect("all", "pdf-report"); err != nil {
+		return err
+	}
+	return t.Expect("any", "pdf-report", "zip-log")
+}
+
+// checkTTL drops a message whose per-message TTL has passed and keeps one without
+func checkTTL(t *Topology) error {
+	if err := t.Queue("work", nil); err != nil {
+		return err
+	}
+	short := message("short")
+	short.Expiration = "50"
+	if err := t.Send("work", short); err != nil {
+		return err
+	}
+	if err := t.Send("work", message("long")); err != nil {
+		return err
+	}
+	time.Sleep(200 * time.Millisecond)
+	return t.Expect("work", "long")
+}
+
+// checkDeadLetter lets a message expire in a queue with a dead letter
+// exchange and checks it arrives in the dead letter queue
+func checkDeadLetter(t *Topology) error {
+	if err := t.Exchange("dlx", amqp.ExchangeFanout); err != nil {
+		return err
+	}
+	if err := t.Queue("dead", nil); err != nil {
+		return err
+	}
+	if err := t.Bind("dead", "", "dlx", nil); err != nil {
+		return err
+	}
+	if err := t.Queue("work", amqp.Table{"x-dead-letter-exchange": t.Name("dlx")}); err != nil {
+		return err
+	}
+	msg := message("expired")
+	msg.Expiration = "50"
+	if err := t.Send("work", msg); err != nil {
+		return err
+	}
+	body, err := t.WaitFor("dead")
+	if err != nil {
+		return err
+	}
+	if body != "expired" {
+		return fmt.Errorf("dead received %q, expected %q", body, "expired")
+	}
+	return t.Expect("work")
+}
+
+// checkPriority delivers waiting messages highest priority first
+func checkPriority(t *Topology) error {
+	if err := t.Queue("jobs", amqp.Table{"x-max-priority": int32(10)}); err != nil {
+		return err
+	}
+	for _, p := range []uint8{1, 9, 5} {
+		msg := message(fmt.Sprintf("priority-%d", p))
+		msg.Priority = p
+		if err := t.Send("jobs", msg); err != nil {
+			return err
+		}
+	}
+	return t.Expect("jobs", "priority-9", "priority-5", "priority-1")
+}
+
+// channelBroker is a RoutingBroker on its own channel of a real connection
+type channelBroker struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+// DialRoutingBroker returns an Open function for a RoutingSuite that
+// connects to uri for each check
+func DialRoutingBroker(uri string) func() (RoutingBroker, error) {
+	return func() (RoutingBroker, error) {
+		conn, err := dial(uri)
+		if err != nil {
+			return nil, err
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			closeConn(conn)
+			return nil, err
+		}
+		return &channelBroker{conn: conn, ch: ch}, nil
+	}
+}
+
+func (b *channelBroker) ExchangeDeclare(name, kind string) error {
+	return b.ch.ExchangeDeclare(name, kind, false, false, false, false, nil)
+}
+
+func (b *channelBroker) QueueDeclare(name string, args amqp.Table) error {
+	_, err := b.ch.QueueDeclare(name, false, false, false, false, args)
+	return err
+}
+
+func (b *channelBroker) QueueBind(queue, key, exchange string, args amqp.Table) error {
+	return b.ch.QueueBind(queue, key, exchange, false, args)
+}
+
+func (b *channelBroker) Publish(exchange, key string, msg amqp.Publishing) error {
+	return b.ch.Publish(exchange, key, false, false, msg)
+}
+
+func (b *channelBroker) Get(queue string) (string, bool, error) {
+	d, ok, err := b.ch.Get(queue, true)
+	return string(d.Body), ok, err
+}
+
+func (b *channelBroker) ExchangeDelete(name string) error {
+	return b.ch.ExchangeDelete(name, false, false)
+}
+
+func (b *channelBroker) QueueDelete(name string) error {
+	_, err := b.ch.QueueDelete(name, false, false, false)
+	return err
+}
+
+func (b *channelBroker) Close() {
+	closeConn(b.conn)
+}
+
+// RoutingHandler runs the routing suite against the bound broker. The
+// checks parameter picks checks by comma separated name.
+func RoutingHandler(serviceName string, open func(uri string) func() (RoutingBroker, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, uri, err := GetURI(serviceName)
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to access RMQ: %v", err)
+			return
+		}
+		var names []string
+		if checks := req.URL.Query().Get("checks"); checks != "" {
+			names = strings.Split(checks, ",")
+		}
+		suite := &RoutingSuite{Open: open(uri), Prefix: fmt.Sprintf("routing.%d", time.Now().UnixNano()), Timeout: 5 * time.Second}
+		results, err := suite.Run(names)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		status := http.StatusOK
+		for _, r := range results {
+			if r.Err != nil {
+				status = http.StatusFailedDependency
+			}
+		}
+		w.WriteHeader(status)
+		writeRoutingResults(w, results)
+	}
+}
+
+func writeRoutingResults(w io.Writer, results []RoutingResult) {
+	for _, r := range results {
+		fmt.Fprintln(w, r)
+	}
+}
+
+// RunRouting runs the routing suite once, prints the results and returns the exit code
+func RunRouting(open func() (RoutingBroker, error), names []string, out io.Writer) int {
+	suite := &RoutingSuite{Open: open, Prefix: fmt.Sprintf("routing.%d", time.Now().UnixNano()), Timeout: 5 * time.Second}
+	results, err := suite.Run(names)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	writeRoutingResults(out, results)
+	for _, r := range results {
+		if r.Err != nil {
+			return 1
+		}
+	}
+	return 0
+}
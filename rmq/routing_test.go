@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRoutingSuite(server *FakeAMQPServer) *RoutingSuite {
+	return &RoutingSuite{Open: DialRoutingBroker(server.URI()), Prefix: "routing.test", Timeout: time.Second}
+}
+
+func TestRoutingChecks(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	results, err := newRoutingSuite(server).Run(nil)
+	require.NoError(t, err)
+
+	var names []string
+	for _, r := range results {
+		assert.NoError(t, r.Err, r.Name)
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"topic", "fanout", "headers", "ttl", "dead-letter", "priority"}, names)
+	exchanges, queues := server.Declared()
+	assert.Empty(t, exchanges, "exchanges should be cleaned up")
+	assert.Empty(t, queues, "queues should be cleaned up")
+	assert.Equal(t, 0, server.Connections())
+}
+
+// misroutingBroker drops everything published to exchanges of one kind
+type misroutingBroker struct {
+	RoutingBroker
+	kind    string
+	dropped map[string]bool
+}
+
+func (b *misroutingBroker) ExchangeDeclare(name, kind string) error {
+	if kind == b.kind {
+		b.dropped[name] = true
+	}
+	return b.RoutingBroker.ExchangeDeclare(name, kind)
+}
+
+func (b *misroutingBroker) Publish(exchange, key string, msg amqp.Publishing) error {
+	if b.dropped[exchange] {
+		return nil
+	}
+	return b.RoutingBroker.Publish(exchange, key, msg)
+}
+
+func TestRoutingCheckFails(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	open := DialRoutingBroker(server.URI())
+	suite := &RoutingSuite{
+		Open: func() (RoutingBroker, error) {
+			broker, err := open()
+			if err != nil {
+				return nil, err
+			}
+			return &misroutingBroker{RoutingBroker: broker, kind: amqp.ExchangeHeaders, dropped: map[string]bool{}}, nil
+		},
+		Prefix:  "routing.test",
+		Timeout: time.Second,
+	}
+	results, err := suite.Run([]string{"headers", "fanout"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.EqualError(t, results[0].Err, `all received [], expected ["pdf-report"]`)
+	assert.NoError(t, results[1].Err)
+	_, queues := server.Declared()
+	assert.Empty(t, queues)
+}
+
+// TestRoutingCheckRefused checks a check fails, and is still cleaned up,
+// when the broker refuses part of its topology
+func TestRoutingCheckRefused(t *testing.T) {
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	server.SetFault("queue.bind", AMQPFault{Err: &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - no bind permission"}})
+
+	results, err := newRoutingSuite(server).Run([]string{"fanout"})
+	require.NoError(t, err)
+	require.Error(t, results[0].Err)
+	assert.Contains(t, results[0].Err.Error(), "ACCESS_REFUSED")
+	exchanges, queues := server.Declared()
+	assert.Empty(t, exchanges)
+	assert.Empty(t, queues)
+}
+
+func TestRoutingUnknownCheck(t *testing.T) {
+	_, err := (&RoutingSuite{}).Run([]string{"topic", "rpc"})
+	assert.EqualError(t, err, `unknown routing check "rpc"`)
+}
+
+func TestRoutingOpenFails(t *testing.T) {
+	suite := &RoutingSuite{Open: func() (RoutingBroker, error) { return nil, errors.New("connection refused") }}
+	results, err := suite.Run([]string{"ttl"})
+	require.NoError(t, err)
+	assert.EqualError(t, results[0].Err, "connection refused")
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.uk.created", false},
+		{"#", "anything.at.all", true},
+		{"*.eu.#", "payments.eu", true},
+		{"*.eu.#", "payments.us.card", false},
+	}
+	for _, c := range cases {
+		b := fakeBinding{key: c.pattern}
+		assert.Equal(t, c.match, bindingMatches(amqp.ExchangeTopic, b, c.key, nil), "%s %s", c.pattern, c.key)
+	}
+}
+
+func TestRoutingHandler(t *testing.T) {
+	SetEnv()
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	var dialled string
+	open := func(uri string) func() (RoutingBroker, error) {
+		dialled = uri
+		return DialRoutingBroker(server.URI())
+	}
+
+	w := httptest.NewRecorder()
+	RoutingHandler("test-rmq", open)(w, httptest.NewRequest("GET", "http://x/routing?checks=topic,priority", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "PASS topic\nPASS priority\n", w.Body.String())
+	assert.Equal(t, "amqp://foobar", dialled)
+
+	w = httptest.NewRecorder()
+	RoutingHandler("test-rmq", open)(w, httptest.NewRequest("GET", "http://x/routing?checks=nope", nil))
+	assert.Equal(t, 400, w.Code)
+}
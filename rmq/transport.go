@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PlaintextDialer opens an unencrypted AMQP connection to uri and returns
+// nil if the broker completed the handshake
+type PlaintextDialer func(uri string) error
+
+// TransportResult is the outcome of the transport policy check. Refused is
+// the error the plaintext connection failed with, if it did. Only a broker
+// that takes the TCP connection and then fails the AMQP handshake passes:
+// any other error says nothing about the policy.
+type TransportResult struct {
+	Host    string
+	Refused error
+}
+
+// OK is true when the broker refused the plaintext handshake
+func (r TransportResult) OK() bool {
+	return refusesPlaintext(r.Refused)
+}
+
+func (r TransportResult) String() string {
+	switch {
+	case r.Refused == nil:
+		return fmt.Sprintf("FAIL transport policy: security: %s accepted a plaintext connection", r.Host)
+	case r.OK():
+		return fmt.Sprintf("PASS transport policy: plaintext connection refused: %v", r.Refused)
+	}
+	return fmt.Sprintf("ERROR transport policy: could not tell whether %s refuses plaintext: %v", r.Host, r.Refused)
+}
+
+// handshakeError is an AMQP handshake that failed after the TCP connection
+// was made
+type handshakeError struct {
+	err error
+}
+
+func (e handshakeError) Error() string {
+	return e.err.Error()
+}
+
+// refusesPlaintext is true when a TLS listener failed the plain handshake,
+// which it does by closing the connection or answering with a TLS alert the
+// client cannot parse. A handshake that timed out, or that got as far as
+// refusing the credentials or vhost, is not a refusal.
+func refusesPlaintext(err error) bool {
+	h, ok := err.(handshakeError)
+	if !ok {
+		return false
+	}
+	if ne, ok := h.err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return h.err != amqp.ErrCredentials && h.err != amqp.ErrVhost
+}
+
+// plaintextURI rewrites an amqps URI to amqp on the same port, which is
+// 5671 when the URI leaves it out
+func plaintextURI(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "amqps" {
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "5671")
+		}
+		u.Scheme = "amqp"
+	}
+	return u, nil
+}
+
+// CheckTransport tries a plain amqp:// handshake on the broker's TLS port
+func CheckTransport(dial PlaintextDialer, uri string) (TransportResult, error) {
+	u, err := plaintextURI(uri)
+	if err != nil {
+		return TransportResult{}, err
+	}
+	return TransportResult{Host: u.Host, Refused: dial(u.String())}, nil
+}
+
+// TransportHandler reports the transport policy check for the bound service
+func TransportHandler(dial PlaintextDialer, serviceName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, uri, err := GetURI(serviceName)
+		var result TransportResult
+		if err == nil {
+			result, err = CheckTransport(dial, uri)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusFailedDependency)
+			fmt.Fprintf(w, "Failed to check transport policy: %v", err)
+			return
+		}
+		if !result.OK() {
+			w.WriteHeader(http.StatusFailedDependency)
+		}
+		fmt.Fprintln(w, result)
+	}
+}
+
+// RunTransport runs the check once, prints the result and returns the exit code
+func RunTransport(dial PlaintextDialer, uri string, out io.Writer) int {
+	result, err := CheckTransport(dial, uri)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to check transport policy: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(out, result)
+	if !result.OK() {
+		return 1
+	}
+	return 0
+}
+
+// DialPlaintext connects without TLS, giving up after ten seconds. Errors
+// after the TCP connection is made are handshakeErrors.
+func DialPlaintext(uri string) error {
+	connected := false
+	conn, err := amqp.DialConfig(uri, amqp.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := dialBroker(uri, network, addr, 10*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			connected = true
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			return conn, nil
+		},
+	})
+	if err != nil {
+		if connected {
+			return handshakeError{err}
+		}
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaintextURI(t *testing.T) {
+	for uri, want := range map[string]string{
+		"amqps://u:p@broker/vhost":       "amqp://u:p@broker:5671/vhost",
+		"amqps://u:p@broker:15671/vhost": "amqp://u:p@broker:15671/vhost",
+		"amqp://u:p@broker:5672/vhost":   "amqp://u:p@broker:5672/vhost",
+	} {
+		u, err := plaintextURI(uri)
+		require.NoError(t, err)
+		assert.Equal(t, want, u.String())
+	}
+}
+
+func TestCheckTransport(t *testing.T) {
+	var dialled string
+	refuse := func(uri string) error {
+		dialled = uri
+		return handshakeError{errors.New("Exception (501) Reason: \"EOF\"")}
+	}
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, RunTransport(refuse, "amqps://u:p@broker/vhost", &out))
+	assert.Equal(t, "amqp://u:p@broker:5671/vhost", dialled)
+	assert.Equal(t, "PASS transport policy: plaintext connection refused: Exception (501) Reason: \"EOF\"\n", out.String())
+
+	out.Reset()
+	accept := func(uri string) error { return nil }
+	assert.Equal(t, 1, RunTransport(accept, "amqps://u:p@broker/vhost", &out))
+	assert.Equal(t, "FAIL transport policy: security: broker:5671 accepted a plaintext connection\n", out.String())
+
+	for _, err := range []error{
+		errors.New("dial tcp: lookup broker: no such host"),
+		handshakeError{amqp.ErrCredentials},
+		handshakeError{&net.OpError{Op: "read", Err: timeoutError{}}},
+	} {
+		out.Reset()
+		fail := func(uri string) error { return err }
+		assert.Equal(t, 1, RunTransport(fail, "amqps://u:p@broker/vhost", &out), "%v", err)
+		assert.Equal(t, fmt.Sprintf("ERROR transport policy: could not tell whether broker:5671 refuses plaintext: %v\n", err), out.String())
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTransportHandler(t *testing.T) {
+	setupTenants()
+	w := httptest.NewRecorder()
+	TransportHandler(func(string) error { return nil }, "tenant-a")(w, httptest.NewRequest("GET", "http://x/transport", nil))
+	assert.Equal(t, 424, w.Code)
+	assert.Equal(t, "FAIL transport policy: security: broker accepted a plaintext connection\n", w.Body.String())
+}
+
+func TestDialPlaintextRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	err = DialPlaintext("amqp://u:p@" + l.Addr().String() + "/")
+	assert.True(t, refusesPlaintext(err), "%v", err)
+}
+
+func TestDialPlaintextNotRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	err = DialPlaintext("amqp://u:p@" + addr + "/")
+	assert.Error(t, err)
+	assert.False(t, refusesPlaintext(err), "nothing listening says nothing about TLS: %v", err)
+
+	server := newFakeAMQPServer(t)
+	defer server.Close()
+	u, err := url.Parse(server.URI())
+	require.NoError(t, err)
+	u.User = url.UserPassword("guest", "wrong")
+	err = DialPlaintext(u.String())
+	assert.Error(t, err)
+	assert.False(t, refusesPlaintext(err), "a broker that refuses the credentials spoke plaintext: %v", err)
+
+	assert.NoError(t, DialPlaintext(server.URI()))
+}